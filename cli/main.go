@@ -19,7 +19,9 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/briandowns/spinner"
@@ -46,6 +48,10 @@ type ASQL struct {
 	wg            *sync.WaitGroup    // WaitGroup to wait for goroutines to finish
 	bufferSize    int                // Buffer size for reading from the connection
 	header        []byte
+	text          bool        // Use the old text protocol instead of framed messages
+	json          bool        // Print result sets as JSON, framed protocol only
+	tlsConfig     *tls.Config // CA bundle and client certificate of TLS connections
+	startTLS      bool        // Connect in clear text and upgrade to TLS with STARTTLS
 }
 
 // New creates a new ASQL instance
@@ -59,6 +65,15 @@ func New() (*ASQL, error) {
 	}, nil
 }
 
+// connection returns the connection to the server
+func (a *ASQL) connection() net.Conn {
+	if a.conn != nil {
+		return a.conn
+	}
+
+	return a.secureConn
+}
+
 // Connect connects to the AriaSQL server
 func (a *ASQL) connect(host string, port int, secure bool, username, password string, bufferSize int) error {
 	var err error
@@ -71,9 +86,13 @@ func (a *ASQL) connect(host string, port int, secure bool, username, password st
 		return err
 	}
 
-	if secure {
+	if a.tlsConfig == nil {
+		a.tlsConfig = &tls.Config{}
+	}
+
+	if secure && !a.startTLS {
 		// Connect to the server using TLS
-		a.secureConn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", host, port), &tls.Config{})
+		a.secureConn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", host, port), a.tlsConfig)
 		if err != nil {
 			return err
 		}
@@ -86,6 +105,23 @@ func (a *ASQL) connect(host string, port int, secure bool, username, password st
 		}
 	}
 
+	if a.startTLS {
+		config := a.tlsConfig.Clone()
+		config.ServerName = host
+
+		a.secureConn, err = startTLS(a.conn, config)
+		if err != nil {
+			a.conn.Close()
+			return err
+		}
+
+		a.conn = nil
+	}
+
+	if !a.text {
+		return a.authenticate(username, password)
+	}
+
 	// Authenticate the user
 	encodedStr := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s\\0%s", username, password)))
 	if a.conn != nil {
@@ -118,10 +154,7 @@ func (a *ASQL) connect(host string, port int, secure bool, username, password st
 
 	authOk := bytes.Split(response, []byte("\n"))[0]
 	version := bytes.Split(response, []byte("\n"))[1]
-	a.header = []byte(fmt.Sprintf(`
-ARIASQL VERSION %s (C) %d ALL RIGHTS RESERVED
-==================================================*
-`, strings.TrimSpace(strings.ReplaceAll(string(version), "VERSION:", "")), time.Now().Year()))
+	a.setHeader(strings.TrimSpace(strings.ReplaceAll(string(version), "VERSION:", "")))
 
 	if string(authOk) == "OK" {
 		a.authenticated = true
@@ -134,6 +167,214 @@ ARIASQL VERSION %s (C) %d ALL RIGHTS RESERVED
 
 }
 
+// startTLS upgrades a clear text connection to TLS, a server refusing it fails the connection
+func startTLS(conn net.Conn, config *tls.Config) (*tls.Conn, error) {
+	err := writeMessage(conn, MSG_STARTTLS, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	typ, payload, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case MSG_STARTTLS:
+	case MSG_ERROR:
+		return nil, fmt.Errorf("STARTTLS refused: %s", decodeError(payload))
+	default:
+		return nil, fmt.Errorf("unexpected message %q", typ)
+	}
+
+	secureConn := tls.Client(conn, config)
+
+	err = secureConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	return secureConn, nil
+}
+
+// loadTLS returns the TLS configuration of a CA bundle verifying the server and a client certificate, either may be empty
+func loadTLS(ca, cert, key string) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + ca)
+		}
+	}
+
+	if cert != "" || key != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// authenticate authenticates the user over the framed protocol
+func (a *ASQL) authenticate(username, password string) error {
+	conn := a.connection()
+
+	err := writeMessage(conn, MSG_STARTUP, append(append([]byte(PROTOCOL_MAGIC), PROTOCOL_VERSION), username...))
+	if err != nil {
+		return err
+	}
+
+	var scram *scramClient
+
+	for {
+		typ, payload, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case MSG_AUTHENTICATION:
+			if len(payload) == 0 {
+				return errors.New("unsupported authentication method")
+			}
+
+			switch {
+			case payload[0] == AUTH_PASSWORD && len(payload) == 1:
+				// Only asked of users created before SCRAM, until they log in
+				err = writeMessage(conn, MSG_PASSWORD, []byte(password))
+			case payload[0] == AUTH_SCRAM_SHA_256 && len(payload) == 1:
+				scram, err = newScramClient(username, password)
+				if err == nil {
+					err = writeMessage(conn, MSG_PASSWORD, scram.first())
+				}
+			case payload[0] == AUTH_SCRAM_CONTINUE && scram != nil:
+				var final []byte
+
+				final, err = scram.final(string(payload[1:]))
+				if err == nil {
+					err = writeMessage(conn, MSG_PASSWORD, final)
+				}
+			case payload[0] == AUTH_SCRAM_FINAL && scram != nil:
+				err = scram.verify(string(payload[1:]))
+				scram = nil
+			default:
+				return errors.New("unsupported authentication method")
+			}
+
+			if err != nil {
+				return err
+			}
+		case MSG_AUTHENTICATED:
+			if scram != nil {
+				return errors.New("server did not finish the SCRAM exchange")
+			}
+
+			a.authenticated = true
+			a.setHeader(string(payload))
+			return nil
+		case MSG_ERROR:
+			return fmt.Errorf("authentication failed: %s", decodeError(payload))
+		default:
+			return fmt.Errorf("unexpected message %q", typ)
+		}
+	}
+}
+
+// setHeader sets the header printed once connected
+func (a *ASQL) setHeader(version string) {
+	a.header = []byte(fmt.Sprintf(`
+ARIASQL VERSION %s (C) %d ALL RIGHTS RESERVED
+==================================================*
+`, version, time.Now().Year()))
+}
+
+// query sends a statement over the framed protocol and returns its formatted result
+func (a *ASQL) query(cmd string) (string, error) {
+	trimmed := strings.TrimSpace(strings.TrimSuffix(cmd, ";"))
+
+	// Output format is up to the client
+	switch strings.ToLower(trimmed) {
+	case "json on":
+		a.json = true
+		return "OK\n", nil
+	case "json off":
+		a.json = false
+		return "OK\n", nil
+	case "close":
+		return "", writeMessage(a.connection(), MSG_TERMINATE, nil)
+	}
+
+	return a.queryOn(a.connection(), cmd)
+}
+
+// queryOn sends a statement on a connection and reads its answer up to command complete or an error
+// Events of a subscription are printed as they arrive until the subscription ends
+func (a *ASQL) queryOn(conn net.Conn, cmd string) (string, error) {
+	err := writeMessage(conn, MSG_QUERY, []byte(cmd))
+	if err != nil {
+		return "", err
+	}
+
+	var columns []string
+	var rows [][][]byte
+	described := false
+
+	for {
+		typ, payload, err := readMessage(conn)
+		if err != nil {
+			return "", err
+		}
+
+		switch typ {
+		case MSG_ROW_DESCRIPTION:
+			values, err := decodeValues(payload)
+			if err != nil {
+				return "", err
+			}
+
+			columns = make([]string, len(values))
+			for i, value := range values {
+				columns[i] = string(value)
+			}
+
+			described = true
+		case MSG_DATA_ROW:
+			values, err := decodeValues(payload)
+			if err != nil {
+				return "", err
+			}
+
+			rows = append(rows, values)
+		case MSG_EVENT:
+			fmt.Println(string(payload))
+		case MSG_COMMAND_COMPLETE:
+			if !described || len(rows) == 0 {
+				return string(payload) + "\n", nil
+			}
+
+			if a.json {
+				return formatJSON(columns, rows)
+			}
+
+			return formatTable(columns, rows), nil
+		case MSG_ERROR:
+			return decodeError(payload).Error() + "\n", nil
+		default:
+			return "", fmt.Errorf("unexpected message %q", typ)
+		}
+	}
+}
+
 // Close closes open connections and files
 func (a *ASQL) close() {
 	if a.conn != nil {
@@ -154,13 +395,19 @@ func main() {
 		tls        = flag.Bool("tls", false, "Use TLS to connect to AriaSQL instance")
 		username   = flag.String("u", "", "AriaSQL user username")
 		password   = flag.String("p", "", "ArilaSQL user password")
-		bufferSize = flag.Int("buffer", 1024, "Buffer size for reading from the connection")
+		bufferSize = flag.Int("buffer", 1024, "Buffer size for reading from the connection, text protocol only")
+		text       = flag.Bool("text", false, "Use the old text protocol, for servers with TextProtocol enabled")
+		startTLS   = flag.Bool("starttls", false, "Connect in clear text and upgrade to TLS, for servers with StartTLS enabled")
+		ca         = flag.String("ca", "", "CA bundle file verifying the server's certificate, the system's CAs if empty")
+		cert       = flag.String("cert", "", "Client certificate file, for servers verifying client certificates")
+		key        = flag.String("key", "", "Client certificate key file")
 	)
 
 	flag.Parse()
 
-	if *username == "" || *password == "" {
-		fmt.Println("Username and password are required")
+	// A user identified by certificate needs no password
+	if *username == "" || (*password == "" && *cert == "") {
+		fmt.Println("Username and password, or a client certificate, are required")
 		os.Exit(1)
 
 	}
@@ -171,6 +418,15 @@ func main() {
 		os.Exit(1)
 	}
 
+	asql.text = *text
+	asql.startTLS = *startTLS
+
+	asql.tlsConfig, err = loadTLS(*ca, *cert, *key)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
 	s := spinner.New(spinner.CharSets[12], 100*time.Millisecond)
 
 	s.Color("blue", "bold")
@@ -235,6 +491,18 @@ func main() {
 
 		tNow := time.Now()
 
+		if !asql.text {
+			response, err := asql.query(cmd)
+			if err != nil {
+				rl.Write([]byte(fmt.Sprintf("Error reading from server: %s\n", err.Error())))
+				asql.signalChannel <- syscall.SIGINT
+				break
+			}
+
+			fmt.Print(response + fmt.Sprintf("Completed in %s\n", time.Since(tNow).String()))
+			continue
+		}
+
 		// Send the statement to the server
 		if asql.conn != nil {
 			_, err := asql.conn.Write([]byte(cmd))
@@ -254,7 +522,7 @@ func main() {
 
 		// Get response
 		response := make([]byte, asql.bufferSize)
-		_, err = asql.conn.Read(response)
+		_, err = asql.connection().Read(response)
 		if err != nil {
 			rl.Write([]byte(fmt.Sprintf("Error reading from server: %s\n", err.Error())))
 			asql.signalChannel <- syscall.SIGINT
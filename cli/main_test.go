@@ -17,7 +17,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"encoding/binary"
+	"net"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -34,3 +38,117 @@ func TestNew(t *testing.T) {
 	}
 
 }
+
+func TestQuery(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	asql, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A server answering a query with a result set larger than a read
+	long := strings.Repeat("x", 4096)
+	go func() {
+		defer server.Close()
+
+		if _, _, err := readMessage(server); err != nil {
+			return
+		}
+
+		row := binary.BigEndian.AppendUint16(nil, 2)
+		row = binary.BigEndian.AppendUint32(row, uint32(len(long)))
+		row = append(row, long...)
+		row = binary.BigEndian.AppendUint32(row, NULL_LENGTH)
+
+		columns := binary.BigEndian.AppendUint16(nil, 2)
+		for _, column := range []string{"name", "note"} {
+			columns = binary.BigEndian.AppendUint32(columns, uint32(len(column)))
+			columns = append(columns, column...)
+		}
+
+		writeMessage(server, MSG_ROW_DESCRIPTION, columns)
+		writeMessage(server, MSG_DATA_ROW, row)
+		writeMessage(server, MSG_COMMAND_COMPLETE, []byte("ROWS 1"))
+
+		if _, _, err := readMessage(server); err != nil {
+			return
+		}
+
+		writeMessage(server, MSG_ERROR, append(binary.BigEndian.AppendUint16(nil, 4), "unexpected token"...))
+	}()
+
+	result, err := asql.queryOn(client, "SELECT * FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(result, "| "+long+" | NULL |") {
+		t.Errorf("Expected the long value and NULL, got %s", result)
+	}
+
+	result, err = asql.queryOn(client, "SELEC * FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != "ERR 4: unexpected token\n" {
+		t.Errorf("Expected syntax error, got %s", result)
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	// A server without TLS refuses the upgrade
+	go func() {
+		defer server.Close()
+
+		if typ, _, err := readMessage(server); err != nil || typ != MSG_STARTTLS {
+			return
+		}
+
+		writeMessage(server, MSG_ERROR, append(binary.BigEndian.AppendUint16(nil, 1), "TLS is not available"...))
+	}()
+
+	_, err := startTLS(client, &tls.Config{})
+	if err == nil || err.Error() != "STARTTLS refused: ERR 1: TLS is not available" {
+		t.Errorf("Expected STARTTLS to be refused, got %v", err)
+	}
+
+	if _, err := loadTLS("missing.pem", "", ""); err == nil {
+		t.Errorf("Expected a missing CA bundle to fail")
+	}
+}
+
+func TestScram(t *testing.T) {
+	// The example exchange of RFC 7677 section 3, user "user" with password "pencil"
+	scram := newScramClientNonce("user", "pencil", "rOprNGfwEbeRWgbNEkqO")
+	if string(scram.first()) != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("Unexpected client-first-message %s", scram.first())
+	}
+
+	final, err := scram.final("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(final) != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Errorf("Unexpected client-final-message %s", final)
+	}
+
+	if err := scram.verify("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("Expected the server signature to be verified, got %v", err)
+	}
+
+	if err := scram.verify("v=AAAA"); err == nil {
+		t.Errorf("Expected a wrong server signature to fail")
+	}
+
+	// A server that does not extend the client's nonce is refused
+	if _, err := newScramClientNonce("user", "pencil", "abc").final("r=xyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"); err == nil {
+		t.Errorf("Expected a foreign nonce to fail")
+	}
+}
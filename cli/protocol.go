@@ -0,0 +1,214 @@
+// asql - AriaSQL CLI
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The framed protocol of the AriaSQL server, see the server's protocol package.
+// Every message is a type byte, the big endian uint32 length of its payload and the payload.
+
+const PROTOCOL_MAGIC = "ARIASQL"      // Starts the startup message
+const PROTOCOL_VERSION = 1            // Protocol version
+const MAX_MESSAGE_SIZE = 1024 << 20   // Largest payload read
+const NULL_LENGTH = 0xffffffff        // Length of a NULL value in a data row
+const AUTH_PASSWORD byte = 0          // Authentication method asking for the password
+const AUTH_SCRAM_SHA_256 byte = 1     // Authentication method starting a SCRAM-SHA-256 exchange
+const AUTH_SCRAM_CONTINUE byte = 2    // Followed by the SCRAM server-first-message
+const AUTH_SCRAM_FINAL byte = 3       // Followed by the SCRAM server-final-message
+const MSG_STARTUP byte = 'S'          // Magic, version and user
+const MSG_PASSWORD byte = 'p'         // The password asked for or a SCRAM message
+const MSG_QUERY byte = 'Q'            // A statement
+const MSG_TERMINATE byte = 'X'        // Closes the connection
+const MSG_STARTTLS byte = 'L'         // Upgrades the connection to TLS before the startup message
+const MSG_AUTHENTICATION byte = 'R'   // The authentication method to answer
+const MSG_AUTHENTICATED byte = 'K'    // Authentication ok and the server version
+const MSG_ROW_DESCRIPTION byte = 'T'  // The columns of the result set
+const MSG_DATA_ROW byte = 'D'         // The values of a row
+const MSG_COMMAND_COMPLETE byte = 'C' // Ends the answer to a query
+const MSG_ERROR byte = 'E'            // An error code and message
+const MSG_EVENT byte = 'N'            // A change streamed to a subscriber as JSON
+const NULL_DISPLAY = "NULL"           // How NULL values are printed
+
+// writeMessage writes a message
+func writeMessage(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// readMessage reads a message, returning its type and payload
+func readMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MAX_MESSAGE_SIZE {
+		return 0, nil, fmt.Errorf("message of %d bytes is larger than %d", size, MAX_MESSAGE_SIZE)
+	}
+
+	payload := make([]byte, size)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// decodeValues decodes the columns of a row description or the values of a data row, NULL is nil
+func decodeValues(payload []byte) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("malformed message")
+	}
+
+	values := make([][]byte, binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+
+	for i := range values {
+		if len(payload) < 4 {
+			return nil, errors.New("malformed message")
+		}
+
+		size := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+
+		if size == NULL_LENGTH {
+			continue
+		}
+
+		if uint32(len(payload)) < size {
+			return nil, errors.New("malformed message")
+		}
+
+		values[i] = append([]byte{}, payload[:size]...)
+		payload = payload[size:]
+	}
+
+	return values, nil
+}
+
+// decodeError decodes an error message
+func decodeError(payload []byte) error {
+	if len(payload) < 2 {
+		return errors.New("malformed message")
+	}
+
+	return fmt.Errorf("ERR %d: %s", binary.BigEndian.Uint16(payload), payload[2:])
+}
+
+// formatTable formats a result set as a table
+func formatTable(columns []string, rows [][][]byte) string {
+	if len(columns) == 0 {
+		return ""
+	}
+
+	widths := make([]int, len(columns))
+	for i, column := range columns {
+		widths[i] = len(column)
+	}
+
+	for _, row := range rows {
+		for i, value := range row {
+			if i < len(widths) && len(display(value)) > widths[i] {
+				widths[i] = len(display(value))
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+
+	border := "+"
+	for _, width := range widths {
+		border += strings.Repeat("-", width+2) + "+"
+	}
+
+	line := func(values []string) {
+		buffer.WriteString("|")
+		for i, value := range values {
+			buffer.WriteString(" " + fmt.Sprintf("%-*v", widths[i], value) + " |")
+		}
+		buffer.WriteString("\n")
+	}
+
+	buffer.WriteString(border + "\n")
+	line(columns)
+	buffer.WriteString(border + "\n")
+
+	for _, row := range rows {
+		values := make([]string, len(columns))
+		for i := range values {
+			if i < len(row) {
+				values[i] = display(row[i])
+			}
+		}
+
+		line(values)
+	}
+
+	buffer.WriteString(border + "\n")
+
+	return buffer.String()
+}
+
+// formatJSON formats a result set as a JSON array of objects, NULL is null
+func formatJSON(columns []string, rows [][][]byte) (string, error) {
+	objects := make([]map[string]interface{}, len(rows))
+
+	for i, row := range rows {
+		objects[i] = make(map[string]interface{}, len(columns))
+
+		for j, column := range columns {
+			if j < len(row) && row[j] != nil {
+				objects[i][column] = string(row[j])
+			} else {
+				objects[i][column] = nil
+			}
+		}
+	}
+
+	b, err := json.Marshal(objects)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b) + "\n", nil
+}
+
+// display returns how a value is printed
+func display(value []byte) string {
+	if value == nil {
+		return NULL_DISPLAY
+	}
+
+	return string(value)
+}
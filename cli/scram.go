@@ -0,0 +1,145 @@
+// Package main SCRAM-SHA-256 client
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// scramClient is the client side of a SCRAM-SHA-256 exchange (RFC 5802, RFC 7677), the password never leaves it
+type scramClient struct {
+	password        string
+	clientFirstBare string // n=user,r=nonce
+	nonce           string // The client's nonce
+	serverSignature []byte // What the server-final-message must prove
+}
+
+// newScramClient starts an exchange with a random nonce
+func newScramClient(username, password string) (*scramClient, error) {
+	b := make([]byte, 18)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return newScramClientNonce(username, password, base64.RawStdEncoding.EncodeToString(b)), nil
+}
+
+// newScramClientNonce starts an exchange with a given nonce
+func newScramClientNonce(username, password, nonce string) *scramClient {
+	username = strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+
+	return &scramClient{password: password, clientFirstBare: "n=" + username + ",r=" + nonce, nonce: nonce}
+}
+
+// first returns the client-first-message, the client does not bind the channel
+func (c *scramClient) first() []byte {
+	return []byte("n,," + c.clientFirstBare)
+}
+
+// final answers the server-first-message with the client-final-message and its proof
+func (c *scramClient) final(serverFirst string) ([]byte, error) {
+	var nonce, salt string
+	var iterations int
+
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, errors.New("malformed SCRAM server-first-message")
+		}
+
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+
+	// The server's nonce extends the client's
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return nil, errors.New("SCRAM nonce does not match")
+	}
+
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || len(saltBytes) == 0 || iterations <= 0 {
+		return nil, errors.New("malformed SCRAM server-first-message")
+	}
+
+	withoutProof := "c=biws,r=" + nonce // biws is base64 of the n,, header
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+
+	salted := hi([]byte(c.password), saltBytes, iterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	proof := hmacSHA256(storedKey[:], authMessage)
+	subtle.XORBytes(proof, proof, clientKey)
+
+	c.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// verify checks the server-final-message proves the server knows the password's verifier
+func (c *scramClient) verify(serverFinal string) error {
+	if !strings.HasPrefix(serverFinal, "v=") {
+		return errors.New("malformed SCRAM server-final-message")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(serverFinal[2:])
+	if err != nil || c.serverSignature == nil || !hmac.Equal(signature, c.serverSignature) {
+		return errors.New("server could not prove it knows the password")
+	}
+
+	return nil
+}
+
+// hi is PBKDF2 with HMAC-SHA-256 of a single block, the salted password of SCRAM
+func hi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		subtle.XORBytes(result, result, u)
+	}
+
+	return result
+}
+
+// hmacSHA256 returns HMAC-SHA-256 of a message
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
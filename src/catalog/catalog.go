@@ -18,10 +18,13 @@
 package catalog
 
 import (
+	"ariasql/mvcc"
 	"ariasql/shared"
 	"ariasql/storage/btree"
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/gob"
 	"encoding/hex"
 	"errors"
@@ -29,12 +32,14 @@ import (
 	"github.com/DataDog/zstd"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/chacha20"
+	"io"
 	"os"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
 )
 
 const MAX_COLUMN_NAME_SIZE = 64 // Max 64 bytes for column name
@@ -57,12 +62,22 @@ const SYS_USERS_EXTENSION = ".usrs" // Users file extension
 
 const DB_PROC_EXTENSION = ".proc" // Procedure file extension
 
+// ROW_XMIN and ROW_XMAX are stored within every row written by a transaction
+// ROW_XMIN is the id of the transaction which created the row version, ROW_XMAX the id of the one which deleted it
+// Rows without them were written outside of a transaction and are visible to everyone
+const ROW_XMIN = "$xmin"
+const ROW_XMAX = "$xmax"
+
 // DB_SCHEMA_TABLE_SEQ_FILE_EXTENSION Table count file extension
 // The table count file is used to store the number of rows in a table
 // Used for sequence columns (there can only be one sequence column per table)
 // The sequence column is a column that auto increments based on the number of rows in the table
 const DB_SCHEMA_TABLE_SEQ_FILE_EXTENSION = ".seq" // Table seq file extension
 
+// DB_UNDO_DIRECTORY is the directory within the catalog directory holding copies of the tables transactions created, dropped or altered, until they end
+// Copies are kept under a directory per transaction id, then per change of the transaction, then per database
+const DB_UNDO_DIRECTORY = "undo"
+
 // Catalog is the root of the database catalog
 type Catalog struct {
 	Databases     map[string]*Database // Databases is a map of database names to database objects
@@ -72,8 +87,29 @@ type Catalog struct {
 	UsersFileLock *sync.Mutex          // Users file lock
 	UsersLock     *sync.Mutex          // Users lock
 	DatabasesLock *sync.Mutex          // Databases lock
+	LoginPolicy   *LoginPolicy         // Login throttling, account lockout and password rules, DefaultLoginPolicy if nil
+	unknownLogins map[string]int       // Consecutive failed logins of user names which do not exist, so they are answered as late as a user's
+}
+
+// LoginPolicy configures login throttling, account lockout and password rules, a zero field disables its rule
+type LoginPolicy struct {
+	MaxFailedLogins    int           // Consecutive failed logins locking an account out
+	LockoutDuration    time.Duration // How long an account stays locked out, until ALTER USER ... ACCOUNT UNLOCK if 0
+	FailedLoginDelay   time.Duration // Wait before a failed login is answered, for every consecutive failure of the user
+	MaxLoginDelay      time.Duration // Longest wait before a failed login is answered
+	MinPasswordLength  int           // Shortest password CREATE USER and ALTER USER ... SET PASSWORD accept
+	PasswordComplexity int           // Character classes, lowercase, uppercase, digits and symbols, a password must mix
+	PasswordLifetime   time.Duration // How long a password is valid, a user with an older one must change it at its next login
 }
 
+// DefaultLoginPolicy slows failed logins down, accounts are only locked out if MaxFailedLogins is configured so the admin cannot be locked out by guessing
+var DefaultLoginPolicy = LoginPolicy{FailedLoginDelay: time.Second, MaxLoginDelay: 5 * time.Second}
+
+const MAX_UNKNOWN_LOGINS = 1024 // User names which do not exist whose failed logins are counted, the counts start over beyond it
+
+// ErrAccountLocked is returned logging in to a locked account
+var ErrAccountLocked = errors.New("account is locked")
+
 // Database is a database object
 type Database struct {
 	Name               string                // Name is the database name
@@ -98,6 +134,7 @@ type Table struct {
 	Encrypt      bool              // Encrypt is true if the table data is encrypted
 	HashedKey    [32]byte          // HashedKey is the hashed key used to encrypt the table data
 	Nonce        [12]byte          // Nonce is the nonce used to encrypt the table data
+	versionLock  sync.Mutex        // Serializes transactions deleting row versions
 }
 
 // Procedure is a procedure object
@@ -143,9 +180,16 @@ type Index struct {
 
 // User is a user object
 type User struct {
-	Username   string
-	Password   string
-	Privileges []*Privilege
+	Username string
+	Password string                // bcrypt hash of the password of a user created before SCRAM, cleared once the user logs in with it
+	Scram    *shared.ScramVerifier // SCRAM-SHA-256 verifier of the password, nil until a user created before SCRAM logs in
+	// Certificate identifies a user without a password by the client certificate TLS verified, CN=name matches its subject's common name, SAN=name one of its alternative names
+	Certificate     string
+	PasswordChanged time.Time // When the password was last set, zero for users created before passwords expired
+	FailedLogins    int       // Consecutive failed logins
+	LockedUntil     time.Time // Locked out after too many failed logins until then
+	Locked          bool      // Locked by ALTER USER ... ACCOUNT LOCK, or locked out with no LockoutDuration, until ACCOUNT UNLOCK
+	Privileges      []*Privilege
 }
 
 // Privilege is a user privilege
@@ -235,80 +279,11 @@ func (cat *Catalog) Open() error {
 							Directory: fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), tblDir.Name()),
 						}
 
-						// Within each table there is a schema file, index files , sequence file, and data file
-
-						// Read schema file
-						schemaFile, err := os.Open(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("%s%s", tblDir.Name(), DB_SCHEMA_TABLE_SCHEMA_FILE_EXTENSION)))
-						if err != nil {
-							return err
-						}
-
-						// Decode schema
-						dec := gob.NewDecoder(schemaFile)
-						tblSchema := &TableSchema{}
-						err = dec.Decode(tblSchema)
-
-						if err != nil {
-							return err
-						}
-
-						tbl.TableSchema = tblSchema
-
-						// Read data file
-						rowFile, err := btree.OpenPager(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("%s%s", tblDir.Name(), DB_SCHEMA_TABLE_DATA_FILE_EXTENSION)), os.O_RDWR, 0755)
-						if err != nil {
-							return err
-						}
-
-						tbl.Rows = rowFile
-
-						// Read sequence file
-						seqFile, err := os.Open(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("%s%s", tblDir.Name(), DB_SCHEMA_TABLE_SEQ_FILE_EXTENSION)))
-						if err != nil {
-							return err
-						}
-
-						tbl.SequenceFile = seqFile
-
-						tblFiles, err := os.ReadDir(fmt.Sprintf("%s", tbl.Directory))
+						err = tbl.open()
 						if err != nil {
 							return err
 						}
 
-						tbl.Indexes = make(map[string]*Index)
-
-						for _, tblFile := range tblFiles {
-							if strings.HasSuffix(tblFile.Name(), DB_SCHEMA_TABLE_INDEX_FILE_EXTENSION) {
-								// Read index file
-								indexFile, err := os.Open(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), tblFile.Name()))
-								if err != nil {
-									return err
-								}
-
-								// Decode index
-								dec := gob.NewDecoder(indexFile)
-								idx := &Index{}
-								err = dec.Decode(idx)
-
-								if err != nil {
-									return err
-								}
-
-								// Open btree
-								bt, err := btree.Open(fmt.Sprintf("%s%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("idx_%s", idx.Name), ".bt"), os.O_RDWR, 0755, 6)
-								if err != nil {
-									return err
-								}
-
-								idx.btree = bt
-
-								tbl.Indexes[idx.Name] = idx
-								tbl.Indexes[idx.Name].lock = &sync.Mutex{}
-
-							}
-
-						}
-
 						db.Tables[tbl.Name] = tbl
 					}
 				}
@@ -392,6 +367,7 @@ func (cat *Catalog) CreateDatabase(name string) error {
 	// Create database
 	cat.Databases[name] = &Database{
 		Name:               name,
+		TablesLock:         &sync.Mutex{},
 		Tables:             make(map[string]*Table),
 		Procedures:         make(map[string]*Procedure),
 		ProceduresFileLock: &sync.Mutex{},
@@ -477,209 +453,615 @@ func (db *Database) DropTable(name string) error {
 
 }
 
-// CreateTable creates a new table in a schema
-func (db *Database) CreateTable(name string, tblSchema *TableSchema, encrypt bool, compress bool, key []byte) error {
-	if tblSchema == nil {
-		return fmt.Errorf("table schema is nil")
-	}
+// SaveTable keeps a copy of table name of db as it is before change number change of transaction xid, RestoreTable puts it back if the change is undone
+// A table which does not exist yet is recorded as such
+func (cat *Catalog) SaveTable(xid uint64, change int, db *Database, name string) error {
+	dir := cat.undoDirectory(xid, strconv.Itoa(change), db.Name)
+	saved := fmt.Sprintf("%s%s%s", dir, shared.GetOsPathSeparator(), name)
 
-	if len(name) > MAX_TABLE_NAME_SIZE {
-		return fmt.Errorf("table name is too long, max length is %d", MAX_TABLE_NAME_SIZE)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
 	}
 
-	// Check if table exists
-	if _, ok := db.Tables[name]; ok {
-		return fmt.Errorf("table %s already exists", name)
-	}
+	tbl := db.GetTable(name)
+	if tbl == nil {
+		// An empty file marks a table the transaction creates
+		f, err := os.Create(saved)
+		if err != nil {
+			return err
+		}
 
-	// Create table
-	db.Tables[name] = &Table{
-		Name:        name,
-		Indexes:     make(map[string]*Index),
-		TableSchema: tblSchema,
-		Directory:   fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name),
+		return f.Close()
 	}
 
-	// Create table directory
-	err := os.Mkdir(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name), 0755)
+	// The copy is complete once it is renamed, a partial copy left by a crash is removed on recovery
+	partial := saved + ".tmp"
+
+	err = copyDirectory(tbl.Directory, partial)
 	if err != nil {
+		os.RemoveAll(partial)
 		return err
 	}
 
-	sequenceDefined := false
-
-	for colName, colDef := range tblSchema.ColumnDefinitions {
-		if len(colName) > MAX_COLUMN_NAME_SIZE {
-			// delete table
-			delete(db.Tables, name)
-			os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-			return fmt.Errorf("column name is too long, max length is %d", MAX_COLUMN_NAME_SIZE)
-		}
+	return os.Rename(partial, saved)
+}
 
-		if !shared.IsValidDataType(colDef.DataType) {
-			delete(db.Tables, name)
-			os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-			return fmt.Errorf("invalid data type %s", colDef.DataType)
-		}
+// RestoreTable puts back table name of db as SaveTable saved it before change number change of transaction xid, dropping the table if it did not exist
+// tbl, if not nil, is reopened from the copy so the row versions referencing it can still be undone
+func (cat *Catalog) RestoreTable(xid uint64, change int, db *Database, name string, tbl *Table) error {
+	dir := cat.undoDirectory(xid, strconv.Itoa(change), db.Name)
+	saved := fmt.Sprintf("%s%s%s", dir, shared.GetOsPathSeparator(), name)
 
-		if colDef.Unique {
-			err = db.Tables[name].CreateIndex(fmt.Sprintf("unique_%s", colName), []string{colName}, true)
-			if err != nil {
-				delete(db.Tables, name)
-				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-				return err
-			}
-		}
+	info, err := os.Stat(saved)
+	if err != nil {
+		return err
+	}
 
-		if colDef.Sequence {
-			if sequenceDefined {
-				delete(db.Tables, name)
-				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-				return fmt.Errorf("only one sequence column is allowed per table")
-			}
+	db.TablesLock.Lock()
+	defer db.TablesLock.Unlock()
 
-			// Sequenced column must be unique and not null
+	if current, ok := db.Tables[name]; ok {
+		current.close()
+		delete(db.Tables, name)
+	}
 
-			if !colDef.Unique || !colDef.NotNull {
-				delete(db.Tables, name)
-				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-				return fmt.Errorf("sequence column %s must be unique and not null", colName)
-			}
+	tblDir := fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name)
 
-			// Datatype MUST be an integer
-			if strings.ToUpper(colDef.DataType) != "INT" && strings.ToUpper(colDef.DataType) != "INTEGER" {
-				delete(db.Tables, name)
-				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-				return fmt.Errorf("sequence column %s must be an integer", colName)
-			}
+	err = os.RemoveAll(tblDir)
+	if err != nil {
+		return err
+	}
 
-			sequenceDefined = true
+	if info.IsDir() {
+		err = os.Rename(saved, tblDir)
+		if err != nil {
+			return err
 		}
 
-		switch strings.ToUpper(colDef.DataType) {
-		case "CHARACTER", "CHAR":
-			// A character datatype requires a length
-			if colDef.Length == 0 {
-				delete(db.Tables, name)
-				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-				return fmt.Errorf("column %s requires a length", colName)
-			}
-		case "NUMERIC", "DECIMAL", "DEC", "FLOAT", "DOUBLE", "REAL":
-			// A numeric datatype requires a precision and scale
-			if colDef.Precision == 0 {
-				delete(db.Tables, name)
-				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-				return fmt.Errorf("column %s requires a precision", colName)
-			}
+		if tbl == nil {
+			tbl = &Table{Name: name}
+		} else {
+			tbl.close()
+		}
 
-			if colDef.Scale == 0 {
-				delete(db.Tables, name)
-				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-				return fmt.Errorf("column %s requires a scale", colName)
-			}
-		case "INT", "INTEGER", "SMALLINT":
-		case "DATE", "TIME", "TIMESTAMP", "DATETIME":
-		case "BINARY":
-		case "UUID":
-		case "BOOLEAN", "BOOL":
-		case "TEXT":
-		case "BLOB":
+		tbl.Directory = tblDir
 
-		default:
-			delete(db.Tables, name)
-			os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-			return fmt.Errorf("invalid data type %s", colDef.DataType)
+		err = tbl.open()
+		if err != nil {
+			return err
 		}
+
+		db.Tables[name] = tbl
 	}
 
-	if encrypt {
-		db.Tables[name].Encrypt = true
+	return os.RemoveAll(cat.undoDirectory(xid, strconv.Itoa(change), ""))
+}
 
-		// sha256 hash the key
-		hash := sha256.New()
+// DiscardTables removes the copies SaveTable kept for transaction xid once it committed
+func (cat *Catalog) DiscardTables(xid uint64) error {
+	return os.RemoveAll(cat.undoDirectory(xid, "", ""))
+}
 
-		// Write data to the hash
-		hash.Write(key)
+// RecoverTables restores the tables saved for the transactions a crash left aborted, latest change first, and discards the copies of the committed ones
+// The copies of prepared transactions are kept until they commit or roll back.  It must be called once the catalog is open, before the row versions of the aborted transactions are undone
+func (cat *Catalog) RecoverTables(aborted, prepared func(xid uint64) bool) error {
+	xidDirs, err := os.ReadDir(fmt.Sprintf("%s%s%s", cat.Directory, shared.GetOsPathSeparator(), DB_UNDO_DIRECTORY))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 
-		// Calculate the hash
-		hashBytes := hash.Sum(nil)
+		return err
+	}
 
-		db.Tables[name].HashedKey = [32]byte(hashBytes)
+	for _, xidDir := range xidDirs {
+		xid, err := strconv.ParseUint(xidDir.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
 
-		// The nonce is 12 bytes of the end of the hash
-		db.Tables[name].Nonce = [12]byte{}
-		db.Tables[name].Nonce = [12]byte(append(db.Tables[name].Nonce[:], hashBytes[len(hashBytes)-12:]...))
-	}
+		if prepared(xid) {
+			continue
+		}
 
-	if compress {
-		db.Tables[name].Compress = true
+		if aborted(xid) {
+			err = cat.restoreTables(xid)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = cat.DiscardTables(xid)
+		if err != nil {
+			return err
+		}
 	}
 
-	// Create sequence file
-	seqFile, err := os.Create(fmt.Sprintf("%s%s%s%s", db.Tables[name].Directory, shared.GetOsPathSeparator(), name, DB_SCHEMA_TABLE_SEQ_FILE_EXTENSION))
+	return nil
+}
+
+// UndoTables restores the tables saved for transaction xid, latest change first, and discards the copies
+// Used for a prepared transaction resumed after a restart which rolls back, before its row versions are undone
+func (cat *Catalog) UndoTables(xid uint64) error {
+	_, err := os.Stat(cat.undoDirectory(xid, "", ""))
 	if err != nil {
-		delete(db.Tables, name)
-		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+		if os.IsNotExist(err) {
+			return nil
+		}
+
 		return err
 	}
 
-	schemaFile, err := os.Create(fmt.Sprintf("%s%s%s%s", db.Tables[name].Directory, shared.GetOsPathSeparator(), name, DB_SCHEMA_TABLE_SCHEMA_FILE_EXTENSION))
+	err = cat.restoreTables(xid)
 	if err != nil {
-		delete(db.Tables, name)
-		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
 		return err
 	}
 
-	defer schemaFile.Close()
-
-	// Encode schema to file
-	enc := gob.NewEncoder(schemaFile)
+	return cat.DiscardTables(xid)
+}
 
-	err = enc.Encode(tblSchema)
+// SavedTables returns the tables saved for transaction xid as database.table
+func (cat *Catalog) SavedTables(xid uint64) ([]string, error) {
+	changeDirs, err := os.ReadDir(cat.undoDirectory(xid, "", ""))
 	if err != nil {
-		delete(db.Tables, name)
-		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-		return err
-	}
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
 
-	// Create btree pager
-	rowFile, err := btree.OpenPager(fmt.Sprintf("%s%s%s%s", db.Tables[name].Directory, shared.GetOsPathSeparator(), name, DB_SCHEMA_TABLE_DATA_FILE_EXTENSION), os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		delete(db.Tables, name)
-		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
-		return err
+		return nil, err
 	}
 
-	db.Tables[name].Rows = rowFile
-
-	db.Tables[name].SequenceFile = seqFile
-	db.Tables[name].SeqLock = &sync.Mutex{}
+	var tables []string
 
-	return nil
-}
+	for _, changeDir := range changeDirs {
+		dbDirs, err := os.ReadDir(cat.undoDirectory(xid, changeDir.Name(), ""))
+		if err != nil {
+			return nil, err
+		}
 
-// GetTable gets a table by name
-func (db *Database) GetTable(tableName string) *Table {
-	return db.Tables[tableName]
-}
+		for _, dbDir := range dbDirs {
+			saved, err := os.ReadDir(cat.undoDirectory(xid, changeDir.Name(), dbDir.Name()))
+			if err != nil {
+				return nil, err
+			}
 
-// CreateIndex creates a new index on a table
-func (tbl *Table) CreateIndex(name string, columns []string, unique bool) error {
-	if len(name) > MAX_INDEX_NAME_SIZE {
-		return fmt.Errorf("index name is too long, max length is %d", MAX_INDEX_NAME_SIZE)
+			for _, entry := range saved {
+				name := dbDir.Name() + "." + strings.TrimSuffix(entry.Name(), ".tmp")
+				if !slices.Contains(tables, name) {
+					tables = append(tables, name)
+				}
+			}
+		}
 	}
 
-	// Check if index exists
-	if _, ok := tbl.Indexes[name]; ok {
-		return fmt.Errorf("index %s already exists", name)
-	}
+	return tables, nil
+}
 
-	bt, err := btree.Open(fmt.Sprintf("%s%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("idx_%s", name), ".bt"), os.O_CREATE|os.O_RDWR, 0755, 6)
+// restoreTables restores the tables saved for the changes of transaction xid, latest change first
+func (cat *Catalog) restoreTables(xid uint64) error {
+	changeDirs, err := os.ReadDir(cat.undoDirectory(xid, "", ""))
 	if err != nil {
 		return err
 	}
 
-	// Create index
+	var changes []int
+
+	for _, changeDir := range changeDirs {
+		change, err := strconv.Atoi(changeDir.Name())
+		if err == nil {
+			changes = append(changes, change)
+		}
+	}
+
+	slices.Sort(changes)
+
+	for i := len(changes) - 1; i >= 0; i-- {
+		dbDirs, err := os.ReadDir(cat.undoDirectory(xid, strconv.Itoa(changes[i]), ""))
+		if err != nil {
+			return err
+		}
+
+		for _, dbDir := range dbDirs {
+			db := cat.GetDatabase(dbDir.Name())
+			if db == nil {
+				continue
+			}
+
+			saved, err := os.ReadDir(cat.undoDirectory(xid, strconv.Itoa(changes[i]), db.Name))
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range saved {
+				if strings.HasSuffix(entry.Name(), ".tmp") {
+					continue // the transaction had not changed the table yet
+				}
+
+				err = cat.RestoreTable(xid, changes[i], db, entry.Name(), db.GetTable(entry.Name()))
+				if err != nil {
+					return fmt.Errorf("restoring table %s.%s: %s", db.Name, entry.Name(), err.Error())
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// undoDirectory returns the directory holding the tables of database saved before change number change of transaction xid
+// With an empty database it is the directory of the change, with an empty change the directory of the transaction
+func (cat *Catalog) undoDirectory(xid uint64, change, database string) string {
+	dir := fmt.Sprintf("%s%s%s%s%d", cat.Directory, shared.GetOsPathSeparator(), DB_UNDO_DIRECTORY, shared.GetOsPathSeparator(), xid)
+
+	for _, sub := range []string{change, database} {
+		if sub == "" {
+			break
+		}
+
+		dir = fmt.Sprintf("%s%s%s", dir, shared.GetOsPathSeparator(), sub)
+	}
+
+	return dir
+}
+
+// copyDirectory copies the files of directory src to a new directory dst
+func copyDirectory(src, dst string) error {
+	err := os.Mkdir(dst, 0755)
+	if err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		err = copyFile(fmt.Sprintf("%s%s%s", src, shared.GetOsPathSeparator(), file.Name()), fmt.Sprintf("%s%s%s", dst, shared.GetOsPathSeparator(), file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies file src to dst, syncing the copy to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// open reads the schema of a table and opens its data, sequence and index files from its directory
+// Within each table there is a schema file, index files , sequence file, and data file
+func (tbl *Table) open() error {
+	// Read schema file
+	schemaFile, err := os.Open(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("%s%s", tbl.Name, DB_SCHEMA_TABLE_SCHEMA_FILE_EXTENSION)))
+	if err != nil {
+		return err
+	}
+
+	defer schemaFile.Close()
+
+	// Decode schema
+	dec := gob.NewDecoder(schemaFile)
+	tblSchema := &TableSchema{}
+	err = dec.Decode(tblSchema)
+
+	if err != nil {
+		return err
+	}
+
+	tbl.TableSchema = tblSchema
+
+	// Read data file
+	rowFile, err := btree.OpenPager(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("%s%s", tbl.Name, DB_SCHEMA_TABLE_DATA_FILE_EXTENSION)), os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+
+	tbl.Rows = rowFile
+
+	// Read sequence file
+	seqFile, err := os.OpenFile(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("%s%s", tbl.Name, DB_SCHEMA_TABLE_SEQ_FILE_EXTENSION)), os.O_RDWR, 0755)
+	if err != nil {
+		return err
+	}
+
+	tbl.SequenceFile = seqFile
+	tbl.SeqLock = &sync.Mutex{}
+
+	tblFiles, err := os.ReadDir(fmt.Sprintf("%s", tbl.Directory))
+	if err != nil {
+		return err
+	}
+
+	tbl.Indexes = make(map[string]*Index)
+
+	for _, tblFile := range tblFiles {
+		if strings.HasSuffix(tblFile.Name(), DB_SCHEMA_TABLE_INDEX_FILE_EXTENSION) {
+			// Read index file
+			indexFile, err := os.Open(fmt.Sprintf("%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), tblFile.Name()))
+			if err != nil {
+				return err
+			}
+
+			// Decode index
+			dec := gob.NewDecoder(indexFile)
+			idx := &Index{}
+			err = dec.Decode(idx)
+			indexFile.Close()
+
+			if err != nil {
+				return err
+			}
+
+			// Open btree
+			bt, err := btree.Open(fmt.Sprintf("%s%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("idx_%s", idx.Name), ".bt"), os.O_RDWR, 0755, 6)
+			if err != nil {
+				return err
+			}
+
+			idx.btree = bt
+
+			tbl.Indexes[idx.Name] = idx
+			tbl.Indexes[idx.Name].lock = &sync.Mutex{}
+
+		}
+
+	}
+
+	return nil
+}
+
+// close closes the data, sequence and index files of a table
+func (tbl *Table) close() {
+	if tbl.Rows != nil {
+		tbl.Rows.Close()
+	}
+
+	if tbl.SequenceFile != nil {
+		tbl.SequenceFile.Close()
+	}
+
+	for _, idx := range tbl.Indexes {
+		if idx.btree != nil {
+			idx.btree.Close()
+		}
+	}
+}
+
+// CreateTable creates a new table in a schema
+func (db *Database) CreateTable(name string, tblSchema *TableSchema, encrypt bool, compress bool, key []byte) error {
+	if tblSchema == nil {
+		return fmt.Errorf("table schema is nil")
+	}
+
+	if len(name) > MAX_TABLE_NAME_SIZE {
+		return fmt.Errorf("table name is too long, max length is %d", MAX_TABLE_NAME_SIZE)
+	}
+
+	// Check if table exists
+	if _, ok := db.Tables[name]; ok {
+		return fmt.Errorf("table %s already exists", name)
+	}
+
+	// Create table
+	db.Tables[name] = &Table{
+		Name:        name,
+		Indexes:     make(map[string]*Index),
+		TableSchema: tblSchema,
+		Directory:   fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name),
+	}
+
+	// Create table directory
+	err := os.Mkdir(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name), 0755)
+	if err != nil {
+		return err
+	}
+
+	sequenceDefined := false
+
+	for colName, colDef := range tblSchema.ColumnDefinitions {
+		if len(colName) > MAX_COLUMN_NAME_SIZE {
+			// delete table
+			delete(db.Tables, name)
+			os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+			return fmt.Errorf("column name is too long, max length is %d", MAX_COLUMN_NAME_SIZE)
+		}
+
+		if !shared.IsValidDataType(colDef.DataType) {
+			delete(db.Tables, name)
+			os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+			return fmt.Errorf("invalid data type %s", colDef.DataType)
+		}
+
+		if colDef.Unique {
+			err = db.Tables[name].CreateIndex(fmt.Sprintf("unique_%s", colName), []string{colName}, true)
+			if err != nil {
+				delete(db.Tables, name)
+				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+				return err
+			}
+		}
+
+		if colDef.Sequence {
+			if sequenceDefined {
+				delete(db.Tables, name)
+				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+				return fmt.Errorf("only one sequence column is allowed per table")
+			}
+
+			// Sequenced column must be unique and not null
+
+			if !colDef.Unique || !colDef.NotNull {
+				delete(db.Tables, name)
+				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+				return fmt.Errorf("sequence column %s must be unique and not null", colName)
+			}
+
+			// Datatype MUST be an integer
+			if strings.ToUpper(colDef.DataType) != "INT" && strings.ToUpper(colDef.DataType) != "INTEGER" {
+				delete(db.Tables, name)
+				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+				return fmt.Errorf("sequence column %s must be an integer", colName)
+			}
+
+			sequenceDefined = true
+		}
+
+		switch strings.ToUpper(colDef.DataType) {
+		case "CHARACTER", "CHAR":
+			// A character datatype requires a length
+			if colDef.Length == 0 {
+				delete(db.Tables, name)
+				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+				return fmt.Errorf("column %s requires a length", colName)
+			}
+		case "NUMERIC", "DECIMAL", "DEC", "FLOAT", "DOUBLE", "REAL":
+			// A numeric datatype requires a precision and scale
+			if colDef.Precision == 0 {
+				delete(db.Tables, name)
+				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+				return fmt.Errorf("column %s requires a precision", colName)
+			}
+
+			if colDef.Scale == 0 {
+				delete(db.Tables, name)
+				os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+				return fmt.Errorf("column %s requires a scale", colName)
+			}
+		case "INT", "INTEGER", "SMALLINT":
+		case "DATE", "TIME", "TIMESTAMP", "DATETIME":
+		case "BINARY":
+		case "UUID":
+		case "BOOLEAN", "BOOL":
+		case "TEXT":
+		case "BLOB":
+
+		default:
+			delete(db.Tables, name)
+			os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+			return fmt.Errorf("invalid data type %s", colDef.DataType)
+		}
+	}
+
+	if encrypt {
+		db.Tables[name].Encrypt = true
+
+		// sha256 hash the key
+		hash := sha256.New()
+
+		// Write data to the hash
+		hash.Write(key)
+
+		// Calculate the hash
+		hashBytes := hash.Sum(nil)
+
+		db.Tables[name].HashedKey = [32]byte(hashBytes)
+
+		// The nonce is 12 bytes of the end of the hash
+		db.Tables[name].Nonce = [12]byte{}
+		db.Tables[name].Nonce = [12]byte(append(db.Tables[name].Nonce[:], hashBytes[len(hashBytes)-12:]...))
+	}
+
+	if compress {
+		db.Tables[name].Compress = true
+	}
+
+	// Create sequence file
+	seqFile, err := os.Create(fmt.Sprintf("%s%s%s%s", db.Tables[name].Directory, shared.GetOsPathSeparator(), name, DB_SCHEMA_TABLE_SEQ_FILE_EXTENSION))
+	if err != nil {
+		delete(db.Tables, name)
+		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+		return err
+	}
+
+	schemaFile, err := os.Create(fmt.Sprintf("%s%s%s%s", db.Tables[name].Directory, shared.GetOsPathSeparator(), name, DB_SCHEMA_TABLE_SCHEMA_FILE_EXTENSION))
+	if err != nil {
+		delete(db.Tables, name)
+		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+		return err
+	}
+
+	defer schemaFile.Close()
+
+	// Encode schema to file
+	enc := gob.NewEncoder(schemaFile)
+
+	err = enc.Encode(tblSchema)
+	if err != nil {
+		delete(db.Tables, name)
+		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+		return err
+	}
+
+	// Create btree pager
+	rowFile, err := btree.OpenPager(fmt.Sprintf("%s%s%s%s", db.Tables[name].Directory, shared.GetOsPathSeparator(), name, DB_SCHEMA_TABLE_DATA_FILE_EXTENSION), os.O_CREATE|os.O_RDWR, 0755)
+	if err != nil {
+		delete(db.Tables, name)
+		os.RemoveAll(fmt.Sprintf("%s%s%s", db.Directory, shared.GetOsPathSeparator(), name))
+		return err
+	}
+
+	db.Tables[name].Rows = rowFile
+
+	db.Tables[name].SequenceFile = seqFile
+	db.Tables[name].SeqLock = &sync.Mutex{}
+
+	return nil
+}
+
+// GetTable gets a table by name
+func (db *Database) GetTable(tableName string) *Table {
+	return db.Tables[tableName]
+}
+
+// CreateIndex creates a new index on a table
+func (tbl *Table) CreateIndex(name string, columns []string, unique bool) error {
+	if len(name) > MAX_INDEX_NAME_SIZE {
+		return fmt.Errorf("index name is too long, max length is %d", MAX_INDEX_NAME_SIZE)
+	}
+
+	// Check if index exists
+	if _, ok := tbl.Indexes[name]; ok {
+		return fmt.Errorf("index %s already exists", name)
+	}
+
+	bt, err := btree.Open(fmt.Sprintf("%s%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), fmt.Sprintf("idx_%s", name), ".bt"), os.O_CREATE|os.O_RDWR, 0755, 6)
+	if err != nil {
+		return err
+	}
+
+	// Create index
 	tbl.Indexes[name] = &Index{
 		Name:    name,
 		Columns: columns,
@@ -748,14 +1130,24 @@ func (tbl *Table) GetIndex(name string) *Index {
 
 // Insert inserts a row into the table
 func (tbl *Table) Insert(rows []map[string]interface{}, db *Database) ([]int64, []map[string]interface{}, error) {
+	return tbl.InsertVersions(rows, db, nil)
+}
+
+// InsertVersions inserts rows as versions created by the snapshot's transaction
+// A nil snapshot inserts rows visible to everyone.  On error the ids of the rows written so far are returned along with it, to be undone
+func (tbl *Table) InsertVersions(rows []map[string]interface{}, db *Database, snapshot *mvcc.Snapshot) ([]int64, []map[string]interface{}, error) {
 	rowIds := make([]int64, 0)                        // inserted row ids
 	insertedRows := make([]map[string]interface{}, 0) // inserted rows
 
 	for _, row := range rows {
 		// Insert row into table
-		rowId, err := tbl.insert(row, db)
+		rowId, err := tbl.insert(row, db, snapshot)
 		if err != nil {
-			return nil, nil, err
+			if rowId >= 0 {
+				rowIds = append(rowIds, rowId) // written but not fully indexed
+			}
+
+			return rowIds, insertedRows, err
 		}
 
 		rowIds = append(rowIds, rowId)
@@ -767,7 +1159,18 @@ func (tbl *Table) Insert(rows []map[string]interface{}, db *Database) ([]int64,
 }
 
 // insert inserts a row into the table
-func (tbl *Table) insert(row map[string]interface{}, db *Database) (int64, error) {
+// If the row was written before the error its id is returned with the error, otherwise -1 and the sequence values taken for it are given back
+func (tbl *Table) insert(row map[string]interface{}, db *Database, snapshot *mvcc.Snapshot) (rowId int64, err error) {
+	var seqs []int // Sequence values taken for the row
+
+	defer func() {
+		if err != nil && rowId < 0 {
+			for i := len(seqs) - 1; i >= 0; i-- {
+				tbl.ReleaseSequence(seqs[i])
+			}
+		}
+	}()
+
 	// Check row against schema
 	for colName, colDef := range tbl.TableSchema.ColumnDefinitions {
 
@@ -1013,6 +1416,7 @@ func (tbl *Table) insert(row map[string]interface{}, db *Database) (int64, error
 				}
 
 				row[colName] = seq
+				seqs = append(seqs, seq)
 			}
 
 			if _, ok := row[colName].(int); !ok {
@@ -1051,47 +1455,9 @@ func (tbl *Table) insert(row map[string]interface{}, db *Database) (int64, error
 				}
 			}
 
-			idx := tbl.CheckIndexedColumn(colName, true)
-			if idx == nil {
-				return -1, fmt.Errorf("problem getting unique rows for column %s", colName)
-			}
-
-			// Check if unique key exists
-			key, err := idx.btree.Get([]byte(fmt.Sprintf("%v", row[colName])))
+			err := tbl.checkUnique(colName, row[colName], -1, snapshot)
 			if err != nil {
-				return -1, fmt.Errorf("problem getting unique rows for column %s", colName)
-			}
-
-			if key != nil {
-
-				for _, rowId := range key.V {
-					// We store a []byte(rowId) in the btree
-					// We need to convert it to an int64
-
-					// Convert []byte to int64
-					id, err := strconv.ParseInt(string(rowId), 10, 64)
-					if err != nil {
-						return -1, errors.New("problem getting unique rows")
-					}
-
-					// Get row from table
-					r, err := tbl.Rows.GetPage(id)
-					if err != nil {
-						return -1, errors.New("problem getting unique rows")
-					}
-
-					// Decode row
-					decoded, err := decodeRow(r)
-					if err != nil {
-						return -1, errors.New("problem getting unique rows")
-					}
-
-					// Check if row exists
-					if decoded[colName] == row[colName] {
-						return -1, fmt.Errorf("row with %s %v already exists", colName, row[colName])
-					}
-
-				}
+				return -1, err
 			}
 
 		}
@@ -1123,8 +1489,13 @@ func (tbl *Table) insert(row map[string]interface{}, db *Database) (int64, error
 
 	}
 
+	var xmin uint64
+	if snapshot != nil {
+		xmin = snapshot.Xid
+	}
+
 	// Write row to table
-	rowId, err := tbl.writeRow(row)
+	rowId, err = tbl.writeRow(row, xmin)
 	if err != nil {
 		return -1, err
 	}
@@ -1138,20 +1509,20 @@ func (tbl *Table) insert(row map[string]interface{}, db *Database) (int64, error
 				if tbl.Compress {
 					val, err = Compress([]byte(fmt.Sprintf("%v", val)))
 					if err != nil {
-						return -1, err
+						return rowId, err
 					}
 				}
 
 				if tbl.Encrypt {
 					val, err = Encrypt(tbl.HashedKey, tbl.Nonce, val.([]byte))
 					if err != nil {
-						return -1, err
+						return rowId, err
 					}
 				}
 
 				err := idx.btree.Put([]byte(fmt.Sprintf("%v", val)), []byte(fmt.Sprintf("%d", rowId)))
 				if err != nil {
-					return -1, err
+					return rowId, err
 				}
 			}
 		}
@@ -1165,10 +1536,16 @@ func (idx *Index) GetBtree() *btree.BTree {
 	return idx.btree
 }
 
-// writeRow writes a row to the table
-func (tbl *Table) writeRow(row map[string]interface{}) (int64, error) {
+// writeRow writes a row to the table as a version created by transaction xmin
+func (tbl *Table) writeRow(row map[string]interface{}, xmin uint64) (int64, error) {
 	// Write row to table
 
+	// Rows written outside of a transaction carry no version
+	if xmin != 0 {
+		row = CopyRow(&row)
+		row[ROW_XMIN] = xmin
+	}
+
 	// encode row to bytes
 	encoded, err := EncodeRow(row)
 	if err != nil {
@@ -1256,50 +1633,168 @@ func (tbl *Table) IncrementSequence() (int, error) {
 	return 0, nil
 }
 
+// ReleaseSequence gives back sequence value seq if it is still the last one handed out, so an insert which did not go through leaves no gap
+func (tbl *Table) ReleaseSequence(seq int) error {
+	tbl.SeqLock.Lock()
+	defer tbl.SeqLock.Unlock()
+
+	d, err := os.ReadFile(tbl.SequenceFile.Name())
+	if err != nil {
+		return err
+	}
+
+	i, err := strconv.Atoi(string(d))
+	if err != nil || i != seq {
+		return nil // a later value was handed out
+	}
+
+	err = tbl.SequenceFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = tbl.SequenceFile.WriteAt([]byte(fmt.Sprintf("%d", seq-1)), 0)
+
+	return err
+}
+
+// ReleaseSequences gives back the sequence values of row rowId, an inserted row being undone, see ReleaseSequence
+func (tbl *Table) ReleaseSequences(rowId int64) error {
+	row, _, _, err := tbl.readRow(rowId)
+	if err != nil {
+		return err
+	}
+
+	for name, colDef := range tbl.TableSchema.ColumnDefinitions {
+		if seq, ok := row[name].(int); ok && colDef.Sequence {
+			err = tbl.ReleaseSequence(seq)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // Iterator is an iterator for rows in a table
 type Iterator struct {
-	table *Table
-	row   int64
+	table    *Table
+	row      int64
+	snapshot *mvcc.Snapshot         // Only rows visible to the snapshot are returned, nil returns every row as stored
+	next     map[string]interface{} // Next visible row, read ahead by Valid
+	ctx      context.Context        // The iterator stops once the context is done, nil never stops it
 }
 
-// GetTable gets the table for the iterator
-func (ri *Iterator) GetTable() *Table {
-	return ri.table
+// GetTable gets the table for the iterator
+func (ri *Iterator) GetTable() *Table {
+	return ri.table
+}
+
+// readRow reads a row as stored, along with the transactions which created and deleted it
+func (tbl *Table) readRow(rowId int64) (map[string]interface{}, uint64, uint64, error) {
+	// Read row from table
+	row, err := tbl.Rows.GetPage(rowId)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	// check for encryption
+	if tbl.Encrypt {
+		row, err = Decrypt(tbl.HashedKey, tbl.Nonce, row)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	if tbl.Compress {
+		row, err = Decompress(row)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+
+	// decode row
+	decoded, err := decodeRow(row)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	xmin, _ := decoded[ROW_XMIN].(uint64)
+	xmax, _ := decoded[ROW_XMAX].(uint64)
+
+	return decoded, xmin, xmax, nil
+}
+
+// rewriteRow writes a row back to its page
+func (tbl *Table) rewriteRow(rowId int64, row map[string]interface{}) error {
+	encoded, err := EncodeRow(row)
+	if err != nil {
+		return err
+	}
+
+	if tbl.Compress {
+		encoded, err = Compress(encoded)
+		if err != nil {
+			return err
+		}
+	}
+
+	if tbl.Encrypt {
+		encoded, err = Encrypt(tbl.HashedKey, tbl.Nonce, encoded)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tbl.Rows.WriteTo(rowId, encoded)
+}
+
+// stripVersion returns the columns of a row without its version
+func stripVersion(row map[string]interface{}) map[string]interface{} {
+	if _, ok := row[ROW_XMIN]; !ok {
+		if _, ok := row[ROW_XMAX]; !ok {
+			return row
+		}
+	}
+
+	columns := make(map[string]interface{}, len(row))
+
+	for k, v := range row {
+		if k != ROW_XMIN && k != ROW_XMAX {
+			columns[k] = v
+		}
+	}
+
+	return columns
 }
 
 // GetRow gets a row by id
 func (tbl *Table) GetRow(rowId int64) (map[string]interface{}, error) {
-	// Read row from table
-	row, err := tbl.Rows.GetPage(rowId)
+	row, _, _, err := tbl.readRow(rowId)
 	if err != nil {
 		return nil, err
 	}
 
-	// check for encryption
-	if tbl.Encrypt {
-		row, err = Decrypt(tbl.HashedKey, tbl.Nonce, row)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	if tbl.Compress {
-		row, err = Decompress(row)
-		if err != nil {
-			return nil, err
-		}
-	}
+	return stripVersion(row), nil
+}
 
-	// decode row
-	decoded, err := decodeRow(row)
+// GetVisibleRow gets a row by id if it is visible to the snapshot, nil otherwise
+func (tbl *Table) GetVisibleRow(rowId int64, snapshot *mvcc.Snapshot) (map[string]interface{}, error) {
+	row, xmin, xmax, err := tbl.readRow(rowId)
 	if err != nil {
 		return nil, err
 	}
 
-	return decoded, nil
+	if !snapshot.Visible(xmin, xmax) {
+		return nil, nil
+	}
+
+	return stripVersion(row), nil
 }
 
 // NewIterator returns a new row iterator
+// Rows are returned as stored, including row versions deleted or not yet committed
 func (tbl *Table) NewIterator() *Iterator {
 	return &Iterator{
 		table: tbl,
@@ -1307,6 +1802,20 @@ func (tbl *Table) NewIterator() *Iterator {
 	}
 }
 
+// NewSnapshotIterator returns a new row iterator over the rows visible to a snapshot
+func (tbl *Table) NewSnapshotIterator(snapshot *mvcc.Snapshot) *Iterator {
+	return &Iterator{
+		table:    tbl,
+		row:      0,
+		snapshot: snapshot,
+	}
+}
+
+// SetContext stops the iterator once ctx is done, a statement canceled stops scanning
+func (ri *Iterator) SetContext(ctx context.Context) {
+	ri.ctx = ctx
+}
+
 // Current returns the current row id
 func (ri *Iterator) Current() int64 {
 	return ri.row
@@ -1314,6 +1823,18 @@ func (ri *Iterator) Current() int64 {
 
 // Next returns the next row in the table
 func (ri *Iterator) Next() (map[string]interface{}, error) {
+	if ri.snapshot != nil {
+		if !ri.Valid() {
+			return nil, errors.New("no more rows")
+		}
+
+		row := ri.next
+		ri.next = nil
+		ri.row++
+
+		return row, nil
+	}
+
 	for {
 		if slices.Contains(ri.table.Rows.GetDeletedPages(), ri.row) {
 			ri.row++
@@ -1346,7 +1867,32 @@ func (ri *Iterator) Next() (map[string]interface{}, error) {
 
 // Valid returns true if the iterator is valid
 func (ri *Iterator) Valid() bool {
-	return ri.row < ri.table.Rows.Count()
+	if ri.ctx != nil && ri.ctx.Err() != nil {
+		return false
+	}
+
+	if ri.snapshot == nil {
+		return ri.row < ri.table.Rows.Count()
+	}
+
+	// Skip ahead to the next row visible to the snapshot
+	for ri.next == nil && ri.row < ri.table.Rows.Count() {
+		if slices.Contains(ri.table.Rows.GetDeletedPages(), ri.row) {
+			ri.row++
+			continue
+		}
+
+		// Overflow pages do not decode and are skipped
+		row, xmin, xmax, err := ri.table.readRow(ri.row)
+		if err != nil || !ri.snapshot.Visible(xmin, xmax) {
+			ri.row++
+			continue
+		}
+
+		ri.next = stripVersion(row)
+	}
+
+	return ri.next != nil
 
 }
 
@@ -1385,13 +1931,7 @@ func (tbl *Table) GetUniqueIndex() *Index {
 // DeleteRow deletes a row from the table
 func (tbl *Table) DeleteRow(rowId int64) error {
 	// Read row from table
-	row, err := tbl.Rows.GetPage(rowId)
-	if err != nil {
-		return err
-	}
-
-	// decode row
-	decoded, err := decodeRow(row)
+	decoded, _, _, err := tbl.readRow(rowId)
 	if err != nil {
 		return err
 	}
@@ -1418,6 +1958,265 @@ func (tbl *Table) DeleteRow(rowId int64) error {
 	return nil
 }
 
+// checkUnique returns an error if a row version other than a dead one or self already holds value within a unique column
+// With a nil snapshot every version counts
+func (tbl *Table) checkUnique(colName string, value interface{}, self int64, snapshot *mvcc.Snapshot) error {
+	idx := tbl.CheckIndexedColumn(colName, true)
+	if idx == nil {
+		return fmt.Errorf("problem getting unique rows for column %s", colName)
+	}
+
+	// Check if unique key exists
+	key, err := idx.btree.Get([]byte(fmt.Sprintf("%v", value)))
+	if err != nil {
+		return fmt.Errorf("problem getting unique rows for column %s", colName)
+	}
+
+	if key == nil {
+		return nil
+	}
+
+	for _, rowId := range key.V {
+		// We store a []byte(rowId) in the btree
+		// We need to convert it to an int64
+
+		// Convert []byte to int64
+		id, err := strconv.ParseInt(string(rowId), 10, 64)
+		if err != nil {
+			return errors.New("problem getting unique rows")
+		}
+
+		if id == self {
+			continue
+		}
+
+		// Rows which were deleted since are skipped
+		row, xmin, xmax, err := tbl.readRow(id)
+		if err != nil {
+			continue
+		}
+
+		if snapshot != nil && snapshot.Dead(xmin, xmax) {
+			continue
+		}
+
+		// Check if row exists
+		if row[colName] == value {
+			return fmt.Errorf("row with %s %v already exists", colName, value)
+		}
+	}
+
+	return nil
+}
+
+// ExpireRow deletes a row version on behalf of the snapshot's transaction, returning the row
+// The version stays in place for the snapshots which can still see it until it is reclaimed with DeleteRow
+// Returns mvcc.ErrSerialization if another transaction deleted the version first
+func (tbl *Table) ExpireRow(rowId int64, snapshot *mvcc.Snapshot) (map[string]interface{}, error) {
+	tbl.versionLock.Lock()
+	defer tbl.versionLock.Unlock()
+
+	row, _, xmax, err := tbl.readRow(rowId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = snapshot.Writable(xmax)
+	if err != nil {
+		return nil, err
+	}
+
+	row[ROW_XMAX] = snapshot.Xid
+
+	err = tbl.rewriteRow(rowId, row)
+	if err != nil {
+		return nil, err
+	}
+
+	return stripVersion(row), nil
+}
+
+// Undo removes the row versions the aborted transactions created, along with their index entries, and restores the ones they deleted
+// Used on recovery, and for a resumed prepared transaction which rolls back.  Sequence values of the removed rows no other version holds are given back
+func (tbl *Table) Undo(aborted func(xid uint64) bool) error {
+	tbl.versionLock.Lock()
+	defer tbl.versionLock.Unlock()
+
+	var released []int             // Sequence values of the removed rows
+	kept := make(map[int]struct{}) // Sequence values of the rows kept
+
+	for rowId := int64(0); rowId < tbl.Rows.Count(); rowId++ {
+		if slices.Contains(tbl.Rows.GetDeletedPages(), rowId) {
+			continue
+		}
+
+		// Overflow pages do not decode and are skipped
+		row, xmin, xmax, err := tbl.readRow(rowId)
+		if err != nil {
+			continue
+		}
+
+		created := xmin != 0 && aborted(xmin)
+
+		for name, colDef := range tbl.TableSchema.ColumnDefinitions {
+			if seq, ok := row[name].(int); ok && colDef.Sequence {
+				if created {
+					released = append(released, seq)
+				} else {
+					kept[seq] = struct{}{}
+				}
+			}
+		}
+
+		if created {
+			err = tbl.DeleteRow(rowId)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if xmax != 0 && aborted(xmax) {
+			delete(row, ROW_XMAX)
+
+			err = tbl.rewriteRow(rowId, row)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Newest first, the sequence goes back as far as the values were the last ones handed out
+	slices.Sort(released)
+
+	for i := len(released) - 1; i >= 0; i-- {
+		if _, ok := kept[released[i]]; ok {
+			continue // an updated row keeps its value
+		}
+
+		err := tbl.ReleaseSequence(released[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Versions returns the rows transaction xid created and the ones it deleted
+func (tbl *Table) Versions(xid uint64) (created, deleted []int64) {
+	tbl.versionLock.Lock()
+	defer tbl.versionLock.Unlock()
+
+	for rowId := int64(0); rowId < tbl.Rows.Count(); rowId++ {
+		if slices.Contains(tbl.Rows.GetDeletedPages(), rowId) {
+			continue
+		}
+
+		// Overflow pages do not decode and are skipped
+		_, xmin, xmax, err := tbl.readRow(rowId)
+		if err != nil {
+			continue
+		}
+
+		if xmin == xid {
+			created = append(created, rowId)
+		}
+
+		if xmax == xid {
+			deleted = append(deleted, rowId)
+		}
+	}
+
+	return created, deleted
+}
+
+// CheckRow returns ErrSerialization if row rowId was deleted or updated by another transaction the snapshot cannot see, it can no longer be locked by the snapshot's transaction
+func (tbl *Table) CheckRow(rowId int64, snapshot *mvcc.Snapshot) error {
+	tbl.versionLock.Lock()
+	defer tbl.versionLock.Unlock()
+
+	_, _, xmax, err := tbl.readRow(rowId)
+	if err != nil {
+		return err
+	}
+
+	return snapshot.Writable(xmax)
+}
+
+// RestoreRow undoes ExpireRow for a transaction which aborted
+func (tbl *Table) RestoreRow(rowId int64, xid uint64) error {
+	tbl.versionLock.Lock()
+	defer tbl.versionLock.Unlock()
+
+	row, _, xmax, err := tbl.readRow(rowId)
+	if err != nil {
+		return err
+	}
+
+	if xmax != xid {
+		return nil
+	}
+
+	delete(row, ROW_XMAX)
+
+	return tbl.rewriteRow(rowId, row)
+}
+
+// UpdateVersion updates a row on behalf of the snapshot's transaction
+// The current version is expired and the updated row is written as a new version, its row id is returned
+// Unique columns are not checked as an update of many rows may pass through duplicates, see CheckUnique
+func (tbl *Table) UpdateVersion(rowId int64, row map[string]interface{}, sets []*SetClause, snapshot *mvcc.Snapshot) (int64, error) {
+	_, err := tbl.applySets(row, sets)
+	if err != nil {
+		return -1, err
+	}
+
+	_, err = tbl.ExpireRow(rowId, snapshot)
+	if err != nil {
+		return -1, err
+	}
+
+	newRowId, err := tbl.writeRow(row, snapshot.Xid)
+	if err != nil {
+		return -1, err
+	}
+
+	// The new version is indexed alongside the expired one, once written it is returned even on error so it is undone
+	for col, val := range row {
+		for _, idx := range tbl.Indexes {
+			if slices.Contains(idx.Columns, col) {
+				err = idx.btree.Put([]byte(fmt.Sprintf("%v", val)), []byte(fmt.Sprintf("%d", newRowId)))
+				if err != nil {
+					return newRowId, err
+				}
+			}
+		}
+	}
+
+	return newRowId, nil
+}
+
+// CheckUnique returns an error if the unique columns of a row version collide with another version the snapshot's transaction cannot ignore
+func (tbl *Table) CheckUnique(rowId int64, snapshot *mvcc.Snapshot) error {
+	row, _, _, err := tbl.readRow(rowId)
+	if err != nil {
+		return err
+	}
+
+	for colName, colDef := range tbl.TableSchema.ColumnDefinitions {
+		if colDef.Unique {
+			err = tbl.checkUnique(colName, row[colName], rowId, snapshot)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 // SetClause Set for update
 type SetClause struct {
 	ColumnName string
@@ -1430,18 +2229,64 @@ func CopyRow(row *map[string]interface{}) map[string]interface{} {
 	for k, v := range *row {
 		newRow[k] = v
 	}
-	return newRow
+	return newRow
+}
+
+// UpdateRow updates a row in the table
+func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*SetClause) error {
+
+	prevRow, err := tbl.applySets(row, sets)
+	if err != nil {
+		return err
+	}
+
+	// Encode row
+	encoded, err := EncodeRow(row)
+	if err != nil {
+		return err
+	}
+
+	err = tbl.Rows.WriteTo(rowId, encoded)
+	if err != nil {
+		return err
+	}
+
+	for _, set := range sets {
+		for colName, _ := range tbl.TableSchema.ColumnDefinitions {
+			if colName == set.ColumnName {
+				for _, idx := range tbl.Indexes {
+					if slices.Contains(idx.Columns, colName) {
+						// Remove old value from index
+						err := idx.btree.Remove([]byte(fmt.Sprintf("%v", prevRow[colName])), []byte(fmt.Sprintf("%d", rowId)))
+						if err != nil {
+							return err
+						}
+
+						// Insert into index
+						err = idx.btree.Put([]byte(fmt.Sprintf("%v", row[colName])), []byte(fmt.Sprintf("%d", rowId)))
+						if err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+
 }
 
-// UpdateRow updates a row in the table
-func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*SetClause) error {
+// applySets applies set clauses to a row, checking the new values against the schema
+// Returns the row as it was before the last set clause
+func (tbl *Table) applySets(row map[string]interface{}, sets []*SetClause) (map[string]interface{}, error) {
 
 	var prevRow map[string]interface{}
 
 	for _, set := range sets {
 
 		if _, ok := row[set.ColumnName]; !ok {
-			return fmt.Errorf("column %s does not exist", set.ColumnName)
+			return nil, fmt.Errorf("column %s does not exist", set.ColumnName)
 		}
 
 		prevRow = CopyRow(&row)
@@ -1455,19 +2300,19 @@ func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*Set
 					if _, ok := row[colName].(string); !ok {
 						if !colDef.NotNull {
 							if row[colName] != nil {
-								return fmt.Errorf("column %s is not a string", colName)
+								return nil, fmt.Errorf("column %s is not a string", colName)
 							}
 						}
 					} else {
 						// Check length
 						if len(row[colName].(string)) > colDef.Length {
-							return fmt.Errorf("column %s is too long", colName)
+							return nil, fmt.Errorf("column %s is too long", colName)
 						}
 					}
 
 				case "NUMERIC", "DECIMAL", "DEC", "FLOAT", "DOUBLE", "REAL":
 					if _, ok := row[colName].(float64); !ok {
-						return fmt.Errorf("column %s is not a float64", colName)
+						return nil, fmt.Errorf("column %s is not a float64", colName)
 					}
 
 					str := fmt.Sprintf("%.14g", row[colName].(float64))
@@ -1487,7 +2332,7 @@ func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*Set
 							// Check scale
 
 							if scale > colDef.Scale {
-								return fmt.Errorf("column %s has too many digits after the decimal point", colName)
+								return nil, fmt.Errorf("column %s has too many digits after the decimal point", colName)
 							}
 
 						}
@@ -1495,7 +2340,7 @@ func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*Set
 						if colDef.Precision > 0 {
 							// Check precision
 							if precision > colDef.Precision {
-								return fmt.Errorf("column %s is too large", colName)
+								return nil, fmt.Errorf("column %s is too large", colName)
 							}
 						}
 					}
@@ -1504,7 +2349,7 @@ func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*Set
 
 					if _, ok := row[colName].(int); !ok {
 						if _, ok := row[colName].(uint64); !ok {
-							return fmt.Errorf("column %s is not an int", colName)
+							return nil, fmt.Errorf("column %s is not an int", colName)
 						} else {
 							row[colName] = int(row[colName].(uint64))
 						}
@@ -1513,14 +2358,14 @@ func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*Set
 					// Check if value fits in INT/INTEGER
 					if strings.ToUpper(colDef.DataType) == "INT" || strings.ToUpper(colDef.DataType) == "INTEGER" {
 						if row[colName].(int) > 2147483647 {
-							return fmt.Errorf("column %s is too large for INT/INTEGER", colName)
+							return nil, fmt.Errorf("column %s is too large for INT/INTEGER", colName)
 						}
 					}
 
 					// Check if value fits in SMALLINT
 					if strings.ToUpper(colDef.DataType) == "SMALLINT" {
 						if row[colName].(int) > 32767 {
-							return fmt.Errorf("column %s is too large for SMALLINT", colName)
+							return nil, fmt.Errorf("column %s is too large for SMALLINT", colName)
 						}
 					}
 
@@ -1531,40 +2376,7 @@ func (tbl *Table) UpdateRow(rowId int64, row map[string]interface{}, sets []*Set
 
 	}
 
-	// Encode row
-	encoded, err := EncodeRow(row)
-	if err != nil {
-		return err
-	}
-
-	err = tbl.Rows.WriteTo(rowId, encoded)
-	if err != nil {
-		return err
-	}
-
-	for _, set := range sets {
-		for colName, _ := range tbl.TableSchema.ColumnDefinitions {
-			if colName == set.ColumnName {
-				for _, idx := range tbl.Indexes {
-					if slices.Contains(idx.Columns, colName) {
-						// Remove old value from index
-						err := idx.btree.Remove([]byte(fmt.Sprintf("%v", prevRow[colName])), []byte(fmt.Sprintf("%d", rowId)))
-						if err != nil {
-							return err
-						}
-
-						// Insert into index
-						err = idx.btree.Put([]byte(fmt.Sprintf("%v", row[colName])), []byte(fmt.Sprintf("%d", rowId)))
-						if err != nil {
-							return err
-						}
-					}
-				}
-			}
-		}
-	}
-
-	return nil
+	return prevRow, nil
 
 }
 
@@ -1683,16 +2495,17 @@ func (cat *Catalog) CreateNewUser(username, password string) error {
 		return fmt.Errorf("user %s already exists", username)
 	}
 
-	// bcrypt password
-	hashedPassword, err := shared.HashPassword(password)
+	// Only a SCRAM verifier of the password is kept
+	verifier, err := shared.NewScramVerifier(password)
 	if err != nil {
 		return err
 	}
 
 	// Create user
 	cat.Users[username] = &User{
-		Username: username,
-		Password: hashedPassword,
+		Username:        username,
+		Scram:           verifier,
+		PasswordChanged: time.Now(),
 	}
 
 	err = cat.EncodeUsersToFile()
@@ -1704,6 +2517,141 @@ func (cat *Catalog) CreateNewUser(username, password string) error {
 
 }
 
+// CreateNewCertificateUser creates a new user identified by a client certificate instead of a password
+func (cat *Catalog) CreateNewCertificateUser(username, subject string) error {
+	_, _, err := parseCertificateSubject(subject)
+	if err != nil {
+		return err
+	}
+
+	// Lock users map
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	// Check if user exists
+	if _, ok := cat.Users[username]; ok {
+		return fmt.Errorf("user %s already exists", username)
+	}
+
+	cat.Users[username] = &User{
+		Username:    username,
+		Certificate: subject,
+	}
+
+	return cat.EncodeUsersToFile()
+}
+
+// parseCertificateSubject splits a certificate subject of CREATE USER ... IDENTIFIED BY CERTIFICATE into CN or SAN and its name
+func parseCertificateSubject(subject string) (string, string, error) {
+	field, name, ok := strings.Cut(subject, "=")
+	field = strings.ToUpper(strings.TrimSpace(field))
+
+	if !ok || (field != "CN" && field != "SAN") || strings.TrimSpace(name) == "" {
+		return "", "", fmt.Errorf("invalid certificate subject %s, expected CN=name or SAN=name", subject)
+	}
+
+	return field, strings.TrimSpace(name), nil
+}
+
+// MatchesCertificate checks a client certificate identifies the user
+func (u *User) MatchesCertificate(cert *x509.Certificate) bool {
+	if u.Certificate == "" || cert == nil {
+		return false
+	}
+
+	field, name, err := parseCertificateSubject(u.Certificate)
+	if err != nil {
+		return false
+	}
+
+	if field == "CN" {
+		return cert.Subject.CommonName == name
+	}
+
+	// Any DNS name, email address, URI or IP address of the certificate
+	names := append(append([]string{}, cert.DNSNames...), cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return slices.Contains(names, name)
+}
+
+// IsCertificateUser checks if a user is identified by a client certificate
+func (cat *Catalog) IsCertificateUser(username string) bool {
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	user, ok := cat.Users[username]
+	return ok && user.Certificate != ""
+}
+
+// AuthenticateCertificate authenticates a user identified by a client certificate, the certificate must have been verified against the server's client CA
+func (cat *Catalog) AuthenticateCertificate(username string, cert *x509.Certificate) (*User, error) {
+	user, err := cat.authenticateCertificate(username, cert)
+	if err != nil {
+		cat.LoginFailed(username)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// authenticateCertificate authenticates a user identified by a client certificate
+func (cat *Catalog) authenticateCertificate(username string, cert *x509.Certificate) (*User, error) {
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	user, ok := cat.Users[username]
+	if !ok {
+		return nil, fmt.Errorf("user %s does not exist", username)
+	}
+
+	if cat.locked(user) {
+		return nil, ErrAccountLocked
+	}
+
+	if !user.MatchesCertificate(cert) {
+		return nil, errors.New("authentication failed")
+	}
+
+	return user, cat.loginSucceeded(user)
+}
+
+// GetCertificateUser gets the user a client certificate identifies, the certificate must have been verified against the server's client CA
+func (cat *Catalog) GetCertificateUser(cert *x509.Certificate) (*User, error) {
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	var found *User
+
+	for _, user := range cat.Users {
+		if !user.MatchesCertificate(cert) {
+			continue
+		}
+
+		if found != nil {
+			return nil, errors.New("client certificate identifies more than one user")
+		}
+
+		found = user
+	}
+
+	if found == nil {
+		return nil, errors.New("client certificate identifies no user")
+	}
+
+	if cat.locked(found) {
+		return nil, ErrAccountLocked
+	}
+
+	return found, nil
+}
+
 // EncodeUsersToFile encodes users to file
 func (cat *Catalog) EncodeUsersToFile() error {
 	// Lock users file
@@ -1766,8 +2714,19 @@ func (cat *Catalog) GetUser(username string) *User {
 	return cat.Users[username]
 }
 
-// AuthenticateUser authenticates a user
+// AuthenticateUser authenticates a user, a failed login is answered once the login policy's delay passed
 func (cat *Catalog) AuthenticateUser(username, password string) (*User, error) {
+	user, err := cat.authenticateUser(username, password)
+	if err != nil {
+		cat.LoginFailed(username)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// authenticateUser authenticates a user by password
+func (cat *Catalog) authenticateUser(username, password string) (*User, error) {
 	cat.UsersLock.Lock()
 	defer cat.UsersLock.Unlock()
 
@@ -1776,13 +2735,227 @@ func (cat *Catalog) AuthenticateUser(username, password string) (*User, error) {
 		return nil, fmt.Errorf("user %s does not exist", username)
 	}
 
-	// Check password
-	ok := shared.ComparePasswords(cat.Users[username].Password, password)
+	user := cat.Users[username]
+
+	if cat.locked(user) {
+		return nil, ErrAccountLocked
+	}
+
+	// A user identified by certificate has no password
+	if user.Certificate != "" {
+		return nil, errors.New("authentication failed")
+	}
+
+	if user.Scram != nil {
+		if !user.Scram.Verify(password) {
+			return nil, errors.New("authentication failed")
+		}
+
+		return user, cat.loginSucceeded(user)
+	}
+
+	// A user created before SCRAM has a bcrypt hash, its password is migrated to a SCRAM verifier once verified
+	ok := shared.ComparePasswords(user.Password, password)
 	if !ok {
 		return nil, errors.New("authentication failed")
 	}
 
-	return cat.Users[username], nil
+	verifier, err := shared.NewScramVerifier(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Scram = verifier
+	user.Password = ""
+	user.FailedLogins = 0
+
+	// Its age is unknown, it expires counting from the migration
+	if user.PasswordChanged.IsZero() {
+		user.PasswordChanged = time.Now()
+	}
+
+	err = cat.EncodeUsersToFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// policy returns the login policy in effect
+func (cat *Catalog) policy() *LoginPolicy {
+	if cat.LoginPolicy == nil {
+		return &DefaultLoginPolicy
+	}
+
+	return cat.LoginPolicy
+}
+
+// locked checks if a user is locked, by ACCOUNT LOCK or locked out after failed logins
+func (cat *Catalog) locked(user *User) bool {
+	return user.Locked || time.Now().Before(user.LockedUntil)
+}
+
+// loginSucceeded resets the failed logins of a user who logged in
+func (cat *Catalog) loginSucceeded(user *User) error {
+	if user.FailedLogins == 0 {
+		return nil
+	}
+
+	user.FailedLogins = 0
+
+	return cat.EncodeUsersToFile()
+}
+
+// CheckLogin checks a user may log in, it is not locked
+// An authentication the catalog does not run itself, i.e. SCRAM, checks it first and reports its outcome through LoginSucceeded or LoginFailed
+func (cat *Catalog) CheckLogin(username string) error {
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	user, ok := cat.Users[username]
+	if ok && cat.locked(user) {
+		return ErrAccountLocked
+	}
+
+	return nil
+}
+
+// LoginSucceeded resets the failed logins of a user who logged in
+func (cat *Catalog) LoginSucceeded(username string) error {
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	user, ok := cat.Users[username]
+	if !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	return cat.loginSucceeded(user)
+}
+
+// LoginFailed counts a failed login of a user, locking it out once it failed MaxFailedLogins times in a row
+// It returns once the login policy's delay passed, the longer the more the user failed, so the failure is answered no sooner
+func (cat *Catalog) LoginFailed(username string) {
+	policy := cat.policy()
+	failures := 1
+
+	cat.UsersLock.Lock()
+
+	user, ok := cat.Users[username]
+	if ok && !cat.locked(user) {
+		user.FailedLogins++
+		failures = user.FailedLogins
+
+		if policy.MaxFailedLogins > 0 && user.FailedLogins >= policy.MaxFailedLogins {
+			user.FailedLogins = 0
+
+			if policy.LockoutDuration > 0 {
+				user.LockedUntil = time.Now().Add(policy.LockoutDuration)
+			} else {
+				user.Locked = true
+			}
+		}
+
+		cat.EncodeUsersToFile()
+	} else if !ok {
+		// A user name which does not exist is answered as late, so the delay does not tell which users exist
+		if cat.unknownLogins == nil || len(cat.unknownLogins) >= MAX_UNKNOWN_LOGINS {
+			cat.unknownLogins = make(map[string]int)
+		}
+
+		cat.unknownLogins[username]++
+		failures = cat.unknownLogins[username]
+	}
+
+	cat.UsersLock.Unlock()
+
+	delay := policy.FailedLoginDelay * time.Duration(failures)
+	if policy.MaxLoginDelay > 0 && delay > policy.MaxLoginDelay {
+		delay = policy.MaxLoginDelay
+	}
+
+	time.Sleep(delay)
+}
+
+// LockUser locks a user until it is unlocked, unlocking also ends a lockout after failed logins
+func (cat *Catalog) LockUser(username string, locked bool) error {
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	user, ok := cat.Users[username]
+	if !ok {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+
+	user.Locked = locked
+
+	if !locked {
+		user.LockedUntil = time.Time{}
+		user.FailedLogins = 0
+	}
+
+	return cat.EncodeUsersToFile()
+}
+
+// CheckPassword checks a new password against the login policy's length and complexity rules
+func (cat *Catalog) CheckPassword(password string) error {
+	policy := cat.policy()
+
+	if len([]rune(password)) < policy.MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", policy.MinPasswordLength)
+	}
+
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	if lower+upper+digit+symbol < policy.PasswordComplexity {
+		return fmt.Errorf("password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", policy.PasswordComplexity)
+	}
+
+	return nil
+}
+
+// PasswordExpired checks if a user's password is older than the login policy's PasswordLifetime, the user must change it before anything else
+func (cat *Catalog) PasswordExpired(username string) bool {
+	lifetime := cat.policy().PasswordLifetime
+	if lifetime <= 0 {
+		return false
+	}
+
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	user, ok := cat.Users[username]
+	if !ok || user.PasswordChanged.IsZero() || user.Certificate != "" {
+		return false
+	}
+
+	return time.Since(user.PasswordChanged) > lifetime
+}
+
+// GetScramVerifier gets the SCRAM verifier of a user and whether the user exists, the verifier is nil until a user created before SCRAM logs in
+func (cat *Catalog) GetScramVerifier(username string) (*shared.ScramVerifier, bool) {
+	cat.UsersLock.Lock()
+	defer cat.UsersLock.Unlock()
+
+	user, ok := cat.Users[username]
+	if !ok {
+		return nil, false
+	}
+
+	return user.Scram, true
 }
 
 // HasPrivilege checks if a user has a privilege
@@ -1922,14 +3095,16 @@ func (cat *Catalog) AlterUserPassword(username, password string) error {
 		return fmt.Errorf("user %s does not exist", username)
 	}
 
-	// bcrypt password
-	hashedPassword, err := shared.HashPassword(password)
+	verifier, err := shared.NewScramVerifier(password)
 	if err != nil {
 		return err
 	}
 
-	// Create user
-	cat.Users[username].Password = hashedPassword
+	// The new password replaces a bcrypt hash left from before SCRAM, or the certificate identifying the user
+	cat.Users[username].Scram = verifier
+	cat.Users[username].Password = ""
+	cat.Users[username].Certificate = ""
+	cat.Users[username].PasswordChanged = time.Now()
 
 	err = cat.EncodeUsersToFile()
 	if err != nil {
@@ -2086,6 +3261,21 @@ func Decrypt(key [32]byte, nonce [12]byte, cipherRow []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// writeSchema writes the schema of a table to its schema file
+func (tbl *Table) writeSchema() error {
+	schemaFile, err := os.Create(fmt.Sprintf("%s%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), tbl.Name, DB_SCHEMA_TABLE_SCHEMA_FILE_EXTENSION))
+	if err != nil {
+		return err
+	}
+
+	defer schemaFile.Close()
+
+	// Encode schema to file
+	enc := gob.NewEncoder(schemaFile)
+
+	return enc.Encode(tbl.TableSchema)
+}
+
 // Alter alters a table, specifically a column
 func (tbl *Table) Alter(columnName string, columnDef *ColumnDefinition) error {
 	if columnDef == nil {
@@ -2124,6 +3314,11 @@ func (tbl *Table) Alter(columnName string, columnDef *ColumnDefinition) error {
 		// Drop column from schema
 		delete(tbl.TableSchema.ColumnDefinitions, columnName)
 
+		err := tbl.writeSchema()
+		if err != nil {
+			return err
+		}
+
 		// iterate over all rows and remove the column
 		ri := tbl.NewIterator()
 
@@ -2247,17 +3442,7 @@ func (tbl *Table) Alter(columnName string, columnDef *ColumnDefinition) error {
 			tbl.TableSchema.ColumnDefinitions[columnName] = columnDef
 
 			// write schema to file
-			schemaFile, err := os.Create(fmt.Sprintf("%s%s%s%s", tbl.Directory, shared.GetOsPathSeparator(), tbl.Name, DB_SCHEMA_TABLE_SCHEMA_FILE_EXTENSION))
-			if err != nil {
-				return err
-			}
-
-			defer schemaFile.Close()
-
-			// Encode schema to file
-			enc := gob.NewEncoder(schemaFile)
-
-			err = enc.Encode(tbl.TableSchema)
+			err := tbl.writeSchema()
 			if err != nil {
 				return err
 			}
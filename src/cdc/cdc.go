@@ -0,0 +1,120 @@
+// Package cdc
+// AriaSQL change data capture package
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package cdc
+
+import (
+	"sync"
+	"time"
+)
+
+const OP_INSERT = "insert" // Row was inserted
+const OP_UPDATE = "update" // Row was updated
+const OP_DELETE = "delete" // Row was deleted
+
+const SUBSCRIPTION_BUFFER = 1024 // Events buffered per subscriber before it is considered behind
+
+// Event is a committed change to a single row
+type Event struct {
+	LSN        uint64                 `json:"lsn"`              // LSN of the WAL record which committed the change
+	CommitTime time.Time              `json:"commit_time"`      // Time the change was committed
+	Database   string                 `json:"database"`         // Database of the table
+	Table      string                 `json:"table"`            // Table the row belongs to
+	Op         string                 `json:"op"`               // insert, update or delete
+	Key        map[string]interface{} `json:"key"`              // The row's sequence and unique columns, nil if the table has none
+	Before     map[string]interface{} `json:"before,omitempty"` // Row before an update or delete
+	After      map[string]interface{} `json:"after,omitempty"`  // Row after an insert or update
+}
+
+// Hub hands committed changes to subscribers
+type Hub struct {
+	lock        sync.Mutex
+	subscribers []*Subscription
+}
+
+// Subscription receives the changes to one table
+// C is closed if the subscriber falls behind and its buffer fills up
+type Subscription struct {
+	C        chan *Event // Changes in commit order
+	Database string      // Database of the table
+	Table    string      // Table subscribed to
+	hub      *Hub
+}
+
+// NewHub creates a new Hub
+func NewHub() *Hub {
+	return &Hub{}
+}
+
+// Subscribe returns a subscription to the changes committed to a table from now on, buffering up to size events
+func (h *Hub) Subscribe(database, table string, size int) *Subscription {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sub := &Subscription{C: make(chan *Event, size), Database: database, Table: table, hub: h}
+	h.subscribers = append(h.subscribers, sub)
+
+	return sub
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	s.hub.unsubscribe(s)
+}
+
+// unsubscribe removes a subscriber and closes its channel, the caller must hold the lock
+func (h *Hub) unsubscribe(sub *Subscription) {
+	for i, s := range h.subscribers {
+		if s == sub {
+			h.subscribers = append(h.subscribers[:i], h.subscribers[i+1:]...)
+			close(sub.C)
+			return
+		}
+	}
+}
+
+// Active returns true if anyone is subscribed, changes need not be captured otherwise
+func (h *Hub) Active() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.subscribers) > 0
+}
+
+// Publish hands committed changes to the subscribers of their tables
+// A subscriber whose buffer is full is dropped rather than holding up commits
+func (h *Hub) Publish(events []*Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for _, event := range events {
+		for _, sub := range append([]*Subscription{}, h.subscribers...) {
+			if sub.Database != event.Database || sub.Table != event.Table {
+				continue
+			}
+
+			select {
+			case sub.C <- event:
+			default:
+				h.unsubscribe(sub)
+			}
+		}
+	}
+}
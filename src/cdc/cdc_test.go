@@ -0,0 +1,61 @@
+// Package cdc tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package cdc
+
+import (
+	"testing"
+)
+
+func TestHub_Publish(t *testing.T) {
+	hub := NewHub()
+
+	if hub.Active() {
+		t.Fatal("expected hub without subscribers to be inactive")
+	}
+
+	users := hub.Subscribe("test", "users", 1)
+	orders := hub.Subscribe("test", "orders", 1)
+
+	hub.Publish([]*Event{{Database: "test", Table: "users", Op: OP_INSERT, After: map[string]interface{}{"id": 1}}})
+
+	event := <-users.C
+	if event.Op != OP_INSERT || event.After["id"] != 1 {
+		t.Fatalf("unexpected event %+v", event)
+	}
+
+	if len(orders.C) != 0 {
+		t.Fatal("expected no events for orders")
+	}
+
+	// A subscriber which falls behind is dropped
+	hub.Publish([]*Event{
+		{Database: "test", Table: "users", Op: OP_DELETE},
+		{Database: "test", Table: "users", Op: OP_DELETE},
+	})
+
+	<-users.C
+
+	if _, ok := <-users.C; ok {
+		t.Fatal("expected subscription to be closed")
+	}
+
+	orders.Close()
+
+	if hub.Active() {
+		t.Fatal("expected hub to be inactive once every subscription ended")
+	}
+}
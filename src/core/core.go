@@ -19,6 +19,9 @@ package core
 
 import (
 	"ariasql/catalog"
+	"ariasql/cdc"
+	"ariasql/lock"
+	"ariasql/mvcc"
 	"ariasql/parser"
 	"ariasql/shared"
 	"ariasql/wal"
@@ -27,19 +30,37 @@ import (
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"log"
-	"net"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // AriaSQL is the core of the database system
 type AriaSQL struct {
-	Config       *Config          // DataDir is the directory where the data is stored
-	Catalog      *catalog.Catalog // Catalog is the root of the database catalog
-	Channels     []*Channel       // Channel to the database, could be through shell or network
-	ChannelsLock *sync.Mutex      // Channels lock
-	WAL          *wal.WAL         // Write ahead log
-	LogFile      *os.File         // Log file
+	Config       *Config                         // DataDir is the directory where the data is stored
+	Catalog      *catalog.Catalog                // Catalog is the root of the database catalog
+	Channels     []*Channel                      // Channel to the database, could be through shell or network
+	ChannelsLock *sync.Mutex                     // Channels lock
+	WAL          *wal.WAL                        // Write ahead log
+	Archive      *wal.Archive                    // WAL archive, nil if archiving is disabled
+	CDC          *cdc.Hub                        // Change data capture, committed row changes are published here
+	Transactions *mvcc.Manager                   // Hands out transaction ids and snapshots
+	Locks        *lock.Manager                   // Row locks held by transactions until they end
+	LogFile      *os.File                        // Log file
+	channelID    uint64                          // Last channel ID handed out
+	readOnly     atomic.Bool                     // Set on replicas, client writes are rejected
+	replication  chan struct{}                   // Closed to stop streaming to replicas
+	streams      []*ReplicaStream                // Streams to the configured replicas, set once replication starts
+	replicating  sync.WaitGroup                  // Streams to replicas still running
+	promoted     chan struct{}                   // Closed once a replica is promoted to primary
+	promoteHooks []func()                        // Run when a replica is promoted, before it takes writes
+	configLock   sync.Mutex                      // Guards the replication timeline within the configuration
+	acks         chan struct{}                   // Closed and replaced whenever a replica acknowledges a record
+	acksLock     sync.Mutex                      // Guards acks
+	prepared     map[string]*PreparedTransaction // Prepared transactions by global id
+	preparedLock sync.Mutex                      // Guards prepared
 }
 
 // Channel is a connection to the database
@@ -47,26 +68,65 @@ type Channel struct {
 	ChannelID uint64
 	Database  *catalog.Database // Current database, this would be a result of using the USE command
 	User      *catalog.User     // Current user, this would be a result of using the USE command
+	statement string            // Statement executing, empty when idle
+	database  string            // Database in use as of the last statement
+	started   time.Time         // When the statement executing started
+	xid       uint64            // Transaction begun, 0 if none
+	cancel    func(error)       // Cancels the statement executing with the error given
+	killed    bool              // The channel was killed, its session ends
+	close     func()            // Closes the connection of the channel when it is killed
+	state     sync.Mutex        // Guards the statement, transaction and kill state
+}
+
+// Process is what a channel is doing, as SHOW PROCESSLIST lists it
+type Process struct {
+	ChannelID   uint64        // Channel id, KILL takes it
+	User        string        // User of the channel
+	Database    string        // Database in use, empty if none
+	Statement   string        // Statement executing, empty when idle
+	Elapsed     time.Duration // How long the statement has been executing
+	Transaction uint64        // Transaction begun, 0 if none
+	State       string        // idle, active, idle in transaction or active in transaction
 }
 
 // Config is the configuration for AriaSQL
 type Config struct {
 	// The path to the data directory
-	DataDir  string     // Data directory
-	Logging  bool       // Enable logging
-	Replicas []*Replica // Every wal write will be sent to these replicas
+	DataDir             string               // Data directory
+	Logging             bool                 // Enable logging
+	Replicas            []*Replica           // Every wal write will be sent to these replicas
+	Replication         *ReplicationListener // Set on a replica, the WAL stream from the primary is received here and client writes are rejected
+	WALArchive          string               // WAL archive directory, keeps WAL segments and base backups for point-in-time recovery.  Empty disables archiving
+	WALSegmentSize      int64                // Size in bytes at which the WAL is rotated into the archive, 0 rotates only when a base backup is taken
+	Timeline            uint64               // Replication timeline, a new timeline starts each time a replica is promoted
+	TimelineHistory     []*TimelineSwitch    // Where each timeline after the first started
+	SynchronousReplicas int                  // Replicas which must acknowledge the WAL records of a COMMIT before it returns, 0 commits asynchronously
+	SynchronousTimeout  time.Duration        // How long a COMMIT waits for acknowledgements, 10s if not set
+	SynchronousFallback string               // What a COMMIT does once the timeout passes, "async" returns as if committed asynchronously (default), "error" returns an error
+	LockTimeout         time.Duration        // How long a statement waits for a row lock another transaction holds, 10s if not set
+	LoginPolicy         *catalog.LoginPolicy // Failed login throttling, opt-in lockout, password rules and expiry, catalog.DefaultLoginPolicy if not set
 }
 
 // Replica is a replica server
 type Replica struct {
-	Host    string       // Hostname or IP address
-	Port    int          // TCP port
-	TLS     bool         // true if TLS is enabled
-	TLSKey  string       // TLS key
-	TLSCert string       // TLS certificate
-	status  bool         // true if connected
-	conn    *net.Conn    // TCP connection
-	addr    *net.TCPAddr // TCP address
+	Host    string // Hostname or IP address
+	Port    int    // TCP port the replica receives the WAL stream on
+	TLS     bool   // true if TLS is enabled
+	TLSKey  string // TLS key, presented to the replica along with TLSCert as client certificate if both are set
+	TLSCert string // TLS certificate
+	TLSCA   string // CA certificate the replica's certificate is verified against, system roots if empty
+	Secret  string // Shared secret the replica expects from its primary
+}
+
+// ReplicationListener is where a replica listens for the WAL stream of its primary
+type ReplicationListener struct {
+	Host    string // Host to listen on
+	Port    int    // Port to listen on
+	TLS     bool   // true if TLS is enabled
+	TLSKey  string // TLS key
+	TLSCert string // TLS certificate
+	TLSCA   string // CA certificate the primary's client certificate is verified against, client certificates are not required if empty
+	Secret  string // Shared secret the primary must present, empty accepts only a primary on this host or with a certificate signed by TLSCA
 }
 
 // New creates a new AriaSQL object
@@ -133,7 +193,7 @@ func New(config *Config) (*AriaSQL, error) {
 		log.SetOutput(logFile)
 	}
 
-	wal, err := wal.OpenWAL(fmt.Sprintf("%s%swal.dat", config.DataDir, shared.GetOsPathSeparator()), os.O_CREATE|os.O_RDWR, 0644)
+	w, err := wal.OpenWAL(fmt.Sprintf("%s%swal.dat", config.DataDir, shared.GetOsPathSeparator()), os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, err
 
@@ -142,23 +202,243 @@ func New(config *Config) (*AriaSQL, error) {
 	gob.Register(&parser.Table{})
 	gob.Register(&parser.Wildcard{})
 
-	return &AriaSQL{
+	var archive *wal.Archive
+
+	// if an archive directory is configured, WAL segments are rotated into it
+	if config.WALArchive != "" {
+		archive, err = wal.OpenArchive(config.WALArchive)
+		if err != nil {
+			return nil, err
+		}
+
+		// Continue the log sequence after what has already been archived
+		lsn, err := archive.LastLSN()
+		if err != nil {
+			return nil, err
+		}
+
+		w.SetLSN(lsn)
+		w.SetArchive(archive, config.WALSegmentSize)
+	}
+
+	if config.Timeline == 0 {
+		config.Timeline = 1
+	}
+
+	transactions, err := mvcc.Open(fmt.Sprintf("%s%sxid.dat", config.DataDir, shared.GetOsPathSeparator()))
+	if err != nil {
+		return nil, err
+	}
+
+	aria := &AriaSQL{
 		Config: config,
 		Catalog: &catalog.Catalog{
 			Directory: config.DataDir,
 		},
-		WAL:          wal,
+		WAL:          w,
+		Archive:      archive,
 		ChannelsLock: &sync.Mutex{},
 		LogFile:      logFile,
-	}, err
+		CDC:          cdc.NewHub(),
+		Transactions: transactions,
+		Locks:        lock.New(),
+		promoted:     make(chan struct{}),
+		acks:         make(chan struct{}),
+	}
+
+	aria.readOnly.Store(config.Replication != nil)
+
+	return aria, err
+}
+
+// ReadOnly returns true if the instance is a replica, writes only come from the primary's WAL stream
+func (ariasql *AriaSQL) ReadOnly() bool {
+	return ariasql.readOnly.Load()
+}
+
+// ReadConfig reads the configuration of the instance in dataDir without opening the instance
+// Nothing is created or written, an instance without a configuration file has the default configuration
+func ReadConfig(dataDir string) (*Config, error) {
+	config := &Config{DataDir: dataDir}
+
+	confFile, err := os.Open(fmt.Sprintf("%s%sariaconf.yaml", dataDir, shared.GetOsPathSeparator()))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer confFile.Close()
+
+	err = yaml.NewDecoder(confFile).Decode(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// BaseBackup takes a base backup of the instance into the WAL archive
+// The current WAL is archived first so the backup lines up with the start of the next segment.  The instance should not be taking writes while the backup is taken
+func (ariasql *AriaSQL) BaseBackup() (*wal.BaseBackup, error) {
+	if ariasql.Archive == nil {
+		return nil, errors.New("WAL archiving is not configured")
+	}
+
+	return baseBackup(ariasql.Config, ariasql.WAL, ariasql.Archive)
+}
+
+// OfflineBaseBackup takes a base backup of the stopped instance in dataDir into its WAL archive
+// Only the WAL is opened, to archive it.  The instance is not started and its configuration is left as it is
+func OfflineBaseBackup(dataDir string) (*wal.BaseBackup, error) {
+	config, err := ReadConfig(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.WALArchive == "" {
+		return nil, errors.New("WAL archiving is not configured")
+	}
+
+	archive, err := wal.OpenArchive(config.WALArchive)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := wal.OpenWAL(fmt.Sprintf("%s%swal.dat", config.DataDir, shared.GetOsPathSeparator()), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	defer w.Close()
+
+	// Continue the log sequence after what has already been archived, as the instance does when it opens
+	lsn, err := archive.LastLSN()
+	if err != nil {
+		return nil, err
+	}
+
+	w.SetLSN(lsn)
+	w.SetArchive(archive, config.WALSegmentSize)
+
+	return baseBackup(config, w, archive)
+}
+
+// baseBackup archives the current WAL and copies the data files of the instance into a new base backup
+func baseBackup(config *Config, w *wal.WAL, archive *wal.Archive) (*wal.BaseBackup, error) {
+	err := w.Rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	return archive.CreateBaseBackup(w.LSN(),
+		fmt.Sprintf("%s%sdatabases", config.DataDir, shared.GetOsPathSeparator()),
+		fmt.Sprintf("%s%susers%s", config.DataDir, shared.GetOsPathSeparator(), catalog.SYS_USERS_EXTENSION),
+		fmt.Sprintf("%s%sxid.dat", config.DataDir, shared.GetOsPathSeparator()))
+}
+
+// RecoverTransactions undoes the changes of the transactions the last run left unfinished when it was not closed cleanly
+// A transaction in doubt committed if the WAL holds its commit record.  The tables the others created, dropped or altered are restored from the copies saved before,
+// then their row versions are removed along with their index entries and the sequence values they took.
+// A transaction which was prepared and not rolled back is resumed instead, in doubt until COMMIT PREPARED or ROLLBACK PREPARED.
+// It must be called once the catalog is open, before any transaction begins
+func (ariasql *AriaSQL) RecoverTransactions() error {
+	first, last := ariasql.Transactions.InDoubt()
+	if first == last {
+		// Copies of tables saved by transactions which all ended are no longer needed
+		none := func(uint64) bool { return false }
+		return ariasql.Catalog.RecoverTables(none, none)
+	}
+
+	var records []*wal.Record
+
+	// Damage within the WAL loses the commit records past it, those transactions are undone
+	if ariasql.Archive != nil {
+		archived, err := ariasql.Archive.Records()
+		var cerr *wal.CorruptionError
+		if err != nil && !errors.As(err, &cerr) {
+			return err
+		}
+
+		records = archived
+	}
+
+	current, err := ariasql.WAL.Records()
+	var cerr *wal.CorruptionError
+	if err != nil && !errors.As(err, &cerr) {
+		return err
+	}
+
+	records = append(records, current...)
+
+	committed := make(map[uint64]struct{})
+	prepared := make(map[uint64]*wal.Record) // Prepare records of the transactions which did not end
+
+	for _, rec := range records {
+		if rec.Xid < first || rec.Xid >= last {
+			continue
+		}
+
+		if rec.Commit {
+			committed[rec.Xid] = struct{}{}
+		}
+
+		switch rec.Stmt.(type) {
+		case *parser.PrepareTransactionStmt:
+			prepared[rec.Xid] = rec
+		case *parser.RollbackStmt:
+			delete(prepared, rec.Xid) // a rollback of a prepared transaction which did not finish is completed here
+		}
+	}
+
+	for xid := range committed {
+		delete(prepared, xid)
+	}
+
+	aborted := func(xid uint64) bool {
+		_, ok := committed[xid]
+		_, pending := prepared[xid]
+		return xid >= first && xid < last && !ok && !pending
+	}
+
+	pending := func(xid uint64) bool {
+		_, ok := prepared[xid]
+		return ok
+	}
+
+	err = ariasql.Catalog.RecoverTables(aborted, pending)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range ariasql.Catalog.GetDatabases() {
+		db := ariasql.Catalog.GetDatabase(name)
+
+		for _, tblName := range db.GetTables() {
+			err = db.GetTable(tblName).Undo(aborted)
+			if err != nil {
+				return fmt.Errorf("recovering table %s.%s: %s", name, tblName, err.Error())
+			}
+		}
+	}
+
+	err = ariasql.resumePrepared(prepared)
+	if err != nil {
+		return err
+	}
+
+	return ariasql.Transactions.Recovered()
 }
 
 // OpenChannel opens a new channel to database
 func (ariasql *AriaSQL) OpenChannel(user *catalog.User) *Channel {
 	ariasql.ChannelsLock.Lock()
 	defer ariasql.ChannelsLock.Unlock()
+	// Channel IDs are never reused, they identify the channel in the WAL
+	ariasql.channelID++
+
 	channel := &Channel{
-		ChannelID: uint64(len(ariasql.Channels) + 1),
+		ChannelID: ariasql.channelID,
 		User:      user,
 	}
 
@@ -182,8 +462,141 @@ func (ariasql *AriaSQL) CloseChannel(channel *Channel) error {
 	return errors.New("channel not found")
 }
 
+// Processes returns what the open channels are doing, in channel id order
+func (ariasql *AriaSQL) Processes() []*Process {
+	ariasql.ChannelsLock.Lock()
+	channels := append([]*Channel{}, ariasql.Channels...)
+	ariasql.ChannelsLock.Unlock()
+
+	processes := make([]*Process, len(channels))
+
+	for i, ch := range channels {
+		processes[i] = ch.Process()
+	}
+
+	sort.Slice(processes, func(i, j int) bool {
+		return processes[i].ChannelID < processes[j].ChannelID
+	})
+
+	return processes
+}
+
+// Process returns what the channel is doing
+func (ch *Channel) Process() *Process {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	p := &Process{ChannelID: ch.ChannelID, Transaction: ch.xid, State: "idle"}
+
+	if ch.User != nil {
+		p.User = ch.User.Username
+	}
+
+	p.Database = ch.database
+
+	if ch.statement != "" {
+		p.State = "active"
+		p.Elapsed = time.Since(ch.started)
+		p.Statement = ch.statement
+	}
+
+	if ch.xid != 0 {
+		p.State += " in transaction"
+	}
+
+	return p
+}
+
+// Run records that the channel started executing a statement within transaction xid (0 if none), cancel cancels it
+// Run and Idle are called by the session of the channel, others see what it is doing through Process
+func (ch *Channel) Run(stmt interface{}, xid uint64, cancel func(error)) {
+	// The statement is rendered before it executes, executing it fills in its AST, passwords are redacted for others to see
+	statement, err := parser.Deparse(parser.Redact(stmt))
+	if err != nil {
+		statement = fmt.Sprintf("%T", stmt) // a statement the deparser cannot render is named by its type
+	}
+
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	ch.statement = statement
+	ch.started = time.Now()
+	ch.xid = xid
+	ch.cancel = cancel
+	ch.database = ch.databaseName()
+}
+
+// Idle records that the channel finished its statement, leaving transaction xid (0 if none) begun
+func (ch *Channel) Idle(xid uint64) {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	ch.statement = ""
+	ch.xid = xid
+	ch.cancel = nil
+	ch.database = ch.databaseName()
+}
+
+// databaseName returns the name of the database in use, empty if none
+func (ch *Channel) databaseName() string {
+	if ch.Database == nil {
+		return ""
+	}
+
+	return ch.Database.Name
+}
+
+// Cancel cancels the statement the channel is executing with err, false if it is idle
+func (ch *Channel) Cancel(err error) bool {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	if ch.cancel == nil {
+		return false
+	}
+
+	ch.cancel(err)
+
+	return true
+}
+
+// Kill kills the channel, the statement executing is canceled with err and the connection is closed
+func (ch *Channel) Kill(err error) {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	ch.killed = true
+
+	if ch.cancel != nil {
+		ch.cancel(err)
+	}
+
+	if ch.close != nil {
+		ch.close()
+	}
+}
+
+// Killed returns true if the channel was killed
+func (ch *Channel) Killed() bool {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	return ch.killed
+}
+
+// OnKill sets what closes the connection of the channel when it is killed
+func (ch *Channel) OnKill(close func()) {
+	ch.state.Lock()
+	defer ch.state.Unlock()
+
+	ch.close = close
+}
+
 // GetChannel returns a channel by ID
 func (ariasql *AriaSQL) GetChannel(channelID uint64) *Channel {
+	ariasql.ChannelsLock.Lock()
+	defer ariasql.ChannelsLock.Unlock()
+
 	for _, ch := range ariasql.Channels {
 		if ch.ChannelID == channelID {
 			return ch
@@ -196,8 +609,14 @@ func (ariasql *AriaSQL) GetChannel(channelID uint64) *Channel {
 
 // Close closes the AriaSQL instance
 func (ariasql *AriaSQL) Close() error {
+	ariasql.StopReplication()
+
+	ariasql.configLock.Lock()
 	ariasql.saveConfig() // save configuration
+	ariasql.configLock.Unlock()
+
 	ariasql.Catalog.Close()
+	ariasql.Transactions.Close()
 
 	if ariasql.Config.Logging {
 		log.SetOutput(os.Stdout)
@@ -210,7 +629,7 @@ func (ariasql *AriaSQL) Close() error {
 
 // saveConfig saves the configuration to a file
 func (ariasql *AriaSQL) saveConfig() error {
-	confFile, err := os.OpenFile(fmt.Sprintf("%s%sariaconf.yaml", ariasql.Config.DataDir, shared.GetOsPathSeparator()), os.O_CREATE|os.O_RDWR, 0644)
+	confFile, err := os.OpenFile(fmt.Sprintf("%s%sariaconf.yaml", ariasql.Config.DataDir, shared.GetOsPathSeparator()), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -18,13 +18,16 @@
 package core
 
 import (
+	"ariasql/parser"
 	"os"
+	"strings"
 	"testing"
 )
 
 func TestNew(t *testing.T) {
 	defer os.Remove("wal.dat")
 	defer os.Remove("wal.dat.del")
+	defer os.Remove("xid.dat")
 	defer os.Remove("ariaconf.yaml")
 	aria, err := New(&Config{
 		DataDir: "./",
@@ -43,9 +46,57 @@ func TestNew(t *testing.T) {
 
 }
 
+func TestOfflineBaseBackup(t *testing.T) {
+	defer os.RemoveAll("backup")
+
+	aria, err := New(&Config{DataDir: "backup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aria.Config.WALArchive = "backup/archive"
+
+	err = aria.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := os.ReadFile("backup/ariaconf.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hand edited configuration, the backup must not rewrite it
+	conf = append([]byte("# archived nightly\n"), conf...)
+
+	err = os.WriteFile("backup/ariaconf.yaml", conf, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := OfflineBaseBackup("backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(backup.Directory, "backup/archive") {
+		t.Fatalf("expected the backup within the archive, got %s", backup.Directory)
+	}
+
+	after, err := os.ReadFile("backup/ariaconf.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(after) != string(conf) {
+		t.Fatal("expected the configuration to be left as it is")
+	}
+}
+
 func TestAriaSQL_OpenChannel(t *testing.T) {
 	defer os.Remove("wal.dat")
 	defer os.Remove("wal.dat.del")
+	defer os.Remove("xid.dat")
 	defer os.Remove("ariaconf.yaml")
 	aria, err := New(&Config{
 		DataDir: "./",
@@ -76,6 +127,7 @@ func TestAriaSQL_OpenChannel(t *testing.T) {
 func TestAriaSQL_RemoveChannel(t *testing.T) {
 	defer os.Remove("wal.dat")
 	defer os.Remove("wal.dat.del")
+	defer os.Remove("xid.dat")
 	defer os.Remove("ariaconf.yaml")
 	aria, err := New(&Config{
 		DataDir: "./",
@@ -95,3 +147,33 @@ func TestAriaSQL_RemoveChannel(t *testing.T) {
 		t.Fatalf("expected 0, got %d", len(aria.Channels))
 	}
 }
+
+func TestChannel_Run(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+	defer os.Remove("xid.dat")
+	defer os.Remove("ariaconf.yaml")
+	aria, err := New(&Config{
+		DataDir: "./",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := aria.OpenChannel(nil)
+
+	// Others see the statement a channel runs without its passwords
+	for _, stmt := range []interface{}{
+		&parser.CreateUserStmt{Username: &parser.Identifier{Value: "bob"}, Password: &parser.Literal{Value: "'secret'"}},
+		&parser.AlterUserStmt{SetType: parser.ALTER_USER_SET_PASSWORD, Username: &parser.Identifier{Value: "bob"}, Value: &parser.Literal{Value: "'secret'"}},
+	} {
+		channel.Run(stmt, 0, nil)
+
+		p := channel.Process()
+		if strings.Contains(p.Statement, "secret") || !strings.Contains(p.Statement, parser.REDACTED) {
+			t.Fatalf("expected the password to be redacted, got %s", p.Statement)
+		}
+
+		channel.Idle(0)
+	}
+}
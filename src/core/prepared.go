@@ -0,0 +1,152 @@
+// Package core
+// AriaSQL core package
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package core
+
+import (
+	"ariasql/lock"
+	"ariasql/mvcc"
+	"ariasql/parser"
+	"ariasql/wal"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// PreparedTransaction is a transaction prepared for two-phase commit, it stays in doubt until COMMIT PREPARED or ROLLBACK PREPARED ends it
+// The WAL holds its prepare record, a restart resumes it with its locks
+type PreparedTransaction struct {
+	Gid         string            // Global transaction id given by the coordinator
+	Tx          *mvcc.Transaction // The transaction, running until it ends
+	Prepared    time.Time         // When the transaction was prepared
+	Owner       string            // User which prepared the transaction
+	Database    string            // Database the transaction was prepared in
+	Transaction interface{}       // The executor's transaction, nil if resumed after a restart
+}
+
+// Prepare registers a prepared transaction under its global id, which must not be in use
+func (ariasql *AriaSQL) Prepare(p *PreparedTransaction) error {
+	ariasql.preparedLock.Lock()
+	defer ariasql.preparedLock.Unlock()
+
+	if ariasql.prepared == nil {
+		ariasql.prepared = make(map[string]*PreparedTransaction)
+	}
+
+	if _, ok := ariasql.prepared[p.Gid]; ok {
+		return fmt.Errorf("transaction identifier %s is already in use", p.Gid)
+	}
+
+	ariasql.prepared[p.Gid] = p
+
+	return nil
+}
+
+// FinishPrepared removes the prepared transaction with global id gid so it can be committed or rolled back, nil if there is none
+func (ariasql *AriaSQL) FinishPrepared(gid string) *PreparedTransaction {
+	ariasql.preparedLock.Lock()
+	defer ariasql.preparedLock.Unlock()
+
+	p, ok := ariasql.prepared[gid]
+	if !ok {
+		return nil
+	}
+
+	delete(ariasql.prepared, gid)
+
+	return p
+}
+
+// PreparedTransactions returns the prepared transactions in doubt, oldest first
+func (ariasql *AriaSQL) PreparedTransactions() []*PreparedTransaction {
+	ariasql.preparedLock.Lock()
+	defer ariasql.preparedLock.Unlock()
+
+	prepared := make([]*PreparedTransaction, 0, len(ariasql.prepared))
+
+	for _, p := range ariasql.prepared {
+		prepared = append(prepared, p)
+	}
+
+	sort.Slice(prepared, func(i, j int) bool {
+		return prepared[i].Tx.Xid < prepared[j].Tx.Xid
+	})
+
+	return prepared
+}
+
+// resumePrepared resumes the transactions the last run prepared and did not end, from their prepare records
+// Each takes back exclusive locks on the tables it changed and on the rows it wrote, so nothing else writes them until it ends
+func (ariasql *AriaSQL) resumePrepared(prepared map[uint64]*wal.Record) error {
+	for xid, rec := range prepared {
+		stmt, ok := rec.Stmt.(*parser.PrepareTransactionStmt)
+		if !ok {
+			return errors.New("expected prepare record")
+		}
+
+		err := ariasql.Prepare(&PreparedTransaction{
+			Gid:      stmt.Gid.Value.(string),
+			Tx:       ariasql.Transactions.Resume(xid),
+			Prepared: rec.Timestamp,
+			Owner:    rec.User,
+			Database: rec.Database,
+		})
+		if err != nil {
+			return err
+		}
+
+		tables, err := ariasql.Catalog.SavedTables(xid)
+		if err != nil {
+			return err
+		}
+
+		for _, table := range tables {
+			err = ariasql.Locks.TryLock(xid, lock.Resource{Table: table, RowId: lock.TABLE}, lock.EXCLUSIVE)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, name := range ariasql.Catalog.GetDatabases() {
+			db := ariasql.Catalog.GetDatabase(name)
+
+			for _, tblName := range db.GetTables() {
+				created, deleted := db.GetTable(tblName).Versions(xid)
+				if len(created) == 0 && len(deleted) == 0 {
+					continue
+				}
+
+				table := name + "." + tblName
+
+				err = ariasql.Locks.TryLock(xid, lock.Resource{Table: table, RowId: lock.TABLE}, lock.INTENTION_EXCLUSIVE)
+				if err != nil {
+					return err
+				}
+
+				for _, rowId := range append(created, deleted...) {
+					err = ariasql.Locks.TryLock(xid, lock.Resource{Table: table, RowId: rowId}, lock.EXCLUSIVE)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,668 @@
+// Package core replication
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package core
+
+import (
+	"ariasql/wal"
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The primary connects to each replica and sends the replication handshake, magic, version, the replica's secret and the primary's timeline history.
+// The replica answers with a status byte and the last LSN it applied, the primary then streams every record after it as WAL frames.
+// The replica acknowledges each applied record with its LSN.
+
+const REPLICATION_MAGIC = "ARIAREPL"                  // Starts the replication handshake
+const REPLICATION_VERSION = 2                         // Replication protocol version
+const REPLICATION_RETRY_INTERVAL = time.Second        // Time between attempts to reach a replica
+const REPLICATION_BUFFER = 4096                       // Record frames buffered per replica before it is considered behind
+const REPLICATION_HANDSHAKE_TIMEOUT = 5 * time.Second // Time allowed for the handshake
+const SYNCHRONOUS_TIMEOUT = 10 * time.Second          // Default time a COMMIT waits for replica acknowledgements
+const SYNCHRONOUS_FALLBACK_ASYNC = "async"            // A COMMIT which timed out waiting for replicas returns as committed
+const SYNCHRONOUS_FALLBACK_ERROR = "error"            // A COMMIT which timed out waiting for replicas returns an error
+
+// Replication handshake status, sent by the replica
+const (
+	REPLICATION_OK       byte = iota // Stream may start
+	REPLICATION_DENIED               // Secret did not match
+	REPLICATION_BUSY                 // The replica is already receiving from a primary
+	REPLICATION_DIVERGED             // The replica's history is not part of the primary's timeline
+	REPLICATION_PRIMARY              // The instance was promoted and no longer takes a stream
+)
+
+// TimelineSwitch is the start of a replication timeline
+type TimelineSwitch struct {
+	Timeline uint64 // Timeline which started
+	LSN      uint64 // Last LSN of the timeline before it, records after it belong to the new timeline
+}
+
+// ReplicationHandshake is what a primary presents to a replica
+type ReplicationHandshake struct {
+	Secret   string            // Shared secret
+	Timeline uint64            // Primary's timeline
+	History  []*TimelineSwitch // Primary's timeline history
+}
+
+// Timeline returns the instance's replication timeline and the history leading up to it
+func (ariasql *AriaSQL) Timeline() (uint64, []*TimelineSwitch) {
+	ariasql.configLock.Lock()
+	defer ariasql.configLock.Unlock()
+
+	return ariasql.Config.Timeline, append([]*TimelineSwitch{}, ariasql.Config.TimelineHistory...)
+}
+
+// Promote promotes a replica to primary
+// The replica stops applying the stream of its old primary, takes writes and starts a new timeline at its last applied LSN.
+// The old primary can only follow it if its history does not go past that LSN, otherwise it has to be rebuilt from a base backup
+func (ariasql *AriaSQL) Promote() (uint64, error) {
+	ariasql.configLock.Lock()
+	if !ariasql.ReadOnly() {
+		ariasql.configLock.Unlock()
+		return 0, errors.New("instance is not a replica")
+	}
+	hooks := append([]func(){}, ariasql.promoteHooks...)
+	ariasql.configLock.Unlock()
+
+	// The stream of the old primary stops being applied and the transactions it left open are rolled back before writes are taken
+	for _, hook := range hooks {
+		hook()
+	}
+
+	ariasql.configLock.Lock()
+	defer ariasql.configLock.Unlock()
+
+	if !ariasql.ReadOnly() {
+		return 0, errors.New("instance is not a replica")
+	}
+
+	ariasql.Config.TimelineHistory = append(ariasql.Config.TimelineHistory, &TimelineSwitch{Timeline: ariasql.Config.Timeline + 1, LSN: ariasql.WAL.LSN()})
+	ariasql.Config.Timeline++
+	ariasql.Config.Replication = nil // starts as primary from now on
+
+	ariasql.readOnly.Store(false)
+	close(ariasql.promoted)
+
+	err := ariasql.saveConfig()
+	if err != nil {
+		return 0, err
+	}
+
+	return ariasql.Config.Timeline, nil
+}
+
+// OnPromote registers f to run when the instance is promoted, before it takes writes
+func (ariasql *AriaSQL) OnPromote(f func()) {
+	ariasql.configLock.Lock()
+	defer ariasql.configLock.Unlock()
+
+	ariasql.promoteHooks = append(ariasql.promoteHooks, f)
+}
+
+// Promoted returns a channel which is closed once the instance is promoted to primary
+func (ariasql *AriaSQL) Promoted() <-chan struct{} {
+	return ariasql.promoted
+}
+
+// FollowTimeline checks a primary's timeline against the replica's history and moves the replica onto it
+// A replica can follow a newer timeline if it did not apply records past the point the timeline started
+func (ariasql *AriaSQL) FollowTimeline(timeline uint64, history []*TimelineSwitch) error {
+	ariasql.configLock.Lock()
+	defer ariasql.configLock.Unlock()
+
+	current := ariasql.Config.Timeline
+
+	if timeline < current {
+		return fmt.Errorf("primary is on timeline %d, behind timeline %d", timeline, current)
+	}
+
+	if timeline == current {
+		return nil
+	}
+
+	lsn := ariasql.WAL.LSN()
+
+	for _, sw := range history {
+		if sw.Timeline > current {
+			if lsn > sw.LSN {
+				return fmt.Errorf("history diverged from timeline %d which started after LSN %d, at LSN %d, rebuild from a base backup", sw.Timeline, sw.LSN, lsn)
+			}
+
+			break
+		}
+	}
+
+	ariasql.Config.Timeline = timeline
+	ariasql.Config.TimelineHistory = history
+
+	return ariasql.saveConfig()
+}
+
+// ReplicaStream is the stream to a replica, kept apart from the replica's configuration which is saved while it runs
+type ReplicaStream struct {
+	Replica *Replica   // Replica streamed to
+	status  bool       // true if connected
+	conn    net.Conn   // Connection to the replica
+	lsn     uint64     // Last LSN the replica acknowledged
+	lock    sync.Mutex // Guards status, conn and lsn
+}
+
+// ReplicaStreams returns the streams to the configured replicas, nil until replication starts
+func (ariasql *AriaSQL) ReplicaStreams() []*ReplicaStream {
+	return ariasql.streams
+}
+
+// Connected returns true if the primary is streaming to the replica
+func (r *ReplicaStream) Connected() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.status
+}
+
+// AckedLSN returns the last LSN the replica acknowledged
+func (r *ReplicaStream) AckedLSN() uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.lsn
+}
+
+// notifyAcks wakes up commits waiting for replica acknowledgements
+func (ariasql *AriaSQL) notifyAcks() {
+	ariasql.acksLock.Lock()
+	defer ariasql.acksLock.Unlock()
+
+	close(ariasql.acks)
+	ariasql.acks = make(chan struct{})
+}
+
+// acknowledged returns the number of replicas which acknowledged lsn
+func (ariasql *AriaSQL) acknowledged(lsn uint64) int {
+	n := 0
+
+	for _, stream := range ariasql.streams {
+		if stream.AckedLSN() >= lsn {
+			n++
+		}
+	}
+
+	return n
+}
+
+// WaitForReplicas waits until n replicas acknowledged the records up to lsn
+// Once the configured timeout passes the commit either goes through asynchronously or an error is returned, as configured
+func (ariasql *AriaSQL) WaitForReplicas(lsn uint64, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	timeout := ariasql.Config.SynchronousTimeout
+	if timeout <= 0 {
+		timeout = SYNCHRONOUS_TIMEOUT
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		ariasql.acksLock.Lock()
+		acks := ariasql.acks
+		ariasql.acksLock.Unlock()
+
+		acked := ariasql.acknowledged(lsn)
+		if acked >= n {
+			return nil
+		}
+
+		select {
+		case <-acks:
+		case <-timer.C:
+			if ariasql.Config.SynchronousFallback == SYNCHRONOUS_FALLBACK_ERROR {
+				return fmt.Errorf("committed locally but only %d of %d replicas acknowledged LSN %d within %s", acked, n, lsn, timeout)
+			}
+
+			log.Printf("replication: only %d of %d replicas acknowledged LSN %d within %s, committed asynchronously", acked, n, lsn, timeout)
+
+			return nil
+		}
+	}
+}
+
+// StartReplication starts streaming the WAL to the configured replicas
+func (ariasql *AriaSQL) StartReplication() {
+	if len(ariasql.Config.Replicas) == 0 || ariasql.replication != nil {
+		return
+	}
+
+	ariasql.replication = make(chan struct{})
+
+	if ariasql.streams == nil {
+		for _, replica := range ariasql.Config.Replicas {
+			ariasql.streams = append(ariasql.streams, &ReplicaStream{Replica: replica})
+		}
+	}
+
+	for _, stream := range ariasql.streams {
+		ariasql.replicating.Add(1)
+		go ariasql.replicate(stream, ariasql.replication)
+	}
+}
+
+// StopReplication stops streaming to the replicas
+func (ariasql *AriaSQL) StopReplication() {
+	if ariasql.replication == nil {
+		return
+	}
+
+	close(ariasql.replication)
+	ariasql.replication = nil
+
+	for _, stream := range ariasql.streams {
+		stream.lock.Lock()
+		if stream.conn != nil {
+			stream.conn.Close()
+		}
+		stream.lock.Unlock()
+	}
+
+	ariasql.replicating.Wait()
+}
+
+// replicate keeps streaming to a replica until stop is closed, reconnecting whenever the connection is lost
+func (ariasql *AriaSQL) replicate(stream *ReplicaStream, stop chan struct{}) {
+	defer ariasql.replicating.Done()
+
+	replica := stream.Replica
+
+	for {
+		err := ariasql.stream(stream, stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if err != nil {
+			log.Printf("replication to %s:%d: %s", replica.Host, replica.Port, err.Error())
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(REPLICATION_RETRY_INTERVAL):
+		}
+	}
+}
+
+// dial connects to a replica
+func (r *Replica) dial() (net.Conn, error) {
+	addr := net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+
+	if !r.TLS {
+		return net.DialTimeout("tcp", addr, REPLICATION_HANDSHAKE_TIMEOUT)
+	}
+
+	config := &tls.Config{ServerName: r.Host, MinVersion: tls.VersionTLS12}
+
+	if r.TLSCA != "" {
+		ca, err := os.ReadFile(r.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("invalid replica CA certificate")
+		}
+	}
+
+	if r.TLSCert != "" && r.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(r.TLSCert, r.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return tls.DialWithDialer(&net.Dialer{Timeout: REPLICATION_HANDSHAKE_TIMEOUT}, "tcp", addr, config)
+}
+
+// stream connects to a replica, sends it the records it is missing and then every record appended to the WAL
+func (ariasql *AriaSQL) stream(stream *ReplicaStream, stop chan struct{}) error {
+	replica := stream.Replica
+
+	conn, err := replica.dial()
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	stream.lock.Lock()
+	select {
+	case <-stop:
+		stream.lock.Unlock()
+		return nil
+	default:
+	}
+	stream.conn = conn
+	stream.lock.Unlock()
+
+	defer func() {
+		stream.lock.Lock()
+		stream.conn = nil
+		stream.status = false
+		stream.lock.Unlock()
+	}()
+
+	conn.SetDeadline(time.Now().Add(REPLICATION_HANDSHAKE_TIMEOUT))
+
+	timeline, history := ariasql.Timeline()
+
+	err = WriteReplicationHandshake(conn, &ReplicationHandshake{Secret: replica.Secret, Timeline: timeline, History: history})
+	if err != nil {
+		return err
+	}
+
+	lsn, err := ReadReplicationStatus(conn)
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	// Subscribe before reading the backlog so no record falls in between
+	sub := ariasql.WAL.Subscribe(REPLICATION_BUFFER)
+	defer sub.Close()
+
+	backlog, err := ariasql.backlog(lsn)
+	if err != nil {
+		return err
+	}
+
+	stream.lock.Lock()
+	stream.status = true
+	stream.lsn = lsn
+	stream.lock.Unlock()
+
+	// Acknowledgements come back while records are sent, the reader is done once the connection is closed
+	acks := make(chan error, 1)
+	done := make(chan struct{})
+
+	defer func() {
+		conn.Close()
+		<-done
+	}()
+
+	go func() {
+		defer close(done)
+
+		for {
+			var ack uint64
+			err := binary.Read(conn, binary.BigEndian, &ack)
+			if err != nil {
+				acks <- err
+				return
+			}
+
+			stream.lock.Lock()
+			if ack > stream.lsn {
+				stream.lsn = ack
+			}
+			stream.lock.Unlock()
+
+			ariasql.notifyAcks()
+		}
+	}()
+
+	w := bufio.NewWriter(conn)
+	sent := lsn
+
+	for _, rec := range backlog {
+		data, err := wal.EncodeRecord(rec)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return err
+		}
+
+		sent = rec.LSN
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-acks:
+			return err
+		case data, ok := <-sub.C:
+			if !ok {
+				return errors.New("replica fell behind, resynchronizing")
+			}
+
+			rec, err := ariasql.WAL.DecodeRecord(data)
+			if err != nil {
+				return err
+			}
+
+			if rec.LSN <= sent {
+				continue // already sent as part of the backlog
+			}
+
+			_, err = w.Write(data)
+			if err != nil {
+				return err
+			}
+
+			err = w.Flush()
+			if err != nil {
+				return err
+			}
+
+			sent = rec.LSN
+		}
+	}
+}
+
+// backlog returns the archived and current WAL records after lsn
+func (ariasql *AriaSQL) backlog(lsn uint64) ([]*wal.Record, error) {
+	// Every record up to last is already written when it is read
+	last := ariasql.WAL.LSN()
+
+	if lsn > last {
+		return nil, fmt.Errorf("replica is at LSN %d, ahead of the primary at LSN %d", lsn, last)
+	}
+
+	var records []*wal.Record
+
+	if ariasql.Archive != nil {
+		recs, err := ariasql.Archive.Records()
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, recs...)
+	}
+
+	recs, err := ariasql.WAL.Records()
+	if err != nil {
+		return nil, err
+	}
+
+	records = append(records, recs...)
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].LSN < records[j].LSN
+	})
+
+	backlog := make([]*wal.Record, 0)
+	next := lsn + 1
+
+	for _, rec := range records {
+		if rec.LSN <= lsn {
+			continue
+		}
+
+		if rec.LSN != next {
+			return nil, fmt.Errorf("records after LSN %d are no longer available, rebuild the replica from a base backup", next-1)
+		}
+
+		backlog = append(backlog, rec)
+		next++
+	}
+
+	if next <= last {
+		return nil, fmt.Errorf("records after LSN %d are no longer available, rebuild the replica from a base backup", next-1)
+	}
+
+	return backlog, nil
+}
+
+// WriteReplicationHandshake sends the replication handshake to a replica
+func WriteReplicationHandshake(w io.Writer, hs *ReplicationHandshake) error {
+	if len(hs.Secret) > 0xffff || len(hs.History) > 0xffff {
+		return errors.New("replication handshake is too long")
+	}
+
+	buf := make([]byte, 0, len(REPLICATION_MAGIC)+13+len(hs.Secret)+16*len(hs.History))
+	buf = append(buf, REPLICATION_MAGIC...)
+	buf = append(buf, REPLICATION_VERSION)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(hs.Secret)))
+	buf = append(buf, hs.Secret...)
+	buf = binary.BigEndian.AppendUint64(buf, hs.Timeline)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(hs.History)))
+
+	for _, sw := range hs.History {
+		buf = binary.BigEndian.AppendUint64(buf, sw.Timeline)
+		buf = binary.BigEndian.AppendUint64(buf, sw.LSN)
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadReplicationHandshake reads the replication handshake of a primary
+func ReadReplicationHandshake(r io.Reader) (*ReplicationHandshake, error) {
+	header := make([]byte, len(REPLICATION_MAGIC)+3)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(header[:len(REPLICATION_MAGIC)]) != REPLICATION_MAGIC {
+		return nil, errors.New("not a replication handshake")
+	}
+
+	if header[len(REPLICATION_MAGIC)] != REPLICATION_VERSION {
+		return nil, fmt.Errorf("unsupported replication protocol version %d", header[len(REPLICATION_MAGIC)])
+	}
+
+	secret := make([]byte, binary.BigEndian.Uint16(header[len(REPLICATION_MAGIC)+1:]))
+
+	_, err = io.ReadFull(r, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &ReplicationHandshake{Secret: string(secret)}
+
+	timeline := make([]byte, 10)
+
+	_, err = io.ReadFull(r, timeline)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.Timeline = binary.BigEndian.Uint64(timeline)
+
+	history := make([]byte, 16*int(binary.BigEndian.Uint16(timeline[8:])))
+
+	_, err = io.ReadFull(r, history)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(history); i += 16 {
+		hs.History = append(hs.History, &TimelineSwitch{
+			Timeline: binary.BigEndian.Uint64(history[i:]),
+			LSN:      binary.BigEndian.Uint64(history[i+8:]),
+		})
+	}
+
+	return hs, nil
+}
+
+// WriteReplicationStatus answers a primary's handshake with a status and the last LSN the replica applied
+func WriteReplicationStatus(w io.Writer, status byte, lsn uint64) error {
+	buf := binary.BigEndian.AppendUint64([]byte{status}, lsn)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadReplicationStatus reads a replica's answer to the handshake and returns the last LSN it applied
+func ReadReplicationStatus(r io.Reader) (uint64, error) {
+	buf := make([]byte, 9)
+
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	switch buf[0] {
+	case REPLICATION_OK:
+		return binary.BigEndian.Uint64(buf[1:]), nil
+	case REPLICATION_DENIED:
+		return 0, errors.New("replica denied the replication secret")
+	case REPLICATION_BUSY:
+		return 0, errors.New("replica is already receiving from a primary")
+	case REPLICATION_DIVERGED:
+		return 0, fmt.Errorf("replica at LSN %d has diverged from this primary's timeline, rebuild it from a base backup", binary.BigEndian.Uint64(buf[1:]))
+	case REPLICATION_PRIMARY:
+		return 0, errors.New("replica was promoted to primary")
+	}
+
+	return 0, fmt.Errorf("unknown replication status %d", buf[0])
+}
+
+// WriteReplicationAck acknowledges an applied record to the primary
+func WriteReplicationAck(w io.Writer, lsn uint64) error {
+	return binary.Write(w, binary.BigEndian, lsn)
+}
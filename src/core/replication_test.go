@@ -0,0 +1,134 @@
+// Package core replication tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package core
+
+import (
+	"ariasql/parser"
+	"ariasql/wal"
+	"bytes"
+	"testing"
+)
+
+// newReplica creates a replica instance with lsn records in its WAL
+func newReplica(t *testing.T, lsn int) *AriaSQL {
+	aria, err := New(&Config{DataDir: t.TempDir(), Replication: &ReplicationListener{Host: "127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { aria.WAL.Close() })
+
+	for i := 0; i < lsn; i++ {
+		err = aria.WAL.Log(&wal.Record{Stmt: &parser.BeginStmt{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return aria
+}
+
+func TestAriaSQL_Promote(t *testing.T) {
+	aria := newReplica(t, 3)
+
+	if !aria.ReadOnly() {
+		t.Fatal("expected replica to be read-only")
+	}
+
+	timeline, err := aria.Promote()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timeline != 2 || aria.ReadOnly() {
+		t.Fatalf("expected writable primary on timeline 2, got timeline %d", timeline)
+	}
+
+	select {
+	case <-aria.Promoted():
+	default:
+		t.Fatal("expected promoted channel to be closed")
+	}
+
+	_, history := aria.Timeline()
+	if len(history) != 1 || history[0].Timeline != 2 || history[0].LSN != 3 {
+		t.Fatalf("expected timeline 2 to start after LSN 3, got %v", history)
+	}
+
+	if _, err := aria.Promote(); err == nil {
+		t.Fatal("expected error promoting a primary")
+	}
+
+	// The promotion survives a restart
+	config := &Config{DataDir: aria.Config.DataDir}
+
+	reopened, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer reopened.WAL.Close()
+
+	if reopened.ReadOnly() || config.Timeline != 2 {
+		t.Fatalf("expected writable instance on timeline 2, got timeline %d", config.Timeline)
+	}
+}
+
+func TestAriaSQL_FollowTimeline(t *testing.T) {
+	history := []*TimelineSwitch{{Timeline: 2, LSN: 3}}
+
+	// Replica which did not get past the start of timeline 2 follows it
+	aria := newReplica(t, 3)
+
+	if err := aria.FollowTimeline(2, history); err != nil {
+		t.Fatal(err)
+	}
+
+	if timeline, _ := aria.Timeline(); timeline != 2 {
+		t.Fatalf("expected timeline 2, got %d", timeline)
+	}
+
+	// A primary left behind on the old timeline is refused
+	if err := aria.FollowTimeline(1, nil); err == nil {
+		t.Fatal("expected error following an older timeline")
+	}
+
+	// Old primary which took writes after the replica was promoted has diverged
+	diverged := newReplica(t, 4)
+
+	if err := diverged.FollowTimeline(2, history); err == nil {
+		t.Fatal("expected diverged history to be refused")
+	}
+}
+
+func TestReplicationHandshake(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+
+	err := WriteReplicationHandshake(buf, &ReplicationHandshake{Secret: "secret", Timeline: 3, History: []*TimelineSwitch{{Timeline: 2, LSN: 10}, {Timeline: 3, LSN: 20}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hs, err := ReadReplicationHandshake(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hs.Secret != "secret" || hs.Timeline != 3 || len(hs.History) != 2 || hs.History[1].LSN != 20 {
+		t.Fatalf("unexpected handshake %+v", hs)
+	}
+}
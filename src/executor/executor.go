@@ -18,10 +18,15 @@ package executor
 
 import (
 	"ariasql/catalog"
+	"ariasql/cdc"
 	"ariasql/core"
+	"ariasql/lock"
+	"ariasql/mvcc"
 	"ariasql/parser"
 	"ariasql/shared"
 	"ariasql/storage/btree"
+	"ariasql/wal"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -39,18 +44,72 @@ import (
 
 // Executor is the main executor structure
 type Executor struct {
-	aria             *core.AriaSQL        // AriaSQL instance pointer
-	ch               *core.Channel        // Channel pointer
-	json             bool                 // Enable JSON output, default is false, set by client from server usually
-	recover          bool                 // Recover flag
-	Transaction      *Transaction         // Transaction statements
-	TransactionBegun bool                 // Transaction begun
-	ResultSetBuffer  []byte               // Result set buffer
-	vars             map[string]*Variable // Defined variables
-	cursors          map[string]*Cursor   // Allocated cursors
-	fetchStatus      atomic.Int32         // Fetch status
-	plan             *Plan                // Execution plan
-	explaining       bool                 // Explaining flag, populates plan
+	aria             *core.AriaSQL         // AriaSQL instance pointer
+	ch               *core.Channel         // Channel pointer
+	json             bool                  // Enable JSON output, default is false, set by client from server usually
+	recover          bool                  // Recover flag
+	Transaction      *Transaction          // Transaction statements
+	TransactionBegun bool                  // Transaction begun
+	ResultSetBuffer  []byte                // Result set buffer
+	result           *Result               // Columns and rows of the result set, nil if the statement had none
+	rowWriter        RowWriter             // Receives the rows of plain SELECTs as they are read, nil keeps every result set
+	streaming        *rowStream            // SELECT executing whose rows are written to the row writer, nil if none
+	vars             map[string]*Variable  // Defined variables
+	cursors          map[string]*Cursor    // Allocated cursors
+	fetchStatus      atomic.Int32          // Fetch status
+	plan             *Plan                 // Execution plan
+	explaining       bool                  // Explaining flag, populates plan
+	replaying        bool                  // Replaying WAL records during point-in-time recovery
+	replayRecord     *wal.Record           // WAL record being replayed, written back to the new WAL once
+	lastRecord       *wal.Record           // Last record the executor logged or replayed
+	changes          []*cdc.Event          // Row changes of the statement or transaction, published once committed
+	syncReplicas     *int                  // Session synchronous_replicas setting, nil uses the server setting
+	isolation        parser.IsolationLevel // Isolation level SET TRANSACTION chose for the next transaction, 0 if none
+	ctx              context.Context       // Context of the statement executing, done once it ran longer than the statement timeout
+	timeouts         Timeouts              // Server timeouts, the session settings override them
+	statementTimeout *time.Duration        // Session statement_timeout setting, nil uses the server setting
+	lockTimeout      *time.Duration        // Session lock_timeout setting, nil uses the server setting
+	idleTimeout      *time.Duration        // Session idle_in_transaction_timeout setting, nil uses the server setting
+	idle             *time.Timer           // Rolls back the transaction begun once the session is idle for longer than the idle timeout
+	idleExpired      bool                  // The idle timer rolled back the transaction begun
+	executing        bool                  // A statement is executing, the idle timer leaves the transaction alone
+	idleLock         sync.Mutex            // Guards idle, idleExpired and executing
+}
+
+// Timeouts limit how long statements run and wait for locks and how long a session may leave a transaction idle, 0 is no limit
+type Timeouts struct {
+	Statement         time.Duration // A statement running longer is canceled, the transaction begun is rolled back with it
+	Lock              time.Duration // A statement waiting longer for a lock fails, the instance's LockTimeout applies if 0
+	IdleInTransaction time.Duration // A transaction left idle longer is rolled back
+}
+
+// ErrStatementTimeout is returned by a statement canceled because it ran longer than the statement timeout
+var ErrStatementTimeout = errors.New("canceling statement due to statement timeout")
+
+// ErrQueryCanceled is returned by a statement KILL QUERY canceled
+var ErrQueryCanceled = errors.New("canceling statement due to user request")
+
+// ErrSessionKilled is returned by the statement executing when KILL ends its session, and by every statement after
+var ErrSessionKilled = errors.New("session killed")
+
+// ErrIdleInTransactionTimeout is returned by the first statement after the transaction begun was rolled back for being idle too long
+var ErrIdleInTransactionTimeout = errors.New("transaction rolled back, it was idle for longer than the idle in transaction timeout")
+
+// Result is the result set of a statement as columns and rows, for clients formatting it themselves
+type Result struct {
+	Columns  []string        // Column names in order
+	Rows     [][]interface{} // Values of each row in column order, strings without their quotes
+	Streamed int             // Rows written to the row writer as they were read, rather than kept in Rows
+}
+
+// RowWriter receives the rows of a result set in batches as they are read, in the order of columns
+type RowWriter func(columns []string, rows [][]interface{}) error
+
+// rowStream is a SELECT whose rows are written to the row writer as they are read rather than kept
+type rowStream struct {
+	selectList *parser.SelectList // Select list each batch is projected by
+	columns    []string           // Columns of the first batch, every batch is written in them
+	written    int                // Rows written
 }
 
 // Variable struct represents a variable on the executor
@@ -64,30 +123,51 @@ type Cursor struct {
 	name      string             // the name of the cursor
 	pos       uint64             // position of the cursor
 	statement *parser.SelectStmt // the select statement
+	tx        *mvcc.Transaction  // read transaction begun when the cursor is opened, FETCH reads from its snapshot
 }
 
 // Transaction represents a transaction
 type Transaction struct {
 	Statements []*TransactionStmt // Transaction statements
+	Tx         *mvcc.Transaction  // Transaction id and snapshot the transaction reads from
+	Versions   []*Version         // Row versions the transaction wrote, undone on rollback
+	Queried    bool               // A statement ran within the transaction, its isolation level can no longer change
+	Savepoints []*Savepoint       // Savepoints of the transaction, oldest first
+	Implicit   bool               // The transaction of a single statement, the statement's WAL record commits it
+	Tables     []*TableChange     // Tables the transaction created, dropped or altered, restored on rollback
+	Changes    []*cdc.Event       // Row changes of a prepared transaction, published once it commits
+	Resumed    bool               // A prepared transaction resumed after a restart, its row versions are found by scanning the tables
 }
 
-// TransactionStmt represents a transaction statement
-type TransactionStmt struct {
-	Id       int         // The statement id
-	Stmt     interface{} // The statement, (insert, update, delete)
-	Commited bool        // Whether the statement has been commited
-	Rollback *Rollback   // Rollback data
+// TableChange is a table a statement of a transaction created, dropped or altered, saved before the change so it can be restored
+type TableChange struct {
+	Database *catalog.Database // Database of the table
+	Name     string            // Table name
+	Table    *catalog.Table    // The table before the change, nil if the transaction created it
+	Versions int               // Row versions written before the change
+}
+
+// Savepoint marks how far a transaction had gotten, ROLLBACK TO SAVEPOINT undoes what came after it
+type Savepoint struct {
+	Name       string // Savepoint name
+	Statements int    // Statements recorded before the savepoint
+	Versions   int    // Row versions written before the savepoint
+	Changes    int    // Row changes captured before the savepoint
+	Tables     int    // Tables changed before the savepoint
 }
 
-// Rollback represents a transaction rollback
-type Rollback struct {
-	Rows []*Before // Rows to rollback to (if applicable)
+// TransactionStmt represents a transaction statement
+type TransactionStmt struct {
+	Id   int         // The statement id
+	Stmt interface{} // The statement, (insert, update, delete)
 }
 
-// Before represents the state of a row before a transaction
-type Before struct {
-	RowId int64                  // The actual row id within the table
-	Row   map[string]interface{} // The row data
+// Version is a row version a transaction created or deleted
+type Version struct {
+	Table    *catalog.Table // Table of the row
+	RowId    int64          // The actual row id within the table
+	Expired  bool           // The transaction deleted the version, otherwise it created it
+	Inserted bool           // The version is an inserted row, its sequence values are given back if it is undone
 }
 
 // Plan represents an execution plan
@@ -111,6 +191,11 @@ const (
 	INDEX_SCAN
 )
 
+// ROW_ID carries the row id of a row being locked by SELECT ... FOR UPDATE | FOR SHARE
+const ROW_ID = "$rowid"
+
+const ROW_BATCH_SIZE = 100 // Rows read before they are written to the row writer
+
 // New creates a new Executor
 // Creates a new AriaSQL executor
 // You must pass in a pointer to an AriaSQL instance and a pointer to a Channel instance
@@ -119,8 +204,75 @@ func New(aria *core.AriaSQL, ch *core.Channel) *Executor {
 	return &Executor{ch: ch, aria: aria}
 }
 
+// changesOwnPassword checks if a statement is the session user's ALTER USER ... SET PASSWORD of its own password
+func (ex *Executor) changesOwnPassword(stmt parser.Statement) bool {
+	s, ok := stmt.(*parser.AlterUserStmt)
+
+	return ok && s.SetType == parser.ALTER_USER_SET_PASSWORD && ex.ch != nil && ex.ch.User != nil && s.Username.Value == ex.ch.User.Username
+}
+
 // Execute executes an abstract syntax tree statement
+// A statement running longer than the statement timeout or canceled through KILL is stopped and the transaction begun is rolled back
 func (ex *Executor) Execute(stmt parser.Statement) error {
+	err := ex.wake()
+	if err != nil {
+		return err
+	}
+
+	defer ex.sleep()
+
+	statement, cancel := context.WithCancelCause(context.Background())
+	ctx, stop := context.Context(statement), context.CancelFunc(func() {})
+	if timeout := ex.statementTimeoutSetting(); timeout > 0 {
+		ctx, stop = context.WithTimeout(statement, timeout)
+	}
+
+	ex.ctx = ctx
+
+	if ex.ch != nil {
+		ex.ch.Run(stmt, ex.xid(), cancel)
+	}
+
+	defer func() {
+		stop()
+		cancel(nil)
+		ex.ctx = nil
+
+		if ex.ch != nil {
+			ex.ch.Idle(ex.xid())
+		}
+	}()
+
+	err = ex.execute(stmt)
+
+	// A read cut short has incomplete results, a write checked before it committed
+	if err == nil && !isWrite(stmt) {
+		err = ex.canceled()
+	}
+
+	if err == ErrStatementTimeout || err == ErrQueryCanceled || err == ErrSessionKilled {
+		ex.ResultSetBuffer = nil
+		ex.result = nil
+
+		if ex.TransactionBegun {
+			ex.abort()
+		}
+	}
+
+	return err
+}
+
+// xid returns the id of the transaction begun, 0 if none
+func (ex *Executor) xid() uint64 {
+	if !ex.TransactionBegun || ex.Transaction == nil {
+		return 0
+	}
+
+	return ex.Transaction.Tx.Xid
+}
+
+// execute executes a statement, the statements within procedures and loops are executed as part of it
+func (ex *Executor) execute(stmt parser.Statement) error {
 
 	// If we are explaining an execution we will create a new plan
 	if ex.explaining {
@@ -128,6 +280,16 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		ex.plan = &Plan{}
 	}
 
+	// A replica only takes writes from its primary's WAL stream
+	if ex.aria.ReadOnly() && !ex.replaying && isWrite(stmt) {
+		return errors.New("cannot write to a read-only replica")
+	}
+
+	// A user whose password expired must change it before anything else
+	if !ex.recover && !ex.replaying && ex.ch != nil && ex.ch.User != nil && !ex.changesOwnPassword(stmt) && ex.aria.Catalog.PasswordExpired(ex.ch.User.Username) {
+		return fmt.Errorf("password expired, change it with ALTER USER %s SET PASSWORD", ex.ch.User.Username)
+	}
+
 	// We will handle the statement based on the type
 	switch s := stmt.(type) {
 	case *parser.BeginStmt:
@@ -141,24 +303,44 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("user does not have the privilege to BEGIN a transaction on system. A user must have BEGIN privilege for specific database")
 		}
 
+		if s.SetTransaction {
+			return ex.setTransaction(s)
+		}
+
 		// Check if transactions already begun
 		if ex.TransactionBegun {
 			return errors.New("transaction already begun")
 		}
 
-		// Set transaction begun flag
-		ex.TransactionBegun = true
+		// SET TRANSACTION outside of a transaction chose the isolation level of this one
+		if s.IsolationLevel == 0 && ex.isolation != 0 {
+			s = &parser.BeginStmt{IsolationLevel: ex.isolation}
+		}
 
-		ex.Transaction = &Transaction{Statements: []*TransactionStmt{}} // Initialize the transaction
+		ex.isolation = 0
 
 		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
+		if err != nil {
+			return err
+		}
+
+		// The transaction reads from a snapshot taken now and its writes stay invisible to others until it commits
+		tx, err := ex.aria.Transactions.Begin(ex.isolationLevel(s.IsolationLevel))
 		if err != nil {
 			return err
 		}
 
+		// Set transaction begun flag
+		ex.TransactionBegun = true
+
+		ex.Transaction = &Transaction{Statements: []*TransactionStmt{}, Tx: tx} // Initialize the transaction
+
 		return nil
 	case *parser.RollbackStmt: // Rollback statement
+		if s.Prepared != nil {
+			return ex.rollbackPrepared(s)
+		}
 
 		// Check if a database is selected
 		if ex.ch.Database == nil {
@@ -175,8 +357,12 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("no transaction begun")
 		}
 
+		if s.Savepoint != nil {
+			return ex.rollbackTo(s)
+		}
+
 		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
@@ -188,186 +374,104 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		return nil
-	case *parser.CommitStmt:
-		// Check if a database is selected
-		if ex.ch.Database == nil {
-			return errors.New("no database selected")
-		}
-
-		// Check user has the privilege to commit
-		if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, "*", []shared.PrivilegeAction{shared.PRIV_COMMIT}) {
-			return errors.New("user does not have the privilege to COMMIT transactions on system. A user must have COMMIT privilege for specific database")
+	case *parser.SavepointStmt:
+		// Check if transaction has begun
+		if !ex.TransactionBegun {
+			return errors.New("no transaction begun")
 		}
 
 		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
 
-		// Transactions are made up of INSERT, UPDATE, DELETE statements
-		for j, tx := range ex.Transaction.Statements {
-			switch ss := tx.Stmt.(type) {
-			case *parser.DeleteStmt: // Execute delete statement
-
-				// Check if a database is selected
-				if ex.ch.Database == nil {
-					// If somehow nil, rollback the transaction
-					err := ex.rollback() // Rollback the transaction
-					if err != nil {
-						return err
-
-					}
-					return errors.New("no database selected")
-
-				}
-
-				// Execute the delete statement
-				// Gather deleted rowIds and deleted rows in case of rollback
-				rowIds, deletedRows, err := ex.executeDeleteStmt(ss)
-				if err != nil {
-					// If an error occurs, rollback the transaction
-					err = ex.rollback()
-					if err != nil {
-						return err
-					}
-				}
-
-				if ex.TransactionBegun { // If transaction has begun
-
-					for i, r := range deletedRows {
-						// Append the row to the rollback data
-						ex.Transaction.Statements[j].Rollback.Rows = append(ex.Transaction.Statements[len(ex.Transaction.Statements)-1].Rollback.Rows, &Before{
-							RowId: rowIds[i],
-							Row:   r,
-						})
-					}
-				}
-
-				continue
-			case *parser.UpdateStmt:
-
-				// Check if a database is selected
-				if ex.ch.Database == nil {
-					if j > 0 {
-						// rollback
-						err := ex.rollback()
-						if err != nil {
-							return err
-						}
-					}
-					return errors.New("no database selected")
+		ex.Transaction.Savepoints = append(ex.Transaction.Savepoints, &Savepoint{
+			Name:       s.Name.Value,
+			Statements: len(ex.Transaction.Statements),
+			Versions:   len(ex.Transaction.Versions),
+			Changes:    len(ex.changes),
+			Tables:     len(ex.Transaction.Tables),
+		})
 
-				}
+		return nil
+	case *parser.ReleaseSavepointStmt:
+		// Check if transaction has begun
+		if !ex.TransactionBegun {
+			return errors.New("no transaction begun")
+		}
 
-				// We get updated rowIds and previous row data in case of rollback
-				rowIds, updatedRows, err := ex.executeUpdateStmt(ss)
-				if err != nil {
-					// If an error occurs, rollback the transaction
-					err = ex.rollback()
-					if err != nil {
-						return err
-					}
-					return err
-				}
+		i := ex.Transaction.savepoint(s.Name.Value)
+		if i < 0 {
+			return errors.New("savepoint does not exist")
+		}
 
-				if ex.TransactionBegun {
-					// Append the updated rows to the rollback data
-					for i, _ := range updatedRows {
-						ex.Transaction.Statements[j].Rollback.Rows = append(ex.Transaction.Statements[len(ex.Transaction.Statements)-1].Rollback.Rows, &Before{
-							RowId: rowIds[i],
-							Row:   updatedRows[i],
-						})
-					}
-				}
+		// Append to wal
+		err := ex.appendWAL(s)
+		if err != nil {
+			return err
+		}
 
-				continue
-			case *parser.InsertStmt:
+		// The savepoint and the ones set after it are gone, what was done since stays part of the transaction
+		ex.Transaction.Savepoints = ex.Transaction.Savepoints[:i]
 
-				// Check if database is nil, cannot be nil
-				if ex.ch.Database == nil {
-					if j > 0 {
-						// rollback
-						err := ex.rollback()
-						if err != nil {
-							return err
-						}
-					}
+		return nil
+	case *parser.PrepareTransactionStmt:
+		// Check if transaction has begun
+		if !ex.TransactionBegun {
+			return errors.New("no transaction begun")
+		}
 
-					return errors.New("no database selected")
-				}
+		// A transaction which cannot be prepared is rolled back
+		err := ex.prepare(s)
+		if err != nil {
+			ex.abort()
+			return err
+		}
 
-				// Get table for insert
-				tbl := ex.ch.Database.GetTable(ss.TableName.Value)
-				if tbl == nil {
-					if j > 0 {
-						// rollback
-						err := ex.rollback()
-						if err != nil {
-							return err
-						}
-					}
-					return errors.New("table does not exist")
-				}
+		return ex.syncWAL()
+	case *parser.CommitStmt:
+		if s.Prepared != nil {
+			return ex.commitPrepared(s)
+		}
 
-				// Check if user has the privilege to insert into the table
-				if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, tbl.Name, []shared.PrivilegeAction{shared.PRIV_INSERT}) {
-					if j > 0 {
-						// rollback
-						err := ex.rollback()
-						if err != nil {
-							return err
-						}
-					}
-					return errors.New("user does not have the privilege to INSERT on system for database " + ex.ch.Database.Name + " and table " + ss.TableName.Value)
-				}
+		// Check if a database is selected
+		if ex.ch.Database == nil {
+			return errors.New("no database selected")
+		}
 
-				// Rows to be inserted
-				var rows []map[string]interface{}
+		// Check user has the privilege to commit
+		if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, "*", []shared.PrivilegeAction{shared.PRIV_COMMIT}) {
+			return errors.New("user does not have the privilege to COMMIT transactions on system. A user must have COMMIT privilege for specific database")
+		}
 
-				// Populate new row based on the insert statement
-				for _, row := range ss.Values {
-					newRow := map[string]interface{}{}
-					for i, col := range ss.ColumnNames {
-						switch row[i].(type) {
-						case *parser.Literal:
-							newRow[col.Value] = row[i].(*parser.Literal).Value
-						case *shared.GenUUID, *shared.SysDate, *shared.SysTime, *shared.SysTimestamp: // If system function
-							newRow[col.Value] = row[i]
-						}
+		// Check if transaction has begun
+		if !ex.TransactionBegun {
+			return errors.New("no transaction begun")
+		}
 
-					}
-					rows = append(rows, newRow)
+		// The commit record is logged before the transaction's changes become visible, a transaction without one is undone on recovery
+		// A serializable transaction which cannot commit is rolled back, so are its statements when the WAL is replayed
+		err := ex.commit(s)
+		if err != nil {
+			ex.abort()
+			return err
+		}
 
-				}
+		err = ex.syncWAL()
+		if err != nil {
+			return err
+		}
 
-				// We get inserted rowIds and inserted rows in case of rollback
-				rowIds, insertedRows, err := tbl.Insert(rows, ex.ch.Database)
-				if err != nil {
-					if j > 0 {
-						// rollback
-						err := ex.rollback()
-						if err != nil {
-							return err
-						}
-					}
-					return err
-				}
+		commit := ex.lastRecord
 
-				for i, rowId := range rowIds {
-					ex.Transaction.Statements[j].Rollback.Rows = append(ex.Transaction.Statements[len(ex.Transaction.Statements)-1].Rollback.Rows, &Before{
-						RowId: rowId,
-						Row:   insertedRows[i],
-					})
-				}
+		ex.publishChanges(commit)
 
-				continue
-			}
+		// With synchronous replication the commit returns once enough replicas received its records
+		if !ex.replaying && commit != nil {
+			return ex.aria.WaitForReplicas(commit.LSN, ex.synchronousReplicas())
 		}
 
-		// Transaction has been commited
-		ex.TransactionBegun = false // Reset transaction begun flag
-
 		return nil
 	case *parser.CreateDatabaseStmt:
 		if !ex.recover { // If not recovering from WAL, check if user has the privilege to create a database
@@ -381,14 +485,14 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("statement not allowed in a transaction")
 		}
 
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		// Create the database
+		err := ex.aria.Catalog.CreateDatabase(s.Name.Value)
 		if err != nil {
 			return err
 		}
 
-		// Create the database
-		return ex.aria.Catalog.CreateDatabase(s.Name.Value)
+		// The statement is logged once it succeeded, a statement which failed is never streamed to replicas
+		return ex.appendWAL(s)
 	case *parser.CreateTableStmt:
 
 		// Check if a database is selected
@@ -402,16 +506,6 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 		}
 
-		if ex.TransactionBegun {
-			return errors.New("statement not allowed in a transaction")
-		}
-
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
 		var encKey string
 
 		if s.EncryptKey != nil {
@@ -422,12 +516,9 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		// Create the table
-		err = ex.ch.Database.CreateTable(s.TableName.Value, s.TableSchema, s.Encrypt, s.Compress, []byte(encKey))
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return ex.changeTable(s, s.TableName.Value, func(*catalog.Table) error {
+			return ex.ch.Database.CreateTable(s.TableName.Value, s.TableSchema, s.Encrypt, s.Compress, []byte(encKey))
+		})
 
 	case *parser.DropTableStmt:
 		// Check if a database is selected
@@ -441,44 +532,21 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 		}
 
-		if ex.TransactionBegun {
-			return errors.New("statement not allowed in a transaction")
-		}
-
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
 		// Drop the table
-		err = ex.ch.Database.DropTable(s.TableName.Value)
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return ex.changeTable(s, s.TableName.Value, func(*catalog.Table) error {
+			return ex.ch.Database.DropTable(s.TableName.Value)
+		})
 	case *parser.CreateIndexStmt:
 		if ex.ch.Database == nil {
 			return errors.New("no database selected")
 		}
 
-		if ex.TransactionBegun {
-			return errors.New("statement not allowed in a transaction")
-		}
-
 		if !ex.recover { // If not recovering from WAL
 			if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, "*", []shared.PrivilegeAction{shared.PRIV_CREATE}) {
 				return errors.New("user does not have the privilege to CREATE on system for database " + ex.ch.Database.Name)
 			}
 		}
 
-		// Get the table
-		tbl := ex.ch.Database.GetTable(s.TableName.Value)
-		if tbl == nil {
-			return errors.New("table does not exist")
-		}
-
 		var columns []string // Columns to create index on
 
 		// convert *parser.Identifier to []string
@@ -486,19 +554,14 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			columns = append(columns, col.Value)
 		}
 
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
 		// Create the index
-		err = tbl.CreateIndex(s.IndexName.Value, columns, s.Unique)
-		if err != nil {
-			return err
-		}
+		return ex.changeTable(s, s.TableName.Value, func(tbl *catalog.Table) error {
+			if tbl == nil {
+				return errors.New("table does not exist")
+			}
 
-		return nil
+			return tbl.CreateIndex(s.IndexName.Value, columns, s.Unique)
+		})
 	case *parser.DropIndexStmt:
 
 		// Check if a database is selected
@@ -506,35 +569,20 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("no database selected")
 		}
 
-		if ex.TransactionBegun {
-			return errors.New("statement not allowed in a transaction")
-		}
-
 		if !ex.recover { // If not recovering from WAL
 			if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, "*", []shared.PrivilegeAction{shared.PRIV_CREATE}) {
 				return errors.New("user does not have the privilege to DROP on system for database " + ex.ch.Database.Name)
 			}
 		}
 
-		// Get the table
-		tbl := ex.ch.Database.GetTable(s.TableName.Value)
-		if tbl == nil {
-			return errors.New("table does not exist")
-		}
-
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
 		// Drop the index
-		err = tbl.DropIndex(s.IndexName.Value)
-		if err != nil {
-			return err
-		}
+		return ex.changeTable(s, s.TableName.Value, func(tbl *catalog.Table) error {
+			if tbl == nil {
+				return errors.New("table does not exist")
+			}
 
-		return nil
+			return tbl.DropIndex(s.IndexName.Value)
+		})
 	case *parser.InsertStmt:
 
 		// Check if a database is selected
@@ -554,12 +602,6 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 		}
 
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(stmt))
-		if err != nil {
-			return err
-		}
-
 		// Rows to be inserted
 		var rows []map[string]interface{}
 
@@ -592,22 +634,31 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 				}
 			}
 		}
-		if ex.TransactionBegun { // if transaction has begun we append the statement to the transaction
-			ex.Transaction.Statements = append(ex.Transaction.Statements, &TransactionStmt{
-				Id:       len(ex.Transaction.Statements),
-				Stmt:     s,
-				Commited: false,
-				Rollback: &Rollback{Rows: []*Before{}},
-			})
-		} else {
+		return ex.transact(s, func() error {
+			// Inserts wait for tables locked with LOCK TABLE
+			err := ex.lock(s.TableName.Value, lock.TABLE, lock.INTENTION_EXCLUSIVE, parser.LOCK_WAIT)
+			if err != nil {
+				return err
+			}
+
+			rowIds, inserted, err := tbl.InsertVersions(rows, ex.ch.Database, ex.Transaction.Tx.Snapshot)
+
+			// Rows inserted before an error are undone along with the statement
+			for _, rowId := range rowIds {
+				ex.Transaction.Versions = append(ex.Transaction.Versions, &Version{Table: tbl, RowId: rowId, Inserted: true})
+			}
 
-			_, _, err = tbl.Insert(rows, ex.ch.Database)
 			if err != nil {
 				return err
 			}
-		}
 
-		return nil
+			for _, row := range inserted {
+				ex.captureChange(tbl, cdc.OP_INSERT, nil, row)
+			}
+
+			// The statement is logged once it has its table locked, after the transactions it waited for
+			return ex.appendWAL(s)
+		})
 	case *parser.UseStmt:
 		// Get the database
 		db := ex.aria.Catalog.GetDatabase(s.DatabaseName.Value)
@@ -620,7 +671,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
@@ -640,14 +691,14 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 		}
 
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		// Drop the database
+		err := ex.aria.Catalog.DropDatabase(s.Name.Value)
 		if err != nil {
 			return err
 		}
 
-		// Drop the database
-		err = ex.aria.Catalog.DropDatabase(s.Name.Value)
+		// Append the statement to the WAL file
+		err = ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
@@ -665,18 +716,38 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("no database selected")
 		}
 
-		// Check if transaction has begun
-		if ex.TransactionBegun {
-			return errors.New("statement not allowed in a transaction")
-		}
-
 		// Execute the select statement
-		_, err := ex.executeSelectStmt(s, false)
-		if err != nil {
+		return ex.transact(nil, func() error {
+			_, err := ex.executeSelectStmt(s, false)
 			return err
+		})
+	case *parser.LockTableStmt:
+		// Check if a database is selected
+		if ex.ch.Database == nil {
+			return errors.New("no database selected")
 		}
 
-		return nil
+		if ex.ch.Database.GetTable(s.TableName.Value) == nil {
+			return errors.New("table does not exist")
+		}
+
+		// The lock is held until the transaction ends, without one it would be released right away
+		if !ex.TransactionBegun {
+			return errors.New("LOCK TABLE can only be used within a transaction")
+		}
+
+		mode, action := lock.SHARED, shared.PRIV_SELECT
+		if s.Mode == parser.LOCK_EXCLUSIVE {
+			mode, action = lock.EXCLUSIVE, shared.PRIV_UPDATE
+		}
+
+		if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, s.TableName.Value, []shared.PrivilegeAction{action}) {
+			return errors.New("user does not have the privilege to LOCK table " + s.TableName.Value)
+		}
+
+		return ex.transact(nil, func() error {
+			return ex.lock(s.TableName.Value, lock.TABLE, mode, parser.LOCK_WAIT)
+		})
 	case *parser.UpdateStmt:
 
 		// Check if a database is selected
@@ -685,28 +756,15 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 
 		}
 
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
-		if ex.TransactionBegun { // If transaction has begun we append the statement to the transaction
-			ex.Transaction.Statements = append(ex.Transaction.Statements, &TransactionStmt{
-				Id:       len(ex.Transaction.Statements),
-				Stmt:     s,
-				Commited: false,
-				Rollback: &Rollback{Rows: []*Before{}},
-			})
-		} else {
-
-			_, _, err = ex.executeUpdateStmt(s)
+		return ex.transact(s, func() error {
+			_, _, err := ex.executeUpdateStmt(s)
 			if err != nil {
 				return err
 			}
-		}
 
-		return nil
+			// The statement is logged once it has its rows locked, after the transactions it waited for
+			return ex.appendWAL(s)
+		})
 
 	case *parser.DeleteStmt:
 
@@ -716,29 +774,16 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 
 		}
 
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
-		if ex.TransactionBegun { // If transaction has begun we append the statement to the transaction
-			ex.Transaction.Statements = append(ex.Transaction.Statements, &TransactionStmt{
-				Id:       len(ex.Transaction.Statements),
-				Stmt:     s,
-				Commited: false,
-				Rollback: &Rollback{Rows: []*Before{}},
-			})
-		} else {
-
-			_, _, err = ex.executeDeleteStmt(s)
+		return ex.transact(s, func() error {
+			_, _, err := ex.executeDeleteStmt(s)
 			if err != nil {
 				return err
 			}
 
-		}
+			// The statement is logged once it has its rows locked, after the transactions it waited for
+			return ex.appendWAL(s)
+		})
 
-		return nil
 	case *parser.CreateUserStmt:
 		if !ex.recover { // If not recovering from WAL
 			if !ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_CREATE}) {
@@ -751,19 +796,27 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("statement not allowed in a transaction")
 		}
 
-		// Append the statement to the WAL file
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
+		// A password logged before the rules changed is replayed as it was
+		if !ex.recover && s.Password != nil {
+			err := ex.aria.Catalog.CheckPassword(s.Password.Value.(string))
+			if err != nil {
+				return err
+			}
 		}
 
 		// Create the user
-		err = ex.aria.Catalog.CreateNewUser(s.Username.Value, s.Password.Value.(string))
+		var err error
+		if s.Certificate != nil {
+			err = ex.aria.Catalog.CreateNewCertificateUser(s.Username.Value, s.Certificate.Value.(string))
+		} else {
+			err = ex.aria.Catalog.CreateNewUser(s.Username.Value, s.Password.Value.(string))
+		}
 		if err != nil {
 			return err
 		}
 
-		return nil
+		// Append the statement to the WAL file
+		return ex.appendWAL(s)
 
 	case *parser.DropUserStmt:
 		if !ex.recover { // If not recovering from WAL
@@ -777,17 +830,12 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("statement not allowed in a transaction")
 		}
 
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
-		err = ex.aria.Catalog.DropUser(s.Username.Value)
+		err := ex.aria.Catalog.DropUser(s.Username.Value)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		return ex.appendWAL(s)
 
 	case *parser.GrantStmt:
 
@@ -834,17 +882,12 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 		}
 
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.aria.Catalog.GrantPrivilegeToUser(s.PrivilegeDefinition.Grantee.Value, priv)
 		if err != nil {
 			return err
 		}
 
-		err = ex.aria.Catalog.GrantPrivilegeToUser(s.PrivilegeDefinition.Grantee.Value, priv)
-		if err != nil {
-			return err
-		}
-
-		return nil
+		return ex.appendWAL(s)
 
 	case *parser.RevokeStmt:
 		if !ex.recover { // If not recovering from WAL
@@ -889,17 +932,12 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 		}
 
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
-		err = ex.aria.Catalog.RevokePrivilegeFromUser(s.PrivilegeDefinition.Revokee.Value, priv)
+		err := ex.aria.Catalog.RevokePrivilegeFromUser(s.PrivilegeDefinition.Revokee.Value, priv)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		return ex.appendWAL(s)
 
 	case *parser.ShowStmt:
 
@@ -923,14 +961,9 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 				results[i] = map[string]interface{}{"User": user, "Grants": strings.Join(privs, ",")}
 			}
 
-			if !ex.json {
-				ex.ResultSetBuffer = shared.CreateTableByteArray(results, shared.GetHeaders(results, true))
-			} else {
-				var err error
-				ex.ResultSetBuffer, err = shared.CreateJSONByteArray(results)
-				if err != nil {
-					return err
-				}
+			err := ex.setResultSet(results, nil)
+			if err != nil {
+				return err
 			}
 			return nil
 		case parser.SHOW_INDEXES:
@@ -969,15 +1002,9 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 				results[i] = map[string]interface{}{"Database": db}
 			}
 
-			if !ex.json {
-				ex.ResultSetBuffer = shared.CreateTableByteArray(results, shared.GetHeaders(results, true))
-			} else {
-				var err error
-				shared.RemoveSingleQuotesFromResult(&results)
-				ex.ResultSetBuffer, err = shared.CreateJSONByteArray(results)
-				if err != nil {
-					return err
-				}
+			err := ex.setResultSet(results, nil)
+			if err != nil {
+				return err
 			}
 			return nil
 		case parser.SHOW_TABLES:
@@ -992,15 +1019,9 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 				results[i] = map[string]interface{}{"Table": db}
 			}
 
-			if !ex.json {
-				ex.ResultSetBuffer = shared.CreateTableByteArray(results, shared.GetHeaders(results, true))
-			} else {
-				var err error
-				shared.RemoveSingleQuotesFromResult(&results)
-				ex.ResultSetBuffer, err = shared.CreateJSONByteArray(results)
-				if err != nil {
-					return err
-				}
+			err := ex.setResultSet(results, nil)
+			if err != nil {
+				return err
 			}
 
 			return nil
@@ -1019,15 +1040,97 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 				results[i] = map[string]interface{}{"User": db}
 			}
 
-			if !ex.json {
-				ex.ResultSetBuffer = shared.CreateTableByteArray(results, shared.GetHeaders(results, true))
-			} else {
-				var err error
-				shared.RemoveSingleQuotesFromResult(&results)
-				ex.ResultSetBuffer, err = shared.CreateJSONByteArray(results)
-				if err != nil {
-					return err
+			err := ex.setResultSet(results, nil)
+			if err != nil {
+				return err
+			}
+
+			return nil
+		case parser.SHOW_LOCKS:
+
+			if !ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_SHOW}) {
+				return errors.New("user does not have the privilege to SHOW on system") // system wide privilege
+			}
+
+			locks := ex.aria.Locks.Locks()
+
+			results := make([]map[string]interface{}, len(locks))
+
+			// Waits come first, with the transactions they wait for
+			for i, l := range locks {
+				waitingFor := make([]string, len(l.WaitingFor))
+				for j, xid := range l.WaitingFor {
+					waitingFor[j] = strconv.FormatUint(xid, 10)
+				}
+
+				results[i] = map[string]interface{}{
+					"Transaction": l.Owner,
+					"Table":       l.Resource.Table,
+					"Row":         l.Resource.RowId,
+					"Mode":        l.Mode.String(),
+					"Granted":     l.Granted,
+					"WaitingFor":  strings.Join(waitingFor, ", "),
+					"Waited":      l.Waited.Round(time.Millisecond).String(),
+				}
+			}
+
+			err := ex.setResultSet(results, []string{"Transaction", "Table", "Row", "Mode", "Granted", "WaitingFor", "Waited"})
+			if err != nil {
+				return err
+			}
+
+			return nil
+		case parser.SHOW_PREPARED_TRANSACTIONS:
+
+			if !ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_SHOW}) {
+				return errors.New("user does not have the privilege to SHOW on system") // system wide privilege
+			}
+
+			prepared := ex.aria.PreparedTransactions()
+
+			results := make([]map[string]interface{}, len(prepared))
+
+			for i, p := range prepared {
+				results[i] = map[string]interface{}{
+					"Gid":         p.Gid,
+					"Transaction": p.Tx.Xid,
+					"Prepared":    p.Prepared.Format(time.RFC3339),
+					"Owner":       p.Owner,
+					"Database":    p.Database,
+				}
+			}
+
+			err := ex.setResultSet(results, []string{"Gid", "Transaction", "Prepared", "Owner", "Database"})
+			if err != nil {
+				return err
+			}
+
+			return nil
+		case parser.SHOW_PROCESSLIST:
+			// Without the system wide SHOW privilege users only see their own channels
+			all := ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_SHOW})
+
+			results := []map[string]interface{}{}
+
+			for _, p := range ex.aria.Processes() {
+				if !all && p.User != ex.ch.User.Username {
+					continue
 				}
+
+				results = append(results, map[string]interface{}{
+					"Id":          p.ChannelID,
+					"User":        p.User,
+					"Database":    p.Database,
+					"Statement":   p.Statement,
+					"Elapsed":     p.Elapsed.Round(time.Millisecond).String(),
+					"Transaction": p.Transaction,
+					"State":       p.State,
+				})
+			}
+
+			err := ex.setResultSet(results, []string{"Id", "User", "Database", "Statement", "Elapsed", "Transaction", "State"})
+			if err != nil {
+				return err
 			}
 
 			return nil
@@ -1036,7 +1139,8 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 	case *parser.AlterUserStmt:
 		if !ex.recover { // If not recovering from WAL
-			if !ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_ALTER}) {
+			// Users change their own password without it
+			if !ex.changesOwnPassword(s) && !ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_ALTER}) {
 				return errors.New("user does not have the privilege to ALTER on system") // Altering a user just requires an ALTER privilege system wide
 			}
 		}
@@ -1046,22 +1150,39 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		if s.SetType == parser.ALTER_USER_SET_PASSWORD {
-			err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+			if !ex.recover {
+				err := ex.aria.Catalog.CheckPassword(s.Value.Value.(string))
+				if err != nil {
+					return err
+				}
+			}
+
+			err := ex.aria.Catalog.AlterUserPassword(s.Username.Value, s.Value.Value.(string))
 			if err != nil {
 				return err
 			}
 
-			err = ex.aria.Catalog.AlterUserPassword(s.Username.Value, s.Value.Value.(string))
+			err = ex.appendWAL(s)
 			if err != nil {
 				return err
 			}
 		} else if s.SetType == parser.ALTER_USER_SET_USERNAME {
-			err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+			err := ex.aria.Catalog.AlterUserUsername(s.Username.Value, s.Value.Value.(string))
+			if err != nil {
+				return err
+			}
+
+			err = ex.appendWAL(s)
+			if err != nil {
+				return err
+			}
+		} else if s.SetType == parser.ALTER_USER_ACCOUNT_LOCK || s.SetType == parser.ALTER_USER_ACCOUNT_UNLOCK {
+			err := ex.aria.Catalog.LockUser(s.Username.Value, s.SetType == parser.ALTER_USER_ACCOUNT_LOCK)
 			if err != nil {
 				return err
 			}
 
-			err = ex.aria.Catalog.AlterUserUsername(s.Username.Value, s.Value.Value.(string))
+			err = ex.appendWAL(s)
 			if err != nil {
 				return err
 			}
@@ -1077,15 +1198,20 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
 
 		// Keep executing until error
 		for ex.fetchStatus.Load() == int32(s.FetchStatus.Value.(uint64)) {
+			err = ex.canceled()
+			if err != nil {
+				return err
+			}
+
 			for _, cursorStmt := range s.Stmts.Stmts {
-				err := ex.Execute(cursorStmt)
+				err := ex.execute(cursorStmt)
 				if err != nil {
 					return err
 				}
@@ -1119,13 +1245,24 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		cursor := ex.cursors[s.CursorName.Value]
 
 		// Append to wal
-		err = ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err = ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
 
 		// Execute the select statement
-		r, err := ex.executeSelectStmt(cursor.statement, true)
+		var r []map[string]interface{}
+		if cursor.tx != nil {
+			// Every fetch reads the rows as they were when the cursor was opened
+			ex.Transaction = &Transaction{Tx: cursor.tx}
+			r, err = ex.executeSelectStmt(cursor.statement, true)
+			ex.Transaction = nil
+		} else {
+			err = ex.transact(nil, func() error {
+				r, err = ex.executeSelectStmt(cursor.statement, true)
+				return err
+			})
+		}
 		if err != nil {
 			return err
 		}
@@ -1221,7 +1358,16 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
+		if err != nil {
+			return err
+		}
+
+		if cursor.tx != nil {
+			ex.aria.Transactions.Commit(cursor.tx)
+		}
+
+		cursor.tx, err = ex.aria.Transactions.Begin(mvcc.REPEATABLE_READ)
 		if err != nil {
 			return err
 		}
@@ -1243,7 +1389,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		switch s.Expr.(type) {
 		case *parser.Literal:
 			// Append to wal
-			err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+			err := ex.appendWAL(s)
 			if err != nil {
 				return err
 			}
@@ -1260,7 +1406,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 
 			// Append to wal
-			err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+			err := ex.appendWAL(s)
 			if err != nil {
 				return err
 			}
@@ -1318,7 +1464,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			}
 
 			// Append to wal
-			err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+			err := ex.appendWAL(s)
 			if err != nil {
 				return err
 			}
@@ -1347,7 +1493,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			ex.vars[s.CursorVariableName.Value] = &Variable{DataType: s.CursorVariableDataType.Value, Value: nil}
 
 			// Append to wal
-			err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+			err := ex.appendWAL(s)
 			if err != nil {
 				return err
 			}
@@ -1376,10 +1522,10 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("cursor does not exist")
 		}
 
-		delete(ex.cursors, s.CursorName.Value) // delete the cursor
+		ex.closeCursor(s.CursorName.Value) // delete the cursor
 
 		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
@@ -1407,7 +1553,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 				return errors.New("cursor does not exist")
 			}
 
-			delete(ex.cursors, s.CursorName.Value) // delete the cursor
+			ex.closeCursor(s.CursorName.Value) // delete the cursor
 		} else if s.CursorVariableName != nil {
 			if ex.vars == nil {
 				return errors.New("no variables")
@@ -1421,7 +1567,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err := ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
@@ -1437,19 +1583,14 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("statement not allowed in a transaction")
 		}
 
-		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
 		// Drop the procedure
-		err = ex.ch.Database.DropProcedure(s.ProcedureName.Value)
+		err := ex.ch.Database.DropProcedure(s.ProcedureName.Value)
 		if err != nil {
 			return err
 		}
 
-		return nil
+		// Append to wal
+		return ex.appendWAL(s)
 
 	case *parser.CreateProcedureStmt:
 		// Check if a database is selected
@@ -1462,14 +1603,8 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("statement not allowed in a transaction")
 		}
 
-		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
 		// Add the procedure to the database
-		err = ex.ch.Database.AddProcedure(&catalog.Procedure{
+		err := ex.ch.Database.AddProcedure(&catalog.Procedure{
 			Name: s.Procedure.Name.Value,
 			Proc: s.Procedure,
 		})
@@ -1477,7 +1612,8 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return err
 		}
 
-		return nil
+		// Append to wal
+		return ex.appendWAL(s)
 
 	case *parser.ExecStmt:
 		// Check if a database is selected
@@ -1523,14 +1659,19 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		}
 
 		// Append to wal
-		err = ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
+		err = ex.appendWAL(s)
 		if err != nil {
 			return err
 		}
 
 		// Execute the procedure
 		for _, ss := range proc.Proc.(*parser.Procedure).Body.Stmts {
-			err := ex.Execute(ss)
+			err = ex.canceled()
+			if err != nil {
+				return err
+			}
+
+			err = ex.execute(ss)
 			if err != nil {
 				return err
 			}
@@ -1544,6 +1685,47 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 
 		return nil
 
+	case *parser.SetStmt:
+		// Session settings last as long as the channel
+		return ex.setSetting(s)
+	case *parser.KillStmt:
+		ch := ex.aria.GetChannel(s.ChannelID)
+		if ch == nil {
+			return errors.New("channel does not exist")
+		}
+
+		// Users can stop their own channels, the channels of others take ALL privileges system wide
+		if ch.User == nil || ch.User.Username != ex.ch.User.Username {
+			if !ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_ALL}) {
+				return errors.New("user does not have the privilege to KILL channels of other users")
+			}
+		}
+
+		if s.Query {
+			if !ch.Cancel(ErrQueryCanceled) {
+				return errors.New("channel is not executing a statement")
+			}
+
+			return nil
+		}
+
+		ch.Kill(ErrSessionKilled)
+
+		return nil
+	case *parser.SubscribeStmt:
+		return errors.New("SUBSCRIBE streams changes over a server connection")
+	case *parser.PromoteStmt:
+		if !ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_ALL}) {
+			return errors.New("user does not have the privilege to PROMOTE on system")
+		}
+
+		// The replica stops applying its primary's stream and takes writes on a new timeline
+		_, err := ex.aria.Promote()
+		if err != nil {
+			return err
+		}
+
+		return nil
 	case *parser.ExplainStmt:
 		// Check if a database is selected
 		if ex.ch.Database == nil {
@@ -1558,7 +1740,7 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 		ex.explaining = true // Set explaining flag to true
 
 		// Execute the statement
-		err := ex.Execute(s.Stmt)
+		err := ex.execute(s.Stmt)
 		if err != nil {
 			return err
 		}
@@ -1577,25 +1759,14 @@ func (ex *Executor) Execute(stmt parser.Statement) error {
 			return errors.New("user does not have the privilege to ALTER on table " + s.TableName.Value)
 		}
 
-		// Append to wal
-		err := ex.aria.WAL.Append(ex.aria.WAL.Encode(s))
-		if err != nil {
-			return err
-		}
-
-		// Get the table
-		table := ex.ch.Database.GetTable(s.TableName.Value)
-		if table == nil {
-			return errors.New("table does not exist")
-
-		}
-
 		// Alter the table
-		err = table.Alter(s.ColumnName.Value, s.ColumnDefinition)
-		if err != nil {
-			return err
-		}
+		return ex.changeTable(s, s.TableName.Value, func(table *catalog.Table) error {
+			if table == nil {
+				return errors.New("table does not exist")
+			}
 
+			return table.Alter(s.ColumnName.Value, s.ColumnDefinition)
+		})
 	default:
 		return errors.New("unsupported statement " + reflect.TypeOf(s).String())
 
@@ -1677,10 +1848,24 @@ func (ex *Executor) executeSelectStmt(stmt *parser.SelectStmt, subquery bool) ([
 			return nil, errors.New("no tables")
 		} // You can't do this!!  There should be tables
 
-		// search reads tables, the where condition and gathers the rows based on that
-		// search will also evaluate joins, subqueries, and other predicates
-		// if the column in a predicate is indexed, we can use the index to locate rows faster to evaluate
-		rows, err := ex.search(tbles, stmt.TableExpression.WhereClause, nil, false, nil, nil)
+		var rows []map[string]interface{}
+		var err error
+
+		// The rows of a plain SELECT are written as they are read if the session streams them
+		if ex.rowWriter != nil && !subquery && !ex.explaining && streamable(stmt) {
+			ex.streaming = &rowStream{selectList: stmt.SelectList}
+			defer func() { ex.streaming = nil }()
+		}
+
+		if stmt.LockingClause != nil {
+			// The rows read are locked until the transaction ends
+			rows, err = ex.lockRows(stmt, tbles, subquery)
+		} else {
+			// search reads tables, the where condition and gathers the rows based on that
+			// search will also evaluate joins, subqueries, and other predicates
+			// if the column in a predicate is indexed, we can use the index to locate rows faster to evaluate
+			rows, err = ex.search(tbles, stmt.TableExpression.WhereClause, nil, false, nil, nil)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -1689,10 +1874,23 @@ func (ex *Executor) executeSelectStmt(stmt *parser.SelectStmt, subquery bool) ([
 			return nil, nil
 		}
 
-		// Pass rows to result set
-		results = rows
+		if ex.streaming != nil {
+			// The rows of the last batch, the columns are written even if no row was read
+			err = ex.writeRows(&rows)
+			if err != nil {
+				return nil, err
+			}
 
-		//If there is a group by clause
+			ex.ResultSetBuffer = nil
+			ex.result = &Result{Columns: ex.streaming.columns, Streamed: ex.streaming.written}
+
+			return nil, nil
+		}
+
+		// Pass rows to result set
+		results = rows
+
+		//If there is a group by clause
 		if stmt.TableExpression.GroupByClause != nil {
 
 			// Group the results
@@ -1803,25 +2001,155 @@ func (ex *Executor) executeSelectStmt(stmt *parser.SelectStmt, subquery bool) ([
 	log.Println(results)
 
 	// Now we format the results
-	if !ex.json {
-		if len(headers) == 0 {
-			ex.ResultSetBuffer = shared.CreateTableByteArray(results, shared.GetHeaders(results, true))
-		} else {
-			ex.ResultSetBuffer = shared.CreateTableByteArray(results, headers)
+	err := ex.setResultSet(results, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil // We return rows in result set buffer
+
+}
+
+// formatTimes formats the time values of rows read from tbl as per their column types
+func formatTimes(tbl *catalog.Table, rows []map[string]interface{}) {
+	for i, row := range rows {
+		for k, v := range row {
+			// Check if value is time.Time
+			if _, ok := v.(time.Time); ok {
+
+				// get the column type and format if need be
+				for name, col := range tbl.TableSchema.ColumnDefinitions {
+
+					if name == k {
+						switch col.DataType {
+						case "DATE":
+							rows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("2006-01-02"))
+						case "TIME":
+							rows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("15:04:05"))
+						case "TIMESTAMP":
+							rows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("2006-01-02 15:04:05"))
+						case "DATETIME":
+							rows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("2006-01-02 15:04:05"))
+						}
+					}
+				}
+
+			}
+
+		}
+	}
+}
+
+// lockRows reads the rows of a SELECT ... FOR UPDATE | FOR SHARE and locks them in order, until the rows its limit asks for are locked
+// Rows locked by other transactions are waited for, unless NOWAIT fails the statement or SKIP LOCKED leaves them out
+func (ex *Executor) lockRows(stmt *parser.SelectStmt, tbles []*catalog.Table, subquery bool) ([]map[string]interface{}, error) {
+	if subquery || len(tbles) != 1 || stmt.TableExpression.GroupByClause != nil || stmt.Distinct || stmt.Union != nil {
+		return nil, errors.New("FOR UPDATE and FOR SHARE are only allowed on a single table without GROUP BY, DISTINCT or UNION")
+	}
+
+	table := stmt.TableExpression.FromClause.Tables[0].Name.Value
+
+	mode := lock.SHARED
+	if stmt.LockingClause.Strength == parser.FOR_UPDATE {
+		mode = lock.EXCLUSIVE
 
+		if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, table, []shared.PrivilegeAction{shared.PRIV_UPDATE}) {
+			return nil, errors.New("user does not have the privilege to UPDATE on table " + table)
 		}
+	}
+
+	var rows []map[string]interface{}
+	var rowIds []int64
+	var err error
+
+	if stmt.TableExpression.WhereClause == nil {
+		// Without a condition every row is read, as search reads them
+		if ex.explaining {
+			ex.plan.Steps = append(ex.plan.Steps, &Step{Operation: FULL_SCAN, Table: table, Column: "n/a", IO: tbles[0].IOCount()})
+			return nil, nil
+		}
+
+		iter := ex.scan(tbles[0])
+
+		for iter.Valid() {
+			row, err := iter.Next()
+			if err != nil {
+				continue
+			}
+
+			rows = append(rows, row)
+			rowIds = append(rowIds, iter.Current())
+		}
+
+		formatTimes(tbles[0], rows)
 	} else {
-		var err error
-		shared.RemoveSingleQuotesFromResult(&results)
-		ex.ResultSetBuffer, err = shared.CreateJSONByteArray(results)
+		err = ex.filter(stmt.TableExpression.WhereClause, tbles, &rows, &rowIds)
 		if err != nil {
 			return nil, err
 		}
+	}
 
+	if ex.explaining {
+		return nil, nil
 	}
 
-	return nil, nil // We return rows in result set buffer
+	// Rows are locked in the order they are returned in, their row ids are carried along while sorting
+	for i := range rows {
+		rows[i][ROW_ID] = rowIds[i] - 1
+	}
+
+	rows, err = ex.orderBy(rows, stmt.TableExpression.OrderByClause)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows skipped by the offset are locked as well, as they are read
+	want := len(rows)
+	if stmt.TableExpression.LimitClause != nil && stmt.TableExpression.LimitClause.Count != nil {
+		want = int(stmt.TableExpression.LimitClause.Count.Value.(uint64))
+
+		if stmt.TableExpression.LimitClause.Offset != nil {
+			want += int(stmt.TableExpression.LimitClause.Offset.Value.(uint64))
+		}
+	}
+
+	var locked []map[string]interface{}
+
+	for _, row := range rows {
+		if len(locked) == want {
+			break
+		}
 
+		rowId := row[ROW_ID].(int64)
+		delete(row, ROW_ID)
+
+		err = ex.lockRow(table, rowId, mode, stmt.LockingClause.WaitPolicy)
+		if err == lock.ErrNotAvailable && stmt.LockingClause.WaitPolicy == parser.LOCK_SKIP_LOCKED {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		// The row may have been changed by the transaction which held the lock
+		err = tbles[0].CheckRow(rowId, ex.Transaction.Tx.Snapshot)
+		if err == mvcc.ErrSerialization && stmt.LockingClause.WaitPolicy == parser.LOCK_SKIP_LOCKED {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		locked = append(locked, row)
+	}
+
+	if stmt.TableExpression.WhereClause == nil {
+		formatTimes(tbles[0], locked)
+	}
+
+	return locked, nil
 }
 
 // checkWildcard checks select list for wildcard
@@ -1870,6 +2198,7 @@ func (ex *Executor) executeUpdateStmt(stmt *parser.UpdateStmt) ([]int64, []map[s
 	var rowIds []int64                // Updated row ids
 	var rows []map[string]interface{} // Rows to update
 	var updatedRows int
+	var updated []int64        // Row ids of the new versions
 	var tbles []*catalog.Table // Table list
 
 	tbles = append(tbles, ex.ch.Database.GetTable(stmt.TableName.Value))
@@ -1896,36 +2225,47 @@ func (ex *Executor) executeUpdateStmt(stmt *parser.UpdateStmt) ([]int64, []map[s
 		setClause := convertSetClauseToCatalogLike(&stmt.SetClause, &row)
 
 		if i < len(rowIds) {
-			if rowIds[i] == 0 {
-				err = tbles[0].UpdateRow(rowIds[i], row, setClause)
-				if err != nil {
-					return nil, nil, err
-				}
-				updatedRows++
-			} else {
-				err = tbles[0].UpdateRow(rowIds[i]-1, row, setClause)
-				if err != nil {
-					return nil, nil, err
-				}
-				updatedRows++
+			err = ex.lockRow(stmt.TableName.Value, rowIds[i]-1, lock.EXCLUSIVE, parser.LOCK_WAIT)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			before := catalog.CopyRow(&row)
+
+			// The current version is expired and the updated row written as a new version
+			ex.Transaction.Versions = append(ex.Transaction.Versions, &Version{Table: tbles[0], RowId: rowIds[i] - 1, Expired: true})
+
+			rowId, err := tbles[0].UpdateVersion(rowIds[i]-1, row, setClause, ex.Transaction.Tx.Snapshot)
+			if rowId >= 0 {
+				ex.Transaction.Versions = append(ex.Transaction.Versions, &Version{Table: tbles[0], RowId: rowId})
+			}
+
+			if err != nil {
+				return nil, nil, err
 			}
+
+			updatedRows++
+			updated = append(updated, rowId)
+
+			ex.captureChange(tbles[0], cdc.OP_UPDATE, before, row)
 		}
 	}
 
-	rowsAffected := map[string]interface{}{"RowsAffected": updatedRows}
-	rows = []map[string]interface{}{rowsAffected}
-
-	// Now we format the results
-	if !ex.json {
-		ex.ResultSetBuffer = shared.CreateTableByteArray(rows, shared.GetHeaders(rows, true))
-	} else {
-		var err error
-		shared.RemoveSingleQuotesFromResult(&rows)
-		ex.ResultSetBuffer, err = shared.CreateJSONByteArray(rows)
+	// Unique columns are checked once every row is updated
+	for _, rowId := range updated {
+		err = tbles[0].CheckUnique(rowId, ex.Transaction.Tx.Snapshot)
 		if err != nil {
 			return nil, nil, err
 		}
+	}
+
+	rowsAffected := map[string]interface{}{"RowsAffected": updatedRows}
+	rows = []map[string]interface{}{rowsAffected}
 
+	// Now we format the results
+	err = ex.setResultSet(rows, nil)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return nil, nil, nil
@@ -1960,28 +2300,31 @@ func (ex *Executor) executeDeleteStmt(stmt *parser.DeleteStmt) ([]int64, []map[s
 	}
 
 	for i := range rows {
-		err = tbles[0].DeleteRow(rowIds[i] - 1)
+		err = ex.lockRow(stmt.TableName.Value, rowIds[i]-1, lock.EXCLUSIVE, parser.LOCK_WAIT)
 		if err != nil {
 			return nil, nil, err
 		}
+
+		// The row stays in place for the snapshots which can still see it
+		_, err = tbles[0].ExpireRow(rowIds[i]-1, ex.Transaction.Tx.Snapshot)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ex.Transaction.Versions = append(ex.Transaction.Versions, &Version{Table: tbles[0], RowId: rowIds[i] - 1, Expired: true})
+
 		deletedRows++
 
+		ex.captureChange(tbles[0], cdc.OP_DELETE, rows[i], nil)
 	}
 
 	rowsAffected := map[string]interface{}{"RowsAffected": deletedRows}
 	rows = []map[string]interface{}{rowsAffected}
 
 	// Now we format the results
-	if !ex.json {
-		ex.ResultSetBuffer = shared.CreateTableByteArray(rows, shared.GetHeaders(rows, true))
-	} else {
-		var err error
-		shared.RemoveSingleQuotesFromResult(&rows)
-		ex.ResultSetBuffer, err = shared.CreateJSONByteArray(rows)
-		if err != nil {
-			return nil, nil, err
-		}
-
+	err = ex.setResultSet(rows, nil)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	return rowIds, rows, nil
@@ -3244,7 +3587,7 @@ func (ex *Executor) search(tbls []*catalog.Table, where *parser.WhereClause, upd
 			}
 
 			// Setup new row iterator
-			iter := tbl.NewIterator()
+			iter := ex.scan(tbl)
 
 			for iter.Valid() {
 				// For every row in the table, we append it to the filtered rows
@@ -3254,42 +3597,25 @@ func (ex *Executor) search(tbls []*catalog.Table, where *parser.WhereClause, upd
 				}
 
 				filteredRows = append(filteredRows, row)
+
+				// A SELECT streaming its rows writes them once a batch is read
+				if ex.streaming != nil && len(filteredRows) >= ROW_BATCH_SIZE {
+					formatTimes(tbl, filteredRows)
+
+					err = ex.writeRows(&filteredRows)
+					if err != nil {
+						return nil, err
+					}
+				}
 			}
 		}
 
 		if ex.explaining {
-			ex.ResultSetBuffer = shared.CreateTableByteArray(convertPlanToRows(ex.plan), shared.GetHeaders(convertPlanToRows(ex.plan), true))
+			ex.explainResult()
 			return filteredRows, nil
 		}
 
-		for i, row := range filteredRows {
-			for k, v := range row {
-				// Check if value is time.Time
-				if _, ok := v.(time.Time); ok {
-
-					tbl := tbls[0]
-
-					// get the column type and format if need be
-					for name, col := range tbl.TableSchema.ColumnDefinitions {
-
-						if name == k {
-							switch col.DataType {
-							case "DATE":
-								filteredRows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("2006-01-02"))
-							case "TIME":
-								filteredRows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("15:04:05"))
-							case "TIMESTAMP":
-								filteredRows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("2006-01-02 15:04:05"))
-							case "DATETIME":
-								filteredRows[i][k] = fmt.Sprintf("'%s'", v.(time.Time).Format("2006-01-02 15:04:05"))
-							}
-						}
-					}
-
-				}
-
-			}
-		}
+		formatTimes(tbls[0], filteredRows)
 
 	} else {
 
@@ -3362,7 +3688,7 @@ func (ex *Executor) opt(cond interface{}, optimize *Optimize, tbls []*catalog.Ta
 				col.TableName = &parser.Identifier{Value: tbl.Name}
 			}
 
-			iter := tbl.NewIterator()
+			iter := ex.scan(tbl)
 			if iter.Valid() {
 				row, err := iter.Next()
 				if err != nil {
@@ -3379,7 +3705,7 @@ func (ex *Executor) opt(cond interface{}, optimize *Optimize, tbls []*catalog.Ta
 
 							col = cond.(*parser.ComparisonPredicate).Right.Value.(*parser.ColumnSpecification)
 
-							iter := tbl.NewIterator()
+							iter := ex.scan(tbl)
 							if iter.Valid() {
 								row, err := iter.Next()
 								if err != nil {
@@ -3418,7 +3744,7 @@ func (ex *Executor) opt(cond interface{}, optimize *Optimize, tbls []*catalog.Ta
 					return errors.New("table does not exist")
 				}
 
-				iter := tbl.NewIterator()
+				iter := ex.scan(tbl)
 				if iter.Valid() {
 					row, err := iter.Next()
 					if err != nil {
@@ -3453,7 +3779,7 @@ func (ex *Executor) opt(cond interface{}, optimize *Optimize, tbls []*catalog.Ta
 					return errors.New("table does not exist")
 				}
 
-				iter := tbl.NewIterator()
+				iter := ex.scan(tbl)
 				if iter.Valid() {
 					row, err := iter.Next()
 					if err != nil {
@@ -3492,7 +3818,7 @@ func (ex *Executor) opt(cond interface{}, optimize *Optimize, tbls []*catalog.Ta
 					return errors.New("table does not exist")
 				}
 
-				iter := tbl.NewIterator()
+				iter := ex.scan(tbl)
 				if iter.Valid() {
 					row, err := iter.Next()
 					if err != nil {
@@ -3529,7 +3855,7 @@ func (ex *Executor) opt(cond interface{}, optimize *Optimize, tbls []*catalog.Ta
 					return errors.New("table does not exist")
 				}
 
-				iter := tbl.NewIterator()
+				iter := ex.scan(tbl)
 				if iter.Valid() {
 					row, err := iter.Next()
 					if err != nil {
@@ -3697,7 +4023,7 @@ func (ex *Executor) filter(where *parser.WhereClause, tbls []*catalog.Table, fil
 				}
 			}
 
-			ex.ResultSetBuffer = shared.CreateTableByteArray(convertPlanToRows(ex.plan), shared.GetHeaders(convertPlanToRows(ex.plan), true))
+			ex.explainResult()
 
 			return nil
 
@@ -3716,7 +4042,7 @@ func (ex *Executor) filter(where *parser.WhereClause, tbls []*catalog.Table, fil
 		}
 
 		// Setup new row iterator
-		iter := tbl.NewIterator()
+		iter := ex.scan(tbl)
 
 		tblIters = append(tblIters, iter)
 
@@ -3807,9 +4133,12 @@ func (ex *Executor) filter(where *parser.WhereClause, tbls []*catalog.Table, fil
 								return err
 							}
 
-							row, err := tbl.GetRow(rRowId)
-							if err != nil {
-								return err
+							// Versions the snapshot cannot see and rows deleted since are skipped
+							ex.read(tbl)
+
+							row, err := tbl.GetVisibleRow(rRowId, ex.snapshot())
+							if err != nil || row == nil {
+								continue
 							}
 
 							// convert to tablename.columnname
@@ -3818,7 +4147,7 @@ func (ex *Executor) filter(where *parser.WhereClause, tbls []*catalog.Table, fil
 								row[fmt.Sprintf("%v.%v", tbl.Name, k)] = vv
 							}
 
-							currentRows = append(currentRows, &Row{ID: rRowId, Row: &row})
+							currentRows = append(currentRows, &Row{ID: rRowId + 1, Row: &row}) // ids are one past the row like the iterator's
 
 						}
 					}
@@ -3834,6 +4163,11 @@ func (ex *Executor) filter(where *parser.WhereClause, tbls []*catalog.Table, fil
 			break
 		}
 
+		err := ex.canceled()
+		if err != nil {
+			return err
+		}
+
 		for i := 0; i < len(tblIters); i++ {
 			iter := tblIters[i]
 
@@ -3955,6 +4289,13 @@ func (ex *Executor) filter(where *parser.WhereClause, tbls []*catalog.Table, fil
 			if len(newRow) > 0 {
 				*filteredRows = append(*filteredRows, newRow)
 
+				// A SELECT streaming its rows writes them once a batch is read
+				if ex.streaming != nil && len(*filteredRows) >= ROW_BATCH_SIZE {
+					err = ex.writeRows(filteredRows)
+					if err != nil {
+						return err
+					}
+				}
 			}
 
 		}
@@ -5535,143 +5876,1499 @@ func (ex *Executor) orderBy(results []map[string]interface{}, orderBy *parser.Or
 // Clear clears the result set buffer
 func (ex *Executor) Clear() {
 	ex.ResultSetBuffer = nil
+	ex.result = nil
 }
 
-// rollback rolls back a transaction
-func (ex *Executor) rollback() error {
-	if !ex.TransactionBegun {
-		return errors.New("no transaction begun")
+// setResultSet sets the result set of a statement, formatted as a table or as JSON, headers are the rows' sorted columns if empty
+func (ex *Executor) setResultSet(rows []map[string]interface{}, headers []string) error {
+	if len(headers) == 0 {
+		headers = shared.GetHeaders(rows, true)
 	}
 
-	ex.TransactionBegun = false
-
-	for _, tx := range ex.Transaction.Statements {
-		if tx.Commited {
-			// If a transaction is commited we can rollback the transaction
-			// This allows for database consistency
-			switch stmt := tx.Stmt.(type) { // only Insert, Update, Delete, statements can be rolled back
-			case *parser.InsertStmt:
-				tbl := ex.ch.Database.GetTable(stmt.TableName.Value)
-
-				if tbl == nil {
-					return errors.New("table does not exist")
-				}
+	ex.result = newResult(rows, headers)
 
-				// In tx.Before for insert we have the row ids that were inserted, thus making it easy to remove them
-				for _, row := range tx.Rollback.Rows {
-					err := tbl.Rows.DeletePage(row.RowId)
-					if err != nil {
-						return err
-					}
-				}
-			case *parser.UpdateStmt:
-				tbl := ex.ch.Database.GetTable(stmt.TableName.Value)
+	if !ex.json {
+		ex.ResultSetBuffer = shared.CreateTableByteArray(rows, headers)
+		return nil
+	}
 
-				if tbl == nil {
-					return errors.New("table does not exist")
-				}
+	shared.RemoveSingleQuotesFromResult(&rows)
 
-				// In tx.Before for update we have the row ids and their previous entire rows thus making it easy to write back the previous value
+	var err error
+	ex.ResultSetBuffer, err = shared.CreateJSONByteArray(rows)
+	return err
+}
 
-				for _, row := range tx.Rollback.Rows {
-					// en
-					encoded, err := catalog.EncodeRow(row.Row)
-					if err != nil {
-						return err
-					}
+// SetRowWriter has the rows of plain SELECTs written to w in batches as they are read, rather than kept in the result set
+// A SELECT which must see every row first, to sort, group, aggregate or limit them, or which reads more than a table or runs subqueries keeps its result set.  nil keeps every result set
+func (ex *Executor) SetRowWriter(w RowWriter) {
+	ex.rowWriter = w
+}
 
-					err = tbl.Rows.WriteTo(row.RowId, encoded)
-					if err != nil {
-						return err
-					}
-				}
-			case *parser.DeleteStmt:
-				tbl := ex.ch.Database.GetTable(stmt.TableName.Value)
+// streamable checks if the rows of a SELECT can be written as they are read, each row is read from a single table and projected on its own
+func streamable(stmt *parser.SelectStmt) bool {
+	te := stmt.TableExpression
+	if te == nil || te.FromClause == nil || len(te.FromClause.Tables) != 1 {
+		return false
+	}
 
-				if tbl == nil {
-					return errors.New("table does not exist")
-				}
+	if stmt.LockingClause != nil || te.GroupByClause != nil || te.HavingClause != nil || te.OrderByClause != nil || te.LimitClause != nil || stmt.Distinct || stmt.Union != nil {
+		return false
+	}
 
-				// In tx.Before for delete we have the row ids and their previous entire rows thus making it easy to write back the previous value
-				for _, row := range tx.Rollback.Rows {
-					// en
-					encoded, err := catalog.EncodeRow(row.Row)
-					if err != nil {
-						return err
-					}
+	for _, expr := range stmt.SelectList.Expressions {
+		switch expr.Value.(type) {
+		case *parser.ColumnSpecification, *parser.Wildcard:
+		default:
+			return false // aggregates see every row, functions and expressions are evaluated on the whole result
+		}
+	}
 
-					err = tbl.Rows.WriteTo(row.RowId, encoded)
-					if err != nil {
-						return err
-					}
+	return te.WhereClause == nil || streamableCondition(te.WhereClause.SearchCondition)
+}
 
-				}
+// streamableCondition checks if a search condition is evaluated on each row on its own, without subqueries
+func streamableCondition(cond interface{}) bool {
+	switch c := cond.(type) {
+	case *parser.LogicalCondition:
+		return streamableCondition(c.Left) && streamableCondition(c.Right)
+	case *parser.NotExpr:
+		return streamableCondition(c.Expr)
+	case *parser.ComparisonPredicate:
+		return !isSubquery(c.Left) && !isSubquery(c.Right)
+	case *parser.BetweenPredicate:
+		return !isSubquery(c.Left) && !isSubquery(c.Lower) && !isSubquery(c.Upper)
+	case *parser.LikePredicate:
+		return !isSubquery(c.Left) && !isSubquery(c.Pattern)
+	case *parser.IsPredicate:
+		return !isSubquery(c.Left)
+	case *parser.InPredicate:
+		for _, value := range c.Values {
+			if isSubquery(value) {
+				return false
 			}
 		}
-	}
 
-	ex.Transaction = nil // clear transaction
+		return !isSubquery(c.Left)
+	}
 
-	return nil
+	return false
 }
 
-// Recover recovers an AriaSQL instance from a WAL file
-func (ex *Executor) Recover(asts []interface{}) error {
-
-	// check if data directory exists
-	if _, err := os.Stat(ex.aria.Config.DataDir); !os.IsNotExist(err) {
+// isSubquery checks if a value expression is a subquery
+func isSubquery(value *parser.ValueExpression) bool {
+	if value == nil {
+		return false
+	}
 
-		err := os.RemoveAll(fmt.Sprintf("%s%sdatabases", ex.aria.Config.DataDir, shared.GetOsPathSeparator()))
-		if err != nil {
-			return err
-		}
+	switch v := value.Value.(type) {
+	case *parser.SelectStmt:
+		return true
+	case *parser.ValueExpression:
+		return isSubquery(v)
 	}
 
-	if _, err := os.Stat(ex.aria.Config.DataDir); !os.IsNotExist(err) {
+	return false
+}
 
-		err := os.RemoveAll(fmt.Sprintf("%s%susers.usrs", ex.aria.Config.DataDir, shared.GetOsPathSeparator()))
-		if err != nil {
-			return err
-		}
-	}
+// writeRows projects rows read by the select list of the SELECT streaming them and writes them to the row writer, they are not kept
+func (ex *Executor) writeRows(rows *[]map[string]interface{}) error {
+	var headers []string
 
-	aria, err := core.New(&core.Config{
-		DataDir: ex.aria.Config.DataDir,
-	})
+	err := ex.selectListFilter(rows, ex.streaming.selectList, &headers)
 	if err != nil {
 		return err
 	}
 
-	aria.Catalog = catalog.New(aria.Config.DataDir)
+	if ex.streaming.columns == nil {
+		if len(headers) == 0 {
+			headers = shared.GetHeaders(*rows, true)
+		}
 
-	if err := aria.Catalog.Open(); err != nil {
-		return err
+		ex.streaming.columns = headers
 	}
 
-	aria.Channels = make([]*core.Channel, 0)
-	aria.ChannelsLock = &sync.Mutex{}
+	result := newResult(*rows, ex.streaming.columns)
 
-	user := aria.Catalog.GetUser("admin") // will bypass privileges as executor is set to recover
-	if user == nil {
-		return fmt.Errorf("admin user not found")
+	err = ex.rowWriter(ex.streaming.columns, result.Rows)
+	if err != nil {
+		return err
 	}
 
-	ex.aria = aria
-	ex.ch = aria.OpenChannel(user)
+	ex.streaming.written += len(result.Rows)
+	*rows = nil
 
-	for _, stmt := range asts {
-		err := ex.Execute(stmt)
-		if err != nil {
-			return err
-		}
-	}
+	return nil
+}
 
-	ex.aria.Close()
+// explainResult sets the execution plan as the result set, always formatted as a table
+func (ex *Executor) explainResult() {
+	rows := convertPlanToRows(ex.plan)
+	headers := shared.GetHeaders(rows, true)
 
-	return nil
+	ex.result = newResult(rows, headers)
+	ex.ResultSetBuffer = shared.CreateTableByteArray(rows, headers)
 }
 
-// SetRecover sets the recover flag
+// newResult orders the values of rows by headers
+func newResult(rows []map[string]interface{}, headers []string) *Result {
+	result := &Result{Columns: headers, Rows: make([][]interface{}, len(rows))}
+
+	for i, row := range rows {
+		values := make([]interface{}, len(headers))
+
+		for j, header := range headers {
+			values[j] = row[header]
+
+			if str, ok := values[j].(string); ok {
+				values[j] = strings.TrimPrefix(strings.TrimSuffix(str, "'"), "'")
+			}
+		}
+
+		result.Rows[i] = values
+	}
+
+	return result
+}
+
+// rollback rolls back a transaction
+// The transaction is aborted, hiding the row versions it created, and its versions are undone
+func (ex *Executor) rollback() error {
+	if ex.Transaction == nil {
+		return errors.New("no transaction begun")
+	}
+
+	tx := ex.Transaction
+
+	ex.TransactionBegun = false
+	ex.Transaction = nil // clear transaction
+	ex.changes = nil     // nothing was committed
+
+	ex.aria.Transactions.Abort(tx.Tx)
+
+	changed := len(tx.Tables) > 0
+
+	var err error
+
+	if tx.Resumed {
+		err = ex.undoResumed(tx.Tx.Xid)
+	} else {
+		err = ex.undo(tx, 0, 0)
+		if err == nil && changed {
+			err = ex.aria.Catalog.DiscardTables(tx.Tx.Xid)
+		}
+	}
+
+	ex.aria.Locks.Release(tx.Tx.Xid)
+
+	if err != nil {
+		return err // the transaction stays aborted so what was not undone stays invisible
+	}
+
+	ex.aria.Transactions.Forget(tx.Tx.Xid)
+
+	return nil
+}
+
+// abort rolls back a transaction which cannot go on, logging the rollback first so it is replayed before what the released locks let through
+func (ex *Executor) abort() {
+	err := ex.appendWAL(&parser.RollbackStmt{})
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	err = ex.rollback()
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// Close ends the session of a closed channel, an open transaction is rolled back, releasing its locks, and the cursors are released
+func (ex *Executor) Close() {
+	ex.idleLock.Lock()
+	defer ex.idleLock.Unlock()
+
+	if ex.idle != nil {
+		ex.idle.Stop()
+		ex.idle = nil
+	}
+
+	if ex.TransactionBegun && ex.Transaction != nil {
+		log.Printf("channel %d closed, rolling back transaction %d", ex.channelID(), ex.Transaction.Tx.Xid)
+		ex.abort()
+	}
+
+	for name := range ex.cursors {
+		ex.closeCursor(name)
+	}
+
+	ex.cursors = nil
+}
+
+// channelID returns the id of the executor's channel, 0 without one
+func (ex *Executor) channelID() uint64 {
+	if ex.ch == nil {
+		return 0
+	}
+
+	return ex.ch.ChannelID
+}
+
+// rollbackTo undoes what the transaction did since a savepoint, the savepoint stays and the ones set after it are gone
+func (ex *Executor) rollbackTo(s *parser.RollbackStmt) error {
+	tx := ex.Transaction
+
+	i := tx.savepoint(s.Savepoint.Value)
+	if i < 0 {
+		return errors.New("savepoint does not exist")
+	}
+
+	// Append to wal
+	err := ex.appendWAL(s)
+	if err != nil {
+		return err
+	}
+
+	sp := tx.Savepoints[i]
+
+	err = ex.undo(tx, sp.Versions, sp.Tables)
+	if err != nil {
+		return err
+	}
+
+	tx.Statements = tx.Statements[:sp.Statements]
+	tx.Savepoints = tx.Savepoints[:i+1]
+	ex.changes = ex.changes[:sp.Changes]
+
+	return nil
+}
+
+// savepoint returns the index of the latest savepoint named name, -1 if there is none
+func (tx *Transaction) savepoint(name string) int {
+	for i := len(tx.Savepoints) - 1; i >= 0; i-- {
+		if tx.Savepoints[i].Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// commit commits a transaction, a serializable transaction which cannot commit stays begun to be rolled back
+// stmt, if not nil, is logged as the commit record once the transaction can commit, an implicit transaction's statement record commits it already.
+// The row versions it deleted are reclaimed once no snapshot can see them anymore
+func (ex *Executor) commit(stmt parser.Statement) error {
+	tx := ex.Transaction
+
+	for _, v := range tx.Versions {
+		tx.Tx.Write(v.Table.Directory)
+	}
+
+	var logCommit func() error
+	if stmt != nil {
+		logCommit = func() error { return ex.appendWAL(stmt) }
+	}
+
+	err := ex.aria.Transactions.CommitLogged(tx.Tx, logCommit)
+	if err != nil {
+		return err
+	}
+
+	// The commit record is logged, recovery no longer restores the tables saved before their changes
+	if len(tx.Tables) > 0 || tx.Resumed {
+		err = ex.aria.Catalog.DiscardTables(tx.Tx.Xid)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	ex.aria.Locks.Release(tx.Tx.Xid)
+
+	ex.TransactionBegun = false
+	ex.Transaction = nil // clear transaction
+
+	var expired []*Version
+
+	for _, v := range tx.Versions {
+		if v.Expired {
+			expired = append(expired, v)
+		}
+	}
+
+	if len(expired) == 0 {
+		return nil
+	}
+
+	ex.aria.Transactions.Reclaim(tx.Tx.Xid, func() {
+		for _, v := range expired {
+			err := v.Table.DeleteRow(v.RowId)
+			if err != nil {
+				log.Printf("reclaiming row %d of table %s: %s", v.RowId, v.Table.Name, err.Error())
+			}
+		}
+	})
+
+	return nil
+}
+
+// prepare prepares the transaction begun for two-phase commit, its prepare record is logged once it passed the checks a commit makes
+// The transaction is handed over to the prepared transactions in doubt, the session can begin another one
+func (ex *Executor) prepare(s *parser.PrepareTransactionStmt) error {
+	tx := ex.Transaction
+
+	for _, v := range tx.Versions {
+		tx.Tx.Write(v.Table.Directory)
+	}
+
+	p := &core.PreparedTransaction{
+		Gid:         s.Gid.Value.(string),
+		Tx:          tx.Tx,
+		Prepared:    time.Now(),
+		Owner:       ex.ch.User.Username,
+		Database:    ex.ch.Database.Name,
+		Transaction: tx,
+	}
+
+	err := ex.aria.Transactions.Prepare(tx.Tx, func() error {
+		err := ex.appendWAL(s)
+		if err != nil {
+			return err
+		}
+
+		// A replayed transaction keeps who prepared it and when
+		if rec := ex.lastRecord; rec != nil && ex.replaying {
+			p.Prepared = rec.Timestamp
+			p.Owner = rec.User
+		}
+
+		return ex.aria.Prepare(p)
+	})
+	if err != nil {
+		return err
+	}
+
+	tx.Changes = ex.changes
+
+	ex.TransactionBegun = false
+	ex.Transaction = nil
+	ex.changes = nil
+
+	return nil
+}
+
+// commitPrepared commits a prepared transaction, which stays in doubt if its commit record cannot be logged
+func (ex *Executor) commitPrepared(s *parser.CommitStmt) error {
+	if ex.TransactionBegun {
+		return errors.New("COMMIT PREPARED cannot run within a transaction")
+	}
+
+	p, err := ex.finishPrepared(s.Prepared.Value.(string), shared.PRIV_COMMIT)
+	if err != nil {
+		return err
+	}
+
+	tx := preparedTransaction(p)
+
+	// The rows a resumed transaction deleted are reclaimed once no snapshot can see them anymore
+	if tx.Resumed {
+		tx.Versions = ex.deletedVersions(tx.Tx.Xid)
+	}
+
+	ex.Transaction = tx
+	ex.changes = tx.Changes
+
+	err = ex.commit(s)
+	if err != nil {
+		ex.Transaction = nil
+		ex.changes = nil
+
+		if prepareErr := ex.aria.Prepare(p); prepareErr != nil {
+			log.Println(prepareErr.Error())
+		}
+
+		return err
+	}
+
+	err = ex.syncWAL()
+	if err != nil {
+		return err
+	}
+
+	commit := ex.lastRecord
+
+	ex.publishChanges(commit)
+
+	// With synchronous replication the commit returns once enough replicas received its records
+	if !ex.replaying && commit != nil {
+		return ex.aria.WaitForReplicas(commit.LSN, ex.synchronousReplicas())
+	}
+
+	return nil
+}
+
+// rollbackPrepared rolls back a prepared transaction, which stays in doubt if its rollback record cannot be logged
+func (ex *Executor) rollbackPrepared(s *parser.RollbackStmt) error {
+	if ex.TransactionBegun {
+		return errors.New("ROLLBACK PREPARED cannot run within a transaction")
+	}
+
+	p, err := ex.finishPrepared(s.Prepared.Value.(string), shared.PRIV_ROLLBACK)
+	if err != nil {
+		return err
+	}
+
+	ex.Transaction = preparedTransaction(p)
+
+	err = ex.appendWAL(s)
+	if err != nil {
+		ex.Transaction = nil
+
+		if prepareErr := ex.aria.Prepare(p); prepareErr != nil {
+			log.Println(prepareErr.Error())
+		}
+
+		return err
+	}
+
+	return ex.rollback()
+}
+
+// finishPrepared takes the prepared transaction gid to end it with action
+// Only the user which prepared it, or a user with ALL privileges system wide, can end it
+func (ex *Executor) finishPrepared(gid string, action shared.PrivilegeAction) (*core.PreparedTransaction, error) {
+	p := ex.aria.FinishPrepared(gid)
+	if p == nil {
+		return nil, errors.New("prepared transaction does not exist")
+	}
+
+	if !ex.recover {
+		allowed := ex.ch.User.HasPrivilege(p.Database, "*", []shared.PrivilegeAction{action})
+		owner := p.Owner == ex.ch.User.Username || ex.ch.User.HasPrivilege("*", "*", []shared.PrivilegeAction{shared.PRIV_ALL})
+
+		if !allowed || !owner {
+			err := ex.aria.Prepare(p)
+			if err != nil {
+				log.Println(err.Error())
+			}
+
+			return nil, errors.New("user does not have the privilege to end prepared transaction " + gid)
+		}
+	}
+
+	return p, nil
+}
+
+// preparedTransaction returns the transaction of a prepared transaction, one resumed after a restart has only its id and snapshot
+func preparedTransaction(p *core.PreparedTransaction) *Transaction {
+	if tx, ok := p.Transaction.(*Transaction); ok {
+		return tx
+	}
+
+	return &Transaction{Statements: []*TransactionStmt{}, Tx: p.Tx, Resumed: true}
+}
+
+// deletedVersions returns the row versions transaction xid deleted, found by scanning the tables
+func (ex *Executor) deletedVersions(xid uint64) []*Version {
+	var versions []*Version
+
+	for _, name := range ex.aria.Catalog.GetDatabases() {
+		db := ex.aria.Catalog.GetDatabase(name)
+
+		for _, tblName := range db.GetTables() {
+			tbl := db.GetTable(tblName)
+
+			_, deleted := tbl.Versions(xid)
+			for _, rowId := range deleted {
+				versions = append(versions, &Version{Table: tbl, RowId: rowId, Expired: true})
+			}
+		}
+	}
+
+	return versions
+}
+
+// undoResumed undoes a prepared transaction resumed after a restart the way recovery undoes an aborted one
+// The tables it changed are restored, then the row versions it wrote are found by scanning the tables and undone
+func (ex *Executor) undoResumed(xid uint64) error {
+	err := ex.aria.Catalog.UndoTables(xid)
+	if err != nil {
+		return err
+	}
+
+	aborted := func(x uint64) bool { return x == xid }
+
+	for _, name := range ex.aria.Catalog.GetDatabases() {
+		db := ex.aria.Catalog.GetDatabase(name)
+
+		for _, tblName := range db.GetTables() {
+			err = db.GetTable(tblName).Undo(aborted)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// undo undoes what transaction tx did after it had written versions row versions and changed tables tables, newest first
+// A changed table is restored once the row versions written after its change are undone, the versions written before are undone on the restored table
+func (ex *Executor) undo(tx *Transaction, versions, tables int) error {
+	for i := len(tx.Tables) - 1; i >= tables; i-- {
+		change := tx.Tables[i]
+
+		err := undo(tx.Tx.Xid, tx.Versions[change.Versions:])
+		if err != nil {
+			return err
+		}
+
+		tx.Versions = tx.Versions[:change.Versions]
+
+		err = ex.aria.Catalog.RestoreTable(tx.Tx.Xid, i, change.Database, change.Name, change.Table)
+		if err != nil {
+			return err
+		}
+
+		tx.Tables = tx.Tables[:i]
+	}
+
+	err := undo(tx.Tx.Xid, tx.Versions[versions:])
+	if err != nil {
+		return err
+	}
+
+	tx.Versions = tx.Versions[:versions]
+
+	return nil
+}
+
+// undo removes the row versions transaction xid created and restores the ones it deleted, newest first
+func undo(xid uint64, versions []*Version) error {
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+
+		var err error
+
+		if v.Expired {
+			err = v.Table.RestoreRow(v.RowId, xid)
+		} else {
+			if v.Inserted {
+				err = v.Table.ReleaseSequences(v.RowId)
+				if err != nil {
+					return err
+				}
+			}
+
+			err = v.Table.DeleteRow(v.RowId)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// transact runs a statement within the transaction begun, or within a transaction of its own outside of one
+// stmt is recorded within the transaction, nil for statements which only read
+// A statement which fails leaves none of its row versions behind
+func (ex *Executor) transact(stmt parser.Statement, run func() error) error {
+	implicit := ex.Transaction == nil
+
+	if implicit {
+		tx, err := ex.aria.Transactions.Begin(mvcc.REPEATABLE_READ)
+		if err != nil {
+			return err
+		}
+
+		ex.Transaction = &Transaction{Statements: []*TransactionStmt{}, Tx: tx, Implicit: true}
+	} else {
+		// Under read committed every statement sees what was committed before it started
+		if ex.Transaction.Tx.Isolation == mvcc.READ_COMMITTED {
+			ex.aria.Transactions.Refresh(ex.Transaction.Tx)
+		}
+
+		ex.Transaction.Queried = true
+	}
+
+	versions := len(ex.Transaction.Versions)
+	tables := len(ex.Transaction.Tables)
+	changes := len(ex.changes)
+
+	err := run()
+
+	// A statement canceled part way through is undone
+	if err == nil {
+		err = ex.canceled()
+	}
+
+	if err != nil {
+		if implicit {
+			rollbackErr := ex.rollback()
+			if rollbackErr != nil {
+				log.Println(rollbackErr.Error())
+			}
+
+			return err
+		}
+
+		// A deadlock victim is rolled back as a whole so the transactions waiting for it can go on
+		if err == lock.ErrDeadlock {
+			ex.abort()
+			return err
+		}
+
+		undoErr := ex.undo(ex.Transaction, versions, tables)
+		if undoErr != nil {
+			log.Println(undoErr.Error())
+		}
+
+		ex.changes = ex.changes[:changes]
+
+		return err
+	}
+
+	if stmt != nil && !implicit {
+		ex.Transaction.Statements = append(ex.Transaction.Statements, &TransactionStmt{
+			Id:   len(ex.Transaction.Statements),
+			Stmt: stmt,
+		})
+	}
+
+	if implicit {
+		err = ex.commit(nil)
+		if err != nil {
+			rollbackErr := ex.rollback()
+			if rollbackErr != nil {
+				log.Println(rollbackErr.Error())
+			}
+
+			return err
+		}
+
+		err = ex.syncWAL()
+		if err != nil {
+			return err
+		}
+
+		ex.publishChanges(ex.lastRecord)
+	}
+
+	return nil
+}
+
+// changeTable runs a statement creating, dropping or altering table name within the transaction begun, or within a transaction of its own outside of one
+// The table is locked exclusively and saved before every change so a failed statement, a rollback to a savepoint or of the transaction restores it.
+// run is given the table as it is once locked, nil if it does not exist
+func (ex *Executor) changeTable(stmt parser.Statement, name string, run func(tbl *catalog.Table) error) error {
+	return ex.transact(stmt, func() error {
+		err := ex.lock(name, lock.TABLE, lock.EXCLUSIVE, parser.LOCK_WAIT)
+		if err != nil {
+			return err
+		}
+
+		tx := ex.Transaction
+
+		err = ex.aria.Catalog.SaveTable(tx.Tx.Xid, len(tx.Tables), ex.ch.Database, name)
+		if err != nil {
+			return err
+		}
+
+		tx.Tables = append(tx.Tables, &TableChange{
+			Database: ex.ch.Database,
+			Name:     name,
+			Table:    ex.ch.Database.GetTable(name),
+			Versions: len(tx.Versions),
+		})
+
+		err = run(ex.ch.Database.GetTable(name))
+		if err != nil {
+			return err
+		}
+
+		// The statement is logged once it has its table locked, after the transactions it waited for
+		return ex.appendWAL(stmt)
+	})
+}
+
+// closeCursor deletes a cursor, ending the read transaction it was opened with
+func (ex *Executor) closeCursor(name string) {
+	if cursor := ex.cursors[name]; cursor != nil && cursor.tx != nil {
+		ex.aria.Transactions.Commit(cursor.tx)
+	}
+
+	delete(ex.cursors, name)
+}
+
+// setTransaction sets the isolation level of the transaction begun, or of the next one outside of a transaction
+func (ex *Executor) setTransaction(s *parser.BeginStmt) error {
+	if !ex.TransactionBegun {
+		ex.isolation = s.IsolationLevel
+		return nil
+	}
+
+	if ex.Transaction.Queried {
+		return errors.New("SET TRANSACTION ISOLATION LEVEL must be called before any statement within the transaction")
+	}
+
+	err := ex.appendWAL(s)
+	if err != nil {
+		return err
+	}
+
+	ex.aria.Transactions.SetIsolation(ex.Transaction.Tx, ex.isolationLevel(s.IsolationLevel))
+
+	return nil
+}
+
+// isolationLevel returns the isolation level a transaction begins with, repeatable read if none is given
+// A replayed serializable transaction is not checked again, it was when it committed
+func (ex *Executor) isolationLevel(level parser.IsolationLevel) mvcc.IsolationLevel {
+	switch level {
+	case parser.ISOLATION_READ_COMMITTED:
+		return mvcc.READ_COMMITTED
+	case parser.ISOLATION_SERIALIZABLE:
+		if ex.replaying {
+			return mvcc.REPEATABLE_READ
+		}
+
+		return mvcc.SERIALIZABLE
+	default:
+		return mvcc.REPEATABLE_READ
+	}
+}
+
+// lockRow locks a row until the transaction ends, waiting up to the lock timeout for the transactions holding it
+// WAL records are replayed in an order in which the waits are over, they take no locks
+func (ex *Executor) lockRow(table string, rowId int64, mode lock.Mode, policy parser.LockWaitPolicy) error {
+	intention := lock.INTENTION_SHARED
+	if mode == lock.EXCLUSIVE {
+		intention = lock.INTENTION_EXCLUSIVE
+	}
+
+	// SKIP LOCKED only skips rows, the table lock is waited for
+	tablePolicy := policy
+	if tablePolicy == parser.LOCK_SKIP_LOCKED {
+		tablePolicy = parser.LOCK_WAIT
+	}
+
+	err := ex.lock(table, lock.TABLE, intention, tablePolicy)
+	if err != nil {
+		return err
+	}
+
+	return ex.lock(table, rowId, mode, policy)
+}
+
+// lock locks row rowId of table, or the whole table for lock.TABLE, until the current transaction ends
+// Unless policy is parser.LOCK_WAIT a lock held by another transaction is not waited for, lock.ErrNotAvailable is returned instead
+func (ex *Executor) lock(table string, rowId int64, mode lock.Mode, policy parser.LockWaitPolicy) error {
+	if ex.replaying {
+		return nil
+	}
+
+	resource := lock.Resource{Table: ex.ch.Database.Name + "." + table, RowId: rowId}
+
+	if policy != parser.LOCK_WAIT {
+		return ex.aria.Locks.TryLock(ex.Transaction.Tx.Xid, resource, mode)
+	}
+
+	// The wait ends with the statement, if it is canceled first
+	ctx, cancel := ex.statementContext(), func() {}
+	if timeout := ex.lockTimeoutSetting(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	defer cancel()
+
+	err := ex.aria.Locks.Lock(ctx, ex.Transaction.Tx.Xid, resource, mode)
+	if err == lock.ErrTimeout {
+		if cancelErr := ex.canceled(); cancelErr != nil {
+			return cancelErr
+		}
+	}
+
+	return err
+}
+
+// statementContext returns the context of the statement executing
+func (ex *Executor) statementContext() context.Context {
+	if ex.ctx == nil {
+		return context.Background()
+	}
+
+	return ex.ctx
+}
+
+// canceled returns ErrStatementTimeout once the statement executing ran longer than the statement timeout
+// A statement KILL canceled gets ErrQueryCanceled or ErrSessionKilled
+func (ex *Executor) canceled() error {
+	if ex.ctx == nil || ex.ctx.Err() == nil {
+		return nil
+	}
+
+	if ex.ctx.Err() == context.DeadlineExceeded {
+		return ErrStatementTimeout
+	}
+
+	return context.Cause(ex.ctx)
+}
+
+// wake marks the session busy executing a statement, stopping the idle timer
+// ErrIdleInTransactionTimeout is returned, once, if the timer rolled back the transaction begun while the session was idle
+func (ex *Executor) wake() error {
+	ex.idleLock.Lock()
+	defer ex.idleLock.Unlock()
+
+	if ex.idle != nil {
+		ex.idle.Stop()
+		ex.idle = nil
+	}
+
+	if ex.idleExpired {
+		ex.idleExpired = false
+		return ErrIdleInTransactionTimeout
+	}
+
+	// A killed session executes nothing more, what it left begun is rolled back
+	if ex.ch != nil && ex.ch.Killed() {
+		if ex.TransactionBegun {
+			ex.abort()
+		}
+
+		return ErrSessionKilled
+	}
+
+	ex.executing = true
+
+	return nil
+}
+
+// sleep marks the session idle, a transaction left begun is rolled back once the session stays idle for longer than the idle timeout
+func (ex *Executor) sleep() {
+	ex.idleLock.Lock()
+	defer ex.idleLock.Unlock()
+
+	ex.executing = false
+
+	timeout := ex.idleTimeoutSetting()
+	if !ex.TransactionBegun || timeout <= 0 {
+		return
+	}
+
+	var timer *time.Timer
+
+	timer = time.AfterFunc(timeout, func() {
+		ex.idleLock.Lock()
+		defer ex.idleLock.Unlock()
+
+		if ex.idle != timer || ex.executing || !ex.TransactionBegun {
+			return // the session went on
+		}
+
+		ex.idle = nil
+		ex.abort()
+		ex.idleExpired = true
+	})
+
+	ex.idle = timer
+}
+
+// scan returns an iterator over the rows of tbl the statement can see, it stops once the statement is canceled
+func (ex *Executor) scan(tbl *catalog.Table) *catalog.Iterator {
+	ex.read(tbl)
+
+	iter := tbl.NewSnapshotIterator(ex.snapshot())
+	iter.SetContext(ex.ctx)
+
+	return iter
+}
+
+// read records that a serializable transaction read tbl
+func (ex *Executor) read(tbl *catalog.Table) {
+	if ex.Transaction != nil {
+		ex.Transaction.Tx.Read(tbl.Directory)
+	}
+}
+
+// snapshot returns the snapshot statements read from
+// Outside of a transaction it is a snapshot of what is committed right now
+func (ex *Executor) snapshot() *mvcc.Snapshot {
+	if ex.Transaction != nil {
+		return ex.Transaction.Tx.Snapshot
+	}
+
+	return ex.aria.Transactions.Snapshot()
+}
+
+// RecoverTo performs a point-in-time recovery of the executor's AriaSQL instance
+// The newest base backup before the target is restored, if the instance has a WAL archive, and the archived and current WAL records after it are replayed until the target is reached.
+// Records past the target are set aside and the replayed records, with their original LSN and timestamp, make up the new WAL.
+// If the WAL is damaged replay stops before the damage, the instance is still recovered and a *wal.CorruptionError describing the damage is returned.
+func (ex *Executor) RecoverTo(target *wal.RecoveryTarget) error {
+	var base *wal.BaseBackup
+	var records []*wal.Record
+	var err error
+
+	// Damaged regions are read around, replay stops at the last intact record before the first one
+	corruption := &wal.CorruptionError{}
+
+	if ex.aria.Archive != nil {
+		base, err = ex.aria.Archive.LatestBaseBackup(target)
+		if err != nil {
+			return err
+		}
+
+		records, err = ex.aria.Archive.Records()
+		if err != nil {
+			var cerr *wal.CorruptionError
+			if !errors.As(err, &cerr) {
+				return err
+			}
+
+			corruption.Corruptions = append(corruption.Corruptions, cerr.Corruptions...)
+		}
+	}
+
+	current, err := ex.aria.WAL.Records()
+	if err != nil {
+		var cerr *wal.CorruptionError
+		if !errors.As(err, &cerr) {
+			return err
+		}
+
+		for _, c := range cerr.Corruptions {
+			if c.AfterLSN == 0 && len(records) > 0 {
+				c.AfterLSN = records[len(records)-1].LSN
+			}
+
+			corruption.Corruptions = append(corruption.Corruptions, c)
+		}
+	}
+
+	records = append(records, current...)
+
+	if len(corruption.Corruptions) > 0 {
+		stop := corruption.StopLSN()
+		if target.LSN == 0 || stop < target.LSN {
+			target = &wal.RecoveryTarget{Time: target.Time, LSN: stop}
+		}
+
+		// LSN 0 means no limit, damage before the first record leaves nothing to replay
+		if stop == 0 {
+			target.LSN = 0
+			records = nil
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].LSN < records[j].LSN
+	})
+
+	// Gather the records between the base backup and the target
+	var replay []*wal.Record
+	var lastLSN uint64
+
+	if base != nil {
+		lastLSN = base.LSN
+	}
+
+	for _, rec := range records {
+		if base != nil && rec.LSN <= base.LSN {
+			continue
+		}
+
+		if target.Reached(rec) {
+			break
+		}
+
+		replay = append(replay, rec)
+		lastLSN = rec.LSN
+	}
+
+	dataDir := ex.aria.Config.DataDir
+	walPath := fmt.Sprintf("%s%swal.dat", dataDir, shared.GetOsPathSeparator())
+
+	ex.aria.Close()
+
+	// Keep the WAL being replaced, it holds the history past the target
+	suffix := fmt.Sprintf(".%d.pre-recovery", time.Now().UnixNano())
+
+	if _, err := os.Stat(walPath); err == nil {
+		err = os.Rename(walPath, walPath+suffix)
+		if err != nil {
+			return err
+		}
+
+		os.Rename(walPath+".del", walPath+suffix+".del")
+	}
+
+	if ex.aria.Archive != nil {
+		_, err = ex.aria.Archive.SetAside(lastLSN)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.RemoveAll(fmt.Sprintf("%s%sdatabases", dataDir, shared.GetOsPathSeparator()))
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(fmt.Sprintf("%s%susers%s", dataDir, shared.GetOsPathSeparator(), catalog.SYS_USERS_EXTENSION))
+	if err != nil {
+		return err
+	}
+
+	if base != nil {
+		err = base.Restore(dataDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	aria, err := core.New(&core.Config{
+		DataDir: dataDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	aria.Catalog = catalog.New(aria.Config.DataDir)
+	aria.Catalog.LoginPolicy = aria.Config.LoginPolicy
+
+	if err := aria.Catalog.Open(); err != nil {
+		return err
+	}
+
+	aria.Channels = make([]*core.Channel, 0)
+	aria.ChannelsLock = &sync.Mutex{}
+
+	user := aria.Catalog.GetUser("admin") // will bypass privileges as executor is set to recover
+	if user == nil {
+		return fmt.Errorf("admin user not found")
+	}
+
+	ex.aria = aria
+	ex.ch = aria.OpenChannel(user)
+	ex.recover = true
+	ex.replaying = true
+
+	defer func() {
+		ex.replaying = false
+		ex.replayRecord = nil
+	}()
+
+	for _, rec := range replay {
+		ex.replayRecord = rec
+
+		err := ex.Execute(rec.Stmt)
+		if err != nil {
+			return fmt.Errorf("recovery failed at LSN %d: %s", rec.LSN, err.Error())
+		}
+	}
+
+	// A transaction without a commit record before the target did not commit, its changes are undone
+	if ex.TransactionBegun {
+		err = ex.rollback()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ex.aria.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(corruption.Corruptions) > 0 {
+		return corruption // recovered up to the damage
+	}
+
+	return nil
+}
+
+// appendWAL appends a statement to the write ahead log
+func (ex *Executor) appendWAL(stmt interface{}) error {
+	if ex.replaying {
+		// When replaying, the record being replayed is written back as is so it keeps its LSN and timestamp.
+		// Statements executed as part of it, such as statements within a WHILE loop, are not logged again.
+		if ex.replayRecord == nil {
+			return nil
+		}
+
+		rec := ex.replayRecord
+		ex.replayRecord = nil
+		ex.lastRecord = rec
+
+		// The record is rewritten with the transaction it was replayed in, which recovery of this WAL goes by
+		rec.Xid, rec.Commit = ex.transactionRecord(stmt)
+
+		return ex.aria.WAL.AppendRecord(rec)
+	}
+
+	if ex.aria.ReadOnly() {
+		return nil // a replica's WAL mirrors its primary's, statements of its own clients are not logged
+	}
+
+	var user, database string
+
+	if ex.ch != nil {
+		if ex.ch.User != nil {
+			user = ex.ch.User.Username
+		}
+
+		if ex.ch.Database != nil {
+			database = ex.ch.Database.Name
+		}
+	}
+
+	rec := &wal.Record{User: user, Database: database, Channel: ex.channelID(), Stmt: stmt}
+	rec.Xid, rec.Commit = ex.transactionRecord(stmt)
+
+	err := ex.aria.WAL.Log(rec)
+	if err != nil {
+		return err
+	}
+
+	ex.lastRecord = rec
+
+	return nil
+}
+
+// syncWAL flushes the WAL up to the last record logged, a commit is acknowledged once its record survives a crash
+func (ex *Executor) syncWAL() error {
+	if ex.replaying || ex.lastRecord == nil {
+		return nil // a replayed record is flushed by whoever replays it
+	}
+
+	return ex.aria.WAL.Sync(ex.lastRecord.LSN)
+}
+
+// transactionRecord returns the transaction a statement logged now ran in and whether its record commits the transaction
+func (ex *Executor) transactionRecord(stmt interface{}) (uint64, bool) {
+	if ex.Transaction == nil {
+		return 0, false
+	}
+
+	_, commit := stmt.(*parser.CommitStmt)
+
+	return ex.Transaction.Tx.Xid, commit || ex.Transaction.Implicit
+}
+
+// Subscribe subscribes to the changes committed to a table of the current database
+func (ex *Executor) Subscribe(stmt *parser.SubscribeStmt) (*cdc.Subscription, error) {
+	if ex.ch.Database == nil {
+		return nil, errors.New("no database selected")
+	}
+
+	tbl := ex.ch.Database.GetTable(stmt.TableName.Value)
+	if tbl == nil {
+		return nil, errors.New("table does not exist")
+	}
+
+	if !ex.ch.User.HasPrivilege(ex.ch.Database.Name, tbl.Name, []shared.PrivilegeAction{shared.PRIV_SELECT}) {
+		return nil, errors.New("user does not have the privilege to SUBSCRIBE on system for database " + ex.ch.Database.Name + " and table " + tbl.Name)
+	}
+
+	return ex.aria.CDC.Subscribe(ex.ch.Database.Name, tbl.Name, cdc.SUBSCRIPTION_BUFFER), nil
+}
+
+// captureChange records a row change for change data capture, it is published once the statement or transaction commits
+func (ex *Executor) captureChange(tbl *catalog.Table, op string, before, after map[string]interface{}) {
+	if !ex.aria.CDC.Active() {
+		return // nobody is listening
+	}
+
+	event := &cdc.Event{
+		Database: ex.ch.Database.Name,
+		Table:    tbl.Name,
+		Op:       op,
+		Before:   changeRow(before),
+		After:    changeRow(after),
+	}
+
+	row := event.After
+	if row == nil {
+		row = event.Before
+	}
+
+	// Sequence and unique columns identify the row
+	for name, colDef := range tbl.TableSchema.ColumnDefinitions {
+		if colDef.Sequence || colDef.Unique {
+			if event.Key == nil {
+				event.Key = make(map[string]interface{})
+			}
+
+			event.Key[name] = row[name]
+		}
+	}
+
+	ex.changes = append(ex.changes, event)
+}
+
+// changeRow copies a row into a change event, string values lose their quotes
+func changeRow(row map[string]interface{}) map[string]interface{} {
+	if row == nil {
+		return nil
+	}
+
+	rows := []map[string]interface{}{catalog.CopyRow(&row)}
+	shared.RemoveSingleQuotesFromResult(&rows)
+
+	return rows[0]
+}
+
+// publishChanges publishes the captured row changes as committed by rec
+func (ex *Executor) publishChanges(rec *wal.Record) {
+	if len(ex.changes) == 0 {
+		return
+	}
+
+	commitTime := time.Now()
+	var lsn uint64
+
+	if rec != nil {
+		lsn = rec.LSN
+		commitTime = rec.Timestamp
+	}
+
+	for _, event := range ex.changes {
+		event.LSN = lsn
+		event.CommitTime = commitTime
+	}
+
+	ex.aria.CDC.Publish(ex.changes)
+	ex.changes = nil
+}
+
+// setSetting changes a session setting, DEFAULT goes back to the server setting
+func (ex *Executor) setSetting(s *parser.SetStmt) error {
+	var value interface{}
+	if s.Value != nil {
+		value = s.Value.(*parser.Literal).Value
+	}
+
+	switch strings.ToLower(s.Variable.Value) {
+	case "synchronous_replicas":
+		if value == nil {
+			ex.syncReplicas = nil
+			return nil
+		}
+
+		n, ok := value.(uint64)
+		if !ok {
+			return errors.New("synchronous_replicas must be a number of replicas")
+		}
+
+		replicas := int(n)
+		ex.syncReplicas = &replicas
+
+		return nil
+	case "statement_timeout", "lock_timeout", "idle_in_transaction_timeout":
+		var timeout *time.Duration
+
+		if value != nil {
+			var err error
+			timeout, err = timeoutSetting(strings.ToLower(s.Variable.Value), value)
+			if err != nil {
+				return err
+			}
+		}
+
+		switch strings.ToLower(s.Variable.Value) {
+		case "statement_timeout":
+			ex.statementTimeout = timeout
+		case "lock_timeout":
+			ex.lockTimeout = timeout
+		default:
+			ex.idleTimeout = timeout
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("unknown setting %s", s.Variable.Value)
+}
+
+// SetTimeouts sets the server timeouts, the session's statement_timeout, lock_timeout and idle_in_transaction_timeout settings override them
+func (ex *Executor) SetTimeouts(timeouts Timeouts) {
+	ex.timeouts = timeouts
+}
+
+// statementTimeoutSetting returns how long a statement may run, 0 if there is no limit
+func (ex *Executor) statementTimeoutSetting() time.Duration {
+	if ex.statementTimeout != nil {
+		return *ex.statementTimeout
+	}
+
+	return ex.timeouts.Statement
+}
+
+// lockTimeoutSetting returns how long a statement waits for a lock, 0 if there is no limit
+// Without a server or session setting it is the instance's LockTimeout, 10s if not set
+func (ex *Executor) lockTimeoutSetting() time.Duration {
+	if ex.lockTimeout != nil {
+		return *ex.lockTimeout
+	}
+
+	if ex.timeouts.Lock > 0 {
+		return ex.timeouts.Lock
+	}
+
+	if ex.aria.Config.LockTimeout > 0 {
+		return ex.aria.Config.LockTimeout
+	}
+
+	return 10 * time.Second
+}
+
+// idleTimeoutSetting returns how long a transaction may be left idle, 0 if there is no limit
+func (ex *Executor) idleTimeoutSetting() time.Duration {
+	if ex.idleTimeout != nil {
+		return *ex.idleTimeout
+	}
+
+	return ex.timeouts.IdleInTransaction
+}
+
+// timeoutSetting parses the value of a timeout setting, a number of milliseconds or a duration such as '30s'.  0 is no limit
+func timeoutSetting(name string, value interface{}) (*time.Duration, error) {
+	switch v := value.(type) {
+	case uint64:
+		timeout := time.Duration(v) * time.Millisecond
+		return &timeout, nil
+	case string:
+		timeout, err := time.ParseDuration(strings.Trim(v, `'"`))
+		if err == nil && timeout >= 0 {
+			return &timeout, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s must be a number of milliseconds or a duration such as '30s'", name)
+}
+
+// synchronousReplicas returns the number of replicas a COMMIT waits for
+func (ex *Executor) synchronousReplicas() int {
+	if ex.syncReplicas != nil {
+		return *ex.syncReplicas
+	}
+
+	return ex.aria.Config.SynchronousReplicas
+}
+
+// isWrite returns true if the statement modifies data, users or schema
+func isWrite(stmt parser.Statement) bool {
+	switch stmt.(type) {
+	case *parser.CreateDatabaseStmt, *parser.DropDatabaseStmt, *parser.CreateTableStmt, *parser.DropTableStmt,
+		*parser.AlterTableStmt, *parser.CreateIndexStmt, *parser.DropIndexStmt, *parser.InsertStmt,
+		*parser.UpdateStmt, *parser.DeleteStmt, *parser.BeginStmt, *parser.CommitStmt, *parser.RollbackStmt,
+		*parser.SavepointStmt, *parser.ReleaseSavepointStmt, *parser.PrepareTransactionStmt,
+		*parser.CreateUserStmt, *parser.DropUserStmt, *parser.AlterUserStmt, *parser.GrantStmt, *parser.RevokeStmt,
+		*parser.CreateProcedureStmt, *parser.DropProcedureStmt, *parser.ExecStmt:
+		return true
+	}
+
+	return false
+}
+
+// Replayer applies WAL records streamed from a primary to a replica
+// Records are executed on one executor per originating channel so the transactions of concurrent clients stay apart, every record is appended to the replica's WAL with its original LSN
+type Replayer struct {
+	aria      *core.AriaSQL        // AriaSQL instance pointer
+	user      *catalog.User        // User records are applied as, privileges are bypassed
+	executors map[uint64]*Executor // Executors of channels with an open transaction
+	xids      map[uint64]uint64    // Transaction id on the primary of each open transaction, by channel
+}
+
+// NewReplayer creates a new Replayer applying records as user
+// A Replayer is kept for as long as the replica applies the stream, a primary which reconnects resumes within the transactions it left open
+func NewReplayer(aria *core.AriaSQL, user *catalog.User) *Replayer {
+	return &Replayer{aria: aria, user: user, executors: make(map[uint64]*Executor), xids: make(map[uint64]uint64)}
+}
+
+// Close rolls back the transactions the primary left open, releasing their locks, once its stream is no longer applied
+func (r *Replayer) Close() {
+	for channel := range r.executors {
+		r.rollback(channel)
+	}
+}
+
+// rollback rolls back the transaction open on a channel
+func (r *Replayer) rollback(channel uint64) {
+	ex := r.executors[channel]
+
+	delete(r.executors, channel)
+	delete(r.xids, channel)
+
+	ex.Close() // nothing is logged, the rollback is not part of the primary's stream
+}
+
+// Apply executes a WAL record and appends it to the WAL
+func (r *Replayer) Apply(rec *wal.Record) error {
+	if rec.LSN <= r.aria.WAL.LSN() {
+		return nil // already applied
+	}
+
+	xid := rec.Xid // rewritten with this server's transaction once appended
+
+	// A primary which restarted hands out its channel ids again, the transaction it left open on the channel was undone there.
+	// It shows by a record of another transaction or a BEGIN, which the primary only logs outside of one
+	if open, ok := r.xids[rec.Channel]; ok && xid != 0 && xid != open {
+		r.rollback(rec.Channel)
+	} else if begin, ok := rec.Stmt.(*parser.BeginStmt); ok && !begin.SetTransaction && r.executors[rec.Channel] != nil {
+		r.rollback(rec.Channel)
+	}
+
+	ex, ok := r.executors[rec.Channel]
+	if !ok {
+		ex = New(r.aria, &core.Channel{ChannelID: rec.Channel, User: r.user})
+		ex.recover = true
+		ex.replaying = true
+	}
+
+	// The record carries the database its channel had selected
+	if rec.Database != "" {
+		ex.ch.Database = r.aria.Catalog.GetDatabase(rec.Database)
+	} else {
+		ex.ch.Database = nil
+	}
+
+	ex.replayRecord = rec
+
+	// Statements are logged once they succeeded, so a record which fails here failed only on this server
+	err := ex.Execute(rec.Stmt)
+	if err != nil {
+		log.Printf("replication: LSN %d failed: %s", rec.LSN, err.Error())
+	}
+
+	// Statements which failed or are not logged are still appended so the LSNs line up with the primary
+	if ex.replayRecord != nil {
+		ex.replayRecord = nil
+		rec.Xid, rec.Commit = 0, false // no transaction of this server ran it
+
+		err = r.aria.WAL.AppendRecord(rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ex.TransactionBegun {
+		r.executors[rec.Channel] = ex
+
+		if xid != 0 {
+			r.xids[rec.Channel] = xid
+		}
+	} else {
+		delete(r.executors, rec.Channel)
+		delete(r.xids, rec.Channel)
+	}
+
+	return nil
+}
+
+// SetRecover sets the recover flag
 func (ex *Executor) SetRecover(rec bool) {
 	ex.recover = rec
 }
@@ -5681,6 +7378,11 @@ func (ex *Executor) GetResultSet() []byte {
 	return ex.ResultSetBuffer
 }
 
+// GetResult returns the columns and rows of the result set, nil if the statement had none
+func (ex *Executor) GetResult() *Result {
+	return ex.result
+}
+
 // SetJsonOutput sets the json output flag
 func (ex *Executor) SetJsonOutput(jsonOutput bool) {
 	ex.json = jsonOutput
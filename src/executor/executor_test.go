@@ -19,13 +19,17 @@ package executor
 import (
 	"ariasql/catalog"
 	"ariasql/core"
+	"ariasql/lock"
 	"ariasql/parser"
 	"ariasql/wal"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -7240,7 +7244,7 @@ func TestStmt38(t *testing.T) {
 	ex.Clear()
 
 	stmt = []byte(`
-	SELECT * FROM users;
+	SELECT * FROM users ORDER BY user_id;
 `)
 
 	lexer = parser.NewLexer(stmt)
@@ -8417,22 +8421,6 @@ func TestExecutor_Recover(t *testing.T) {
 		return
 	}
 
-	wal, err := wal.OpenWAL("./test/wal.dat", os.O_CREATE|os.O_RDWR, 0644)
-	if err != nil {
-		t.Errorf("OpenWAL failed: %v", err)
-		return
-	}
-
-	defer wal.Close()
-
-	asts, err := wal.RecoverASTs()
-	if err != nil {
-		t.Fatal(err)
-		return
-	}
-
-	wal.Close()
-
 	aria, err := core.New(&core.Config{
 		DataDir: "./test",
 	})
@@ -8442,8 +8430,6 @@ func TestExecutor_Recover(t *testing.T) {
 		return
 	}
 
-	defer aria.Close()
-
 	aria.Catalog = catalog.New(aria.Config.DataDir)
 
 	if err = aria.Catalog.Open(); err != nil {
@@ -8455,14 +8441,11 @@ func TestExecutor_Recover(t *testing.T) {
 
 	aria.ChannelsLock = &sync.Mutex{}
 
-	user := aria.Catalog.GetUser("admin")
-
-	ch := aria.OpenChannel(user)
-
-	ex := New(aria, ch)
+	ex := New(aria, nil)
 	ex.SetRecover(true)
 
-	err = ex.Recover(asts)
+	// Without a target every record of the WAL is replayed
+	err = ex.RecoverTo(&wal.RecoveryTarget{})
 	if err != nil {
 		t.Fatal(err)
 		return
@@ -8488,9 +8471,9 @@ func TestExecutor_Recover(t *testing.T) {
 
 	aria.ChannelsLock = &sync.Mutex{}
 
-	user = aria.Catalog.GetUser("admin")
+	user := aria.Catalog.GetUser("admin")
 
-	ch = aria.OpenChannel(user)
+	ch := aria.OpenChannel(user)
 
 	ex = New(aria, ch)
 
@@ -8546,6 +8529,129 @@ func TestExecutor_Recover(t *testing.T) {
 	}
 }
 
+func TestExecutor_RecoverTo(t *testing.T) {
+	defer os.RemoveAll("./test/")
+
+	aria, err := core.New(&core.Config{
+		DataDir:    "./test",
+		WALArchive: "./test/archive",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	aria.Catalog = catalog.New(aria.Config.DataDir)
+
+	if err := aria.Catalog.Open(); err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	aria.Channels = make([]*core.Channel, 0)
+	aria.ChannelsLock = &sync.Mutex{}
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	execute := func(ex *Executor, stmt string) {
+		t.Log(stmt)
+
+		lexer := parser.NewLexer([]byte(stmt))
+		p := parser.NewParser(lexer)
+		ast, err := p.Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ex.Clear()
+
+		err = ex.Execute(ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	execute(ex, "CREATE DATABASE test;")
+	execute(ex, "USE test;")
+	execute(ex, "CREATE TABLE test (x INT);")
+	execute(ex, "INSERT INTO test (x) VALUES (1);")
+
+	// Base backup, the records so far are archived
+	aria.Catalog.Close()
+
+	_, err = aria.BaseBackup()
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	aria.Catalog = catalog.New(aria.Config.DataDir)
+
+	if err := aria.Catalog.Open(); err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	ex.ch.Database = aria.Catalog.GetDatabase("test")
+
+	execute(ex, "USE test;")
+	execute(ex, "INSERT INTO test (x) VALUES (2);")
+
+	until := aria.WAL.LSN()
+
+	execute(ex, "DELETE FROM test WHERE x = 1;")
+
+	ex = New(aria, nil)
+	ex.SetRecover(true)
+
+	err = ex.RecoverTo(&wal.RecoveryTarget{LSN: until})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	aria, err = core.New(&core.Config{
+		DataDir: "./test",
+	})
+	if err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	defer aria.Close()
+
+	aria.Catalog = catalog.New(aria.Config.DataDir)
+
+	if err := aria.Catalog.Open(); err != nil {
+		t.Fatal(err)
+		return
+	}
+
+	aria.Channels = make([]*core.Channel, 0)
+	aria.ChannelsLock = &sync.Mutex{}
+
+	if aria.WAL.LSN() != until {
+		t.Fatalf("expected WAL to continue from LSN %d, got %d", until, aria.WAL.LSN())
+	}
+
+	ex = New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	execute(ex, "USE test;")
+	execute(ex, "SELECT * FROM test;")
+
+	expect := `+---+
+| x |
++---+
+| 1 |
+| 2 |
++---+
+`
+
+	if string(ex.ResultSetBuffer) != expect {
+		t.Fatalf("expected %s, got %s", expect, string(ex.ResultSetBuffer))
+	}
+}
+
 func TestStmt44(t *testing.T) {
 	defer os.RemoveAll("./test/")
 
@@ -14465,7 +14571,6 @@ func TestStmt78(t *testing.T) {
 | 2       | 'adoe'             |
 | 3       | 'bdoe'             |
 | 4       | 'cdoe'             |
-| 5       | 'updated_username' |
 | 6       | 'edoe'             |
 | 7       | 'fdoe'             |
 | 8       | 'gdoe'             |
@@ -14477,6 +14582,7 @@ func TestStmt78(t *testing.T) {
 | 14      | 'mdoe'             |
 | 15      | 'ndoe'             |
 | 16      | 'odo'              |
+| 5       | 'updated_username' |
 +---------+--------------------+
 `
 
@@ -18491,3 +18597,1740 @@ func TestStmt99(t *testing.T) {
 
 	log.Println(string(ex.ResultSetBuffer))
 }
+
+// openTestInstance opens an AriaSQL instance within a temporary directory
+func openTestInstance(t *testing.T) *core.AriaSQL {
+	aria, err := core.New(&core.Config{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aria.Catalog = catalog.New(aria.Config.DataDir)
+
+	if err := aria.Catalog.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	aria.Channels = make([]*core.Channel, 0)
+	aria.ChannelsLock = &sync.Mutex{}
+
+	t.Cleanup(func() { aria.Close() })
+
+	return aria
+}
+
+// executeSQL parses and executes a statement, returning the JSON result set
+func executeSQL(ex *Executor, sql string) (string, error) {
+	stmt, err := parser.NewParser(parser.NewLexer([]byte(sql))).Parse()
+	if err != nil {
+		return "", err
+	}
+
+	ex.Clear()
+
+	err = ex.Execute(stmt)
+	if err != nil {
+		return "", err
+	}
+
+	return string(ex.GetResultSet()), nil
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex1.SetJsonOutput(true)
+	ex2.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (1);",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex2, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Uncommitted changes are only visible to their own transaction
+	for _, sql := range []string{"BEGIN;", "INSERT INTO t (val) VALUES (2);", "UPDATE t SET val = 10 WHERE id = 1;"} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	result, err := executeSQL(ex1, "SELECT val FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(result, `"val":10`) || !strings.Contains(result, `"val":2`) || strings.Contains(result, `"val":1}`) {
+		t.Fatalf("expected own changes, got %s", result)
+	}
+
+	result, err = executeSQL(ex2, "SELECT val FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"val":1}]` {
+		t.Fatalf("expected committed rows only, got %s", result)
+	}
+
+	// A transaction begun before the commit keeps reading its snapshot
+	if _, err := executeSQL(ex2, "BEGIN;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex1, "COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = executeSQL(ex2, "SELECT val FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"val":1}]` {
+		t.Fatalf("expected snapshot rows, got %s", result)
+	}
+
+	// Writing a row changed since the snapshot was taken is a conflict
+	if _, err := executeSQL(ex2, "UPDATE t SET val = 20 WHERE id = 1;"); err == nil || err.Error() != "could not serialize access due to concurrent update" {
+		t.Fatalf("expected serialization error, got %v", err)
+	}
+
+	if _, err := executeSQL(ex2, "ROLLBACK;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = executeSQL(ex2, "SELECT val FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"val":2},{"val":10}]` {
+		t.Fatalf("expected committed rows, got %s", result)
+	}
+}
+
+func TestSnapshotIsolationRollback(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (1), (2);",
+		"BEGIN;",
+		"INSERT INTO t (val) VALUES (3);",
+		"UPDATE t SET val = 10 WHERE id = 1;",
+		"DELETE FROM t WHERE id = 2;",
+		"ROLLBACK;",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	result, err := executeSQL(ex, "SELECT * FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"val":1},{"id":2,"val":2}]` {
+		t.Fatalf("expected rows before the transaction, got %s", result)
+	}
+
+	// Once no snapshot can see them the versions a committed transaction deleted are reclaimed
+	for _, sql := range []string{"UPDATE t SET val = 10 WHERE id = 1;", "DELETE FROM t WHERE id = 2;"} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	tbl := ex.ch.Database.GetTable("t")
+
+	rows := 0
+	for iter := tbl.NewIterator(); iter.Valid(); {
+		row, err := iter.Next()
+		if err == nil && row != nil {
+			rows++
+		}
+	}
+
+	if rows != 1 {
+		t.Fatalf("expected 1 stored row version, got %d", rows)
+	}
+}
+
+func TestIsolationLevels(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex1.SetJsonOutput(true)
+	ex2.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE doctors (id INT NOT NULL UNIQUE SEQUENCE, on_call INT);",
+		"INSERT INTO doctors (on_call) VALUES (1), (1);",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex2, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read committed statements see what committed before they started
+	if _, err := executeSQL(ex2, "BEGIN ISOLATION LEVEL READ COMMITTED;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex1, "INSERT INTO doctors (on_call) VALUES (0);"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex2, "SELECT COUNT(*) FROM doctors;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"COUNT":3}]` {
+		t.Fatalf("expected newly committed row, got %s", result)
+	}
+
+	if _, err := executeSQL(ex2, "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE;"); err == nil {
+		t.Fatal("expected error changing the isolation level after a statement")
+	}
+
+	if _, err := executeSQL(ex2, "COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Write skew, both take a doctor off call after checking another one stays on call
+	if _, err := executeSQL(ex1, "BEGIN ISOLATION LEVEL SERIALIZABLE;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex2, "SET TRANSACTION ISOLATION LEVEL SERIALIZABLE;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex2, "BEGIN;"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ex := range []*Executor{ex1, ex2} {
+		result, err := executeSQL(ex, "SELECT COUNT(*) FROM doctors WHERE on_call = 1;")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result != `[{"COUNT":2}]` {
+			t.Fatalf("expected two doctors on call, got %s", result)
+		}
+	}
+
+	if _, err := executeSQL(ex1, "UPDATE doctors SET on_call = 0 WHERE id = 1;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex2, "UPDATE doctors SET on_call = 0 WHERE id = 2;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex1, "COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex2, "COMMIT;"); err == nil || err.Error() != "could not serialize access due to concurrent update" {
+		t.Fatalf("expected serialization error, got %v", err)
+	}
+
+	if ex2.TransactionBegun {
+		t.Fatal("expected the transaction to be rolled back")
+	}
+
+	result, err = executeSQL(ex2, "SELECT COUNT(*) FROM doctors WHERE on_call = 1;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"COUNT":1}]` {
+		t.Fatalf("expected one doctor on call, got %s", result)
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (1);",
+		"BEGIN;",
+		"INSERT INTO t (val) VALUES (2);",
+		"SAVEPOINT batch;",
+		"INSERT INTO t (val) VALUES (3);",
+		"UPDATE t SET val = 10 WHERE id = 1;",
+		"SAVEPOINT inner_batch;",
+		"DELETE FROM t WHERE id = 2;",
+		"ROLLBACK TO SAVEPOINT batch;",
+		"INSERT INTO t (val) VALUES (4);",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// Savepoints set after the one rolled back to are gone
+	if _, err := executeSQL(ex, "ROLLBACK TO SAVEPOINT inner_batch;"); err == nil || err.Error() != "savepoint does not exist" {
+		t.Fatalf("expected savepoint does not exist, got %v", err)
+	}
+
+	// The savepoint rolled back to stays until released
+	for _, sql := range []string{"ROLLBACK TO batch;", "INSERT INTO t (val) VALUES (5);", "RELEASE SAVEPOINT batch;"} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex, "RELEASE SAVEPOINT batch;"); err == nil {
+		t.Fatal("expected error releasing a released savepoint")
+	}
+
+	if _, err := executeSQL(ex, "COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex, "SELECT val FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"val":1},{"val":2},{"val":5}]` {
+		t.Fatalf("expected rows up to the savepoint and after it, got %s", result)
+	}
+
+	if _, err := executeSQL(ex, "SAVEPOINT batch;"); err == nil || err.Error() != "no transaction begun" {
+		t.Fatalf("expected no transaction begun, got %v", err)
+	}
+}
+
+func TestRowLocks(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex3 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex3.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE accounts (id INT NOT NULL UNIQUE SEQUENCE, balance INT);",
+		"INSERT INTO accounts (balance) VALUES (100), (100);",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	for _, ex := range []*Executor{ex2, ex3} {
+		if _, err := executeSQL(ex, "USE test;"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A writer waits for the transaction which changed the row, and goes on once it rolls back
+	for _, sql := range []string{"BEGIN;", "UPDATE accounts SET balance = 50 WHERE id = 1;"} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	done := make(chan error)
+
+	go func() {
+		_, err := executeSQL(ex2, "UPDATE accounts SET balance = 75 WHERE id = 1;")
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	result, err := executeSQL(ex3, "SHOW LOCKS;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(result, `"Granted":false`) || !strings.Contains(result, `"Table":"test.accounts"`) {
+		t.Fatalf("expected a lock wait, got %s", result)
+	}
+
+	if _, err := executeSQL(ex1, "ROLLBACK;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Deadlock, each transaction waits for the row the other changed
+	for _, sql := range []string{"BEGIN;", "UPDATE accounts SET balance = 0 WHERE id = 1;"} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	for _, sql := range []string{"BEGIN;", "UPDATE accounts SET balance = 200 WHERE id = 2;"} {
+		if _, err := executeSQL(ex2, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	go func() {
+		_, err := executeSQL(ex1, "UPDATE accounts SET balance = 0 WHERE id = 2;")
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := executeSQL(ex2, "UPDATE accounts SET balance = 200 WHERE id = 1;"); err != lock.ErrDeadlock {
+		t.Fatalf("expected %v, got %v", lock.ErrDeadlock, err)
+	}
+
+	if ex2.TransactionBegun {
+		t.Fatal("expected the deadlock victim to be rolled back")
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex1, "COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = executeSQL(ex3, "SELECT balance FROM accounts;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"balance":0},{"balance":0}]` {
+		t.Fatalf("expected both balances of the surviving transaction, got %s", result)
+	}
+
+	result, err = executeSQL(ex3, "SHOW LOCKS;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != "[]" && result != "null" {
+		t.Fatalf("expected no locks, got %s", result)
+	}
+}
+
+func TestSelectForUpdate(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex1.SetJsonOutput(true)
+	ex2.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE jobs (id INT NOT NULL UNIQUE SEQUENCE, status CHAR(16));",
+		"INSERT INTO jobs (status) VALUES ('pending'), ('pending'), ('pending');",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex2, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Workers claim different jobs
+	claim := "SELECT id FROM jobs WHERE status = 'pending' ORDER BY id ASC LIMIT 1 FOR UPDATE SKIP LOCKED;"
+
+	if _, err := executeSQL(ex1, "BEGIN;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex1, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1}]` {
+		t.Fatalf("expected job 1 to be claimed, got %s", result)
+	}
+
+	if _, err := executeSQL(ex2, "BEGIN;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = executeSQL(ex2, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":2}]` {
+		t.Fatalf("expected job 2 to be claimed, got %s", result)
+	}
+
+	// NOWAIT fails instead of waiting for the claimed job
+	if _, err := executeSQL(ex2, "SELECT id FROM jobs WHERE id = 1 FOR UPDATE NOWAIT;"); err != lock.ErrNotAvailable {
+		t.Fatalf("expected %v, got %v", lock.ErrNotAvailable, err)
+	}
+
+	for _, sql := range []string{"UPDATE jobs SET status = 'done' WHERE id = 1;", "COMMIT;"} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex2, "ROLLBACK;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the claims are gone the next worker claims the first pending job
+	result, err = executeSQL(ex2, claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":2}]` {
+		t.Fatalf("expected job 2 to be claimed, got %s", result)
+	}
+
+	// Without a condition every row is locked
+	result, err = executeSQL(ex2, "SELECT id FROM jobs ORDER BY id ASC FOR SHARE;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1},{"id":2},{"id":3}]` {
+		t.Fatalf("expected every job, got %s", result)
+	}
+
+	if _, err := executeSQL(ex2, "SELECT COUNT(*) FROM jobs GROUP BY status FOR UPDATE;"); err == nil {
+		t.Fatal("expected FOR UPDATE with GROUP BY to fail")
+	}
+}
+
+func TestLockTable(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE jobs (id INT NOT NULL UNIQUE SEQUENCE, status CHAR(16));",
+		"INSERT INTO jobs (status) VALUES ('pending');",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex2, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex1, "LOCK TABLE jobs IN EXCLUSIVE MODE;"); err == nil {
+		t.Fatal("expected LOCK TABLE outside of a transaction to fail")
+	}
+
+	for _, sql := range []string{"BEGIN;", "LOCK TABLE jobs IN EXCLUSIVE MODE;"} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// Writers wait for the table lock to be released
+	done := make(chan error)
+
+	go func() {
+		_, err := executeSQL(ex2, "INSERT INTO jobs (status) VALUES ('pending');")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected the insert to wait for the table lock, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := executeSQL(ex1, "COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// A shared table lock lets readers lock rows but not writers
+	for _, sql := range []string{"BEGIN;", "LOCK TABLE jobs IN SHARE MODE;"} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	result, err := executeSQL(ex2, "SELECT id FROM jobs WHERE id = 1 FOR SHARE NOWAIT;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1}]` {
+		t.Fatalf("expected job 1, got %s", result)
+	}
+
+	if _, err := executeSQL(ex2, "SELECT id FROM jobs WHERE id = 1 FOR UPDATE NOWAIT;"); err != lock.ErrNotAvailable {
+		t.Fatalf("expected %v, got %v", lock.ErrNotAvailable, err)
+	}
+
+	if _, err := executeSQL(ex1, "ROLLBACK;"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverTransactions(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() *core.AriaSQL {
+		aria, err := core.New(&core.Config{DataDir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aria.Catalog = catalog.New(aria.Config.DataDir)
+
+		if err := aria.Catalog.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := aria.RecoverTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		aria.Channels = make([]*core.Channel, 0)
+		aria.ChannelsLock = &sync.Mutex{}
+
+		return aria
+	}
+
+	aria := open()
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE jobs (id INT NOT NULL UNIQUE SEQUENCE, status CHAR(16));",
+		"INSERT INTO jobs (status) VALUES ('pending'), ('pending');",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	for _, sql := range []string{"USE test;", "BEGIN;", "UPDATE jobs SET status = 'done' WHERE id = 2;", "COMMIT;"} {
+		if _, err := executeSQL(ex2, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// The server goes down in the middle of a transaction
+	for _, sql := range []string{
+		"BEGIN;",
+		"INSERT INTO jobs (status) VALUES ('lost');",
+		"UPDATE jobs SET status = 'lost' WHERE id = 1;",
+		"DELETE FROM jobs WHERE id = 2;",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	aria.Close()
+
+	aria = open()
+	defer aria.Close()
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex.SetJsonOutput(true)
+
+	if _, err := executeSQL(ex, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex, "SELECT * FROM jobs;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"status":"pending"},{"id":2,"status":"done"}]` {
+		t.Fatalf("expected only the committed changes, got %s", result)
+	}
+
+	// The sequence value and index entry of the undone insert are gone
+	if _, err := executeSQL(ex, "INSERT INTO jobs (status) VALUES ('pending');"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = executeSQL(ex, "SELECT * FROM jobs WHERE id = 3;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":3,"status":"pending"}]` {
+		t.Fatalf("expected the new row to take the undone row's id, got %s", result)
+	}
+}
+
+func TestTransactionalDDL(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE accounts (id INT NOT NULL UNIQUE SEQUENCE, name CHAR(32));",
+		"INSERT INTO accounts (name) VALUES ('alice'), ('bob');",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	db := aria.Catalog.GetDatabase("test")
+
+	// A migration rolled back leaves the catalog as it was
+	for _, sql := range []string{
+		"BEGIN;",
+		"INSERT INTO accounts (name) VALUES ('carol');",
+		"ALTER TABLE accounts ALTER COLUMN balance INT;",
+		"CREATE INDEX accounts_name ON accounts (name);",
+		"INSERT INTO accounts (name, balance) VALUES ('dave', 10);",
+		"CREATE TABLE audit (id INT NOT NULL UNIQUE SEQUENCE, event TEXT);",
+		"INSERT INTO audit (event) VALUES ('migrated');",
+		"ROLLBACK;",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	accounts := db.GetTable("accounts")
+
+	if _, ok := accounts.TableSchema.ColumnDefinitions["balance"]; ok {
+		t.Fatal("expected the added column to be rolled back")
+	}
+
+	if accounts.GetIndex("accounts_name") != nil {
+		t.Fatal("expected the created index to be rolled back")
+	}
+
+	if db.GetTable("audit") != nil {
+		t.Fatal("expected the created table to be rolled back")
+	}
+
+	result, err := executeSQL(ex, "SELECT * FROM accounts;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"name":"alice"},{"id":2,"name":"bob"}]` {
+		t.Fatalf("expected the rows before the transaction, got %s", result)
+	}
+
+	// A dropped table comes back with its rows
+	for _, sql := range []string{"BEGIN;", "DROP TABLE accounts;", "ROLLBACK;"} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	result, err = executeSQL(ex, "SELECT * FROM accounts;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"name":"alice"},{"id":2,"name":"bob"}]` {
+		t.Fatalf("expected the dropped table to be restored, got %s", result)
+	}
+
+	// A failing statement undoes only its own change, the migration goes on and commits
+	for _, sql := range []string{"BEGIN;", "ALTER TABLE accounts ALTER COLUMN balance INT;"} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex, "ALTER TABLE accounts ALTER COLUMN code INT NOT NULL;"); err == nil {
+		t.Fatal("expected a not null column to fail on existing rows")
+	}
+
+	for _, sql := range []string{"CREATE INDEX accounts_name ON accounts (name);", "COMMIT;"} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	accounts = db.GetTable("accounts")
+
+	if _, ok := accounts.TableSchema.ColumnDefinitions["code"]; ok {
+		t.Fatal("expected the failed column to be rolled back")
+	}
+
+	if _, ok := accounts.TableSchema.ColumnDefinitions["balance"]; !ok {
+		t.Fatal("expected the added column to be committed")
+	}
+
+	if accounts.GetIndex("accounts_name") == nil {
+		t.Fatal("expected the created index to be committed")
+	}
+
+	if entries, _ := os.ReadDir(filepath.Join(aria.Config.DataDir, catalog.DB_UNDO_DIRECTORY)); len(entries) != 0 {
+		t.Fatalf("expected no saved tables left, got %d", len(entries))
+	}
+}
+
+func TestRecoverTransactionalDDL(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() *core.AriaSQL {
+		aria, err := core.New(&core.Config{DataDir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aria.Catalog = catalog.New(aria.Config.DataDir)
+
+		if err := aria.Catalog.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := aria.RecoverTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		aria.Channels = make([]*core.Channel, 0)
+		aria.ChannelsLock = &sync.Mutex{}
+
+		return aria
+	}
+
+	aria := open()
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	// The server goes down in the middle of a migration
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE jobs (id INT NOT NULL UNIQUE SEQUENCE, status CHAR(16));",
+		"CREATE TABLE logs (id INT NOT NULL UNIQUE SEQUENCE, line TEXT);",
+		"INSERT INTO jobs (status) VALUES ('pending');",
+		"BEGIN;",
+		"ALTER TABLE jobs ALTER COLUMN priority INT;",
+		"CREATE INDEX jobs_status ON jobs (status);",
+		"DROP TABLE logs;",
+		"CREATE TABLE workers (id INT NOT NULL UNIQUE SEQUENCE);",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	aria.Close()
+
+	aria = open()
+	defer aria.Close()
+
+	db := aria.Catalog.GetDatabase("test")
+
+	jobs := db.GetTable("jobs")
+	if jobs == nil {
+		t.Fatal("expected table jobs")
+	}
+
+	if _, ok := jobs.TableSchema.ColumnDefinitions["priority"]; ok {
+		t.Fatal("expected the added column to be rolled back")
+	}
+
+	if jobs.GetIndex("jobs_status") != nil {
+		t.Fatal("expected the created index to be rolled back")
+	}
+
+	if db.GetTable("logs") == nil {
+		t.Fatal("expected the dropped table to be restored")
+	}
+
+	if db.GetTable("workers") != nil {
+		t.Fatal("expected the created table to be rolled back")
+	}
+
+	if _, err := os.Stat(filepath.Join(db.Directory, "workers")); !os.IsNotExist(err) {
+		t.Fatal("expected the directory of the created table to be removed")
+	}
+
+	ex = New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex.SetJsonOutput(true)
+
+	if _, err := executeSQL(ex, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex, "SELECT * FROM jobs;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"status":"pending"}]` {
+		t.Fatalf("expected the rows before the migration, got %s", result)
+	}
+}
+
+func TestPreparedTransaction(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex1.SetJsonOutput(true)
+	ex2.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE orders (id INT NOT NULL UNIQUE SEQUENCE, status CHAR(16));",
+		"INSERT INTO orders (status) VALUES ('new');",
+		"BEGIN;",
+		"INSERT INTO orders (status) VALUES ('paid');",
+		"PREPARE TRANSACTION 'order-2';",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if ex1.TransactionBegun {
+		t.Fatal("expected the session to be detached from the prepared transaction")
+	}
+
+	if _, err := executeSQL(ex2, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex2, "SELECT * FROM orders;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"status":"new"}]` {
+		t.Fatalf("expected the prepared row to be invisible, got %s", result)
+	}
+
+	result, err = executeSQL(ex2, "SHOW PREPARED TRANSACTIONS;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(result, `"Gid":"order-2"`) || !strings.Contains(result, `"Owner":"admin"`) {
+		t.Fatalf("expected prepared transaction order-2, got %s", result)
+	}
+
+	// A global transaction id in doubt cannot be reused
+	for _, sql := range []string{"BEGIN;", "INSERT INTO orders (status) VALUES ('lost');", "PREPARE TRANSACTION 'order-2';"} {
+		_, err = executeSQL(ex1, sql)
+	}
+
+	if err == nil {
+		t.Fatal("expected error for a global transaction id in use")
+	}
+
+	if ex1.TransactionBegun {
+		t.Fatal("expected the transaction which could not be prepared to be rolled back")
+	}
+
+	if _, err := executeSQL(ex2, "COMMIT PREPARED 'order-3';"); err == nil {
+		t.Fatal("expected error for an unknown prepared transaction")
+	}
+
+	if _, err := executeSQL(ex2, "COMMIT PREPARED 'order-2';"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = executeSQL(ex2, "SELECT * FROM orders;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"status":"new"},{"id":2,"status":"paid"}]` {
+		t.Fatalf("expected the committed row, got %s", result)
+	}
+
+	for _, sql := range []string{
+		"BEGIN;",
+		"DELETE FROM orders WHERE id = 1;",
+		"PREPARE TRANSACTION 'order-1';",
+		"ROLLBACK PREPARED 'order-1';",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	result, err = executeSQL(ex2, "SELECT * FROM orders;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"status":"new"},{"id":2,"status":"paid"}]` {
+		t.Fatalf("expected the deleted row to be restored, got %s", result)
+	}
+
+	if len(aria.PreparedTransactions()) != 0 {
+		t.Fatal("expected no prepared transactions in doubt")
+	}
+}
+
+func TestRecoverPreparedTransaction(t *testing.T) {
+	dir := t.TempDir()
+
+	open := func() *core.AriaSQL {
+		aria, err := core.New(&core.Config{DataDir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		aria.Catalog = catalog.New(aria.Config.DataDir)
+
+		if err := aria.Catalog.Open(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := aria.RecoverTransactions(); err != nil {
+			t.Fatal(err)
+		}
+
+		aria.Channels = make([]*core.Channel, 0)
+		aria.ChannelsLock = &sync.Mutex{}
+
+		return aria
+	}
+
+	aria := open()
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	// The server goes down while the coordinator has yet to decide
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE orders (id INT NOT NULL UNIQUE SEQUENCE, status CHAR(16));",
+		"INSERT INTO orders (status) VALUES ('new');",
+		"INSERT INTO orders (status) VALUES ('new');",
+		"BEGIN;",
+		"UPDATE orders SET status = 'paid' WHERE id = 1;",
+		"PREPARE TRANSACTION 'pay-1';",
+		"BEGIN;",
+		"DELETE FROM orders WHERE id = 2;",
+		"CREATE TABLE refunds (id INT NOT NULL UNIQUE SEQUENCE);",
+		"PREPARE TRANSACTION 'cancel-2';",
+		"BEGIN;",
+		"INSERT INTO orders (status) VALUES ('lost');",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	aria.Close()
+
+	aria = open()
+
+	prepared := aria.PreparedTransactions()
+	if len(prepared) != 2 || prepared[0].Gid != "pay-1" || prepared[1].Gid != "cancel-2" {
+		t.Fatalf("expected prepared transactions pay-1 and cancel-2, got %d", len(prepared))
+	}
+
+	if prepared[0].Owner != "admin" || prepared[0].Database != "test" {
+		t.Fatalf("expected pay-1 prepared by admin in test, got %s in %s", prepared[0].Owner, prepared[0].Database)
+	}
+
+	ex = New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex.SetJsonOutput(true)
+
+	if _, err := executeSQL(ex, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex, "SELECT * FROM orders;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"status":"new"},{"id":2,"status":"new"}]` {
+		t.Fatalf("expected the prepared changes to be invisible, got %s", result)
+	}
+
+	// The resumed transactions hold their locks again
+	if _, err := executeSQL(ex, "SELECT * FROM orders WHERE id = 2 FOR UPDATE NOWAIT;"); err == nil {
+		t.Fatal("expected the row deleted by cancel-2 to be locked")
+	}
+
+	if _, err := executeSQL(ex, "COMMIT PREPARED 'pay-1';"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex, "ROLLBACK PREPARED 'cancel-2';"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err = executeSQL(ex, "SELECT * FROM orders;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":2,"status":"new"},{"id":1,"status":"paid"}]` {
+		t.Fatalf("expected pay-1 committed and cancel-2 rolled back, got %s", result)
+	}
+
+	if aria.Catalog.GetDatabase("test").GetTable("refunds") != nil {
+		t.Fatal("expected the table created by cancel-2 to be rolled back")
+	}
+
+	aria.Close()
+
+	aria = open()
+	defer aria.Close()
+
+	if len(aria.PreparedTransactions()) != 0 {
+		t.Fatal("expected no prepared transactions in doubt")
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (0);",
+		"SET statement_timeout = '200ms';",
+		"BEGIN;",
+		"INSERT INTO t (val) VALUES (100);",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// A runaway loop is canceled and the transaction rolled back
+	start := time.Now()
+
+	_, err := executeSQL(ex, "WHILE @@FETCH_STATUS = 0 BEGIN UPDATE t SET val = val + 1 WHERE id = 1; END;")
+	if err != ErrStatementTimeout {
+		t.Fatalf("expected statement timeout, got %v", err)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the loop to be canceled after 200ms, took %s", time.Since(start))
+	}
+
+	if ex.TransactionBegun {
+		t.Fatal("expected the transaction to be rolled back")
+	}
+
+	if _, err := executeSQL(ex, "SET statement_timeout = DEFAULT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex, "SELECT * FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"val":0}]` {
+		t.Fatalf("expected the transaction's changes to be undone, got %s", result)
+	}
+
+	if _, err := executeSQL(ex, "SET statement_timeout = 'soon';"); err == nil {
+		t.Fatal("expected error for an invalid timeout")
+	}
+}
+
+func TestLockTimeoutSetting(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (0);",
+		"BEGIN;",
+		"UPDATE t SET val = 1 WHERE id = 1;",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	ex2.SetTimeouts(Timeouts{Lock: time.Minute})
+
+	for _, sql := range []string{"USE test;", "SET lock_timeout = 50;"} {
+		if _, err := executeSQL(ex2, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	start := time.Now()
+
+	if _, err := executeSQL(ex2, "UPDATE t SET val = 2 WHERE id = 1;"); err != lock.ErrTimeout {
+		t.Fatalf("expected lock timeout, got %v", err)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("expected the session setting to override the server's, waited %s", time.Since(start))
+	}
+
+	// The statement timeout ends a lock wait as well
+	for _, sql := range []string{"SET lock_timeout = 0;", "SET statement_timeout = 50;", "BEGIN;"} {
+		if _, err := executeSQL(ex2, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if _, err := executeSQL(ex2, "UPDATE t SET val = 2 WHERE id = 1;"); err != ErrStatementTimeout {
+		t.Fatalf("expected statement timeout, got %v", err)
+	}
+
+	if ex2.TransactionBegun {
+		t.Fatal("expected the transaction to be rolled back")
+	}
+}
+
+func TestIdleInTransactionTimeout(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2.SetJsonOutput(true)
+	ex1.SetTimeouts(Timeouts{IdleInTransaction: 50 * time.Millisecond})
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (0);",
+		"BEGIN;",
+		"UPDATE t SET val = 1 WHERE id = 1;",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// The abandoned transaction lets go of its row lock
+	if _, err := executeSQL(ex2, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex2, "UPDATE t SET val = 2 WHERE id = 1;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex1, "COMMIT;"); err != ErrIdleInTransactionTimeout {
+		t.Fatalf("expected idle in transaction timeout, got %v", err)
+	}
+
+	if ex1.TransactionBegun {
+		t.Fatal("expected the transaction to be rolled back")
+	}
+
+	result, err := executeSQL(ex2, "SELECT * FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"val":2}]` {
+		t.Fatalf("expected the idle transaction's update to be undone, got %s", result)
+	}
+
+	// The session goes on
+	if _, err := executeSQL(ex1, "SELECT * FROM t;"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKill(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex3 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex3.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (0);",
+		"BEGIN;",
+		"UPDATE t SET val = 1 WHERE id = 1;",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	for _, sql := range []string{"USE test;", "BEGIN;", "INSERT INTO t (val) VALUES (5);"} {
+		if _, err := executeSQL(ex2, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// The second session waits for the first one's row lock
+	done := make(chan error, 1)
+	go func() {
+		_, err := executeSQL(ex2, "UPDATE t SET val = 2 WHERE id = 1;")
+		done <- err
+	}()
+
+	waiting := func() bool {
+		for _, p := range aria.Processes() {
+			if p.ChannelID == ex2.ch.ChannelID {
+				return p.State == "active in transaction"
+			}
+		}
+
+		return false
+	}
+
+	for !waiting() {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, err := executeSQL(ex3, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex3, "SHOW PROCESSLIST;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(result, `"Statement":"UPDATE t SET val = 2 WHERE id = 1;"`) || !strings.Contains(result, `"State":"idle in transaction"`) {
+		t.Fatalf("expected the waiting update and the idle transaction, got %s", result)
+	}
+
+	if _, err := executeSQL(ex3, fmt.Sprintf("KILL QUERY %d;", ex2.ch.ChannelID)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != ErrQueryCanceled {
+		t.Fatalf("expected the update to be canceled, got %v", err)
+	}
+
+	if ex2.TransactionBegun {
+		t.Fatal("expected the canceled statement's transaction to be rolled back")
+	}
+
+	if _, err := executeSQL(ex3, fmt.Sprintf("KILL QUERY %d;", ex1.ch.ChannelID)); err == nil {
+		t.Fatal("expected error for a channel not executing a statement")
+	}
+
+	if _, err := executeSQL(ex3, fmt.Sprintf("KILL %d;", ex1.ch.ChannelID)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex1, "COMMIT;"); err != ErrSessionKilled {
+		t.Fatalf("expected the killed session to end, got %v", err)
+	}
+
+	if ex1.TransactionBegun {
+		t.Fatal("expected the killed session's transaction to be rolled back")
+	}
+
+	result, err = executeSQL(ex3, "SELECT * FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"val":0}]` {
+		t.Fatalf("expected both transactions to be rolled back, got %s", result)
+	}
+
+	if _, err := executeSQL(ex3, "KILL 999;"); err == nil {
+		t.Fatal("expected error for an unknown channel")
+	}
+}
+
+func TestClose(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex1 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2 := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	ex2.SetJsonOutput(true)
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (0);",
+		"DECLARE c CURSOR FOR SELECT * FROM t;",
+		"BEGIN;",
+		"UPDATE t SET val = 1 WHERE id = 1;",
+		"INSERT INTO t (val) VALUES (5);",
+	} {
+		if _, err := executeSQL(ex1, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// The channel closes mid transaction
+	ex1.Close()
+	aria.CloseChannel(ex1.ch)
+
+	if ex1.TransactionBegun || ex1.Transaction != nil {
+		t.Fatal("expected the open transaction to be rolled back")
+	}
+
+	if ex1.cursors != nil {
+		t.Fatal("expected the cursors to be released")
+	}
+
+	if len(aria.Locks.Locks()) != 0 {
+		t.Fatal("expected the transaction's locks to be released")
+	}
+
+	for _, sql := range []string{"USE test;", "SET lock_timeout = 100;", "UPDATE t SET val = 2 WHERE id = 1;"} {
+		if _, err := executeSQL(ex2, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	result, err := executeSQL(ex2, "SELECT * FROM t;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result != `[{"id":1,"val":2}]` {
+		t.Fatalf("expected the closed channel's writes to be undone, got %s", result)
+	}
+
+	// Closing twice does nothing more
+	ex1.Close()
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	aria := openTestInstance(t)
+	aria.Catalog.LoginPolicy = &catalog.LoginPolicy{MinPasswordLength: 8, PasswordComplexity: 3, PasswordLifetime: time.Hour}
+
+	admin := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	// Passwords must be long and mixed enough
+	for sql, expect := range map[string]string{
+		"CREATE USER bob IDENTIFIED BY 'Sh0rt';":              "password must be at least 8 characters long",
+		"CREATE USER bob IDENTIFIED BY 'longbutlowercase';":   "password must mix at least 3 of lowercase letters, uppercase letters, digits and symbols",
+		"CREATE USER bob IDENTIFIED BY 'Long3nough';":         "",
+		"ALTER USER bob SET PASSWORD 'alsolowercase';":        "password must mix at least 3 of lowercase letters, uppercase letters, digits and symbols",
+		"CREATE USER svc IDENTIFIED BY CERTIFICATE 'CN=svc';": "",
+	} {
+		_, err := executeSQL(admin, sql)
+		if (expect == "" && err != nil) || (expect != "" && (err == nil || err.Error() != expect)) {
+			t.Fatalf("%s: expected %q, got %v", sql, expect, err)
+		}
+	}
+
+	if _, err := executeSQL(admin, "GRANT CONNECT TO bob;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A password older than its lifetime must be changed before anything else
+	bob := aria.Catalog.GetUser("bob")
+	bob.PasswordChanged = time.Now().Add(-2 * time.Hour)
+
+	ex := New(aria, aria.OpenChannel(bob))
+
+	if _, err := executeSQL(ex, "SHOW DATABASES;"); err == nil || err.Error() != "password expired, change it with ALTER USER bob SET PASSWORD" {
+		t.Fatalf("expected the password to have expired, got %v", err)
+	}
+
+	// Users change their own password without ALTER, but not someone else's
+	if _, err := executeSQL(ex, "ALTER USER bob SET PASSWORD 'N3wPassword';"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := executeSQL(ex, "ALTER USER admin SET PASSWORD 'N3wPassword';"); err == nil || !strings.Contains(err.Error(), "privilege to ALTER") {
+		t.Fatalf("expected bob to need ALTER to change admin's password, got %v", err)
+	}
+
+	if aria.Catalog.PasswordExpired("bob") {
+		t.Fatal("expected the new password to be valid")
+	}
+
+	if _, err := aria.Catalog.AuthenticateUser("bob", "N3wPassword"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A locked account is refused until it is unlocked
+	if _, err := executeSQL(admin, "ALTER USER bob ACCOUNT LOCK;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := aria.Catalog.AuthenticateUser("bob", "N3wPassword"); err != catalog.ErrAccountLocked {
+		t.Fatalf("expected bob to be locked, got %v", err)
+	}
+
+	if _, err := executeSQL(admin, "ALTER USER bob ACCOUNT UNLOCK;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := aria.Catalog.AuthenticateUser("bob", "N3wPassword"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitSyncsWAL(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	// A statement outside a transaction commits on its own
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, val INT);",
+		"INSERT INTO t (val) VALUES (1);",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if aria.WAL.Synced() != aria.WAL.LSN() {
+		t.Fatalf("expected the insert to be flushed, synced %d of %d", aria.WAL.Synced(), aria.WAL.LSN())
+	}
+
+	for _, sql := range []string{"BEGIN;", "INSERT INTO t (val) VALUES (2);"} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// A transaction's records are flushed by its commit
+	if _, err := executeSQL(ex, "COMMIT;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if aria.WAL.Synced() != aria.WAL.LSN() {
+		t.Fatalf("expected the commit to be flushed, synced %d of %d", aria.WAL.Synced(), aria.WAL.LSN())
+	}
+
+	// and a prepared transaction by its prepare
+	for _, sql := range []string{"BEGIN;", "INSERT INTO t (val) VALUES (3);", "PREPARE TRANSACTION 'tx1';"} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if aria.WAL.Synced() != aria.WAL.LSN() {
+		t.Fatalf("expected the prepare to be flushed, synced %d of %d", aria.WAL.Synced(), aria.WAL.LSN())
+	}
+}
+
+func TestFailedStatementNotLogged(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE, val INT);",
+		"INSERT INTO t (id, val) VALUES (1, 1);",
+		"CREATE USER alice IDENTIFIED BY 'Password1!';",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	lsn := aria.WAL.LSN()
+
+	// Every statement fails, none of them may reach the WAL and so the replicas
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"DROP DATABASE missing;",
+		"CREATE USER alice IDENTIFIED BY 'Password1!';",
+		"DROP USER bob;",
+		"INSERT INTO t (id, val) VALUES (1, 2);",
+		"DROP PROCEDURE missing;",
+	} {
+		if _, err := executeSQL(ex, sql); err == nil {
+			t.Fatalf("%s: expected an error", sql)
+		}
+	}
+
+	if aria.WAL.LSN() != lsn {
+		t.Fatalf("expected no record to be logged, LSN went from %d to %d", lsn, aria.WAL.LSN())
+	}
+}
+
+func TestReplayerRestartedPrimary(t *testing.T) {
+	aria := openTestInstance(t)
+
+	replayer := NewReplayer(aria, aria.Catalog.GetUser("admin"))
+
+	// The primary's first run leaves a transaction open on channel 1, its second run hands the channel out again
+	records := []struct {
+		database string
+		xid      uint64
+		sql      string
+	}{
+		{"", 0, "CREATE DATABASE test;"},
+		{"test", 0, "CREATE TABLE t (a INT);"},
+		{"test", 0, "BEGIN;"},
+		{"test", 5, "INSERT INTO t (a) VALUES (1);"},
+		{"test", 8, "INSERT INTO t (a) VALUES (2);"},
+		{"test", 0, "BEGIN;"},
+		{"test", 9, "INSERT INTO t (a) VALUES (3);"},
+		{"test", 9, "COMMIT;"},
+	}
+
+	for i, r := range records {
+		stmt, err := parser.NewParser(parser.NewLexer([]byte(r.sql))).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = replayer.Apply(&wal.Record{LSN: uint64(i + 1), Timestamp: time.Now(), Database: r.database, Channel: 1, Xid: r.xid, Stmt: stmt})
+		if err != nil {
+			t.Fatalf("%s: %s", r.sql, err)
+		}
+	}
+
+	if running := aria.Transactions.Running(); len(running) != 0 {
+		t.Fatalf("expected the transaction of the first run to be rolled back, got %v", running)
+	}
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	if _, err := executeSQL(ex, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := executeSQL(ex, "SELECT * FROM t ORDER BY a;")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := `+---+
+| a |
++---+
+| 2 |
+| 3 |
++---+
+`
+
+	if result != expect {
+		t.Fatalf("expected the rows of the second run only, got %s", result)
+	}
+}
+
+func TestRowWriter(t *testing.T) {
+	aria := openTestInstance(t)
+
+	ex := New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	values := make([]string, 250)
+	for i := range values {
+		values[i] = fmt.Sprintf("(%d)", i+1)
+	}
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT);",
+		"INSERT INTO t (id) VALUES " + strings.Join(values, ", ") + ";",
+	} {
+		if _, err := executeSQL(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	var batches []int
+	var columns []string
+
+	ex.SetRowWriter(func(c []string, rows [][]interface{}) error {
+		columns = c
+		batches = append(batches, len(rows))
+		return nil
+	})
+
+	// Rows are written a batch at a time as they are read, with or without a WHERE, a sorted SELECT keeps its rows
+	for _, test := range []struct {
+		sql      string
+		batches  []int
+		streamed int
+		kept     int
+	}{
+		{"SELECT * FROM t;", []int{100, 100, 50}, 250, 0},
+		{"SELECT id FROM t WHERE id > 10;", []int{100, 100, 40}, 240, 0},
+		{"SELECT id FROM t WHERE id > 10 ORDER BY id;", nil, 0, 240},
+	} {
+		batches, columns = nil, nil
+
+		if _, err := executeSQL(ex, test.sql); err != nil {
+			t.Fatalf("%s: %s", test.sql, err)
+		}
+
+		if fmt.Sprint(batches) != fmt.Sprint(test.batches) || (test.batches != nil && fmt.Sprint(columns) != "[id]") {
+			t.Fatalf("%s: expected batches %v of [id], got %v of %v", test.sql, test.batches, batches, columns)
+		}
+
+		result := ex.GetResult()
+		if result.Streamed != test.streamed || len(result.Rows) != test.kept {
+			t.Fatalf("%s: expected %d rows streamed and %d kept, got %d and %d", test.sql, test.streamed, test.kept, result.Streamed, len(result.Rows))
+		}
+	}
+}
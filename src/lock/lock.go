@@ -0,0 +1,428 @@
+// Package lock
+// AriaSQL lock manager package
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lock
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrDeadlock is returned to the transaction whose lock request would close a cycle of transactions waiting for each other
+// The transaction is the victim, it has to be rolled back so the others can go on
+var ErrDeadlock = errors.New("deadlock detected, transaction rolled back")
+
+// ErrTimeout is returned when a lock is not granted before the request's context is done
+var ErrTimeout = errors.New("lock wait timeout exceeded")
+
+// ErrNotAvailable is returned by TryLock when the lock cannot be granted without waiting
+var ErrNotAvailable = errors.New("could not obtain lock, it is held by another transaction")
+
+// TABLE is the row id of a lock on a whole table
+const TABLE = -1
+
+// Mode is a lock mode
+type Mode int
+
+const (
+	INTENTION_SHARED    Mode = iota // Held on a table by transactions locking rows of it in shared mode
+	INTENTION_EXCLUSIVE             // Held on a table by transactions locking rows of it in exclusive mode
+	SHARED                          // Held by any number of transactions at once, readers locking what they read
+	EXCLUSIVE                       // Held by one transaction, writers locking what they change
+)
+
+// String returns the name of the lock mode
+func (mode Mode) String() string {
+	switch mode {
+	case INTENTION_SHARED:
+		return "INTENTION SHARED"
+	case INTENTION_EXCLUSIVE:
+		return "INTENTION EXCLUSIVE"
+	case EXCLUSIVE:
+		return "EXCLUSIVE"
+	default:
+		return "SHARED"
+	}
+}
+
+// Resource is what is locked, a row of a table or the whole table
+type Resource struct {
+	Table string // Table name
+	RowId int64  // Row id within the table, TABLE for the whole table
+}
+
+// Manager grants locks to transactions, locks are held until the transaction releases them all at its end
+type Manager struct {
+	lock    sync.Mutex
+	locks   map[Resource]*entry              // Locks held or waited for
+	held    map[uint64]map[Resource]struct{} // Resources each transaction holds or waits for
+	waiting map[uint64]*waiter               // Lock request each waiting transaction waits on
+}
+
+// entry is the state of a locked resource
+type entry struct {
+	holders map[uint64]Mode // Transactions holding the lock and the mode they hold it in
+	queue   []*waiter       // Requests waiting to be granted, in the order they are granted
+}
+
+// waiter is a lock request waiting to be granted
+type waiter struct {
+	owner    uint64
+	resource Resource
+	mode     Mode
+	since    time.Time
+	granted  chan struct{} // Closed once the lock is granted
+}
+
+// Lock is a lock held or waited for, as listed by Locks
+type Lock struct {
+	Owner      uint64        // Transaction holding or waiting for the lock
+	Resource   Resource      // Locked resource
+	Mode       Mode          // Lock mode
+	Granted    bool          // false while the transaction waits for the lock
+	WaitingFor []uint64      // Transactions the waiting transaction waits for
+	Waited     time.Duration // How long the transaction has been waiting
+}
+
+// New creates a new lock manager
+func New() *Manager {
+	return &Manager{
+		locks:   make(map[Resource]*entry),
+		held:    make(map[uint64]map[Resource]struct{}),
+		waiting: make(map[uint64]*waiter),
+	}
+}
+
+// compatible returns true if locks of both modes can be held at once by different transactions
+func compatible(a, b Mode) bool {
+	switch {
+	case a == EXCLUSIVE || b == EXCLUSIVE:
+		return false
+	case a == INTENTION_SHARED || b == INTENTION_SHARED:
+		return true
+	default:
+		return a == b // intention exclusive locks go together, shared locks go together
+	}
+}
+
+// covers returns true if a lock held in mode held gives everything a lock in mode does
+func covers(held, mode Mode) bool {
+	return held == mode || held == EXCLUSIVE || mode == INTENTION_SHARED
+}
+
+// combine returns the mode of a lock held in mode held upgraded by a request in mode
+func combine(held, mode Mode) Mode {
+	switch {
+	case covers(held, mode):
+		return held
+	case covers(mode, held):
+		return mode
+	default:
+		return EXCLUSIVE // shared and intention exclusive
+	}
+}
+
+// Lock locks resource for transaction owner, waiting until the lock is granted or ctx is done
+// A transaction holding a lock in a weaker mode has it upgraded.  ErrDeadlock is returned if waiting would deadlock, ErrTimeout once ctx is done
+func (m *Manager) Lock(ctx context.Context, owner uint64, resource Resource, mode Mode) error {
+	return m.acquire(ctx, owner, resource, mode, true)
+}
+
+// TryLock locks resource for transaction owner if it can without waiting, ErrNotAvailable is returned otherwise
+func (m *Manager) TryLock(owner uint64, resource Resource, mode Mode) error {
+	return m.acquire(context.Background(), owner, resource, mode, false)
+}
+
+// acquire locks resource for transaction owner, waiting for the lock if wait is set
+func (m *Manager) acquire(ctx context.Context, owner uint64, resource Resource, mode Mode, wait bool) error {
+	m.lock.Lock()
+
+	e := m.locks[resource]
+	if e == nil {
+		e = &entry{holders: make(map[uint64]Mode)}
+		m.locks[resource] = e
+	}
+
+	held, holds := e.holders[owner]
+	if holds {
+		if covers(held, mode) {
+			m.lock.Unlock()
+			return nil
+		}
+
+		mode = combine(held, mode)
+	}
+
+	// Upgrades only wait for the other holders, the requests queued wait for the lock the transaction already holds
+	ahead := len(e.queue)
+	if holds {
+		ahead = 0
+	}
+
+	if m.grantable(e, owner, mode, ahead) {
+		e.holders[owner] = mode
+		m.hold(owner, resource)
+		m.lock.Unlock()
+		return nil
+	}
+
+	if !wait {
+		m.lock.Unlock()
+		return ErrNotAvailable
+	}
+
+	w := &waiter{owner: owner, resource: resource, mode: mode, since: time.Now(), granted: make(chan struct{})}
+
+	if holds {
+		e.queue = append([]*waiter{w}, e.queue...)
+	} else {
+		e.queue = append(e.queue, w)
+	}
+
+	m.waiting[owner] = w
+	m.hold(owner, resource)
+
+	if m.deadlocked(owner) {
+		m.dequeue(w)
+		m.lock.Unlock()
+		return ErrDeadlock
+	}
+
+	m.lock.Unlock()
+
+	select {
+	case <-w.granted:
+		return nil
+	case <-ctx.Done():
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	// The lock may have been granted while the context was done
+	select {
+	case <-w.granted:
+		return nil
+	default:
+	}
+
+	m.dequeue(w)
+
+	return ErrTimeout
+}
+
+// Release releases every lock transaction owner holds and grants the requests waiting on them which can go ahead now
+func (m *Manager) Release(owner uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for resource := range m.held[owner] {
+		e := m.locks[resource]
+		if e == nil {
+			continue
+		}
+
+		delete(e.holders, owner)
+		m.grant(resource, e)
+	}
+
+	delete(m.held, owner)
+}
+
+// Locks returns the locks held and waited for, waits first
+func (m *Manager) Locks() []*Lock {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var locks []*Lock
+
+	for resource, e := range m.locks {
+		for i, w := range e.queue {
+			locks = append(locks, &Lock{
+				Owner:      w.owner,
+				Resource:   resource,
+				Mode:       w.mode,
+				WaitingFor: m.blockers(e, w, i),
+				Waited:     time.Since(w.since),
+			})
+		}
+
+		for owner, mode := range e.holders {
+			locks = append(locks, &Lock{Owner: owner, Resource: resource, Mode: mode, Granted: true})
+		}
+	}
+
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].Granted != locks[j].Granted {
+			return !locks[i].Granted
+		}
+
+		if locks[i].Owner != locks[j].Owner {
+			return locks[i].Owner < locks[j].Owner
+		}
+
+		if locks[i].Resource.Table != locks[j].Resource.Table {
+			return locks[i].Resource.Table < locks[j].Resource.Table
+		}
+
+		return locks[i].Resource.RowId < locks[j].Resource.RowId
+	})
+
+	return locks
+}
+
+// hold records that owner holds or waits for resource, the caller must hold the lock
+func (m *Manager) hold(owner uint64, resource Resource) {
+	if m.held[owner] == nil {
+		m.held[owner] = make(map[Resource]struct{})
+	}
+
+	m.held[owner][resource] = struct{}{}
+}
+
+// grantable returns true if owner can be granted a lock in mode without overtaking the first ahead requests queued, the caller must hold the lock
+func (m *Manager) grantable(e *entry, owner uint64, mode Mode, ahead int) bool {
+	for holder, held := range e.holders {
+		if holder != owner && !compatible(held, mode) {
+			return false
+		}
+	}
+
+	// Requests are granted in order, a request does not overtake an earlier one
+	for _, w := range e.queue[:ahead] {
+		if w.owner != owner {
+			return false
+		}
+	}
+
+	return true
+}
+
+// grant grants the queued requests on resource which can go ahead, in order, the caller must hold the lock
+func (m *Manager) grant(resource Resource, e *entry) {
+	for len(e.queue) > 0 {
+		w := e.queue[0]
+
+		if !m.grantable(e, w.owner, w.mode, 0) {
+			break
+		}
+
+		e.queue = e.queue[1:]
+
+		e.holders[w.owner] = combine(e.holders[w.owner], w.mode)
+
+		delete(m.waiting, w.owner)
+		close(w.granted)
+	}
+
+	if len(e.holders) == 0 && len(e.queue) == 0 {
+		delete(m.locks, resource)
+	}
+}
+
+// dequeue withdraws a waiting request, the caller must hold the lock
+func (m *Manager) dequeue(w *waiter) {
+	e := m.locks[w.resource]
+
+	for i, queued := range e.queue {
+		if queued == w {
+			e.queue = append(e.queue[:i:i], e.queue[i+1:]...)
+			break
+		}
+	}
+
+	delete(m.waiting, w.owner)
+
+	// A request which was never granted is no longer held, unless the owner held the lock before
+	if _, ok := e.holders[w.owner]; !ok {
+		delete(m.held[w.owner], w.resource)
+
+		if len(m.held[w.owner]) == 0 {
+			delete(m.held, w.owner)
+		}
+	}
+
+	// Requests queued behind the withdrawn one may go ahead now
+	m.grant(w.resource, e)
+}
+
+// blockers returns the transactions a request queued at position i waits for, the caller must hold the lock
+func (m *Manager) blockers(e *entry, w *waiter, i int) []uint64 {
+	var owners []uint64
+
+	for holder, held := range e.holders {
+		if holder != w.owner && !compatible(held, w.mode) {
+			owners = append(owners, holder)
+		}
+	}
+
+	// Requests are granted in order, so every earlier request holds this one up whatever its mode
+	for _, ahead := range e.queue[:i] {
+		if ahead.owner != w.owner && !slices.Contains(owners, ahead.owner) {
+			owners = append(owners, ahead.owner)
+		}
+	}
+
+	sort.Slice(owners, func(i, j int) bool { return owners[i] < owners[j] })
+
+	return owners
+}
+
+// deadlocked returns true if owner waits, directly or through other waiting transactions, for itself, the caller must hold the lock
+func (m *Manager) deadlocked(owner uint64) bool {
+	visited := make(map[uint64]bool)
+
+	var waitsFor func(xid uint64) bool
+	waitsFor = func(xid uint64) bool {
+		w := m.waiting[xid]
+		if w == nil {
+			return false
+		}
+
+		e := m.locks[w.resource]
+
+		for i, queued := range e.queue {
+			if queued != w {
+				continue
+			}
+
+			for _, blocker := range m.blockers(e, w, i) {
+				if blocker == owner {
+					return true
+				}
+
+				if visited[blocker] {
+					continue
+				}
+
+				visited[blocker] = true
+
+				if waitsFor(blocker) {
+					return true
+				}
+			}
+		}
+
+		return false
+	}
+
+	return waitsFor(owner)
+}
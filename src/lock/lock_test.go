@@ -0,0 +1,247 @@
+// Package lock tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestManager_Lock(t *testing.T) {
+	m := New()
+	row := Resource{Table: "users", RowId: 1}
+
+	// Shared locks are held together
+	if err := m.Lock(context.Background(), 1, row, SHARED); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Lock(context.Background(), 2, row, SHARED); err != nil {
+		t.Fatal(err)
+	}
+
+	// An exclusive lock waits for them to be released
+	granted := make(chan error)
+
+	go func() {
+		granted <- m.Lock(context.Background(), 3, row, EXCLUSIVE)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	locks := m.Locks()
+	if len(locks) != 3 || locks[0].Granted || locks[0].Owner != 3 || len(locks[0].WaitingFor) != 2 {
+		t.Fatalf("expected transaction 3 waiting for 1 and 2, got %+v", locks[0])
+	}
+
+	m.Release(1)
+
+	select {
+	case <-granted:
+		t.Fatal("expected the lock to wait for transaction 2")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	m.Release(2)
+
+	if err := <-granted; err != nil {
+		t.Fatal(err)
+	}
+
+	m.Release(3)
+
+	if len(m.Locks()) != 0 {
+		t.Fatalf("expected no locks, got %d", len(m.Locks()))
+	}
+}
+
+func TestManager_LockTimeout(t *testing.T) {
+	m := New()
+	row := Resource{Table: "users", RowId: 1}
+
+	if err := m.Lock(context.Background(), 1, row, EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := m.Lock(ctx, 2, row, SHARED); err != ErrTimeout {
+		t.Fatalf("expected %v, got %v", ErrTimeout, err)
+	}
+
+	// The timed out request is withdrawn
+	if locks := m.Locks(); len(locks) != 1 || locks[0].Owner != 1 {
+		t.Fatalf("expected only the lock of transaction 1, got %d locks", len(locks))
+	}
+}
+
+func TestManager_LockDeadlock(t *testing.T) {
+	m := New()
+	a := Resource{Table: "accounts", RowId: 1}
+	b := Resource{Table: "accounts", RowId: 2}
+
+	m.Lock(context.Background(), 1, a, EXCLUSIVE)
+	m.Lock(context.Background(), 2, b, EXCLUSIVE)
+
+	granted := make(chan error)
+
+	go func() {
+		granted <- m.Lock(context.Background(), 1, b, EXCLUSIVE)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Transaction 2 would wait for 1 which waits for 2
+	if err := m.Lock(context.Background(), 2, a, EXCLUSIVE); err != ErrDeadlock {
+		t.Fatalf("expected %v, got %v", ErrDeadlock, err)
+	}
+
+	// Once the victim releases its locks the other transaction goes on
+	m.Release(2)
+
+	if err := <-granted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManager_LockDeadlockQueued(t *testing.T) {
+	m := New()
+	table := Resource{Table: "accounts", RowId: TABLE}
+	row := Resource{Table: "accounts", RowId: 1}
+
+	m.Lock(context.Background(), 3, row, EXCLUSIVE)
+	m.Lock(context.Background(), 1, table, SHARED)
+
+	// Transaction 2 waits for the shared lock of 1
+	granted := make(chan error, 2)
+
+	go func() {
+		granted <- m.Lock(context.Background(), 2, table, INTENTION_EXCLUSIVE)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Transaction 3 is compatible with 1 but queues behind 2
+	go func() {
+		granted <- m.Lock(context.Background(), 3, table, INTENTION_SHARED)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// Transaction 1 would wait for 3 which waits for 2 which waits for 1
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := m.Lock(ctx, 1, row, EXCLUSIVE); err != ErrDeadlock {
+		t.Fatalf("expected %v, got %v", ErrDeadlock, err)
+	}
+
+	m.Release(1)
+
+	for i := 0; i < 2; i++ {
+		if err := <-granted; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestManager_LockUpgrade(t *testing.T) {
+	m := New()
+	row := Resource{Table: "users", RowId: 1}
+
+	m.Lock(context.Background(), 1, row, SHARED)
+
+	// Transaction 2 waits for the shared lock of 1
+	granted := make(chan error)
+
+	go func() {
+		granted <- m.Lock(context.Background(), 2, row, EXCLUSIVE)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The holder upgrades ahead of the waiting request
+	if err := m.Lock(context.Background(), 1, row, EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Release(1)
+
+	if err := <-granted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManager_TryLock(t *testing.T) {
+	m := New()
+	table := Resource{Table: "jobs", RowId: TABLE}
+	row := Resource{Table: "jobs", RowId: 1}
+
+	// Row locks come with intention locks on their table
+	if err := m.TryLock(1, table, INTENTION_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.TryLock(1, row, EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.TryLock(2, table, INTENTION_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.TryLock(2, row, SHARED); err != ErrNotAvailable {
+		t.Fatalf("expected %v, got %v", ErrNotAvailable, err)
+	}
+
+	// A shared table lock conflicts with the writers of the table
+	if err := m.TryLock(3, table, SHARED); err != ErrNotAvailable {
+		t.Fatalf("expected %v, got %v", ErrNotAvailable, err)
+	}
+
+	m.Release(1)
+	m.Release(2)
+
+	if err := m.TryLock(3, table, SHARED); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.TryLock(4, table, INTENTION_SHARED); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.TryLock(4, table, INTENTION_EXCLUSIVE); err != ErrNotAvailable {
+		t.Fatalf("expected %v, got %v", ErrNotAvailable, err)
+	}
+
+	// Shared and intention exclusive held by one transaction make an exclusive lock
+	if err := m.TryLock(3, table, INTENTION_EXCLUSIVE); err != ErrNotAvailable {
+		t.Fatalf("expected %v, got %v", ErrNotAvailable, err)
+	}
+
+	m.Release(4)
+
+	if err := m.TryLock(3, table, INTENTION_EXCLUSIVE); err != nil {
+		t.Fatal(err)
+	}
+
+	if locks := m.Locks(); len(locks) != 1 || locks[0].Mode != EXCLUSIVE {
+		t.Fatalf("expected an exclusive table lock, got %+v", locks)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"ariasql/server"
 	"ariasql/shared"
 	"ariasql/wal"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/briandowns/spinner"
@@ -35,57 +36,142 @@ import (
 
 // The main function starts the AriaSQL server
 // you can pass the -recover flag to recover the AriaSQL instance from the WAL if it was not shut down properly, crashed, etc
+// -until or -until-lsn stop the recovery at a point in time, i.e. right before a bad DELETE
+// -basebackup takes a base backup into the configured WAL archive, the server should not be running while it is taken
+// -waldump prints the WAL records as SQL, -table, -from and -to filter the records printed
+// -promote promotes a stopped replica to primary, a running replica is promoted with the PROMOTE statement
 func main() {
 
 	var (
-		recov     = flag.Bool("recover", false, "Recover AriaSQL instance from WAL")
-		recovFile = flag.String("wal", "wal.dat", "Recover AriaSQL instance from WAL file")
+		recov      = flag.Bool("recover", false, "Recover AriaSQL instance from WAL")
+		recovFile  = flag.String("wal", "", "Recover AriaSQL instance from WAL file, defaults to wal.dat in the data directory")
+		until      = flag.String("until", "", "Stop recovery at this local time, i.e. '2026-10-01 12:00:00'")
+		untilLSN   = flag.Uint64("until-lsn", 0, "Stop recovery after the WAL record with this LSN")
+		baseBackup = flag.Bool("basebackup", false, "Take a base backup into the WAL archive")
+		walDump    = flag.Bool("waldump", false, "Print WAL records, including archived ones, as SQL")
+		dumpTable  = flag.String("table", "", "Only dump records touching this table, i.e. 'users' or 'db.users'")
+		dumpFrom   = flag.String("from", "", "Only dump records appended at or after this local time, i.e. '2026-10-01 12:00:00'")
+		dumpTo     = flag.String("to", "", "Only dump records appended at or before this local time, i.e. '2026-10-01 13:00:00'")
+		promote    = flag.Bool("promote", false, "Promote a replica to primary on a new replication timeline")
 	)
 
 	flag.Parse()
 
+	if *baseBackup {
+		backup, err := core.OfflineBaseBackup(shared.GetDefaultDataDir())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Base backup taken at LSN %d into %s\n", backup.LSN, backup.Directory)
+
+		os.Exit(0)
+	}
+
+	if *promote {
+		aria, err := core.New(nil)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		timeline, err := aria.Promote()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		aria.Close()
+
+		fmt.Printf("Replica promoted to primary on timeline %d\n", timeline)
+
+		os.Exit(0)
+	}
+
+	if *walDump {
+		filter := &wal.DumpFilter{Table: *dumpTable}
+
+		for _, f := range []struct {
+			value string
+			t     *time.Time
+		}{{*dumpFrom, &filter.From}, {*dumpTo, &filter.To}} {
+			if f.value == "" {
+				continue
+			}
+
+			t, err := time.ParseInLocation("2006-01-02 15:04:05", f.value, time.Local)
+			if err != nil {
+				fmt.Println("Invalid -from or -to time, expected format YYYY-MM-DD HH:MM:SS")
+				os.Exit(1)
+			}
+
+			*f.t = t
+		}
+
+		records, err := walRecords(*recovFile)
+		var corruption *wal.CorruptionError
+		if errors.As(err, &corruption) {
+			fmt.Fprintln(os.Stderr, err) // the intact records are still dumped
+		} else if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = wal.Dump(os.Stdout, records, filter)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
 	if *recov {
 		fmt.Println("Recovering AriaSQL instance from WAL...")
 
+		target := &wal.RecoveryTarget{LSN: *untilLSN}
+
+		if *until != "" {
+			t, err := time.ParseInLocation("2006-01-02 15:04:05", *until, time.Local)
+			if err != nil {
+				fmt.Println("Invalid -until time, expected format YYYY-MM-DD HH:MM:SS")
+				os.Exit(1)
+			}
+
+			target.Time = t
+		}
+
 		wg := &sync.WaitGroup{}
 
+		var err error
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			var w *wal.WAL
-			var err error
+
+			var aria *core.AriaSQL
+			aria, err = core.New(nil)
+			if err != nil {
+				return
+			}
 
 			// Will look in default data directory for wal.dat unless specified
-			if *recovFile == "" {
-				w, err = wal.OpenWAL(shared.GetDefaultDataDir()+shared.GetOsPathSeparator()+"wal.dat", os.O_CREATE|os.O_RDWR, 0644)
-				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
-				}
-			} else {
+			if *recovFile != "" {
+				var w *wal.WAL
 				w, err = wal.OpenWAL(*recovFile, os.O_CREATE|os.O_RDWR, 0644)
 				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
+					return
 				}
-			}
 
-			defer w.Close()
+				aria.WAL.Close()
+				aria.WAL = w
+			}
 
-			ex := executor.New(nil, nil)
+			ex := executor.New(aria, nil)
 			ex.SetRecover(true) // set true to avoid checking permissions
 
-			asts, err := w.RecoverASTs()
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
-
-			err = ex.Recover(asts)
-			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
-			}
+			err = ex.RecoverTo(target)
 		}()
 
 		s := spinner.New(spinner.CharSets[12], 100*time.Millisecond)
@@ -95,7 +181,18 @@ func main() {
 		wg.Wait()
 		s.Stop()
 
-		fmt.Sprintf("AriaSQL instance recovered from WAL successfully")
+		var corruption *wal.CorruptionError
+		if errors.As(err, &corruption) {
+			fmt.Println(err)
+			fmt.Printf("AriaSQL instance recovered from WAL up to LSN %d, records after the damage were not replayed\n", corruption.StopLSN())
+
+			os.Exit(0)
+		} else if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Println("AriaSQL instance recovered from WAL successfully")
 
 		os.Exit(0)
 
@@ -115,42 +212,169 @@ func main() {
 		}
 
 		aria.Catalog = catalog.New(aria.Config.DataDir)
+		aria.Catalog.LoginPolicy = aria.Config.LoginPolicy
 
 		if err := aria.Catalog.Open(); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
+		// Transactions left unfinished by a crash are undone
+		if err := aria.RecoverTransactions(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
 		aria.Channels = make([]*core.Channel, 0)
 		aria.ChannelsLock = &sync.Mutex{}
 
-		server, err := server.NewTCPServer(3695, "0.0.0.0", aria, 1024)
+		// A replica receives the WAL stream of its primary
+		var replication *server.ReplicationServer
+
+		if aria.Config.Replication != nil {
+			replication, err = server.NewReplicationServer(aria)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			go replication.Start()
+		}
+
+		// A primary streams its WAL to its replicas
+		aria.StartReplication()
+
+		tcpServer, err := server.NewTCPServer(3695, "0.0.0.0", aria, 1024)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
+		// PostgreSQL drivers and tools connect on their own port
+		var postgres *server.PostgresServer
+
+		if tcpServer.PostgresPort != 0 {
+			postgres, err = server.NewPostgresServer(tcpServer)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			go postgres.Start()
+		}
+
+		// Scripts query over HTTP on its own port
+		var api *server.HTTPServer
+
+		if tcpServer.HTTPPort != 0 {
+			api, err = server.NewHTTPServer(tcpServer)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+
+			go api.Start()
+		}
+
 		go func() {
 			sig := <-sigs
 			switch sig {
 			case syscall.SIGINT:
 				// Handling SIGINT (Ctrl+C) signal
 				fmt.Println("Received SIGINT, shutting down...")
-				server.Stop()
+				tcpServer.Stop()
+				if postgres != nil {
+					postgres.Stop()
+				}
+				if api != nil {
+					api.Stop()
+				}
+				if replication != nil {
+					replication.Stop()
+				}
+				aria.StopReplication()
 				aria.Catalog.Close()
 				aria.WAL.Close()
 				os.Exit(0)
 			case syscall.SIGTERM:
 				// Handling SIGTERM signal
 				fmt.Println("Received SIGTERM, shutting down...")
-				server.Stop()
+				tcpServer.Stop()
+				if postgres != nil {
+					postgres.Stop()
+				}
+				if api != nil {
+					api.Stop()
+				}
+				if replication != nil {
+					replication.Stop()
+				}
+				aria.StopReplication()
 				aria.Catalog.Close()
 				aria.WAL.Close()
 				os.Exit(0)
 			}
 		}()
 
-		server.Start()
+		tcpServer.Start()
+	}
+
+}
+
+// walRecords reads the records to dump, from the given WAL file or otherwise from the WAL archive and current WAL of the instance
+// The files are only read, the instance is not opened so nothing is truncated, migrated or rewritten
+func walRecords(file string) ([]*wal.Record, error) {
+	if file != "" {
+		return wal.ReadWAL(file)
+	}
+
+	config, err := core.ReadConfig(shared.GetDefaultDataDir())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*wal.Record, 0)
+	corruption := &wal.CorruptionError{}
+
+	// Damaged files are read around, the damage is reported along with the intact records
+	collect := func(recs []*wal.Record, err error) error {
+		var cerr *wal.CorruptionError
+		if errors.As(err, &cerr) {
+			corruption.Corruptions = append(corruption.Corruptions, cerr.Corruptions...)
+		} else if err != nil {
+			return err
+		}
+
+		records = append(records, recs...)
+
+		return nil
+	}
+
+	if config.WALArchive != "" {
+		if _, err := os.Stat(config.WALArchive); err == nil {
+			archive, err := wal.OpenArchive(config.WALArchive)
+			if err != nil {
+				return nil, err
+			}
+
+			err = collect(archive.Records())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	walFile := fmt.Sprintf("%s%swal.dat", config.DataDir, shared.GetOsPathSeparator())
+	if _, err := os.Stat(walFile); err == nil {
+		err = collect(wal.ReadWAL(walFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(corruption.Corruptions) > 0 {
+		return records, corruption
 	}
 
+	return records, nil
 }
@@ -0,0 +1,607 @@
+// Package mvcc
+// AriaSQL multi-version concurrency control package
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package mvcc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// XID_RESERVE is how many transaction ids are reserved on disk at a time
+// Ids are never handed out twice, after a restart numbering continues past the last reservation
+const XID_RESERVE = 1024
+
+// ErrSerialization is returned when a transaction writes a row another transaction changed since its snapshot was taken,
+// or a serializable transaction read a table a concurrent transaction changed.  The transaction has to be rolled back and retried
+var ErrSerialization = errors.New("could not serialize access due to concurrent update")
+
+// IsolationLevel decides which snapshot a transaction's statements read from and what it is checked for before it commits
+type IsolationLevel int
+
+const (
+	READ_COMMITTED  IsolationLevel = iota // Every statement reads from a snapshot taken when the statement starts
+	REPEATABLE_READ                       // Every statement reads from the snapshot taken when the transaction began
+	SERIALIZABLE                          // Repeatable read, and the transaction cannot commit changes once a transaction committed since its snapshot changed a table it read
+)
+
+// Manager hands out transaction ids and snapshots and tracks which transactions are running or aborted
+// Row versions carry the id of the transaction which created them (xmin) and the one which deleted them (xmax), transaction id 0 is always committed
+// Every id below the manager's next id which is neither running nor aborted is committed
+type Manager struct {
+	lock       sync.Mutex
+	file       *os.File                // Holds the reserved transaction id horizon, and the first id of a run not closed cleanly
+	next       uint64                  // Next transaction id
+	reserved   uint64                  // Ids below this one are reserved on disk
+	first      uint64                  // First transaction id of this run
+	unfinished uint64                  // First transaction id of the run before this one if it was not closed cleanly, 0 once recovered
+	running    map[uint64]*Transaction // Running transactions
+	aborted    map[uint64]struct{}     // Aborted transactions whose row versions have not been undone yet
+	garbage    []*garbage              // Row versions waiting for the snapshots which can see them to end
+	written    []*Transaction          // Committed transactions which changed tables, kept while a running serializable transaction cannot see them
+}
+
+// Transaction is a running transaction
+type Transaction struct {
+	Xid       uint64              // Transaction id, stamped on the row versions the transaction writes
+	Snapshot  *Snapshot           // Snapshot the transaction reads from
+	Isolation IsolationLevel      // Isolation level, changed through SetIsolation
+	reads     map[string]struct{} // Tables a serializable transaction read
+	writes    map[string]struct{} // Tables the transaction changed
+	prepared  bool                // Prepared for two-phase commit, it passed the checks a commit makes
+}
+
+// Snapshot decides which row versions a transaction sees
+type Snapshot struct {
+	Xid     uint64              // Transaction taking the snapshot, its own changes are always visible
+	Xmin    uint64              // Oldest transaction running when the snapshot was taken
+	Xmax    uint64              // Transactions from this id on started after the snapshot was taken
+	running map[uint64]struct{} // Transactions running when the snapshot was taken
+	manager *Manager
+}
+
+// garbage is a reclaim function waiting for the snapshots which can see the row versions a transaction deleted
+type garbage struct {
+	xid     uint64
+	reclaim func()
+}
+
+// Open opens the transaction id file at path and continues numbering after its last reservation
+// If the last run was not closed cleanly the transactions it left running are in doubt until recovered, see InDoubt
+func Open(path string) (*Manager, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manager{
+		file:    file,
+		next:    1,
+		running: make(map[uint64]*Transaction),
+		aborted: make(map[uint64]struct{}),
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if stat.Size() > 0 {
+		buf := make([]byte, stat.Size())
+
+		_, err = file.ReadAt(buf, 0)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		// The reservation, followed by the first id of the run while it is not closed cleanly
+		fields := strings.Fields(string(buf))
+		if len(fields) == 0 || len(fields) > 2 {
+			file.Close()
+			return nil, errors.New("invalid transaction id file")
+		}
+
+		m.next, err = strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			file.Close()
+			return nil, errors.New("invalid transaction id file")
+		}
+
+		if len(fields) == 2 {
+			m.unfinished, err = strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				file.Close()
+				return nil, errors.New("invalid transaction id file")
+			}
+		}
+	}
+
+	m.reserved = m.next
+	m.first = m.next
+
+	return m, nil
+}
+
+// Close closes the transaction id file
+// The run is closed cleanly if no transaction is left running or aborted without its row versions undone
+func (m *Manager) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if len(m.running) == 0 && len(m.aborted) == 0 && m.unfinished == 0 {
+		err := m.write(strconv.FormatUint(m.next, 10))
+		if err != nil {
+			m.file.Close()
+			return err
+		}
+	}
+
+	return m.file.Close()
+}
+
+// reserve reserves the next block of transaction ids on disk, the caller must hold the lock
+func (m *Manager) reserve() error {
+	reserved := m.next + XID_RESERVE
+
+	err := m.write(fmt.Sprintf("%d %d", reserved, m.start()))
+	if err != nil {
+		return err
+	}
+
+	m.reserved = reserved
+
+	return nil
+}
+
+// start returns the first transaction id which may be left running if the run is not closed cleanly, the caller must hold the lock
+// Prepared transactions resumed from an earlier run are left running as well
+func (m *Manager) start() uint64 {
+	start := m.first
+	if m.unfinished != 0 {
+		start = m.unfinished
+	}
+
+	for xid := range m.running {
+		if xid < start {
+			start = xid
+		}
+	}
+
+	return start
+}
+
+// write replaces the contents of the transaction id file, the caller must hold the lock
+func (m *Manager) write(contents string) error {
+	err := m.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.file.WriteAt([]byte(contents), 0)
+	if err != nil {
+		return err
+	}
+
+	return m.file.Sync()
+}
+
+// InDoubt returns the range of transaction ids, from first up to but not including last, the last run may have left running when it was not closed cleanly
+// first equals last if there are none.  The row versions of the transactions which did not commit have to be undone before any transaction begins, then Recovered is called
+func (m *Manager) InDoubt() (first, last uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.unfinished == 0 {
+		return m.first, m.first
+	}
+
+	return m.unfinished, m.first
+}
+
+// Recovered records that the row versions of the transactions in doubt which did not commit have been undone
+func (m *Manager) Recovered() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.unfinished = 0
+
+	return m.write(fmt.Sprintf("%d %d", m.reserved, m.start()))
+}
+
+// Resume registers transaction xid, prepared before the last run ended, as running again
+// Its row versions stay invisible until it commits or aborts.  It must be called before Recovered, for the transactions in doubt which were prepared
+func (m *Manager) Resume(xid uint64) *Transaction {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tx := &Transaction{Xid: xid, Isolation: REPEATABLE_READ, prepared: true}
+	tx.Snapshot = m.snapshot(xid)
+	m.running[xid] = tx
+
+	return tx
+}
+
+// Begin starts a transaction with a snapshot of the transactions committed so far
+func (m *Manager) Begin(isolation IsolationLevel) (*Transaction, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.next >= m.reserved {
+		err := m.reserve()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tx := &Transaction{Xid: m.next, Isolation: isolation}
+	m.next++
+
+	tx.Snapshot = m.snapshot(tx.Xid)
+	m.running[tx.Xid] = tx
+
+	return tx, nil
+}
+
+// Snapshot returns a snapshot of the transactions committed so far for reads outside of a transaction
+// Such a snapshot does not hold back reclaiming the row versions it can see
+func (m *Manager) Snapshot() *Snapshot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.snapshot(0)
+}
+
+// snapshot takes a snapshot for transaction xid, the caller must hold the lock
+func (m *Manager) snapshot(xid uint64) *Snapshot {
+	s := &Snapshot{Xid: xid, Xmin: xid, Xmax: m.next, running: make(map[uint64]struct{}), manager: m}
+
+	for id := range m.running {
+		s.running[id] = struct{}{}
+
+		if id < s.Xmin {
+			s.Xmin = id
+		}
+	}
+
+	return s
+}
+
+// SetIsolation changes the isolation level of a transaction which has not read anything yet
+// The transaction gets a new snapshot, as if it began now
+func (m *Manager) SetIsolation(tx *Transaction, isolation IsolationLevel) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tx.Isolation = isolation
+	tx.Snapshot = m.snapshot(tx.Xid)
+}
+
+// Refresh gives a read committed transaction a new snapshot for its next statement
+func (m *Manager) Refresh(tx *Transaction) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	tx.Snapshot = m.snapshot(tx.Xid)
+}
+
+// Commit commits a transaction, its row versions become visible to snapshots taken from now on
+// A serializable transaction which changed something is first checked against the transactions committed since its snapshot was taken.
+// If one of them changed a table the transaction read, ErrSerialization is returned and the transaction stays running, to be aborted
+func (m *Manager) Commit(tx *Transaction) error {
+	return m.CommitLogged(tx, nil)
+}
+
+// CommitLogged commits a transaction like Commit, calling log to write its commit record once it passed its checks and before it becomes visible
+// If log fails its error is returned and the transaction stays running, to be aborted.  A prepared transaction is not checked again
+func (m *Manager) CommitLogged(tx *Transaction, log func() error) error {
+	m.lock.Lock()
+
+	if !tx.prepared {
+		err := m.check(tx)
+		if err != nil {
+			m.lock.Unlock()
+			return err
+		}
+	}
+
+	if log != nil {
+		err := log()
+		if err != nil {
+			m.lock.Unlock()
+			return err
+		}
+	}
+
+	delete(m.running, tx.Xid)
+
+	if len(tx.writes) > 0 {
+		m.written = append(m.written, tx)
+	}
+
+	m.prune()
+	ready := m.collect()
+	m.lock.Unlock()
+
+	for _, reclaim := range ready {
+		reclaim()
+	}
+
+	return nil
+}
+
+// Prepare prepares a transaction for two-phase commit, checking it as a commit would and calling log to write its prepare record once it passed
+// The transaction stays running and invisible, it commits later without being checked again.
+// If the check or log fails the error is returned and the transaction stays running unprepared, to be aborted
+func (m *Manager) Prepare(tx *Transaction, log func() error) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	err := m.check(tx)
+	if err != nil {
+		return err
+	}
+
+	if log != nil {
+		err = log()
+		if err != nil {
+			return err
+		}
+	}
+
+	tx.prepared = true
+
+	return nil
+}
+
+// check returns ErrSerialization if a serializable transaction which changed something read a table a transaction committed since its snapshot changed, the caller must hold the lock
+func (m *Manager) check(tx *Transaction) error {
+	if tx.Isolation == SERIALIZABLE && len(tx.writes) > 0 {
+		for _, w := range m.written {
+			if tx.Snapshot.concurrent(w.Xid) && w.changed(tx.reads) {
+				return ErrSerialization
+			}
+		}
+	}
+
+	return nil
+}
+
+// Abort aborts a transaction, the row versions it created are invisible and the ones it deleted stay visible to everyone
+// Once the versions have been undone Forget drops the transaction from the aborted set
+func (m *Manager) Abort(tx *Transaction) {
+	m.lock.Lock()
+	delete(m.running, tx.Xid)
+	m.aborted[tx.Xid] = struct{}{}
+	m.prune()
+	ready := m.collect()
+	m.lock.Unlock()
+
+	for _, reclaim := range ready {
+		reclaim()
+	}
+}
+
+// Forget drops an aborted transaction whose row versions have been undone
+func (m *Manager) Forget(xid uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.aborted, xid)
+}
+
+// Reclaim runs reclaim once no running snapshot can see the row versions committed transaction xid deleted
+func (m *Manager) Reclaim(xid uint64, reclaim func()) {
+	m.lock.Lock()
+	m.garbage = append(m.garbage, &garbage{xid: xid, reclaim: reclaim})
+	ready := m.collect()
+	m.lock.Unlock()
+
+	for _, reclaim := range ready {
+		reclaim()
+	}
+}
+
+// collect removes and returns the reclaim functions no running snapshot stands in the way of, the caller must hold the lock
+func (m *Manager) collect() []func() {
+	horizon := m.horizon()
+
+	var ready []func()
+	var waiting []*garbage
+
+	for _, g := range m.garbage {
+		if g.xid < horizon {
+			ready = append(ready, g.reclaim)
+		} else {
+			waiting = append(waiting, g)
+		}
+	}
+
+	m.garbage = waiting
+
+	return ready
+}
+
+// prune drops the committed transactions no running serializable transaction has to be checked against, the caller must hold the lock
+func (m *Manager) prune() {
+	var written []*Transaction
+
+	for _, w := range m.written {
+		for _, tx := range m.running {
+			if tx.Isolation == SERIALIZABLE && tx.Snapshot.concurrent(w.Xid) {
+				written = append(written, w)
+				break
+			}
+		}
+	}
+
+	m.written = written
+}
+
+// horizon returns the oldest transaction id a running snapshot may not see the changes of, the caller must hold the lock
+func (m *Manager) horizon() uint64 {
+	horizon := m.next
+
+	for _, tx := range m.running {
+		if tx.Snapshot.Xmin < horizon {
+			horizon = tx.Snapshot.Xmin
+		}
+	}
+
+	return horizon
+}
+
+// Running returns the ids of the running transactions
+func (m *Manager) Running() []uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	var xids []uint64
+
+	for xid := range m.running {
+		xids = append(xids, xid)
+	}
+
+	return xids
+}
+
+// Aborted returns true if transaction xid aborted and its row versions have not been undone yet
+func (m *Manager) Aborted(xid uint64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, ok := m.aborted[xid]
+
+	return ok
+}
+
+// Committed returns true if transaction xid committed
+func (m *Manager) Committed(xid uint64) bool {
+	if xid == 0 {
+		return true
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if xid >= m.next {
+		return false
+	}
+
+	if _, ok := m.running[xid]; ok {
+		return false
+	}
+
+	_, ok := m.aborted[xid]
+
+	return !ok
+}
+
+// Read records that a serializable transaction read a table
+func (tx *Transaction) Read(table string) {
+	if tx.Isolation != SERIALIZABLE {
+		return
+	}
+
+	if tx.reads == nil {
+		tx.reads = make(map[string]struct{})
+	}
+
+	tx.reads[table] = struct{}{}
+}
+
+// Write records that the transaction changed a table
+func (tx *Transaction) Write(table string) {
+	if tx.writes == nil {
+		tx.writes = make(map[string]struct{})
+	}
+
+	tx.writes[table] = struct{}{}
+}
+
+// changed returns true if the transaction changed one of tables
+func (tx *Transaction) changed(tables map[string]struct{}) bool {
+	for table := range tx.writes {
+		if _, ok := tables[table]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// concurrent returns true if transaction xid had not committed when the snapshot was taken
+func (s *Snapshot) concurrent(xid uint64) bool {
+	if xid >= s.Xmax {
+		return true
+	}
+
+	_, ok := s.running[xid]
+
+	return ok
+}
+
+// sees returns true if the changes of transaction xid are visible to the snapshot
+func (s *Snapshot) sees(xid uint64) bool {
+	if xid == s.Xid || xid == 0 {
+		return true
+	}
+
+	if xid >= s.Xmax {
+		return false
+	}
+
+	if _, ok := s.running[xid]; ok {
+		return false
+	}
+
+	return !s.manager.Aborted(xid)
+}
+
+// Visible returns true if a row version created by xmin and deleted by xmax (0 if not deleted) is visible to the snapshot
+func (s *Snapshot) Visible(xmin, xmax uint64) bool {
+	if !s.sees(xmin) {
+		return false
+	}
+
+	return xmax == 0 || !s.sees(xmax)
+}
+
+// Dead returns true if a row version is gone for the snapshot's transaction and every transaction starting from now on
+// A version is dead if its creator aborted, or it was deleted by the snapshot's own transaction or a committed one
+func (s *Snapshot) Dead(xmin, xmax uint64) bool {
+	if xmin != 0 && s.manager.Aborted(xmin) {
+		return true
+	}
+
+	return xmax != 0 && (xmax == s.Xid || s.manager.Committed(xmax))
+}
+
+// Writable returns ErrSerialization if a row version deleted by xmax (0 if not deleted) cannot be deleted by the snapshot's transaction
+// Another transaction deleting the version first, whether it is still running or committed since the snapshot was taken, is a conflict
+func (s *Snapshot) Writable(xmax uint64) error {
+	if xmax == 0 || xmax == s.Xid || s.manager.Aborted(xmax) {
+		return nil
+	}
+
+	return ErrSerialization
+}
@@ -0,0 +1,309 @@
+// Package mvcc tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package mvcc
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot_Visible(t *testing.T) {
+	m, err := Open(filepath.Join(t.TempDir(), "xid.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	t1, _ := m.Begin(REPEATABLE_READ)
+	t2, _ := m.Begin(REPEATABLE_READ)
+
+	// Rows written outside of a transaction and a transaction's own rows are visible
+	if !t2.Snapshot.Visible(0, 0) || !t2.Snapshot.Visible(t2.Xid, 0) {
+		t.Fatal("expected row to be visible")
+	}
+
+	// Rows of a transaction running when the snapshot was taken are not, even once it commits
+	m.Commit(t1)
+
+	if t2.Snapshot.Visible(t1.Xid, 0) {
+		t.Fatal("expected row of a concurrent transaction to be invisible")
+	}
+
+	t3, _ := m.Begin(REPEATABLE_READ)
+
+	if !t3.Snapshot.Visible(t1.Xid, 0) || t3.Snapshot.Visible(0, t1.Xid) {
+		t.Fatal("expected changes of a committed transaction to be visible")
+	}
+
+	// An aborted transaction's rows are invisible and its deletes undone
+	m.Abort(t2)
+
+	if t3.Snapshot.Visible(t2.Xid, 0) || !t3.Snapshot.Visible(0, t2.Xid) {
+		t.Fatal("expected changes of an aborted transaction to be invisible")
+	}
+
+	if t3.Snapshot.Writable(t2.Xid) != nil || t3.Snapshot.Writable(t1.Xid) != ErrSerialization {
+		t.Fatal("unexpected write conflict")
+	}
+
+	if !t3.Snapshot.Dead(t2.Xid, 0) || !t3.Snapshot.Dead(0, t1.Xid) || t3.Snapshot.Dead(0, 0) {
+		t.Fatal("unexpected dead row versions")
+	}
+
+	m.Commit(t3)
+}
+
+func TestManager_Reclaim(t *testing.T) {
+	m, err := Open(filepath.Join(t.TempDir(), "xid.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	reader, _ := m.Begin(REPEATABLE_READ)
+	writer, _ := m.Begin(REPEATABLE_READ)
+	m.Commit(writer)
+
+	reclaimed := false
+	m.Reclaim(writer.Xid, func() { reclaimed = true })
+
+	// The reader's snapshot still sees the versions the writer deleted
+	if reclaimed {
+		t.Fatal("expected reclaim to wait for the reader")
+	}
+
+	m.Commit(reader)
+
+	if !reclaimed {
+		t.Fatal("expected versions to be reclaimed")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xid.dat")
+
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, _ := m.Begin(REPEATABLE_READ)
+	m.Commit(tx)
+	m.Close()
+
+	// Numbering continues past what was handed out before
+	m, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	next, _ := m.Begin(REPEATABLE_READ)
+	if next.Xid <= tx.Xid {
+		t.Fatalf("expected transaction id after %d, got %d", tx.Xid, next.Xid)
+	}
+
+	if !next.Snapshot.Visible(tx.Xid, 0) {
+		t.Fatal("expected rows of earlier transactions to be visible")
+	}
+}
+
+func TestManager_InDoubt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xid.dat")
+
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, _ := m.Begin(REPEATABLE_READ)
+	m.Commit(committed)
+
+	running, _ := m.Begin(REPEATABLE_READ)
+
+	// Closed with a transaction still running, as if the server crashed
+	m.Close()
+
+	m, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, last := m.InDoubt()
+	if first > committed.Xid || last <= running.Xid {
+		t.Fatalf("expected transactions %d and %d in doubt, got %d to %d", committed.Xid, running.Xid, first, last)
+	}
+
+	if err := m.Recovered(); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Close()
+
+	// Once recovered nothing is in doubt
+	m, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	if first, last := m.InDoubt(); first != last {
+		t.Fatalf("expected no transactions in doubt, got %d to %d", first, last)
+	}
+}
+
+func TestManager_CommitSerializable(t *testing.T) {
+	m, err := Open(filepath.Join(t.TempDir(), "xid.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer m.Close()
+
+	// Write skew, each transaction reads what the other changes
+	t1, _ := m.Begin(SERIALIZABLE)
+	t2, _ := m.Begin(SERIALIZABLE)
+
+	t1.Read("doctors")
+	t1.Write("doctors")
+	t2.Read("doctors")
+	t2.Write("doctors")
+
+	if err := m.Commit(t1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Commit(t2); err != ErrSerialization {
+		t.Fatalf("expected %v, got %v", ErrSerialization, err)
+	}
+
+	m.Abort(t2)
+
+	// Repeatable read transactions are not checked
+	t3, _ := m.Begin(REPEATABLE_READ)
+	t4, _ := m.Begin(REPEATABLE_READ)
+
+	t3.Read("doctors")
+	t3.Write("doctors")
+	t4.Read("doctors")
+	t4.Write("doctors")
+
+	if err := m.Commit(t3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Commit(t4); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read only serializable transactions and ones which read other tables commit
+	t5, _ := m.Begin(SERIALIZABLE)
+	t6, _ := m.Begin(SERIALIZABLE)
+	t7, _ := m.Begin(SERIALIZABLE)
+
+	t5.Write("doctors")
+	t6.Read("doctors")
+	t7.Read("shifts")
+	t7.Write("shifts")
+
+	if err := m.Commit(t5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Commit(t6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Commit(t7); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction beginning after the commit sees the change
+	t8, _ := m.Begin(SERIALIZABLE)
+	t8.Read("doctors")
+	t8.Write("doctors")
+
+	if err := m.Commit(t8); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.written) != 0 {
+		t.Fatalf("expected committed transactions to be pruned, got %d", len(m.written))
+	}
+}
+
+func TestManager_Resume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "xid.dat")
+
+	m, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepared, _ := m.Begin(REPEATABLE_READ)
+
+	if err := m.Prepare(prepared, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Close()
+
+	m, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The prepared transaction is running again after the restart
+	tx := m.Resume(prepared.Xid)
+
+	if err := m.Recovered(); err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Snapshot().Visible(prepared.Xid, 0) {
+		t.Fatal("expected the versions of the prepared transaction to be invisible")
+	}
+
+	m.Close()
+
+	// Until it ends it stays in doubt across restarts
+	m, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first, last := m.InDoubt(); first > prepared.Xid || last <= prepared.Xid {
+		t.Fatalf("expected transaction %d in doubt, got %d to %d", prepared.Xid, first, last)
+	}
+
+	tx = m.Resume(prepared.Xid)
+	m.Recovered()
+
+	if err := m.Commit(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !m.Snapshot().Visible(prepared.Xid, 0) {
+		t.Fatal("expected the versions of the committed transaction to be visible")
+	}
+
+	m.Close()
+}
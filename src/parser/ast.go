@@ -97,6 +97,49 @@ type SelectStmt struct {
 	TableExpression *TableExpression
 	Union           *SelectStmt
 	UnionAll        bool
+	LockingClause   *LockingClause
+}
+
+type LockingStrength int
+
+const (
+	_ LockingStrength = iota
+	FOR_UPDATE
+	FOR_SHARE
+)
+
+type LockWaitPolicy int
+
+const (
+	LOCK_WAIT LockWaitPolicy = iota
+	LOCK_NOWAIT
+	LOCK_SKIP_LOCKED
+)
+
+// LockingClause represents a FOR UPDATE or FOR SHARE clause of a SELECT statement, optionally followed by NOWAIT or SKIP LOCKED
+type LockingClause struct {
+	Strength   LockingStrength // Lock the selected rows for update or share
+	WaitPolicy LockWaitPolicy  // What happens to rows another transaction has locked
+}
+
+type LockMode int
+
+const (
+	_ LockMode = iota
+	LOCK_SHARE
+	LOCK_EXCLUSIVE
+)
+
+// LockTableStmt represents a LOCK TABLE name IN SHARE | EXCLUSIVE MODE statement
+type LockTableStmt struct {
+	TableName *Identifier
+	Mode      LockMode
+}
+
+// KillStmt represents a KILL [QUERY] channel_id statement
+type KillStmt struct {
+	ChannelID uint64 // Channel to kill
+	Query     bool   // Only cancel the statement the channel is executing, the session goes on
 }
 
 // UpdateStmt represents an UPDATE statement
@@ -344,14 +387,55 @@ type LimitClause struct {
 	Count  *Literal
 }
 
-// BeginStmt represents a BEGIN statement
-type BeginStmt struct{}
+type IsolationLevel int
 
-// CommitStmt represents a COMMIT statement
-type CommitStmt struct{}
+const (
+	_ IsolationLevel = iota
+	ISOLATION_READ_COMMITTED
+	ISOLATION_REPEATABLE_READ
+	ISOLATION_SERIALIZABLE
+)
+
+// BeginStmt represents a BEGIN statement like BEGIN ISOLATION LEVEL SERIALIZABLE;
+// SET TRANSACTION ISOLATION LEVEL ...; is parsed into a BeginStmt as well, it sets the isolation level without beginning a transaction
+type BeginStmt struct {
+	IsolationLevel IsolationLevel // 0 if no isolation level is given
+	SetTransaction bool           // true if the statement is SET TRANSACTION
+}
+
+// CommitStmt represents a COMMIT statement, or a COMMIT PREPARED 'gid'; statement
+type CommitStmt struct {
+	Prepared *Literal // Global id of the prepared transaction to commit, nil commits the transaction begun
+}
+
+// RollbackStmt represents a ROLLBACK statement, a ROLLBACK TO SAVEPOINT name; or a ROLLBACK PREPARED 'gid'; statement
+type RollbackStmt struct {
+	Savepoint *Identifier // Savepoint to roll back to, nil rolls back the whole transaction
+	Prepared  *Literal    // Global id of the prepared transaction to roll back
+}
+
+// PrepareTransactionStmt represents a PREPARE TRANSACTION 'gid'; statement, the first phase of a two-phase commit
+type PrepareTransactionStmt struct {
+	Gid *Literal // Global transaction id the transaction is committed or rolled back by later
+}
+
+// SavepointStmt represents a SAVEPOINT name; statement
+type SavepointStmt struct {
+	Name *Identifier // savepoint name
+}
+
+// ReleaseSavepointStmt represents a RELEASE SAVEPOINT name; statement
+type ReleaseSavepointStmt struct {
+	Name *Identifier // savepoint name
+}
 
-// RollbackStmt represents a ROLLBACK statement
-type RollbackStmt struct{}
+// PromoteStmt represents a PROMOTE statement, promoting a replica to primary
+type PromoteStmt struct{}
+
+// SubscribeStmt represents a SUBSCRIBE TO statement, streaming the changes committed to a table
+type SubscribeStmt struct {
+	TableName *Identifier
+}
 
 // GrantStmt represents a GRANT statement
 type GrantStmt struct {
@@ -373,8 +457,9 @@ type PrivilegeDefinition struct {
 
 // CreateUserStmt represents a CREATE USER statement
 type CreateUserStmt struct {
-	Username *Identifier
-	Password *Literal
+	Username    *Identifier
+	Password    *Literal
+	Certificate *Literal // Client certificate subject identifying the user instead of a password, CN=name or SAN=name
 }
 
 // DropUserStmt represents a DROP USER statement
@@ -391,6 +476,9 @@ const (
 	SHOW_USERS
 	SHOW_INDEXES
 	SHOW_GRANTS
+	SHOW_LOCKS
+	SHOW_PREPARED_TRANSACTIONS
+	SHOW_PROCESSLIST
 )
 
 // ShowStmt represents a SHOW statement
@@ -413,6 +501,8 @@ const (
 	_ AlterUserSetType = iota
 	ALTER_USER_SET_PASSWORD
 	ALTER_USER_SET_USERNAME
+	ALTER_USER_ACCOUNT_LOCK   // ACCOUNT LOCK, Value is nil
+	ALTER_USER_ACCOUNT_UNLOCK // ACCOUNT UNLOCK, Value is nil
 )
 
 // AlterUserStmt represents an ALTER USER statement
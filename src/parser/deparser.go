@@ -0,0 +1,1117 @@
+// Package parser deparser
+// AriaSQL parser deparser renders abstract syntax trees back into SQL statements.
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package parser
+
+import (
+	"ariasql/catalog"
+	"ariasql/shared"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const REDACTED = "********" // Replaces passwords within redacted statements
+
+// Redact returns a copy of the statement with any password replaced, for statements shown to others such as dumps and the process list
+func Redact(stmt interface{}) interface{} {
+	switch s := stmt.(type) {
+	case *CreateUserStmt:
+		if s.Certificate != nil {
+			return s // a certificate subject is no secret
+		}
+
+		c := *s
+		c.Password = &Literal{Value: REDACTED}
+		return &c
+	case *AlterUserStmt:
+		if s.SetType == ALTER_USER_SET_PASSWORD {
+			c := *s
+			c.Value = &Literal{Value: REDACTED}
+			return &c
+		}
+	}
+
+	return stmt
+}
+
+// Deparse renders a statement AST back into SQL
+// The result parses back into an equivalent AST, formatting and the column order of CREATE TABLE are not preserved
+func Deparse(node Node) (string, error) {
+	stmt, err := deparseStmt(node)
+	if err != nil {
+		return "", err
+	}
+
+	return stmt + ";", nil
+}
+
+// deparseStmt renders a statement without the terminating semicolon
+func deparseStmt(node Node) (string, error) {
+	switch n := node.(type) {
+	case *CreateDatabaseStmt:
+		return "CREATE DATABASE " + n.Name.Value, nil
+	case *DropDatabaseStmt:
+		return "DROP DATABASE " + n.Name.Value, nil
+	case *UseStmt:
+		return "USE " + n.DatabaseName.Value, nil
+	case *CreateTableStmt:
+		return deparseCreateTableStmt(n)
+	case *DropTableStmt:
+		return "DROP TABLE " + n.TableName.Value, nil
+	case *CreateIndexStmt:
+		unique := ""
+		if n.Unique {
+			unique = "UNIQUE "
+		}
+
+		return fmt.Sprintf("CREATE %sINDEX %s ON %s (%s)", unique, n.IndexName.Value, n.TableName.Value, deparseIdentifiers(n.ColumnNames)), nil
+	case *DropIndexStmt:
+		return fmt.Sprintf("DROP INDEX %s ON %s", n.IndexName.Value, n.TableName.Value), nil
+	case *AlterTableStmt:
+		if n.ColumnDefinition == nil {
+			return fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", n.TableName.Value, n.ColumnName.Value), nil
+		}
+
+		colDef, err := deparseColumnDefinition(n.ColumnDefinition)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s %s", n.TableName.Value, n.ColumnName.Value, colDef), nil
+	case *InsertStmt:
+		return deparseInsertStmt(n)
+	case *UpdateStmt:
+		return deparseUpdateStmt(n)
+	case *DeleteStmt:
+		stmt := "DELETE FROM " + n.TableName.Value
+
+		if n.WhereClause != nil {
+			where, err := deparseExpr(n.WhereClause.SearchCondition)
+			if err != nil {
+				return "", err
+			}
+
+			stmt += " WHERE " + where
+		}
+
+		return stmt, nil
+	case *SelectStmt:
+		return deparseSelectStmt(n)
+	case *ExplainStmt:
+		stmt, err := deparseStmt(n.Stmt)
+		if err != nil {
+			return "", err
+		}
+
+		return "EXPLAIN " + stmt, nil
+	case *BeginStmt:
+		var level string
+
+		switch n.IsolationLevel {
+		case ISOLATION_READ_COMMITTED:
+			level = "READ COMMITTED"
+		case ISOLATION_REPEATABLE_READ:
+			level = "REPEATABLE READ"
+		case ISOLATION_SERIALIZABLE:
+			level = "SERIALIZABLE"
+		}
+
+		if n.SetTransaction {
+			return "SET TRANSACTION ISOLATION LEVEL " + level, nil
+		}
+
+		if level != "" {
+			return "BEGIN ISOLATION LEVEL " + level, nil
+		}
+
+		return "BEGIN", nil
+	case *CommitStmt:
+		if n.Prepared != nil {
+			return "COMMIT PREPARED " + quote(n.Prepared.Value), nil
+		}
+
+		return "COMMIT", nil
+	case *RollbackStmt:
+		if n.Savepoint != nil {
+			return "ROLLBACK TO SAVEPOINT " + n.Savepoint.Value, nil
+		}
+
+		if n.Prepared != nil {
+			return "ROLLBACK PREPARED " + quote(n.Prepared.Value), nil
+		}
+
+		return "ROLLBACK", nil
+	case *LockTableStmt:
+		if n.Mode == LOCK_SHARE {
+			return fmt.Sprintf("LOCK TABLE %s IN SHARE MODE", n.TableName.Value), nil
+		}
+
+		return fmt.Sprintf("LOCK TABLE %s IN EXCLUSIVE MODE", n.TableName.Value), nil
+	case *KillStmt:
+		if n.Query {
+			return fmt.Sprintf("KILL QUERY %d", n.ChannelID), nil
+		}
+
+		return fmt.Sprintf("KILL %d", n.ChannelID), nil
+	case *PrepareTransactionStmt:
+		return "PREPARE TRANSACTION " + quote(n.Gid.Value), nil
+	case *SavepointStmt:
+		return "SAVEPOINT " + n.Name.Value, nil
+	case *ReleaseSavepointStmt:
+		return "RELEASE SAVEPOINT " + n.Name.Value, nil
+	case *CreateUserStmt:
+		if n.Certificate != nil {
+			return fmt.Sprintf("CREATE USER %s IDENTIFIED BY CERTIFICATE %s", n.Username.Value, quote(n.Certificate.Value)), nil
+		}
+
+		return fmt.Sprintf("CREATE USER %s IDENTIFIED BY %s", n.Username.Value, quote(n.Password.Value)), nil
+	case *DropUserStmt:
+		return "DROP USER " + n.Username.Value, nil
+	case *AlterUserStmt:
+		switch n.SetType {
+		case ALTER_USER_SET_PASSWORD:
+			return fmt.Sprintf("ALTER USER %s SET PASSWORD %s", n.Username.Value, quote(n.Value.Value)), nil
+		case ALTER_USER_SET_USERNAME:
+			return fmt.Sprintf("ALTER USER %s SET USERNAME %s", n.Username.Value, quote(n.Value.Value)), nil
+		case ALTER_USER_ACCOUNT_LOCK:
+			return fmt.Sprintf("ALTER USER %s ACCOUNT LOCK", n.Username.Value), nil
+		case ALTER_USER_ACCOUNT_UNLOCK:
+			return fmt.Sprintf("ALTER USER %s ACCOUNT UNLOCK", n.Username.Value), nil
+		}
+
+		return "", fmt.Errorf("unknown ALTER USER type %d", n.SetType)
+	case *GrantStmt:
+		return deparsePrivilegeDefinition("GRANT", n.PrivilegeDefinition, n.PrivilegeDefinition.Grantee), nil
+	case *RevokeStmt:
+		return deparsePrivilegeDefinition("REVOKE", n.PrivilegeDefinition, n.PrivilegeDefinition.Revokee), nil
+	case *ShowStmt:
+		switch n.ShowType {
+		case SHOW_DATABASES:
+			return "SHOW DATABASES", nil
+		case SHOW_TABLES:
+			return "SHOW TABLES", nil
+		case SHOW_USERS:
+			return "SHOW USERS", nil
+		case SHOW_INDEXES:
+			return "SHOW INDEXES FROM " + n.From.Value, nil
+		case SHOW_GRANTS:
+			if n.For == nil {
+				return "SHOW GRANTS", nil
+			}
+
+			return "SHOW GRANTS FOR " + n.For.Value, nil
+		case SHOW_LOCKS:
+			return "SHOW LOCKS", nil
+		case SHOW_PREPARED_TRANSACTIONS:
+			return "SHOW PREPARED TRANSACTIONS", nil
+		case SHOW_PROCESSLIST:
+			return "SHOW PROCESSLIST", nil
+		}
+
+		return "", fmt.Errorf("unknown SHOW type %d", n.ShowType)
+	case *CreateProcedureStmt:
+		return deparseProcedure(n.Procedure)
+	case *DropProcedureStmt:
+		return "DROP PROCEDURE " + n.ProcedureName.Value, nil
+	case *ExecStmt:
+		args, err := deparseExprs(n.Args)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("EXEC %s(%s)", n.ProcedureName.Value, args), nil
+	case *DeclareStmt:
+		if n.CursorStmt != nil {
+			sel, err := deparseSelectStmt(n.CursorStmt)
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("DECLARE %s CURSOR FOR %s", n.CursorName.Value, sel), nil
+		}
+
+		return fmt.Sprintf("DECLARE %s %s", n.CursorVariableName.Value, n.CursorVariableDataType.Value), nil
+	case *OpenStmt:
+		return "OPEN " + n.CursorName.Value, nil
+	case *FetchStmt:
+		return fmt.Sprintf("FETCH NEXT FROM %s INTO %s", n.CursorName.Value, deparseIdentifiers(n.Into)), nil
+	case *CloseStmt:
+		return "CLOSE " + n.CursorName.Value, nil
+	case *DeallocateStmt:
+		if n.CursorVariableName != nil {
+			return "DEALLOCATE " + n.CursorVariableName.Value, nil
+		}
+
+		return "DEALLOCATE " + n.CursorName.Value, nil
+	case *WhileStmt:
+		block, err := deparseBeginEndBlock(n.Stmts)
+		if err != nil {
+			return "", err
+		}
+
+		status, err := deparseExpr(n.FetchStatus)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("WHILE @@FETCH_STATUS = %s %s", status, block), nil
+	case *PrintStmt:
+		expr, err := deparseExpr(n.Expr)
+		if err != nil {
+			return "", err
+		}
+
+		return "PRINT " + expr, nil
+	case *SetStmt:
+		if n.Value == nil {
+			return fmt.Sprintf("SET %s = DEFAULT", n.Variable.Value), nil
+		}
+
+		value, err := deparseExpr(n.Value)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("SET %s = %s", n.Variable.Value, value), nil
+	case *ReturnStmt:
+		expr, err := deparseExpr(n.Expr)
+		if err != nil {
+			return "", err
+		}
+
+		return "RETURN " + expr, nil
+	case *BreakStmt:
+		return "BREAK", nil
+	case *ExitStmt:
+		return "EXIT", nil
+	case *BeginEndBlock:
+		return deparseBeginEndBlock(n)
+	}
+
+	return "", fmt.Errorf("cannot deparse %T", node)
+}
+
+// deparseCreateTableStmt renders a CREATE TABLE statement, columns are rendered in name order
+func deparseCreateTableStmt(stmt *CreateTableStmt) (string, error) {
+	columns := make([]string, 0, len(stmt.TableSchema.ColumnDefinitions))
+	for name := range stmt.TableSchema.ColumnDefinitions {
+		columns = append(columns, name)
+	}
+
+	sort.Strings(columns)
+
+	defs := make([]string, 0, len(columns))
+	var foreignKeys []string
+
+	for _, name := range columns {
+		colDef := stmt.TableSchema.ColumnDefinitions[name]
+
+		def, err := deparseColumnDefinition(colDef)
+		if err != nil {
+			return "", err
+		}
+
+		defs = append(defs, name+" "+def)
+
+		if colDef.References != nil {
+			foreignKeys = append(foreignKeys, fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s(%s)", name, colDef.References.TableName, colDef.References.ColumnName))
+		}
+	}
+
+	// Table options are parsed as trailing constraints
+	var options []string
+	options = append(options, foreignKeys...)
+
+	if stmt.Compress {
+		options = append(options, "COMPRESS")
+	}
+
+	if stmt.Encrypt {
+		key := "''"
+		if stmt.EncryptKey != nil {
+			key = deparseLiteral(stmt.EncryptKey.Value)
+		}
+
+		options = append(options, "ENCRYPT("+key+")")
+	}
+
+	if len(options) > 0 {
+		defs = append(defs, strings.Join(options, " "))
+	}
+
+	return fmt.Sprintf("CREATE TABLE %s (%s)", stmt.TableName.Value, strings.Join(defs, ", ")), nil
+}
+
+// deparseColumnDefinition renders a column data type followed by its constraints
+func deparseColumnDefinition(colDef *catalog.ColumnDefinition) (string, error) {
+	def := colDef.DataType
+
+	switch colDef.DataType {
+	case "CHAR", "CHARACTER", "BINARY":
+		if colDef.Length > 0 {
+			def += fmt.Sprintf("(%d)", colDef.Length)
+		}
+	case "DEC", "DECIMAL", "NUMERIC", "REAL", "FLOAT", "DOUBLE":
+		if colDef.Precision > 0 || colDef.Scale > 0 {
+			def += fmt.Sprintf("(%d, %d)", colDef.Precision, colDef.Scale)
+		}
+	}
+
+	if colDef.NotNull {
+		def += " NOT NULL"
+	}
+
+	if colDef.Unique {
+		def += " UNIQUE"
+	}
+
+	if colDef.Sequence {
+		def += " SEQUENCE"
+	}
+
+	if colDef.Default != nil {
+		value, err := deparseExpr(colDef.Default)
+		if err != nil {
+			return "", err
+		}
+
+		def += " DEFAULT " + value
+	}
+
+	if colDef.Check != nil {
+		check, err := deparseExpr(colDef.Check)
+		if err != nil {
+			return "", err
+		}
+
+		def += " CHECK (" + check + ")"
+	}
+
+	return def, nil
+}
+
+// deparseInsertStmt renders an INSERT statement
+func deparseInsertStmt(stmt *InsertStmt) (string, error) {
+	rows := make([]string, 0, len(stmt.Values))
+
+	for _, row := range stmt.Values {
+		values, err := deparseExprs(row)
+		if err != nil {
+			return "", err
+		}
+
+		rows = append(rows, "("+values+")")
+	}
+
+	return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", stmt.TableName.Value, deparseIdentifiers(stmt.ColumnNames), strings.Join(rows, ", ")), nil
+}
+
+// deparseUpdateStmt renders an UPDATE statement
+func deparseUpdateStmt(stmt *UpdateStmt) (string, error) {
+	sets := make([]string, 0, len(stmt.SetClause))
+
+	for _, set := range stmt.SetClause {
+		// The set value is a literal wrapping either a raw value or an expression
+		var value interface{} = set.Value
+		if set.Value != nil {
+			switch set.Value.Value.(type) {
+			case *Identifier, *BinaryExpression, *ColumnSpecification, *shared.SysDate, *shared.SysTime, *shared.SysTimestamp, *shared.GenUUID:
+				value = set.Value.Value
+			}
+		}
+
+		v, err := deparseExpr(value)
+		if err != nil {
+			return "", err
+		}
+
+		sets = append(sets, set.Column.Value+" = "+v)
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET %s", stmt.TableName.Value, strings.Join(sets, ", "))
+
+	if stmt.WhereClause != nil {
+		where, err := deparseExpr(stmt.WhereClause.SearchCondition)
+		if err != nil {
+			return "", err
+		}
+
+		sql += " WHERE " + where
+	}
+
+	return sql, nil
+}
+
+// deparseSelectStmt renders a SELECT statement including any unions
+func deparseSelectStmt(stmt *SelectStmt) (string, error) {
+	sql := "SELECT "
+
+	if stmt.Distinct {
+		sql += "DISTINCT "
+	}
+
+	if stmt.SelectList != nil {
+		exprs := make([]string, 0, len(stmt.SelectList.Expressions))
+
+		for _, expr := range stmt.SelectList.Expressions {
+			e, err := deparseExpr(expr)
+			if err != nil {
+				return "", err
+			}
+
+			exprs = append(exprs, e)
+		}
+
+		sql += strings.Join(exprs, ", ")
+	}
+
+	if te := stmt.TableExpression; te != nil {
+		if te.FromClause != nil {
+			tables := make([]string, 0, len(te.FromClause.Tables))
+			for _, table := range te.FromClause.Tables {
+				tables = append(tables, deparseTable(table))
+			}
+
+			sql += " FROM " + strings.Join(tables, ", ")
+		}
+
+		if te.WhereClause != nil {
+			where, err := deparseExpr(te.WhereClause.SearchCondition)
+			if err != nil {
+				return "", err
+			}
+
+			sql += " WHERE " + where
+		}
+
+		if te.GroupByClause != nil {
+			groupBy, err := deparseValueExpressions(te.GroupByClause.GroupByExpressions)
+			if err != nil {
+				return "", err
+			}
+
+			sql += " GROUP BY " + groupBy
+		}
+
+		if te.HavingClause != nil {
+			having, err := deparseExpr(te.HavingClause.SearchCondition)
+			if err != nil {
+				return "", err
+			}
+
+			sql += " HAVING " + having
+		}
+
+		if te.OrderByClause != nil {
+			orderBy, err := deparseValueExpressions(te.OrderByClause.OrderByExpressions)
+			if err != nil {
+				return "", err
+			}
+
+			sql += " ORDER BY " + orderBy
+
+			if te.OrderByClause.Order == DESC {
+				sql += " DESC"
+			} else if te.OrderByClause.Order == ASC {
+				sql += " ASC"
+			}
+		}
+
+		if te.LimitClause != nil {
+			if te.LimitClause.Count != nil {
+				count, err := deparseExpr(te.LimitClause.Count)
+				if err != nil {
+					return "", err
+				}
+
+				sql += " LIMIT " + count
+			}
+
+			if te.LimitClause.Offset != nil {
+				offset, err := deparseExpr(te.LimitClause.Offset)
+				if err != nil {
+					return "", err
+				}
+
+				sql += " OFFSET " + offset
+			}
+		}
+	}
+
+	if stmt.LockingClause != nil {
+		if stmt.LockingClause.Strength == FOR_SHARE {
+			sql += " FOR SHARE"
+		} else {
+			sql += " FOR UPDATE"
+		}
+
+		switch stmt.LockingClause.WaitPolicy {
+		case LOCK_NOWAIT:
+			sql += " NOWAIT"
+		case LOCK_SKIP_LOCKED:
+			sql += " SKIP LOCKED"
+		}
+	}
+
+	if stmt.Union != nil {
+		union, err := deparseSelectStmt(stmt.Union)
+		if err != nil {
+			return "", err
+		}
+
+		if stmt.UnionAll {
+			sql += " UNION ALL " + union
+		} else {
+			sql += " UNION " + union
+		}
+	}
+
+	return sql, nil
+}
+
+// deparseProcedure renders a CREATE PROCEDURE statement
+func deparseProcedure(procedure *Procedure) (string, error) {
+	params := make([]string, 0, len(procedure.Parameters))
+
+	for _, param := range procedure.Parameters {
+		p := param.Name.Value + " " + param.DataType.Value
+
+		if param.Length != nil {
+			p += fmt.Sprintf("(%v)", param.Length.Value)
+		} else if param.Precision != nil && param.Scale != nil {
+			p += fmt.Sprintf("(%v, %v)", param.Precision.Value, param.Scale.Value)
+		}
+
+		params = append(params, p)
+	}
+
+	body, err := deparseBeginEndBlock(procedure.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("CREATE PROCEDURE %s (%s) %s", procedure.Name.Value, strings.Join(params, ", "), body), nil
+}
+
+// deparseBeginEndBlock renders a BEGIN ... END block
+func deparseBeginEndBlock(block *BeginEndBlock) (string, error) {
+	if block == nil {
+		return "BEGIN END", nil
+	}
+
+	sql := "BEGIN "
+
+	for _, s := range block.Stmts {
+		stmt, err := deparseStmt(s)
+		if err != nil {
+			return "", err
+		}
+
+		sql += stmt + "; "
+	}
+
+	return sql + "END", nil
+}
+
+// deparsePrivilegeDefinition renders a GRANT or REVOKE statement
+func deparsePrivilegeDefinition(keyword string, def *PrivilegeDefinition, user *Identifier) string {
+	actions := make([]string, 0, len(def.Actions))
+	for _, action := range def.Actions {
+		actions = append(actions, action.String())
+	}
+
+	sql := keyword + " " + strings.Join(actions, ", ")
+
+	if def.Object != nil {
+		sql += " ON " + def.Object.Value
+	}
+
+	if user != nil {
+		sql += " TO " + user.Value
+	}
+
+	return sql
+}
+
+// deparseTable renders a table within a FROM clause
+func deparseTable(table *Table) string {
+	if table.Alias != nil {
+		return table.Name.Value + " AS " + table.Alias.Value
+	}
+
+	return table.Name.Value
+}
+
+// deparseIdentifiers renders a comma separated identifier list
+func deparseIdentifiers(identifiers []*Identifier) string {
+	values := make([]string, 0, len(identifiers))
+	for _, identifier := range identifiers {
+		values = append(values, identifier.Value)
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// deparseValueExpressions renders a comma separated value expression list
+func deparseValueExpressions(exprs []*ValueExpression) (string, error) {
+	values := make([]string, 0, len(exprs))
+
+	for _, expr := range exprs {
+		value, err := deparseExpr(expr)
+		if err != nil {
+			return "", err
+		}
+
+		values = append(values, value)
+	}
+
+	return strings.Join(values, ", "), nil
+}
+
+// deparseExprs renders a comma separated expression list
+func deparseExprs(exprs []interface{}) (string, error) {
+	values := make([]string, 0, len(exprs))
+
+	for _, expr := range exprs {
+		value, err := deparseExpr(expr)
+		if err != nil {
+			return "", err
+		}
+
+		values = append(values, value)
+	}
+
+	return strings.Join(values, ", "), nil
+}
+
+// deparseLiteral renders a literal value
+// String literals keep their quotes from the lexer, unquoted strings are keywords such as SYS_TIME
+func deparseLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return v
+	case bool:
+		if v {
+			return "TRUE"
+		}
+
+		return "FALSE"
+	case float64:
+		f := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(f, ".") {
+			f += ".0" // Keep the literal a float when parsed back
+		}
+
+		return f
+	case []byte:
+		return quote(string(v))
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// quote quotes a string value which was stored without its quotes
+// The lexer has no escapes, a value containing a single quote is quoted with double quotes instead
+func quote(value interface{}) string {
+	s := fmt.Sprintf("%v", value)
+	if strings.Contains(s, "'") {
+		return "\"" + s + "\""
+	}
+
+	return "'" + s + "'"
+}
+
+// comparisonOperatorString returns the SQL form of a comparison operator
+func comparisonOperatorString(op ComparisonOperator) string {
+	switch op {
+	case OP_EQ:
+		return "="
+	case OP_NEQ:
+		return "<>"
+	case OP_LT:
+		return "<"
+	case OP_LTE:
+		return "<="
+	case OP_GT:
+		return ">"
+	case OP_GTE:
+		return ">="
+	}
+
+	return "?"
+}
+
+// binaryExpressionOperatorString returns the SQL form of an arithmetic operator
+func binaryExpressionOperatorString(op BinaryExpressionOperator) string {
+	switch op {
+	case OP_PLUS:
+		return "+"
+	case OP_MINUS:
+		return "-"
+	case OP_MULT:
+		return "*"
+	case OP_DIV:
+		return "/"
+	}
+
+	return "?"
+}
+
+// binaryExpressionPrecedence returns the precedence of an arithmetic operator
+func binaryExpressionPrecedence(op BinaryExpressionOperator) int {
+	if op == OP_MULT || op == OP_DIV {
+		return 2
+	}
+
+	return 1
+}
+
+// deparseOperand renders an operand of a binary or logical expression, adding parentheses when the operand binds looser than its parent
+func deparseOperand(operand interface{}, parent interface{}, right bool) (string, error) {
+	value, err := deparseExpr(operand)
+	if err != nil {
+		return "", err
+	}
+
+	switch p := parent.(type) {
+	case *BinaryExpression:
+		if child, ok := operand.(*BinaryExpression); ok {
+			cp, pp := binaryExpressionPrecedence(child.Op), binaryExpressionPrecedence(p.Op)
+			if cp < pp || (right && cp == pp) {
+				return "(" + value + ")", nil
+			}
+		}
+	case *LogicalCondition:
+		if child, ok := operand.(*LogicalCondition); ok && child.Op != p.Op {
+			return "(" + value + ")", nil
+		}
+	}
+
+	return value, nil
+}
+
+// deparseExpr renders an expression, predicate or search condition
+func deparseExpr(expr interface{}) (string, error) {
+	switch e := expr.(type) {
+	case nil:
+		return "NULL", nil
+	case *Literal:
+		if e == nil {
+			return "NULL", nil
+		}
+
+		return deparseLiteral(e.Value), nil
+	case *Identifier:
+		return e.Value, nil
+	case *Wildcard:
+		return "*", nil
+	case *Variable:
+		return e.VariableName.Value, nil
+	case *ColumnSpecification:
+		if e.TableName != nil {
+			return e.TableName.Value + "." + e.ColumnName.Value, nil
+		}
+
+		return e.ColumnName.Value, nil
+	case *ValueExpression:
+		var value string
+		var err error
+
+		if sel, ok := e.Value.(*SelectStmt); ok {
+			value, err = deparseSelectStmt(sel)
+			value = "(" + value + ")"
+		} else if sub, ok := e.Value.(*ValueExpression); ok {
+			// Subqueries are wrapped in a value expression of their own
+			value, err = deparseExpr(sub)
+		} else {
+			value, err = deparseExpr(e.Value)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if e.Alias != nil {
+			value += " AS " + e.Alias.Value
+		}
+
+		return value, nil
+	case *SelectStmt:
+		sel, err := deparseSelectStmt(e)
+		if err != nil {
+			return "", err
+		}
+
+		return "(" + sel + ")", nil
+	case *BinaryExpression:
+		left, err := deparseOperand(e.Left, e, false)
+		if err != nil {
+			return "", err
+		}
+
+		right, err := deparseOperand(e.Right, e, true)
+		if err != nil {
+			return "", err
+		}
+
+		return left + " " + binaryExpressionOperatorString(e.Op) + " " + right, nil
+	case *UnaryExpr:
+		value, err := deparseExpr(e.Expr)
+		if err != nil {
+			return "", err
+		}
+
+		return e.Op + value, nil
+	case *AggregateFunc:
+		args, err := deparseExprs(e.Args)
+		if err != nil {
+			return "", err
+		}
+
+		return e.FuncName + "(" + args + ")", nil
+	case *ComparisonPredicate:
+		left, err := deparseExpr(e.Left)
+		if err != nil {
+			return "", err
+		}
+
+		right, err := deparseExpr(e.Right)
+		if err != nil {
+			return "", err
+		}
+
+		return left + " " + comparisonOperatorString(e.Op) + " " + right, nil
+	case *LogicalCondition:
+		if e.Op == OP_NOT {
+			value, err := deparseExpr(e.Left)
+			if err != nil {
+				return "", err
+			}
+
+			return "NOT (" + value + ")", nil
+		}
+
+		left, err := deparseOperand(e.Left, e, false)
+		if err != nil {
+			return "", err
+		}
+
+		right, err := deparseOperand(e.Right, e, true)
+		if err != nil {
+			return "", err
+		}
+
+		op := "AND"
+		if e.Op == OP_OR {
+			op = "OR"
+		}
+
+		return left + " " + op + " " + right, nil
+	case *NotExpr:
+		// NOT BETWEEN, NOT IN and NOT LIKE are parsed into a NotExpr wrapping the predicate
+		return deparsePredicate(e.Expr, true)
+	case *BetweenPredicate, *InPredicate, *LikePredicate:
+		return deparsePredicate(e, false)
+	case *IsPredicate:
+		left, err := deparseExpr(e.Left)
+		if err != nil {
+			return "", err
+		}
+
+		if e.Null {
+			return left + " IS NULL", nil
+		}
+
+		return left + " IS NOT NULL", nil
+	case *ExistsPredicate:
+		value, err := deparseExpr(e.Expr)
+		if err != nil {
+			return "", err
+		}
+
+		if !strings.HasPrefix(value, "(") {
+			value = "(" + value + ")"
+		}
+
+		return "EXISTS " + value, nil
+	case *CaseExpr:
+		sql := "CASE"
+
+		for _, when := range e.WhenClauses {
+			cond, err := deparseExpr(when.Condition)
+			if err != nil {
+				return "", err
+			}
+
+			result, err := deparseExpr(when.Result)
+			if err != nil {
+				return "", err
+			}
+
+			sql += " WHEN " + cond + " THEN " + result
+		}
+
+		if e.ElseClause != nil {
+			elseValue := e.ElseClause
+			if ec, ok := e.ElseClause.(*ElseClause); ok {
+				elseValue = ec.Result
+			}
+
+			result, err := deparseExpr(elseValue)
+			if err != nil {
+				return "", err
+			}
+
+			sql += " ELSE " + result
+		}
+
+		return sql + " END", nil
+	case *UpperFunc:
+		return deparseFunc("UPPER", e.Arg)
+	case *LowerFunc:
+		return deparseFunc("LOWER", e.Arg)
+	case *ReverseFunc:
+		return deparseFunc("REVERSE", e.Arg)
+	case *RoundFunc:
+		return deparseFunc("ROUND", e.Arg)
+	case *LengthFunc:
+		return deparseFunc("LENGTH", e.Arg)
+	case *TrimFunc:
+		return deparseFunc("TRIM", e.Arg)
+	case *ConcatFunc:
+		return deparseFunc("CONCAT", e.Args...)
+	case *CoalesceFunc:
+		return deparseFunc("COALESCE", append(append([]interface{}{}, e.Args...), e.Value)...)
+	case *CastFunc:
+		value, err := deparseExpr(e.Expr)
+		if err != nil {
+			return "", err
+		}
+
+		return "CAST(" + value + " AS " + e.DataType.Value + ")", nil
+	case *PositionFunc:
+		arg, err := deparseExpr(e.Arg)
+		if err != nil {
+			return "", err
+		}
+
+		in, err := deparseExpr(e.In)
+		if err != nil {
+			return "", err
+		}
+
+		return "POSITION(" + arg + " IN " + in + ")", nil
+	case *SubstrFunc:
+		if e.Length == nil {
+			return deparseFunc("SUBSTRING", e.Arg, e.StartPos)
+		}
+
+		return deparseFunc("SUBSTRING", e.Arg, e.StartPos, e.Length)
+	case *shared.SysDate:
+		return "SYS_DATE", nil
+	case *shared.SysTime:
+		return "SYS_TIME", nil
+	case *shared.SysTimestamp:
+		return "SYS_TIMESTAMP", nil
+	case *shared.GenUUID:
+		return "GENERATE_UUID", nil
+	case string, uint64, int, int64, float64, bool:
+		return deparseLiteral(e), nil
+	}
+
+	return "", fmt.Errorf("cannot deparse %T", expr)
+}
+
+// deparsePredicate renders a BETWEEN, IN or LIKE predicate, optionally negated
+func deparsePredicate(predicate interface{}, not bool) (string, error) {
+	neg := ""
+	if not {
+		neg = "NOT "
+	}
+
+	switch e := predicate.(type) {
+	case *BetweenPredicate:
+		left, err := deparseExpr(e.Left)
+		if err != nil {
+			return "", err
+		}
+
+		lower, err := deparseExpr(e.Lower)
+		if err != nil {
+			return "", err
+		}
+
+		upper, err := deparseExpr(e.Upper)
+		if err != nil {
+			return "", err
+		}
+
+		return left + " " + neg + "BETWEEN " + lower + " AND " + upper, nil
+	case *InPredicate:
+		left, err := deparseExpr(e.Left)
+		if err != nil {
+			return "", err
+		}
+
+		values, err := deparseValueExpressions(e.Values)
+		if err != nil {
+			return "", err
+		}
+
+		// A subquery already renders its own parentheses
+		if len(e.Values) == 1 && strings.HasPrefix(values, "(SELECT") {
+			return left + " " + neg + "IN " + values, nil
+		}
+
+		return left + " " + neg + "IN (" + values + ")", nil
+	case *LikePredicate:
+		left, err := deparseExpr(e.Left)
+		if err != nil {
+			return "", err
+		}
+
+		pattern, err := deparseExpr(e.Pattern)
+		if err != nil {
+			return "", err
+		}
+
+		return left + " " + neg + "LIKE " + pattern, nil
+	}
+
+	value, err := deparseExpr(predicate)
+	if err != nil {
+		return "", err
+	}
+
+	if not {
+		return "NOT (" + value + ")", nil
+	}
+
+	return value, nil
+}
+
+// deparseFunc renders a function call
+func deparseFunc(name string, args ...interface{}) (string, error) {
+	values, err := deparseExprs(args)
+	if err != nil {
+		return "", err
+	}
+
+	return name + "(" + values + ")", nil
+}
@@ -0,0 +1,141 @@
+// Package parser deparser tests
+// AriaSQL parser deparser tests
+// Copyright (C) Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package parser
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeparse(t *testing.T) {
+	// Each statement is already in the form the deparser renders it
+	statements := []string{
+		"CREATE DATABASE test;",
+		"DROP DATABASE test;",
+		"USE test;",
+		"CREATE TABLE test (a INT NOT NULL UNIQUE SEQUENCE, b CHAR(50) DEFAULT 'x', c DECIMAL(10, 2), d DATE DEFAULT SYS_DATE);",
+		"DROP TABLE test;",
+		"CREATE UNIQUE INDEX idx ON test (a, b);",
+		"CREATE INDEX idx ON test (a);",
+		"DROP INDEX idx ON test;",
+		"INSERT INTO test (a, b, c) VALUES (1, 'hello', 1.5), (2, NULL, 2.0);",
+		"UPDATE test SET a = a + 1 WHERE b = 'world';",
+		"UPDATE test SET d = SYS_DATE;",
+		"DELETE FROM test WHERE a = 1 AND b = 'hello';",
+		"DELETE FROM test WHERE a > 1 OR b LIKE 'h%';",
+		"DELETE FROM test WHERE a BETWEEN 1 AND 5;",
+		"DELETE FROM test WHERE a NOT IN (1, 2, 3);",
+		"DELETE FROM test WHERE b IS NOT NULL;",
+		"DELETE FROM test WHERE (a = 1 OR b = 2) AND c = 3;",
+		"DELETE FROM test WHERE a = 1 AND (b = 2 OR c = 3) AND (d = 4 OR e = 5);",
+		"SELECT * FROM test;",
+		"SELECT a, COUNT(b) AS cnt FROM test AS t WHERE t.a >= 1 GROUP BY a ORDER BY a DESC LIMIT 1 OFFSET 2;",
+		"SELECT 1 + 1 * (2 + 1) AS result;",
+		"SELECT UPPER(b) FROM test WHERE a IN (SELECT a FROM test2);",
+		"BEGIN;",
+		"BEGIN ISOLATION LEVEL SERIALIZABLE;",
+		"SET TRANSACTION ISOLATION LEVEL READ COMMITTED;",
+		"COMMIT;",
+		"ROLLBACK;",
+		"SHOW LOCKS;",
+		"SELECT * FROM jobs WHERE status = 'new' LIMIT 1 FOR UPDATE SKIP LOCKED;",
+		"SELECT id FROM jobs FOR SHARE NOWAIT;",
+		"LOCK TABLE jobs IN SHARE MODE;",
+		"SAVEPOINT batch1;",
+		"ROLLBACK TO SAVEPOINT batch1;",
+		"RELEASE SAVEPOINT batch1;",
+		"PREPARE TRANSACTION 'order-42';",
+		"COMMIT PREPARED 'order-42';",
+		"ROLLBACK PREPARED 'order-42';",
+		"SHOW PREPARED TRANSACTIONS;",
+		"SHOW PROCESSLIST;",
+		"SHOW GRANTS;",
+		"KILL 3;",
+		"KILL QUERY 3;",
+		"CREATE USER username IDENTIFIED BY 'password';",
+		"CREATE USER svc IDENTIFIED BY CERTIFICATE 'CN=svc';",
+		"DROP USER username;",
+		"ALTER USER admin SET PASSWORD 'newpassword';",
+		"ALTER USER svc ACCOUNT LOCK;",
+		"ALTER USER svc ACCOUNT UNLOCK;",
+		"GRANT SELECT, INSERT ON db1.tbl1 TO username;",
+		"GRANT CONNECT TO username;",
+		"ALTER TABLE users DROP COLUMN age;",
+		"SET synchronous_replicas = 2;",
+		"SET synchronous_replicas = DEFAULT;",
+	}
+
+	for _, statement := range statements {
+		lexer := NewLexer([]byte(statement))
+		parser := NewParser(lexer)
+
+		stmt, err := parser.Parse()
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		sql, err := Deparse(stmt)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		if sql != statement {
+			t.Fatalf("expected %s, got %s", statement, sql)
+		}
+	}
+}
+
+func TestDeparseMixedLogicalOperators(t *testing.T) {
+	// Logical operators bind as the parser nests them, the deparsed grouping parses back into the same conditions
+	statements := map[string]string{
+		"DELETE FROM test WHERE a = 1 AND b = 2 OR c = 3;":          "DELETE FROM test WHERE a = 1 AND (b = 2 OR c = 3);",
+		"DELETE FROM test WHERE a = 1 OR b = 2 AND c = 3 OR d = 4;": "DELETE FROM test WHERE a = 1 OR (b = 2 AND (c = 3 OR d = 4));",
+		"DELETE FROM test WHERE ((a = 1 OR b = 2)) AND c = 3;":      "DELETE FROM test WHERE (a = 1 OR b = 2) AND c = 3;",
+	}
+
+	for statement, expect := range statements {
+		stmt, err := NewParser(NewLexer([]byte(statement))).Parse()
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		sql, err := Deparse(stmt)
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		if sql != expect {
+			t.Fatalf("expected %s, got %s", expect, sql)
+		}
+
+		reparsed, err := NewParser(NewLexer([]byte(sql))).Parse()
+		if err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+
+		if !reflect.DeepEqual(reparsed, stmt) {
+			t.Fatalf("expected %s to parse back into the conditions of %s", sql, statement)
+		}
+	}
+}
+
+func TestDeparseUnsupported(t *testing.T) {
+	_, err := Deparse(&Table{Name: &Identifier{Value: "test"}})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
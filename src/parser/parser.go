@@ -23,6 +23,7 @@ import (
 	"ariasql/shared"
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
 )
@@ -48,7 +49,7 @@ var (
 		"UPPER", "LOWER", "CAST", "COALESCE", "REVERSE", "ROUND", "POSITION", "LENGTH", "REPLACE",
 		"CONCAT", "SUBSTRING", "TRIM", "GENERATE_UUID", "SYS_DATE", "SYS_TIME", "SYS_TIMESTAMP", "SYS_DATETIME",
 		"CASE", "WHEN", "THEN", "ELSE", "END", "IF", "ELSEIF", "DEALLOCATE", "NEXT", "WHILE", "PRINT", "EXPLAIN",
-		"COMPRESS", "ENCRYPT", "COLUMN",
+		"COMPRESS", "ENCRYPT", "COLUMN", "PROMOTE", "SUBSCRIBE", "SAVEPOINT", "RELEASE", "LOCK", "PREPARE", "KILL",
 	}, shared.DataTypes...)
 )
 
@@ -72,6 +73,7 @@ const (
 	DIVIDE_TOK            // /
 	MODULUS_TOK           // %
 	AT_TOK                // @
+	PARAM_TOK             // $n, replaced by its bound value
 )
 
 // Parser is a parser for SQL
@@ -82,9 +84,10 @@ type Parser struct {
 
 // Lexer is a lexer for SQL
 type Lexer struct {
-	input  []byte  // Input to be tokenized
-	pos    int     // Position in the input
-	tokens []Token // Tokens found
+	input  []byte    // Input to be tokenized
+	pos    int       // Position in the input
+	tokens []Token   // Tokens found
+	params [][]Token // Tokens of the values bound to $1, $2, ...
 }
 
 // Token is a token found by the lexer
@@ -102,6 +105,54 @@ func NewLexer(input []byte) *Lexer {
 	}
 }
 
+// Bind binds values to the $1, $2, ... parameters of the input, a value is a single literal whatever it contains
+// Values are nil, bool, string, int64 or float64, a parameter without a value is NULL
+func (l *Lexer) Bind(params ...interface{}) error {
+	l.params = make([][]Token, len(params))
+
+	for i, param := range params {
+		switch v := param.(type) {
+		case nil:
+			l.params[i] = []Token{{tokenT: KEYWORD_TOK, value: "NULL"}}
+		case bool:
+			l.params[i] = []Token{{tokenT: LITERAL_TOK, value: v}}
+		case string:
+			// Quoted and escaped as the lexer keeps string literals
+			l.params[i] = []Token{{tokenT: LITERAL_TOK, value: "'" + strings.ReplaceAll(v, "'", "\\'") + "'"}}
+		case int64:
+			// As the lexer reads the number, a negative number is a minus and the number
+			if v < 0 {
+				l.params[i] = append(l.params[i], Token{tokenT: MINUS_TOK, value: "-"})
+			}
+
+			n := uint64(v)
+			if v < 0 {
+				n = uint64(-v)
+			}
+
+			if n <= math.MaxUint32 {
+				l.params[i] = append(l.params[i], Token{tokenT: LITERAL_TOK, value: n})
+			} else {
+				l.params[i] = append(l.params[i], Token{tokenT: LITERAL_TOK, value: float64(n)})
+			}
+		case float64:
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("parameter $%d is not a finite number", i+1)
+			}
+
+			if v < 0 {
+				l.params[i] = append(l.params[i], Token{tokenT: MINUS_TOK, value: "-"})
+			}
+
+			l.params[i] = append(l.params[i], Token{tokenT: LITERAL_TOK, value: math.Abs(v)})
+		default:
+			return fmt.Errorf("unsupported value %v of parameter $%d", param, i+1)
+		}
+	}
+
+	return nil
+}
+
 // isLetter returns true if r is a letter
 func isLetter(r rune) bool {
 	return (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || r == '_' || r == '.' || r == '*'
@@ -331,6 +382,18 @@ func (l *Lexer) nextToken() Token {
 				l.pos++
 				continue
 			}
+
+			l.pos++
+
+			start := l.pos
+			for l.pos < len(l.input) && isDigit(rune(l.input[l.pos])) {
+				l.pos++
+			}
+
+			if l.pos > start {
+				n, _ := strconv.Atoi(string(l.input[start:l.pos]))
+				return Token{tokenT: PARAM_TOK, value: n}
+			}
 			continue
 		case ';':
 			if !insideLiteral {
@@ -449,6 +512,18 @@ func (l *Lexer) tokenize() {
 		if tok.tokenT == EOF_TOK {
 			break
 		}
+
+		// A parameter is replaced by its value's tokens, its value is never lexed as part of the input
+		if tok.tokenT == PARAM_TOK {
+			n := tok.value.(int)
+			if n < 1 || n > len(l.params) {
+				l.tokens = append(l.tokens, Token{tokenT: KEYWORD_TOK, value: "NULL"})
+			} else {
+				l.tokens = append(l.tokens, l.params[n-1]...)
+			}
+			continue
+		}
+
 		l.tokens = append(l.tokens, tok)
 	}
 
@@ -574,6 +649,22 @@ func (p *Parser) Parse() (Node, error) {
 			return p.parseExecStmt()
 		case "EXPLAIN":
 			return p.parseExplainStmt()
+		case "PROMOTE":
+			return p.parsePromoteStmt()
+		case "SET":
+			return p.parseSetStmt()
+		case "SUBSCRIBE":
+			return p.parseSubscribeStmt()
+		case "SAVEPOINT":
+			return p.parseSavepointStmt()
+		case "RELEASE":
+			return p.parseReleaseSavepointStmt()
+		case "LOCK":
+			return p.parseLockTableStmt()
+		case "PREPARE":
+			return p.parsePrepareTransactionStmt()
+		case "KILL":
+			return p.parseKillStmt()
 
 		}
 	}
@@ -1172,6 +1263,24 @@ func (p *Parser) parseAlterUserStmt() (Node, error) {
 	alterUserStmt.Username = &Identifier{Value: p.peek(0).value.(string)}
 	p.consume() // Consume username
 
+	// ACCOUNT LOCK or ACCOUNT UNLOCK
+	if p.peek(0).tokenT == IDENT_TOK && strings.ToUpper(p.peek(0).value.(string)) == "ACCOUNT" {
+		p.consume() // Consume ACCOUNT
+
+		action, _ := p.peek(0).value.(string)
+
+		switch strings.ToUpper(action) {
+		case "LOCK":
+			alterUserStmt.SetType = ALTER_USER_ACCOUNT_LOCK
+		case "UNLOCK":
+			alterUserStmt.SetType = ALTER_USER_ACCOUNT_UNLOCK
+		default:
+			return nil, errors.New("expected LOCK or UNLOCK")
+		}
+
+		return alterUserStmt, nil
+	}
+
 	if p.peek(0).tokenT != KEYWORD_TOK {
 		return nil, errors.New("expected keyword")
 	}
@@ -1215,6 +1324,18 @@ func (p *Parser) parseShowStmt() (Node, error) {
 		return &ShowStmt{ShowType: SHOW_TABLES}, nil
 	case "USERS":
 		return &ShowStmt{ShowType: SHOW_USERS}, nil
+	case "LOCKS":
+		return &ShowStmt{ShowType: SHOW_LOCKS}, nil
+	case "PROCESSLIST":
+		return &ShowStmt{ShowType: SHOW_PROCESSLIST}, nil
+	case "PREPARED":
+		p.consume() // Consume PREPARED
+
+		if p.peek(0).tokenT != IDENT_TOK || strings.ToUpper(p.peek(0).value.(string)) != "TRANSACTIONS" {
+			return nil, errors.New("expected TRANSACTIONS")
+		}
+
+		return &ShowStmt{ShowType: SHOW_PREPARED_TRANSACTIONS}, nil
 	case "INDEXES":
 		p.consume() // Consume INDEXES
 
@@ -1505,22 +1626,268 @@ func (p *Parser) parsePrivilegeStmt(revoke bool) (Node, error) {
 }
 
 // parseBeginStmt parses a BEGIN statement
+// BEGIN; or BEGIN ISOLATION LEVEL level;
 func (p *Parser) parseBeginStmt() (Node, error) {
 	p.consume() // Consume BEGIN
-	return &BeginStmt{}, nil
+
+	beginStmt := &BeginStmt{}
+
+	if p.peek(0).tokenT == IDENT_TOK && strings.ToUpper(p.peek(0).value.(string)) == "ISOLATION" {
+		level, err := p.parseIsolationLevel()
+		if err != nil {
+			return nil, err
+		}
+
+		beginStmt.IsolationLevel = level
+	}
+
+	return beginStmt, nil
+}
+
+// parseSetTransactionStmt parses a SET TRANSACTION ISOLATION LEVEL level; statement
+func (p *Parser) parseSetTransactionStmt() (Node, error) {
+	p.consume() // Consume TRANSACTION
+
+	if p.peek(0).tokenT != IDENT_TOK || strings.ToUpper(p.peek(0).value.(string)) != "ISOLATION" {
+		return nil, errors.New("expected ISOLATION LEVEL")
+	}
+
+	level, err := p.parseIsolationLevel()
+	if err != nil {
+		return nil, err
+	}
+
+	return &BeginStmt{IsolationLevel: level, SetTransaction: true}, nil
+}
+
+// parseIsolationLevel parses ISOLATION LEVEL READ COMMITTED | REPEATABLE READ | SERIALIZABLE
+func (p *Parser) parseIsolationLevel() (IsolationLevel, error) {
+	p.consume() // Consume ISOLATION
+
+	if p.peek(0).tokenT != IDENT_TOK || strings.ToUpper(p.peek(0).value.(string)) != "LEVEL" {
+		return 0, errors.New("expected LEVEL")
+	}
+
+	p.consume() // Consume LEVEL
+
+	if p.peek(0).tokenT != IDENT_TOK {
+		return 0, errors.New("expected isolation level")
+	}
+
+	var level IsolationLevel
+
+	switch strings.ToUpper(p.peek(0).value.(string)) {
+	case "READ":
+		if p.peek(1).tokenT != IDENT_TOK || strings.ToUpper(p.peek(1).value.(string)) != "COMMITTED" {
+			return 0, errors.New("expected READ COMMITTED")
+		}
+
+		p.consume() // Consume READ
+		level = ISOLATION_READ_COMMITTED
+	case "REPEATABLE":
+		if p.peek(1).tokenT != IDENT_TOK || strings.ToUpper(p.peek(1).value.(string)) != "READ" {
+			return 0, errors.New("expected REPEATABLE READ")
+		}
+
+		p.consume() // Consume REPEATABLE
+		level = ISOLATION_REPEATABLE_READ
+	case "SERIALIZABLE":
+		level = ISOLATION_SERIALIZABLE
+	default:
+		return 0, errors.New("expected READ COMMITTED, REPEATABLE READ or SERIALIZABLE")
+	}
+
+	p.consume() // Consume COMMITTED, READ or SERIALIZABLE
+
+	return level, nil
 }
 
 // parseCommitStmt parses a COMMIT statement
+// COMMIT; or COMMIT PREPARED 'gid';
 func (p *Parser) parseCommitStmt() (Node, error) {
 	p.consume() // Consume COMMIT
+
+	if p.peek(0).tokenT == IDENT_TOK && strings.ToUpper(p.peek(0).value.(string)) == "PREPARED" {
+		gid, err := p.parseTransactionId()
+		if err != nil {
+			return nil, err
+		}
+
+		return &CommitStmt{Prepared: gid}, nil
+	}
+
 	return &CommitStmt{}, nil
 }
 
 // parseRollbackStmt parses a ROLLBACK statement
+// ROLLBACK;, ROLLBACK TO [SAVEPOINT] name; or ROLLBACK PREPARED 'gid';
 func (p *Parser) parseRollbackStmt() (Node, error) {
 	p.consume() // Consume ROLLBACK
-	return &RollbackStmt{}, nil
 
+	if p.peek(0).tokenT == IDENT_TOK && strings.ToUpper(p.peek(0).value.(string)) == "PREPARED" {
+		gid, err := p.parseTransactionId()
+		if err != nil {
+			return nil, err
+		}
+
+		return &RollbackStmt{Prepared: gid}, nil
+	}
+
+	if p.peek(0).tokenT != KEYWORD_TOK || p.peek(0).value != "TO" {
+		return &RollbackStmt{}, nil
+	}
+
+	p.consume() // Consume TO
+
+	name, err := p.parseSavepointName()
+	if err != nil {
+		return nil, err
+	}
+
+	return &RollbackStmt{Savepoint: name}, nil
+}
+
+// parsePrepareTransactionStmt parses a PREPARE TRANSACTION 'gid' statement
+func (p *Parser) parsePrepareTransactionStmt() (Node, error) {
+	gid, err := p.parseTransactionId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrepareTransactionStmt{Gid: gid}, nil
+}
+
+// parseTransactionId parses the keyword before a global transaction id, PREPARE TRANSACTION or PREPARED, and the id itself
+func (p *Parser) parseTransactionId() (*Literal, error) {
+	if p.peek(0).value == "PREPARE" {
+		p.consume() // Consume PREPARE
+
+		if p.peek(0).tokenT != IDENT_TOK || strings.ToUpper(p.peek(0).value.(string)) != "TRANSACTION" {
+			return nil, errors.New("expected TRANSACTION")
+		}
+	}
+
+	p.consume() // Consume TRANSACTION or PREPARED
+
+	gid, ok := p.peek(0).value.(string)
+	if p.peek(0).tokenT != LITERAL_TOK || !ok {
+		return nil, errors.New("expected transaction identifier")
+	}
+
+	gid = gid[1 : len(gid)-1] // Strip quotes
+	p.consume()               // Consume transaction identifier
+
+	if gid == "" {
+		return nil, errors.New("transaction identifier cannot be empty")
+	}
+
+	return &Literal{Value: gid}, nil
+}
+
+// parseSavepointStmt parses a SAVEPOINT name; statement
+func (p *Parser) parseSavepointStmt() (Node, error) {
+	p.consume() // Consume SAVEPOINT
+
+	if p.peek(0).tokenT != IDENT_TOK {
+		return nil, errors.New("expected savepoint name")
+	}
+
+	savepointStmt := &SavepointStmt{Name: &Identifier{Value: p.peek(0).value.(string)}}
+	p.consume() // Consume savepoint name
+
+	return savepointStmt, nil
+}
+
+// parseReleaseSavepointStmt parses a RELEASE [SAVEPOINT] name; statement
+func (p *Parser) parseReleaseSavepointStmt() (Node, error) {
+	p.consume() // Consume RELEASE
+
+	name, err := p.parseSavepointName()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReleaseSavepointStmt{Name: name}, nil
+}
+
+// parseSavepointName parses [SAVEPOINT] name
+func (p *Parser) parseSavepointName() (*Identifier, error) {
+	if p.peek(0).tokenT == KEYWORD_TOK && p.peek(0).value == "SAVEPOINT" {
+		p.consume() // Consume SAVEPOINT
+	}
+
+	if p.peek(0).tokenT != IDENT_TOK {
+		return nil, errors.New("expected savepoint name")
+	}
+
+	name := &Identifier{Value: p.peek(0).value.(string)}
+	p.consume() // Consume savepoint name
+
+	return name, nil
+}
+
+// parsePromoteStmt parses a PROMOTE statement
+func (p *Parser) parsePromoteStmt() (Node, error) {
+	p.consume() // Consume PROMOTE
+	return &PromoteStmt{}, nil
+}
+
+// parseSubscribeStmt parses a SUBSCRIBE TO table statement
+func (p *Parser) parseSubscribeStmt() (Node, error) {
+	p.consume() // Consume SUBSCRIBE
+
+	if p.peek(0).tokenT != KEYWORD_TOK || p.peek(0).value != "TO" {
+		return nil, errors.New("expected TO")
+	}
+
+	p.consume() // Consume TO
+
+	if p.peek(0).tokenT != IDENT_TOK {
+		return nil, errors.New("expected table name")
+	}
+
+	subscribeStmt := &SubscribeStmt{TableName: &Identifier{Value: p.peek(0).value.(string)}}
+	p.consume() // Consume table name
+
+	return subscribeStmt, nil
+}
+
+// parseSetStmt parses a SET statement which changes a session setting
+// SET setting_name = value; or SET setting_name = DEFAULT; to go back to the server setting
+func (p *Parser) parseSetStmt() (Node, error) {
+	p.consume() // Consume SET
+
+	if p.peek(0).tokenT != IDENT_TOK || strings.HasPrefix(p.peek(0).value.(string), "@") {
+		return nil, errors.New("expected setting name")
+	}
+
+	if strings.ToUpper(p.peek(0).value.(string)) == "TRANSACTION" {
+		return p.parseSetTransactionStmt()
+	}
+
+	setStmt := &SetStmt{Variable: &Identifier{Value: p.peek(0).value.(string)}}
+	p.consume() // Consume setting name
+
+	if (p.peek(0).tokenT != COMPARISON_TOK || p.peek(0).value != "=") && (p.peek(0).tokenT != KEYWORD_TOK || p.peek(0).value != "TO") {
+		return nil, errors.New("expected = or TO")
+	}
+
+	p.consume() // Consume = or TO
+
+	switch {
+	case p.peek(0).tokenT == LITERAL_TOK:
+		setStmt.Value = &Literal{Value: p.peek(0).value}
+	case p.peek(0).tokenT == IDENT_TOK:
+		setStmt.Value = &Literal{Value: p.peek(0).value}
+	case p.peek(0).tokenT == KEYWORD_TOK && p.peek(0).value == "DEFAULT":
+		setStmt.Value = nil
+	default:
+		return nil, errors.New("expected value")
+	}
+
+	p.consume() // Consume value
+
+	return setStmt, nil
 }
 
 // parseDeleteStmt parses a DELETE statement
@@ -2212,6 +2579,22 @@ func (p *Parser) parseCreateUserStmt() (Node, error) {
 
 	p.consume() // Consume BY
 
+	// IDENTIFIED BY CERTIFICATE 'CN=name' identifies the user by its client certificate
+	if p.peek(0).tokenT == IDENT_TOK && strings.ToUpper(p.peek(0).value.(string)) == "CERTIFICATE" {
+		p.consume() // Consume CERTIFICATE
+
+		if p.peek(0).tokenT != LITERAL_TOK {
+			return nil, errors.New("expected certificate subject")
+		}
+
+		subject := p.peek(0).value.(string)
+		createUserStmt.Certificate = &Literal{Value: strings.TrimSuffix(strings.TrimPrefix(subject, "'"), "'")}
+
+		p.consume() // Consume subject
+
+		return createUserStmt, nil
+	}
+
 	if p.peek(0).tokenT != LITERAL_TOK {
 		return nil, errors.New("expected literal")
 	}
@@ -2750,6 +3133,16 @@ func (p *Parser) parseSelectStmt() (Node, error) {
 		selectStmt.TableExpression.LimitClause = limitClause
 	}
 
+	// Look for FOR UPDATE or FOR SHARE
+	if p.peek(0).tokenT == KEYWORD_TOK && p.peek(0).value == "FOR" {
+		lockingClause, err := p.parseLockingClause()
+		if err != nil {
+			return nil, err
+		}
+
+		selectStmt.LockingClause = lockingClause
+	}
+
 	// Look for union
 	if p.peek(0).value == "UNION" {
 		p.consume()
@@ -2771,6 +3164,115 @@ func (p *Parser) parseSelectStmt() (Node, error) {
 
 }
 
+// parseLockingClause parses FOR UPDATE | SHARE [NOWAIT | SKIP LOCKED]
+func (p *Parser) parseLockingClause() (*LockingClause, error) {
+	p.consume() // Consume FOR
+
+	lockingClause := &LockingClause{}
+
+	switch {
+	case p.peek(0).tokenT == KEYWORD_TOK && p.peek(0).value == "UPDATE":
+		lockingClause.Strength = FOR_UPDATE
+	case p.peek(0).tokenT == IDENT_TOK && strings.ToUpper(p.peek(0).value.(string)) == "SHARE":
+		lockingClause.Strength = FOR_SHARE
+	default:
+		return nil, errors.New("expected UPDATE or SHARE")
+	}
+
+	p.consume() // Consume UPDATE or SHARE
+
+	if p.peek(0).tokenT != IDENT_TOK {
+		return lockingClause, nil
+	}
+
+	switch strings.ToUpper(p.peek(0).value.(string)) {
+	case "NOWAIT":
+		lockingClause.WaitPolicy = LOCK_NOWAIT
+	case "SKIP":
+		if p.peek(1).tokenT != IDENT_TOK || strings.ToUpper(p.peek(1).value.(string)) != "LOCKED" {
+			return nil, errors.New("expected SKIP LOCKED")
+		}
+
+		p.consume() // Consume SKIP
+		lockingClause.WaitPolicy = LOCK_SKIP_LOCKED
+	default:
+		return nil, errors.New("expected NOWAIT or SKIP LOCKED")
+	}
+
+	p.consume() // Consume NOWAIT or LOCKED
+
+	return lockingClause, nil
+}
+
+// parseLockTableStmt parses a LOCK TABLE name IN SHARE | EXCLUSIVE MODE statement
+func (p *Parser) parseLockTableStmt() (Node, error) {
+	p.consume() // Consume LOCK
+
+	if p.peek(0).tokenT != KEYWORD_TOK || p.peek(0).value != "TABLE" {
+		return nil, errors.New("expected TABLE")
+	}
+
+	p.consume() // Consume TABLE
+
+	if p.peek(0).tokenT != IDENT_TOK {
+		return nil, errors.New("expected table name")
+	}
+
+	lockTableStmt := &LockTableStmt{TableName: &Identifier{Value: p.peek(0).value.(string)}}
+	p.consume() // Consume table name
+
+	if p.peek(0).tokenT != KEYWORD_TOK || p.peek(0).value != "IN" {
+		return nil, errors.New("expected IN")
+	}
+
+	p.consume() // Consume IN
+
+	if p.peek(0).tokenT != IDENT_TOK {
+		return nil, errors.New("expected SHARE or EXCLUSIVE")
+	}
+
+	switch strings.ToUpper(p.peek(0).value.(string)) {
+	case "SHARE":
+		lockTableStmt.Mode = LOCK_SHARE
+	case "EXCLUSIVE":
+		lockTableStmt.Mode = LOCK_EXCLUSIVE
+	default:
+		return nil, errors.New("expected SHARE or EXCLUSIVE")
+	}
+
+	p.consume() // Consume SHARE or EXCLUSIVE
+
+	if p.peek(0).tokenT != IDENT_TOK || strings.ToUpper(p.peek(0).value.(string)) != "MODE" {
+		return nil, errors.New("expected MODE")
+	}
+
+	p.consume() // Consume MODE
+
+	return lockTableStmt, nil
+}
+
+// parseKillStmt parses a KILL [QUERY] channel_id statement
+func (p *Parser) parseKillStmt() (Node, error) {
+	p.consume() // Consume KILL
+
+	killStmt := &KillStmt{}
+
+	if p.peek(0).tokenT == IDENT_TOK && strings.ToUpper(p.peek(0).value.(string)) == "QUERY" {
+		killStmt.Query = true
+		p.consume() // Consume QUERY
+	}
+
+	channelID, ok := p.peek(0).value.(uint64)
+	if p.peek(0).tokenT != LITERAL_TOK || !ok {
+		return nil, errors.New("expected channel id")
+	}
+
+	killStmt.ChannelID = channelID
+	p.consume() // Consume channel id
+
+	return killStmt, nil
+}
+
 // parseLimitClause parses a LIMIT clause
 func (p *Parser) parseLimitClause() (*LimitClause, error) {
 	limitClause := &LimitClause{}
@@ -2932,6 +3434,22 @@ func (p *Parser) parseSearchCondition() (interface{}, error) {
 	var err error
 	var not *NotExpr
 
+	// A parenthesized search condition groups the logical operators within it
+	if p.peek(0).tokenT == LPAREN_TOK {
+		if group := p.parseConditionGroup(); group != nil {
+			if p.peek(0).tokenT == KEYWORD_TOK && (p.peek(0).value == "AND" || p.peek(0).value == "OR") {
+				logical, err := p.parseLogicalExpr(group)
+				if err != nil {
+					return nil, err
+				}
+
+				return logical, nil
+			}
+
+			return group, nil
+		}
+	}
+
 	if p.peek(0).tokenT == IDENT_TOK {
 		if p.peek(1).value == "NOT" {
 			// put ident in the not position
@@ -3178,6 +3696,28 @@ func (p *Parser) parseSearchCondition() (interface{}, error) {
 
 }
 
+// parseConditionGroup parses a search condition within parentheses, nil if the parentheses do not hold one
+func (p *Parser) parseConditionGroup() interface{} {
+	currentPos := p.pos
+
+	// Eat (
+	p.consume()
+
+	if p.peek(0).value != "SELECT" {
+		expr, err := p.parseSearchCondition()
+		if err == nil && p.peek(0).tokenT == RPAREN_TOK {
+			// Eat )
+			p.consume()
+
+			return expr
+		}
+	}
+
+	p.pos = currentPos
+
+	return nil
+}
+
 // parseLikeExpr parses a LIKE expression
 func (p *Parser) parseLikeExpr(left *ValueExpression) (*LikePredicate, error) {
 	// Parse left side of like expression
@@ -3432,7 +3972,7 @@ func (p *Parser) parseFromClause() (*FromClause, error) {
 			continue
 		}
 
-		if p.peek(0).tokenT == SEMICOLON_TOK || p.peek(0).value == "WHERE" || p.peek(0).tokenT == LPAREN_TOK || p.peek(0).tokenT == RPAREN_TOK || p.peek(0).value == "GROUP" || p.peek(0).value == "HAVING" || p.peek(0).value == "ORDER" || p.peek(0).value == "LIMIT" || p.peek(0).value == "INNER" || p.peek(0).value == "LEFT" || p.peek(0).value == "RIGHT" || p.peek(0).value == "FULL" || p.peek(0).value == "GROUP" || p.peek(0).value == "HAVING" || p.peek(0).value == "ORDER" || p.peek(0).value == "LIMIT" || p.peek(0).value == "UNION" || p.peek(0).value == "JOIN" || p.peek(0).value == "JOIN" {
+		if p.peek(0).tokenT == SEMICOLON_TOK || p.peek(0).value == "WHERE" || p.peek(0).tokenT == LPAREN_TOK || p.peek(0).tokenT == RPAREN_TOK || p.peek(0).value == "GROUP" || p.peek(0).value == "HAVING" || p.peek(0).value == "ORDER" || p.peek(0).value == "LIMIT" || p.peek(0).value == "INNER" || p.peek(0).value == "LEFT" || p.peek(0).value == "RIGHT" || p.peek(0).value == "FULL" || p.peek(0).value == "GROUP" || p.peek(0).value == "HAVING" || p.peek(0).value == "ORDER" || p.peek(0).value == "LIMIT" || p.peek(0).value == "UNION" || p.peek(0).value == "JOIN" || p.peek(0).value == "FOR" {
 			break
 		}
 
@@ -19,6 +19,8 @@ package parser
 import (
 	"ariasql/shared"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 )
 
@@ -2852,6 +2854,27 @@ func TestNewParserCreateUserStmt(t *testing.T) {
 
 }
 
+func TestNewParserCreateUserCertificateStmt(t *testing.T) {
+	stmt, err := NewParser(NewLexer([]byte("CREATE USER svc IDENTIFIED BY CERTIFICATE 'CN=svc';"))).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createUserStmt, ok := stmt.(*CreateUserStmt)
+	if !ok {
+		t.Fatalf("expected *CreateUserStmt, got %T", stmt)
+	}
+
+	if createUserStmt.Password != nil || createUserStmt.Certificate == nil || createUserStmt.Certificate.Value != "CN=svc" {
+		t.Fatalf("expected certificate CN=svc, got %+v", createUserStmt)
+	}
+
+	_, err = NewParser(NewLexer([]byte("CREATE USER svc IDENTIFIED BY CERTIFICATE;"))).Parse()
+	if err == nil {
+		t.Fatal("expected a missing subject to fail")
+	}
+}
+
 func TestNewParserGrantStmt(t *testing.T) {
 	statement := []byte(`
 	GRANT CONNECT TO username;
@@ -7059,3 +7082,325 @@ func TestNewParserAlterTable2(t *testing.T) {
 	}
 
 }
+
+func TestNewParserPromoteStmt(t *testing.T) {
+	statement := []byte(`
+	PROMOTE;
+`)
+
+	lexer := NewLexer(statement)
+	t.Log(string(statement))
+
+	parser := NewParser(lexer)
+	if parser == nil {
+		t.Fatal("expected non-nil parser")
+	}
+
+	stmt, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := stmt.(*PromoteStmt); !ok {
+		t.Fatalf("expected *PromoteStmt, got %T", stmt)
+	}
+}
+
+func TestNewParserSetStmt(t *testing.T) {
+	statement := []byte(`
+	SET synchronous_replicas = 2;
+`)
+
+	lexer := NewLexer(statement)
+	t.Log(string(statement))
+
+	parser := NewParser(lexer)
+	if parser == nil {
+		t.Fatal("expected non-nil parser")
+	}
+
+	stmt, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setStmt, ok := stmt.(*SetStmt)
+	if !ok {
+		t.Fatalf("expected *SetStmt, got %T", stmt)
+	}
+
+	if setStmt.Variable.Value != "synchronous_replicas" {
+		t.Fatalf("expected synchronous_replicas, got %s", setStmt.Variable.Value)
+	}
+
+	if setStmt.Value.(*Literal).Value.(uint64) != 2 {
+		t.Fatalf("expected 2, got %v", setStmt.Value.(*Literal).Value)
+	}
+}
+
+func TestNewParserBeginStmt_IsolationLevel(t *testing.T) {
+	tests := map[string]IsolationLevel{
+		"BEGIN ISOLATION LEVEL SERIALIZABLE;":             ISOLATION_SERIALIZABLE,
+		"BEGIN isolation level repeatable read;":          ISOLATION_REPEATABLE_READ,
+		"SET TRANSACTION ISOLATION LEVEL READ COMMITTED;": ISOLATION_READ_COMMITTED,
+	}
+
+	for statement, level := range tests {
+		lexer := NewLexer([]byte(statement))
+		parser := NewParser(lexer)
+
+		stmt, err := parser.Parse()
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		beginStmt, ok := stmt.(*BeginStmt)
+		if !ok {
+			t.Fatalf("expected *BeginStmt, got %T", stmt)
+		}
+
+		if beginStmt.IsolationLevel != level {
+			t.Fatalf("%s: expected isolation level %d, got %d", statement, level, beginStmt.IsolationLevel)
+		}
+
+		if beginStmt.SetTransaction != (statement[:3] == "SET") {
+			t.Fatalf("%s: unexpected SetTransaction %v", statement, beginStmt.SetTransaction)
+		}
+	}
+
+	_, err := NewParser(NewLexer([]byte("BEGIN ISOLATION LEVEL SNAPSHOT;"))).Parse()
+	if err == nil {
+		t.Fatal("expected error for unknown isolation level")
+	}
+}
+
+func TestNewParserSavepointStmt(t *testing.T) {
+	stmt, err := NewParser(NewLexer([]byte("SAVEPOINT batch1;"))).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savepointStmt, ok := stmt.(*SavepointStmt)
+	if !ok {
+		t.Fatalf("expected *SavepointStmt, got %T", stmt)
+	}
+
+	if savepointStmt.Name.Value != "batch1" {
+		t.Fatalf("expected batch1, got %s", savepointStmt.Name.Value)
+	}
+
+	for _, statement := range []string{"ROLLBACK TO SAVEPOINT batch1;", "ROLLBACK TO batch1;"} {
+		stmt, err = NewParser(NewLexer([]byte(statement))).Parse()
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		rollbackStmt, ok := stmt.(*RollbackStmt)
+		if !ok {
+			t.Fatalf("expected *RollbackStmt, got %T", stmt)
+		}
+
+		if rollbackStmt.Savepoint == nil || rollbackStmt.Savepoint.Value != "batch1" {
+			t.Fatalf("%s: expected savepoint batch1", statement)
+		}
+	}
+
+	stmt, err = NewParser(NewLexer([]byte("RELEASE SAVEPOINT batch1;"))).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	releaseStmt, ok := stmt.(*ReleaseSavepointStmt)
+	if !ok {
+		t.Fatalf("expected *ReleaseSavepointStmt, got %T", stmt)
+	}
+
+	if releaseStmt.Name.Value != "batch1" {
+		t.Fatalf("expected batch1, got %s", releaseStmt.Name.Value)
+	}
+}
+
+func TestNewParserSelectStmt_LockingClause(t *testing.T) {
+	tests := map[string]LockingClause{
+		"SELECT * FROM jobs FOR UPDATE;": {Strength: FOR_UPDATE, WaitPolicy: LOCK_WAIT},
+		"SELECT * FROM jobs WHERE status = 'new' ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED;": {Strength: FOR_UPDATE, WaitPolicy: LOCK_SKIP_LOCKED},
+		"SELECT id FROM jobs WHERE id IN (1, 2) FOR SHARE NOWAIT;":                            {Strength: FOR_SHARE, WaitPolicy: LOCK_NOWAIT},
+	}
+
+	for statement, expected := range tests {
+		stmt, err := NewParser(NewLexer([]byte(statement))).Parse()
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		selectStmt, ok := stmt.(*SelectStmt)
+		if !ok {
+			t.Fatalf("expected *SelectStmt, got %T", stmt)
+		}
+
+		if selectStmt.LockingClause == nil || *selectStmt.LockingClause != expected {
+			t.Fatalf("%s: expected %+v, got %+v", statement, expected, selectStmt.LockingClause)
+		}
+	}
+}
+
+func TestNewParserLockTableStmt(t *testing.T) {
+	stmt, err := NewParser(NewLexer([]byte("LOCK TABLE jobs IN EXCLUSIVE MODE;"))).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lockTableStmt, ok := stmt.(*LockTableStmt)
+	if !ok {
+		t.Fatalf("expected *LockTableStmt, got %T", stmt)
+	}
+
+	if lockTableStmt.TableName.Value != "jobs" || lockTableStmt.Mode != LOCK_EXCLUSIVE {
+		t.Fatalf("expected jobs in exclusive mode, got %s %d", lockTableStmt.TableName.Value, lockTableStmt.Mode)
+	}
+
+	_, err = NewParser(NewLexer([]byte("LOCK TABLE jobs IN ROW MODE;"))).Parse()
+	if err == nil {
+		t.Fatal("expected error for unknown lock mode")
+	}
+}
+
+func TestNewParserPrepareTransactionStmt(t *testing.T) {
+	stmt, err := NewParser(NewLexer([]byte("PREPARE TRANSACTION 'order-42';"))).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepareStmt, ok := stmt.(*PrepareTransactionStmt)
+	if !ok {
+		t.Fatalf("expected *PrepareTransactionStmt, got %T", stmt)
+	}
+
+	if prepareStmt.Gid.Value != "order-42" {
+		t.Fatalf("expected order-42, got %v", prepareStmt.Gid.Value)
+	}
+
+	stmt, err = NewParser(NewLexer([]byte("commit prepared 'order-42';"))).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commitStmt, ok := stmt.(*CommitStmt)
+	if !ok {
+		t.Fatalf("expected *CommitStmt, got %T", stmt)
+	}
+
+	if commitStmt.Prepared == nil || commitStmt.Prepared.Value != "order-42" {
+		t.Fatal("expected prepared transaction order-42")
+	}
+
+	stmt, err = NewParser(NewLexer([]byte("ROLLBACK PREPARED 'order-42';"))).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rollbackStmt, ok := stmt.(*RollbackStmt)
+	if !ok {
+		t.Fatalf("expected *RollbackStmt, got %T", stmt)
+	}
+
+	if rollbackStmt.Prepared == nil || rollbackStmt.Prepared.Value != "order-42" {
+		t.Fatal("expected prepared transaction order-42")
+	}
+
+	for _, statement := range []string{"PREPARE TRANSACTION;", "PREPARE TRANSACTION '';", "PREPARE order;", "COMMIT PREPARED 42;"} {
+		_, err = NewParser(NewLexer([]byte(statement))).Parse()
+		if err == nil {
+			t.Fatalf("%s: expected error", statement)
+		}
+	}
+}
+
+func TestNewParserKillStmt(t *testing.T) {
+	tests := map[string]KillStmt{
+		"KILL 3;":        {ChannelID: 3},
+		"KILL QUERY 12;": {ChannelID: 12, Query: true},
+		"kill query 1;":  {ChannelID: 1, Query: true},
+	}
+
+	for statement, expected := range tests {
+		stmt, err := NewParser(NewLexer([]byte(statement))).Parse()
+		if err != nil {
+			t.Fatalf("%s: %s", statement, err)
+		}
+
+		killStmt, ok := stmt.(*KillStmt)
+		if !ok {
+			t.Fatalf("expected *KillStmt, got %T", stmt)
+		}
+
+		if *killStmt != expected {
+			t.Fatalf("%s: expected %+v, got %+v", statement, expected, *killStmt)
+		}
+	}
+
+	for _, statement := range []string{"KILL;", "KILL QUERY;", "KILL 'x';"} {
+		_, err := NewParser(NewLexer([]byte(statement))).Parse()
+		if err == nil {
+			t.Fatalf("%s: expected error", statement)
+		}
+	}
+}
+
+func TestNewParserSubscribeStmt(t *testing.T) {
+	statement := []byte(`
+	SUBSCRIBE TO users;
+`)
+
+	lexer := NewLexer(statement)
+	t.Log(string(statement))
+
+	parser := NewParser(lexer)
+	if parser == nil {
+		t.Fatal("expected non-nil parser")
+	}
+
+	stmt, err := parser.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscribeStmt, ok := stmt.(*SubscribeStmt)
+	if !ok {
+		t.Fatalf("expected *SubscribeStmt, got %T", stmt)
+	}
+
+	if subscribeStmt.TableName.Value != "users" {
+		t.Fatalf("expected users, got %s", subscribeStmt.TableName.Value)
+	}
+}
+
+func TestLexerBind(t *testing.T) {
+	lexer := NewLexer([]byte("SELECT * FROM users WHERE name = $1 AND pw = $2 AND id = $3 AND note = '$1' AND age IS $4 AND x IS $5;"))
+
+	err := lexer.Bind("\\", " OR 1 = 1", int64(7), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stmt, err := NewParser(lexer).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql, err := Deparse(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each parameter is one literal whatever it contains, a parameter without a value is NULL
+	for _, want := range []string{`name = '\'`, `pw = ' OR 1 = 1'`, "id = 7", `note = '$1'`, "age IS NULL", "x IS NULL"} {
+		if !strings.Contains(sql, want) {
+			t.Fatalf("expected %s in %s", want, sql)
+		}
+	}
+
+	if err := NewLexer(nil).Bind(math.NaN()); err == nil {
+		t.Fatal("expected NaN to be refused")
+	}
+}
@@ -0,0 +1,247 @@
+// Package protocol
+// AriaSQL client protocol package
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Every message is a type byte, the big endian uint32 length of its payload and the payload.
+// A client opens with a startup message, magic, protocol version and user, the server asks for the password with an authentication request
+// and answers it with authentication ok, carrying the server version, or with an error.
+// A query is answered with a row description and a data row per row when it has a result set, then command complete, or with an error.
+// A subscription streams its events until the client sends the next message.
+// Before the startup message a client may send STARTTLS, the server answers with STARTTLS and the TLS handshake follows, or with an error if it has no TLS.
+// With SCRAM-SHA-256 the client answers the authentication request with its client-first-message in a password message, the server sends its
+// server-first-message in a SCRAM continue authentication message, the client its client-final-message and the server its server-final-message
+// in a SCRAM final authentication message before authentication ok. The user authenticated is the startup message's, the n= of the client-first-message is ignored.
+// A user identified by certificate is answered with authentication ok, or an error, right after the startup message, its client certificate authenticates it.
+
+const MAGIC = "ARIASQL"             // Starts the startup message
+const VERSION = 1                   // Protocol version
+const MAX_MESSAGE_SIZE = 1024 << 20 // Largest payload read, a longer message is a protocol error
+
+// Message types
+const (
+	STARTUP          byte = 'S' // Client, magic, version and user
+	PASSWORD         byte = 'p' // Client, the password asked for or a SCRAM message
+	QUERY            byte = 'Q' // Client, a statement
+	TERMINATE        byte = 'X' // Client, closes the connection
+	STARTTLS         byte = 'L' // Client and server, upgrades the connection to TLS before the startup message
+	AUTHENTICATION   byte = 'R' // Server, the authentication method the client must answer
+	AUTHENTICATED    byte = 'K' // Server, authentication ok and the server version
+	ROW_DESCRIPTION  byte = 'T' // Server, the columns of the result set
+	DATA_ROW         byte = 'D' // Server, the values of a row, NULL has the length 0xffffffff
+	COMMAND_COMPLETE byte = 'C' // Server, ends the answer to a query with its tag
+	ERROR            byte = 'E' // Server, ends the answer to a query or the authentication with an error code and message
+	EVENT            byte = 'N' // Server, a change streamed to a subscriber as JSON
+)
+
+// Authentication methods
+const (
+	AUTH_PASSWORD       byte = iota // Password in clear text, over TLS unless the network is trusted, only asked of users created before SCRAM until they log in
+	AUTH_SCRAM_SHA_256              // SCRAM-SHA-256 without channel binding, the password never crosses the wire
+	AUTH_SCRAM_CONTINUE             // Followed by the server-first-message
+	AUTH_SCRAM_FINAL                // Followed by the server-final-message
+)
+
+// Error codes
+const (
+	ERROR_PROTOCOL       uint16 = iota + 1 // Unexpected or malformed message
+	ERROR_AUTHENTICATION                   // Authentication failed
+	ERROR_PRIVILEGE                        // The user lacks a privilege
+	ERROR_SYNTAX                           // The statement did not parse
+	ERROR_EXECUTION                        // The statement failed
+	ERROR_CANCELED                         // The statement was canceled or the session killed
+	ERROR_TIMEOUT                          // The statement or a lock wait timed out
+)
+
+const null = 0xffffffff // Length of a NULL value in a data row
+
+// Message is a protocol message
+type Message struct {
+	Type    byte   // Message type
+	Payload []byte // Message payload
+}
+
+// Error is an error message
+type Error struct {
+	Code    uint16 // Error code
+	Message string // Error message
+}
+
+// Error returns the error message
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WriteMessage writes a message
+func WriteMessage(w io.Writer, typ byte, payload []byte) error {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+
+	_, err := w.Write(append(buf, payload...))
+	return err
+}
+
+// ReadMessage reads a message
+func ReadMessage(r io.Reader) (*Message, error) {
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("message of %d bytes is larger than %d", size, MAX_MESSAGE_SIZE)
+	}
+
+	msg := &Message{Type: header[0], Payload: make([]byte, size)}
+
+	_, err = io.ReadFull(r, msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// EncodeStartup encodes a startup message
+func EncodeStartup(user string) []byte {
+	buf := append([]byte(MAGIC), VERSION)
+	return append(buf, user...)
+}
+
+// DecodeStartup decodes a startup message and returns its user
+func DecodeStartup(payload []byte) (string, error) {
+	if len(payload) < len(MAGIC)+1 || string(payload[:len(MAGIC)]) != MAGIC {
+		return "", errors.New("not a startup message")
+	}
+
+	if payload[len(MAGIC)] != VERSION {
+		return "", fmt.Errorf("unsupported protocol version %d", payload[len(MAGIC)])
+	}
+
+	return string(payload[len(MAGIC)+1:]), nil
+}
+
+// EncodeRowDescription encodes the columns of a result set
+func EncodeRowDescription(columns []string) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+
+	for _, column := range columns {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(column)))
+		buf = append(buf, column...)
+	}
+
+	return buf
+}
+
+// DecodeRowDescription decodes the columns of a result set
+func DecodeRowDescription(payload []byte) ([]string, error) {
+	values, err := decodeValues(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]string, len(values))
+
+	for i, value := range values {
+		if value == nil {
+			return nil, errors.New("column without a name")
+		}
+
+		columns[i] = string(value)
+	}
+
+	return columns, nil
+}
+
+// EncodeDataRow encodes the values of a row, a nil value is NULL
+func EncodeDataRow(values [][]byte) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+
+	for _, value := range values {
+		if value == nil {
+			buf = binary.BigEndian.AppendUint32(buf, null)
+			continue
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+		buf = append(buf, value...)
+	}
+
+	return buf
+}
+
+// DecodeDataRow decodes the values of a row, NULL is nil
+func DecodeDataRow(payload []byte) ([][]byte, error) {
+	return decodeValues(payload)
+}
+
+// decodeValues decodes a count followed by length prefixed values
+func decodeValues(payload []byte) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("malformed message")
+	}
+
+	values := make([][]byte, binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+
+	for i := range values {
+		if len(payload) < 4 {
+			return nil, errors.New("malformed message")
+		}
+
+		size := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+
+		if size == null {
+			continue
+		}
+
+		if uint32(len(payload)) < size {
+			return nil, errors.New("malformed message")
+		}
+
+		values[i] = append([]byte{}, payload[:size]...) // a value which is not NULL is never nil
+		payload = payload[size:]
+	}
+
+	return values, nil
+}
+
+// EncodeError encodes an error message
+func EncodeError(code uint16, message string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), message...)
+}
+
+// DecodeError decodes an error message
+func DecodeError(payload []byte) (*Error, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("malformed message")
+	}
+
+	return &Error{Code: binary.BigEndian.Uint16(payload), Message: string(payload[2:])}, nil
+}
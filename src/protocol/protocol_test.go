@@ -0,0 +1,113 @@
+// Package protocol tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessage(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	long := strings.Repeat("x", 100000) // much larger than a read
+
+	for _, payload := range []string{"", "SELECT 1;", long} {
+		if err := WriteMessage(buf, QUERY, []byte(payload)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, payload := range []string{"", "SELECT 1;", long} {
+		msg, err := ReadMessage(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type != QUERY || string(msg.Payload) != payload {
+			t.Fatalf("expected query of %d bytes, got %q of %d bytes", len(payload), msg.Type, len(msg.Payload))
+		}
+	}
+
+	// A truncated message is an error
+	WriteMessage(buf, QUERY, []byte("SELECT 1;"))
+	buf.Truncate(buf.Len() - 1)
+
+	if _, err := ReadMessage(buf); err == nil {
+		t.Fatal("expected error for a truncated message")
+	}
+
+	header := binary.BigEndian.AppendUint32([]byte{QUERY}, MAX_MESSAGE_SIZE+1)
+	if _, err := ReadMessage(bytes.NewReader(header)); err == nil {
+		t.Fatal("expected error for a message larger than the limit")
+	}
+}
+
+func TestStartup(t *testing.T) {
+	user, err := DecodeStartup(EncodeStartup("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user != "admin" {
+		t.Fatalf("expected admin, got %s", user)
+	}
+
+	if _, err := DecodeStartup([]byte("YWRtaW4=")); err == nil {
+		t.Fatal("expected error for a payload without the magic")
+	}
+
+	if _, err := DecodeStartup(append([]byte(MAGIC), VERSION+1)); err == nil {
+		t.Fatal("expected error for an unsupported version")
+	}
+}
+
+func TestRows(t *testing.T) {
+	columns, err := DecodeRowDescription(EncodeRowDescription([]string{"id", "name"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(columns, []string{"id", "name"}) {
+		t.Fatalf("expected id and name, got %v", columns)
+	}
+
+	values, err := DecodeDataRow(EncodeDataRow([][]byte{[]byte("1"), nil, {}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(values) != 3 || string(values[0]) != "1" || values[1] != nil || values[2] == nil || len(values[2]) != 0 {
+		t.Fatalf("expected 1, NULL and an empty value, got %q", values)
+	}
+
+	if _, err := DecodeDataRow(EncodeDataRow([][]byte{[]byte("1")})[:5]); err == nil {
+		t.Fatal("expected error for a malformed row")
+	}
+
+	e, err := DecodeError(EncodeError(ERROR_SYNTAX, "unexpected token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Code != ERROR_SYNTAX || e.Error() != "unexpected token" {
+		t.Fatalf("expected syntax error, got %d %s", e.Code, e.Message)
+	}
+}
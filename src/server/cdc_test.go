@@ -0,0 +1,139 @@
+// Package server change data capture tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/cdc"
+	"ariasql/core"
+	"ariasql/executor"
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	ex := executor.New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE users (id INT NOT NULL UNIQUE SEQUENCE, name CHAR(50));",
+		"CREATE TABLE orders (id INT NOT NULL UNIQUE SEQUENCE);",
+	} {
+		if err := execute(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	s := &TCPServer{aria: aria, BufferSize: 1024, TextProtocol: true}
+
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	go s.handleConnection(conn)
+
+	r := bufio.NewReader(client)
+
+	readLine := func() string {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return strings.TrimSpace(line)
+	}
+
+	client.Write([]byte(base64.StdEncoding.EncodeToString([]byte("admin\\0admin"))))
+	if line := readLine(); line != "OK" {
+		t.Fatalf("expected OK, got %s", line)
+	}
+
+	readLine() // version
+
+	client.Write([]byte("USE test;"))
+	readLine()
+
+	client.Write([]byte("SUBSCRIBE TO users;"))
+	if line := readLine(); line != "OK" {
+		t.Fatalf("expected OK, got %s", line)
+	}
+
+	for _, sql := range []string{
+		"INSERT INTO orders (id) VALUES (1);",
+		"INSERT INTO users (name) VALUES ('alex');",
+		"UPDATE users SET name = 'bob' WHERE id = 1;",
+		"BEGIN;",
+		"DELETE FROM users WHERE name = 'bob';",
+		"ROLLBACK;",
+		"DELETE FROM users WHERE name = 'bob';",
+	} {
+		if err := execute(ex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	expect := []struct {
+		op     string
+		before string
+		after  string
+	}{
+		{cdc.OP_INSERT, "", "alex"},
+		{cdc.OP_UPDATE, "alex", "bob"},
+		{cdc.OP_DELETE, "bob", ""},
+	}
+
+	for _, e := range expect {
+		event := &cdc.Event{}
+
+		err := json.Unmarshal([]byte(readLine()), event)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if event.Op != e.op || event.Table != "users" || event.Database != "test" || event.LSN == 0 || event.CommitTime.IsZero() {
+			t.Fatalf("unexpected event %+v", event)
+		}
+
+		if event.Key["id"] != float64(1) {
+			t.Fatalf("expected key id 1, got %v", event.Key)
+		}
+
+		if e.before != "" && event.Before["name"] != e.before {
+			t.Fatalf("expected before image %s, got %v", e.before, event.Before)
+		}
+
+		if e.after != "" && event.After["name"] != e.after {
+			t.Fatalf("expected after image %s, got %v", e.after, event.After)
+		}
+	}
+
+	client.Write([]byte("UNSUBSCRIBE;"))
+	if line := readLine(); line != "OK" {
+		t.Fatalf("expected OK, got %s", line)
+	}
+
+	// The connection takes statements again
+	client.Write([]byte("SELECT * FROM orders;"))
+	if line := readLine(); strings.HasPrefix(line, "ERR") {
+		t.Fatal(line)
+	}
+}
@@ -0,0 +1,330 @@
+// Package server framed protocol
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/catalog"
+	"ariasql/executor"
+	"ariasql/lock"
+	"ariasql/parser"
+	"ariasql/protocol"
+	"ariasql/shared"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// handleFramedConnection serves the framed protocol
+func (s *TCPServer) handleFramedConnection(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	msg, err := protocol.ReadMessage(r)
+	if err != nil {
+		return
+	}
+
+	if msg.Type == protocol.STARTTLS {
+		upgraded, err := s.startTLS(conn, r, w)
+		if err != nil {
+			return
+		}
+
+		if upgraded != conn {
+			defer upgraded.Close()
+
+			conn = upgraded
+			r = bufio.NewReader(conn)
+			w = bufio.NewWriter(conn)
+		} else if w.Flush() != nil {
+			return
+		}
+
+		msg, err = protocol.ReadMessage(r)
+		if err != nil {
+			return
+		}
+	}
+
+	user, err := s.authenticate(conn, msg, r, w)
+	if err != nil {
+		return
+	}
+
+	_, exe, closeSession := s.session(conn, user)
+	defer closeSession()
+
+	err = protocol.WriteMessage(w, protocol.AUTHENTICATED, []byte(shared.VERSION))
+	if err != nil {
+		return
+	}
+
+	for {
+		err = w.Flush()
+		if err != nil {
+			return
+		}
+
+		msg, err := protocol.ReadMessage(r)
+		if err != nil {
+			return
+		}
+
+		switch msg.Type {
+		case protocol.QUERY:
+			err = s.query(conn, r, w, exe, msg.Payload)
+		case protocol.TERMINATE:
+			return
+		default:
+			err = writeError(w, protocol.ERROR_PROTOCOL, fmt.Sprintf("unexpected message type %q", msg.Type))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// authenticate decodes the startup message and runs a SCRAM-SHA-256 exchange, the user is returned once authenticated
+// A user created before SCRAM is asked for its password once, logging in migrates it to a SCRAM verifier
+// A user identified by certificate is authenticated by the connection's verified client certificate
+func (s *TCPServer) authenticate(conn net.Conn, msg *protocol.Message, r io.Reader, w *bufio.Writer) (*catalog.User, error) {
+	if msg.Type != protocol.STARTUP {
+		return nil, fail(w, protocol.ERROR_PROTOCOL, "expected a startup message")
+	}
+
+	username, err := protocol.DecodeStartup(msg.Payload)
+	if err != nil {
+		return nil, fail(w, protocol.ERROR_PROTOCOL, err.Error())
+	}
+
+	// A locked account is refused before it is asked for anything
+	err = s.aria.Catalog.CheckLogin(username)
+	if err != nil {
+		return nil, fail(w, protocol.ERROR_AUTHENTICATION, err.Error())
+	}
+
+	verifier, exists := s.aria.Catalog.GetScramVerifier(username)
+
+	var user *catalog.User
+
+	if s.aria.Catalog.IsCertificateUser(username) {
+		// A user identified by certificate is authenticated by the client certificate TLS verified, nothing is asked
+		user, err = s.aria.Catalog.AuthenticateCertificate(username, verifiedCertificate(conn))
+		if err != nil {
+			return nil, fail(w, protocol.ERROR_AUTHENTICATION, "authentication failed")
+		}
+	} else if exists && verifier == nil {
+		user, err = s.authenticatePassword(username, r, w)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !exists {
+			verifier = scramMockVerifier(username)
+		}
+
+		err = s.scram(username, verifier, r, w)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.aria.Catalog.LoginSucceeded(username)
+		if err != nil {
+			return nil, fail(w, protocol.ERROR_AUTHENTICATION, "authentication failed") // dropped during the exchange
+		}
+
+		user = s.aria.Catalog.GetUser(username)
+		if user == nil {
+			return nil, fail(w, protocol.ERROR_AUTHENTICATION, "authentication failed")
+		}
+	}
+
+	// Check if user has CONNECT privilege
+	if !user.HasPrivilege("", "", []shared.PrivilegeAction{shared.PRIV_CONNECT}) {
+		return nil, fail(w, protocol.ERROR_PRIVILEGE, "user does not have CONNECT privilege")
+	}
+
+	return user, nil
+}
+
+// authenticatePassword asks for the password in clear text
+func (s *TCPServer) authenticatePassword(username string, r io.Reader, w *bufio.Writer) (*catalog.User, error) {
+	err := protocol.WriteMessage(w, protocol.AUTHENTICATION, []byte{protocol.AUTH_PASSWORD})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := protocol.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Type != protocol.PASSWORD {
+		return nil, fail(w, protocol.ERROR_PROTOCOL, "expected a password message")
+	}
+
+	user, err := s.aria.Catalog.AuthenticateUser(username, string(msg.Payload))
+	if err != nil {
+		return nil, fail(w, protocol.ERROR_AUTHENTICATION, "authentication failed")
+	}
+
+	return user, nil
+}
+
+// query executes a statement and writes its result set, or its error
+func (s *TCPServer) query(conn net.Conn, r *bufio.Reader, w *bufio.Writer, exe *executor.Executor, q []byte) error {
+	stmt, err := parser.NewParser(parser.NewLexer(q)).Parse()
+	if err != nil {
+		return writeError(w, protocol.ERROR_SYNTAX, err.Error())
+	}
+
+	if subscribeStmt, ok := stmt.(*parser.SubscribeStmt); ok {
+		return s.subscribeFramed(conn, r, w, exe, subscribeStmt)
+	}
+
+	defer exe.Clear()
+
+	err = exe.Execute(stmt)
+	if err != nil {
+		return writeError(w, errorCode(err), err.Error())
+	}
+
+	result := exe.GetResult()
+	if result == nil {
+		return protocol.WriteMessage(w, protocol.COMMAND_COMPLETE, []byte("OK"))
+	}
+
+	err = protocol.WriteMessage(w, protocol.ROW_DESCRIPTION, protocol.EncodeRowDescription(result.Columns))
+	if err != nil {
+		return err
+	}
+
+	for _, row := range result.Rows {
+		values := make([][]byte, len(row))
+
+		for i, value := range row {
+			if value != nil {
+				values[i] = []byte(fmt.Sprintf("%v", value))
+			}
+		}
+
+		err = protocol.WriteMessage(w, protocol.DATA_ROW, protocol.EncodeDataRow(values))
+		if err != nil {
+			return err
+		}
+	}
+
+	return protocol.WriteMessage(w, protocol.COMMAND_COMPLETE, []byte(fmt.Sprintf("ROWS %d", len(result.Rows))))
+}
+
+// subscribeFramed streams the changes committed to a table as event messages until the client sends its next message
+// The message ending the stream is answered with command complete, a terminate message closes the connection
+func (s *TCPServer) subscribeFramed(conn net.Conn, r *bufio.Reader, w *bufio.Writer, exe *executor.Executor, stmt *parser.SubscribeStmt) error {
+	sub, err := exe.Subscribe(stmt)
+	if err != nil {
+		return writeError(w, errorCode(err), err.Error())
+	}
+
+	defer sub.Close()
+
+	err = protocol.WriteMessage(w, protocol.COMMAND_COMPLETE, []byte("OK"))
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		msg, err := protocol.ReadMessage(r)
+		if err == nil && msg.Type == protocol.TERMINATE {
+			err = io.EOF
+		}
+
+		done <- err
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err // client went away
+			}
+
+			return protocol.WriteMessage(w, protocol.COMMAND_COMPLETE, []byte("OK"))
+		case event, ok := <-sub.C:
+			if !ok {
+				// Stop waiting on the client before handing the connection back
+				conn.SetReadDeadline(time.Now())
+				<-done
+				conn.SetReadDeadline(time.Time{})
+
+				return writeError(w, protocol.ERROR_EXECUTION, "subscriber fell behind, subscribe again")
+			}
+
+			b, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			err = protocol.WriteMessage(w, protocol.EVENT, b)
+			if err == nil {
+				err = w.Flush()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// errorCode returns the protocol error code of a statement's error
+func errorCode(err error) uint16 {
+	switch {
+	case errors.Is(err, executor.ErrQueryCanceled), errors.Is(err, executor.ErrSessionKilled):
+		return protocol.ERROR_CANCELED
+	case errors.Is(err, executor.ErrStatementTimeout), errors.Is(err, executor.ErrIdleInTransactionTimeout), errors.Is(err, lock.ErrTimeout):
+		return protocol.ERROR_TIMEOUT
+	case strings.Contains(err.Error(), "privilege"):
+		return protocol.ERROR_PRIVILEGE
+	}
+
+	return protocol.ERROR_EXECUTION
+}
+
+// writeError writes an error message
+func writeError(w io.Writer, code uint16, message string) error {
+	return protocol.WriteMessage(w, protocol.ERROR, protocol.EncodeError(code, message))
+}
+
+// fail writes an error message ending the connection and returns it as an error
+func fail(w *bufio.Writer, code uint16, message string) error {
+	writeError(w, code, message)
+	w.Flush()
+
+	return &protocol.Error{Code: code, Message: message}
+}
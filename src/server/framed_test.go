@@ -0,0 +1,195 @@
+// Package server framed protocol tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/core"
+	"ariasql/protocol"
+	"ariasql/shared"
+	"net"
+	"strings"
+	"testing"
+)
+
+// framedClient connects to a server over the framed protocol
+func framedClient(t *testing.T, s *TCPServer, username, password string) (net.Conn, *protocol.Error) {
+	client, conn := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go s.handleConnection(conn)
+
+	return client, framedLogin(t, client, username, password)
+}
+
+// framedLogin sends the startup message and answers the authentication method asked for, the error returned is the server's
+// A user identified by certificate is not asked for anything
+func framedLogin(t *testing.T, client net.Conn, username, password string) *protocol.Error {
+	send(t, client, protocol.STARTUP, protocol.EncodeStartup(username))
+
+	msg := receive(t, client)
+	if msg.Type == protocol.AUTHENTICATION {
+		switch msg.Payload[0] {
+		case protocol.AUTH_PASSWORD:
+			send(t, client, protocol.PASSWORD, []byte(password))
+			msg = receive(t, client)
+		case protocol.AUTH_SCRAM_SHA_256:
+			msg = scramLogin(t, client, password)
+		default:
+			t.Fatalf("unexpected authentication method %d", msg.Payload[0])
+		}
+	}
+
+	switch msg.Type {
+	case protocol.AUTHENTICATED:
+		if string(msg.Payload) != shared.VERSION {
+			t.Fatalf("expected version %s, got %s", shared.VERSION, msg.Payload)
+		}
+
+		return nil
+	case protocol.ERROR:
+		e, err := protocol.DecodeError(msg.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return e
+	}
+
+	t.Fatalf("unexpected message %q", msg.Type)
+	return nil
+}
+
+// send writes a message
+func send(t *testing.T, conn net.Conn, typ byte, payload []byte) {
+	if err := protocol.WriteMessage(conn, typ, payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads a message
+func receive(t *testing.T, conn net.Conn) *protocol.Message {
+	msg, err := protocol.ReadMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+// framedQuery sends a query and reads the answer up to command complete or an error
+func framedQuery(t *testing.T, conn net.Conn, sql string) ([]string, [][][]byte, string, *protocol.Error) {
+	send(t, conn, protocol.QUERY, []byte(sql))
+
+	var columns []string
+	var rows [][][]byte
+
+	for {
+		msg := receive(t, conn)
+
+		switch msg.Type {
+		case protocol.ROW_DESCRIPTION:
+			var err error
+			columns, err = protocol.DecodeRowDescription(msg.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case protocol.DATA_ROW:
+			values, err := protocol.DecodeDataRow(msg.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rows = append(rows, values)
+		case protocol.COMMAND_COMPLETE:
+			return columns, rows, string(msg.Payload), nil
+		case protocol.ERROR:
+			e, err := protocol.DecodeError(msg.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return nil, nil, "", e
+		default:
+			t.Fatalf("unexpected message %q", msg.Type)
+		}
+	}
+}
+
+func TestFramedProtocol(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	s := &TCPServer{aria: aria, BufferSize: 1024}
+
+	if _, e := framedClient(t, s, "admin", "wrong"); e == nil || e.Code != protocol.ERROR_AUTHENTICATION {
+		t.Fatalf("expected authentication error, got %v", e)
+	}
+
+	conn, e := framedClient(t, s, "admin", "admin")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	long := strings.Repeat("x", 3000) // larger than the buffer size
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, name TEXT, note CHAR(50));",
+		"INSERT INTO t (name, note) VALUES ('" + long + "', NULL);",
+		"INSERT INTO t (name, note) VALUES ('alex', 'hi');",
+	} {
+		if _, _, tag, e := framedQuery(t, conn, sql); e != nil || tag != "OK" {
+			t.Fatalf("expected OK, got %s %v", tag, e)
+		}
+	}
+
+	columns, rows, tag, e := framedQuery(t, conn, "SELECT * FROM t;")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if strings.Join(columns, ",") != "id,name,note" || tag != "ROWS 2" || len(rows) != 2 {
+		t.Fatalf("expected 2 rows of id, name and note, got %v %s %d rows", columns, tag, len(rows))
+	}
+
+	if string(rows[0][1]) != long || rows[0][2] != nil {
+		t.Fatalf("expected the long name and a NULL note, got %d bytes and %q", len(rows[0][1]), rows[0][2])
+	}
+
+	if string(rows[1][0]) != "2" || string(rows[1][1]) != "alex" || string(rows[1][2]) != "hi" {
+		t.Fatalf("expected 2, alex and hi, got %q", rows[1])
+	}
+
+	if _, _, _, e := framedQuery(t, conn, "SELEC * FROM t;"); e == nil || e.Code != protocol.ERROR_SYNTAX {
+		t.Fatalf("expected syntax error, got %v", e)
+	}
+
+	if _, _, _, e := framedQuery(t, conn, "SELECT * FROM missing;"); e == nil || e.Code != protocol.ERROR_EXECUTION {
+		t.Fatalf("expected execution error, got %v", e)
+	}
+
+	// The connection goes on after errors
+	if _, rows, _, e := framedQuery(t, conn, "SELECT * FROM t WHERE id = 2;"); e != nil || len(rows) != 1 {
+		t.Fatalf("expected a row, got %d rows %v", len(rows), e)
+	}
+
+	send(t, conn, protocol.TERMINATE, nil)
+
+	if _, err := protocol.ReadMessage(conn); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,655 @@
+// Package server HTTP API
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/catalog"
+	"ariasql/executor"
+	"ariasql/parser"
+	"ariasql/protocol"
+	"ariasql/shared"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The HTTP API runs statements sent as JSON and answers with JSON, so scripts need no client of their own.
+// POST /query runs a statement, POST /tx runs statements in a transaction, POST /token exchanges basic credentials for a bearer token.
+// Requests authenticate with basic credentials, accepted over TLS only, or a bearer token, or over TLS with a client certificate identifying a user, every request runs in a session of its own.
+// A statement's $n placeholders are bound to its params as literals, never spliced into its text, a query asking for application/x-ndjson is streamed a row per line.
+
+const HTTP_MAX_BODY = 16 << 20                    // Largest request body read
+const HTTP_TOKEN_TTL = time.Hour                  // How long a bearer token is valid for
+const HTTP_NDJSON = "application/x-ndjson"        // Media type of streamed results
+const HTTP_STREAM_FLUSH = 100                     // Rows streamed between flushes
+const HTTP_READ_HEADER_TIMEOUT = 10 * time.Second // How long a client may take to send the headers of a request
+const HTTP_READ_TIMEOUT = time.Minute             // How long a client may take to send a whole request
+const HTTP_IDLE_TIMEOUT = 2 * time.Minute         // How long an idle keep-alive connection is kept open
+
+// HTTPServer serves the HTTP API on its own port, sessions are configured as the TCP server's
+type HTTPServer struct {
+	server     *TCPServer            // Server whose instance and session settings are used
+	listener   net.Listener          // HTTP listener
+	http       *http.Server          // Serves the API
+	tokens     map[string]*httpToken // Bearer tokens issued
+	tokensLock sync.Mutex            // Guards tokens
+}
+
+// httpToken is a bearer token issued to a user
+type httpToken struct {
+	username string
+	expires  time.Time
+}
+
+// httpStatement is a statement of a request
+type httpStatement struct {
+	SQL    string        `json:"sql"`    // Statement, $n placeholders stand for the params
+	Params []interface{} `json:"params"` // Values of the placeholders, null, numbers, booleans and strings
+}
+
+// httpQuery is the request of /query
+type httpQuery struct {
+	Database string `json:"database"` // Database selected before the statement, none if empty
+	httpStatement
+}
+
+// httpTransaction is the request of /tx
+type httpTransaction struct {
+	Database   string           `json:"database"`   // Database selected before the transaction, none if empty
+	Statements []*httpStatement `json:"statements"` // Statements run in the transaction
+}
+
+// httpResult is the result of a statement
+type httpResult struct {
+	Columns []*httpColumn   `json:"columns,omitempty"` // Columns of the rows, none if the statement returns no rows
+	Rows    [][]interface{} `json:"rows,omitempty"`    // Rows returned
+	Tag     string          `json:"tag"`               // Command tag, i.e. SELECT 2 or UPDATE 1
+}
+
+// httpColumn is a column of a result
+type httpColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // INT, FLOAT, BOOL or TEXT, by the column's first value which is not NULL
+}
+
+// httpError is an error answered to a request
+type httpError struct {
+	status    int    // HTTP status
+	Code      uint16 `json:"code"`                // Protocol error code
+	Message   string `json:"message"`             // Error message
+	Statement *int   `json:"statement,omitempty"` // Index of the statement of a transaction which failed
+}
+
+// Error returns the error message
+func (e *httpError) Error() string {
+	return e.Message
+}
+
+// connKey is the context key of a request's connection
+type connKey struct{}
+
+// NewHTTPServer creates an HTTP API listener on the TCP server's host and HTTPPort
+func NewHTTPServer(s *TCPServer) (*HTTPServer, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.HTTPPort)))
+	if err != nil {
+		return nil, err
+	}
+
+	// HTTPS if the server's connections are TLS
+	if s.TLS && s.tlsConfig != nil {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+
+	h := &HTTPServer{server: s, listener: listener, tokens: make(map[string]*httpToken)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query", h.handleQuery)
+	mux.HandleFunc("/tx", h.handleTransaction)
+	mux.HandleFunc("/token", h.handleToken)
+
+	// Responses have no write timeout, a result streamed as NDJSON takes as long as its rows take to be read
+	h.http = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: HTTP_READ_HEADER_TIMEOUT,
+		ReadTimeout:       HTTP_READ_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+		// KILL ends a session by closing the connection of its request
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, conn)
+		},
+	}
+
+	return h, nil
+}
+
+// Addr returns the address the HTTP API listens on
+func (h *HTTPServer) Addr() net.Addr {
+	return h.listener.Addr()
+}
+
+// Start serves the HTTP API until the server is stopped
+func (h *HTTPServer) Start() {
+	h.http.Serve(h.listener)
+}
+
+// Stop stops the HTTP API listener and closes its connections
+func (h *HTTPServer) Stop() {
+	h.http.Close()
+}
+
+// handleToken issues a bearer token to a user authenticated with basic credentials
+func (h *HTTPServer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		writeHTTPError(w, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: "basic credentials required"})
+		return
+	}
+
+	user, err := h.login(r, username, password)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	token := hex.EncodeToString(b)
+	expires := time.Now().Add(HTTP_TOKEN_TTL)
+
+	h.tokensLock.Lock()
+	for t, issued := range h.tokens {
+		if time.Now().After(issued.expires) {
+			delete(h.tokens, t)
+		}
+	}
+
+	h.tokens[token] = &httpToken{username: user.Username, expires: expires}
+	h.tokensLock.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": token, "expires": expires.UTC().Format(time.RFC3339)})
+}
+
+// handleQuery runs a statement and answers with its result, streamed as NDJSON if asked for
+func (h *HTTPServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	var query httpQuery
+
+	exe, closeSession, err := h.open(r, &query)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	defer closeSession()
+
+	var stream *ndjsonStream
+
+	// The rows of a plain SELECT are streamed as the executor reads them
+	if strings.Contains(r.Header.Get("Accept"), HTTP_NDJSON) {
+		stream = &ndjsonStream{w: w}
+		exe.SetRowWriter(stream.write)
+	}
+
+	result, err := runStatement(exe, &query.httpStatement)
+	if err != nil {
+		if stream != nil && stream.started {
+			stream.fail(err) // the rows streamed so far are followed by the error
+			return
+		}
+
+		writeHTTPError(w, err)
+		return
+	}
+
+	if stream != nil {
+		stream.finish(result)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleTransaction runs statements in a transaction, committed once they all ran and rolled back at the first error
+func (h *HTTPServer) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+
+	var tx httpTransaction
+
+	exe, closeSession, err := h.open(r, &tx)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	defer closeSession() // rolls back the transaction if it is still begun
+
+	if len(tx.Statements) == 0 {
+		writeHTTPError(w, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_PROTOCOL, Message: "no statements"})
+		return
+	}
+
+	err = exe.Execute(&parser.BeginStmt{})
+	if err != nil {
+		writeHTTPError(w, statementError(err))
+		return
+	}
+
+	results := make([]*httpResult, len(tx.Statements))
+
+	for i, stmt := range tx.Statements {
+		results[i], err = runStatement(exe, stmt)
+		if err != nil {
+			if e, ok := err.(*httpError); ok {
+				e.Statement = &i
+			}
+
+			writeHTTPError(w, err)
+			return
+		}
+
+		if !exe.TransactionBegun {
+			writeHTTPError(w, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_EXECUTION, Message: "statement ended the transaction", Statement: &i})
+			return
+		}
+	}
+
+	err = exe.Execute(&parser.CommitStmt{})
+	if err != nil {
+		writeHTTPError(w, statementError(err))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// httpRequest is a request body naming the database to select
+type httpRequest interface {
+	database() string
+}
+
+// open authenticates a request, decodes its body into req and opens its session, with the database selected if one is named
+func (h *HTTPServer) open(r *http.Request, req httpRequest) (*executor.Executor, func(), error) {
+	user, err := h.authenticate(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoder := json.NewDecoder(http.MaxBytesReader(nil, r.Body, HTTP_MAX_BODY))
+	decoder.UseNumber()
+
+	err = decoder.Decode(req)
+	if err != nil {
+		return nil, nil, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_PROTOCOL, Message: "malformed request: " + err.Error()}
+	}
+
+	conn, _ := r.Context().Value(connKey{}).(net.Conn)
+
+	_, exe, closeSession := h.server.session(conn, user)
+
+	if db := req.database(); db != "" {
+		err = exe.Execute(&parser.UseStmt{DatabaseName: &parser.Identifier{Value: db}})
+		if err != nil {
+			closeSession()
+			return nil, nil, statementError(err)
+		}
+	}
+
+	return exe, closeSession, nil
+}
+
+// database returns the database of a query
+func (q *httpQuery) database() string {
+	return q.Database
+}
+
+// database returns the database of a transaction
+func (t *httpTransaction) database() string {
+	return t.Database
+}
+
+// authenticate returns the user of a request's basic credentials or bearer token, or of its client certificate without either
+func (h *HTTPServer) authenticate(r *http.Request) (*catalog.User, error) {
+	if username, password, ok := r.BasicAuth(); ok {
+		return h.login(r, username, password)
+	}
+
+	auth := r.Header.Get("Authorization")
+
+	if auth == "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		user, err := h.server.aria.Catalog.GetCertificateUser(r.TLS.VerifiedChains[0][0])
+		if err != nil {
+			return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: "authentication failed"}
+		}
+
+		return h.connect(user)
+	}
+
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: "basic credentials, a bearer token or a client certificate required"}
+	}
+
+	h.tokensLock.Lock()
+	token := h.tokens[strings.TrimPrefix(auth, "Bearer ")]
+	h.tokensLock.Unlock()
+
+	if token == nil || time.Now().After(token.expires) {
+		return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: "invalid or expired token"}
+	}
+
+	// A user dropped since the token was issued is gone
+	user := h.server.aria.Catalog.GetUser(token.username)
+	if user == nil {
+		return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: "invalid or expired token"}
+	}
+
+	// as is the token of a user locked since
+	err := h.server.aria.Catalog.CheckLogin(token.username)
+	if err != nil {
+		return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: err.Error()}
+	}
+
+	return h.connect(user)
+}
+
+// login authenticates a user by the password of a request's basic credentials, which are only accepted over TLS as they cross the connection in clear text
+func (h *HTTPServer) login(r *http.Request, username, password string) (*catalog.User, error) {
+	if r.TLS == nil {
+		return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: "basic credentials are only accepted over HTTPS"}
+	}
+
+	user, err := h.server.aria.Catalog.AuthenticateUser(username, password)
+	if errors.Is(err, catalog.ErrAccountLocked) {
+		return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: err.Error()}
+	}
+
+	if err != nil {
+		return nil, &httpError{status: http.StatusUnauthorized, Code: protocol.ERROR_AUTHENTICATION, Message: "authentication failed"}
+	}
+
+	return h.connect(user)
+}
+
+// connect checks the user has the CONNECT privilege
+func (h *HTTPServer) connect(user *catalog.User) (*catalog.User, error) {
+	if !user.HasPrivilege("", "", []shared.PrivilegeAction{shared.PRIV_CONNECT}) {
+		return nil, &httpError{status: http.StatusForbidden, Code: protocol.ERROR_PRIVILEGE, Message: "user does not have CONNECT privilege"}
+	}
+
+	return user, nil
+}
+
+// runStatement binds a statement's params and executes it
+func runStatement(exe *executor.Executor, s *httpStatement) (*httpResult, error) {
+	if countParameters(s.SQL) > len(s.Params) {
+		return nil, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_PROTOCOL, Message: fmt.Sprintf("statement has %d parameters, %d given", countParameters(s.SQL), len(s.Params))}
+	}
+
+	params := make([]interface{}, len(s.Params))
+	for i, param := range s.Params {
+		value, err := jsonValue(param)
+		if err != nil {
+			return nil, err
+		}
+
+		params[i] = value
+	}
+
+	sql := strings.TrimSpace(s.SQL)
+	if !strings.HasSuffix(sql, ";") {
+		sql += ";"
+	}
+
+	lexer := parser.NewLexer([]byte(sql))
+
+	err := lexer.Bind(params...)
+	if err != nil {
+		return nil, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_PROTOCOL, Message: err.Error()}
+	}
+
+	stmt, err := parser.NewParser(lexer).Parse()
+	if err != nil {
+		return nil, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_SYNTAX, Message: err.Error()}
+	}
+
+	if _, ok := stmt.(*parser.SubscribeStmt); ok {
+		return nil, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_EXECUTION, Message: "SUBSCRIBE is not supported over HTTP"}
+	}
+
+	defer exe.Clear()
+
+	err = exe.Execute(stmt)
+	if err != nil {
+		return nil, statementError(err)
+	}
+
+	result := &httpResult{Tag: commandTag(stmt, exe.GetResult())}
+
+	switch stmt.(type) {
+	case *parser.UpdateStmt, *parser.DeleteStmt:
+		return result, nil // the rows affected are in the tag
+	}
+
+	if r := exe.GetResult(); r != nil {
+		result.Columns = httpColumns(r.Columns, r.Rows)
+		result.Rows = r.Rows
+	}
+
+	return result, nil
+}
+
+// httpColumns returns the columns of rows, typed by the first value of each which is not NULL
+func httpColumns(names []string, rows [][]interface{}) []*httpColumn {
+	columns := make([]*httpColumn, len(names))
+
+	for i, name := range names {
+		columns[i] = &httpColumn{Name: name, Type: "TEXT"}
+
+		for _, row := range rows {
+			if row[i] != nil {
+				columns[i].Type = jsonType(row[i])
+				break
+			}
+		}
+	}
+
+	return columns
+}
+
+// jsonValue returns a JSON param as the value bound to its placeholder
+func jsonValue(param interface{}) (interface{}, error) {
+	switch v := param.(type) {
+	case nil, bool, string:
+		return v, nil
+	case json.Number:
+		if n, ok := parseNumber(v.String()); ok {
+			return n, nil
+		}
+	}
+
+	return nil, &httpError{status: http.StatusBadRequest, Code: protocol.ERROR_PROTOCOL, Message: fmt.Sprintf("unsupported parameter %v, expected null, a number, a boolean or a string", param)}
+}
+
+// jsonType returns the type of a result value
+func jsonType(value interface{}) string {
+	switch valueType(value) {
+	case PG_INT8:
+		return "INT"
+	case PG_FLOAT8:
+		return "FLOAT"
+	case PG_BOOL:
+		return "BOOL"
+	}
+
+	return "TEXT"
+}
+
+// ndjsonStream writes a result as NDJSON, its columns, a row per line, then its tag
+// Rows the executor streams are written and flushed a batch at a time as they are read, the columns are typed by the first batch
+type ndjsonStream struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+	started bool // The columns were written, the status can no longer change
+}
+
+// start answers with the columns, rows follow
+func (s *ndjsonStream) start(columns []*httpColumn) error {
+	s.w.Header().Set("Content-Type", HTTP_NDJSON)
+	s.w.WriteHeader(http.StatusOK)
+
+	s.encoder = json.NewEncoder(s.w)
+	s.started = true
+
+	return s.encoder.Encode(map[string]interface{}{"columns": columns})
+}
+
+// write writes a batch of rows the executor read and flushes them to the client
+func (s *ndjsonStream) write(columns []string, rows [][]interface{}) error {
+	if !s.started {
+		err := s.start(httpColumns(columns, rows))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, row := range rows {
+		err := s.encoder.Encode(row)
+		if err != nil {
+			return err // client went away, the statement stops
+		}
+	}
+
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+// finish writes the rows of a result which was not streamed, then the tag
+func (s *ndjsonStream) finish(result *httpResult) {
+	if !s.started {
+		if s.start(result.Columns) != nil {
+			return
+		}
+
+		flusher, _ := s.w.(http.Flusher)
+
+		for i, row := range result.Rows {
+			if s.encoder.Encode(row) != nil {
+				return // client went away
+			}
+
+			if flusher != nil && (i+1)%HTTP_STREAM_FLUSH == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+
+	s.encoder.Encode(map[string]interface{}{"tag": result.Tag})
+}
+
+// fail ends a stream whose statement failed after rows were written with the error, in place of the tag
+func (s *ndjsonStream) fail(err error) {
+	var e *httpError
+	if !errors.As(err, &e) {
+		e = &httpError{status: http.StatusInternalServerError, Code: protocol.ERROR_EXECUTION, Message: err.Error()}
+	}
+
+	s.encoder.Encode(map[string]interface{}{"error": e})
+}
+
+// statementError returns the HTTP error of a statement's error
+func statementError(err error) error {
+	code := errorCode(err)
+
+	status := http.StatusUnprocessableEntity
+	switch code {
+	case protocol.ERROR_PRIVILEGE:
+		status = http.StatusForbidden
+	case protocol.ERROR_CANCELED, protocol.ERROR_TIMEOUT:
+		status = http.StatusServiceUnavailable
+	}
+
+	return &httpError{status: status, Code: code, Message: err.Error()}
+}
+
+// allowPost answers a request which is not a POST with method not allowed
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+
+	w.Header().Set("Allow", http.MethodPost)
+	writeHTTPError(w, &httpError{status: http.StatusMethodNotAllowed, Code: protocol.ERROR_PROTOCOL, Message: "method not allowed"})
+
+	return false
+}
+
+// writeHTTPError answers a request with an error
+func writeHTTPError(w http.ResponseWriter, err error) {
+	var e *httpError
+	if !errors.As(err, &e) {
+		e = &httpError{status: http.StatusInternalServerError, Code: protocol.ERROR_EXECUTION, Message: err.Error()}
+	}
+
+	if e.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="AriaSQL"`)
+	}
+
+	writeJSON(w, e.status, map[string]interface{}{"error": e})
+}
+
+// writeJSON answers a request with a JSON body
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	var buf bytes.Buffer
+
+	err := json.NewEncoder(&buf).Encode(body)
+	if err != nil {
+		status = http.StatusInternalServerError
+		buf.Reset()
+		fmt.Fprintf(&buf, "{\"error\":{\"code\":%d,\"message\":%q}}\n", protocol.ERROR_EXECUTION, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
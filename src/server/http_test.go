@@ -0,0 +1,311 @@
+// Package server HTTP API tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/core"
+	"ariasql/protocol"
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testHTTPServer is the HTTP API served over TLS, as basic credentials require, with a client trusting its certificate
+type testHTTPServer struct {
+	*HTTPServer
+	client *http.Client
+}
+
+// startHTTPServer serves the HTTP API of an instance over TLS on a free port of 127.0.0.1 until the test ends
+func startHTTPServer(t *testing.T, aria *core.AriaSQL) *testHTTPServer {
+	certs := newTestCerts(t, "svc")
+
+	s := &TCPServer{aria: aria, Host: "127.0.0.1", TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey}
+
+	var err error
+	s.tlsConfig, err = s.loadTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHTTPServer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go h.Start()
+	t.Cleanup(h.Stop)
+
+	return &testHTTPServer{HTTPServer: h, client: &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certs.pool}}}}
+}
+
+// post sends a request to the HTTP API and returns its status and body
+func post(t *testing.T, h *testHTTPServer, path, auth, accept, body string) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, "https://"+h.Addr().String()+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	var b strings.Builder
+	_, err = bufio.NewReader(resp.Body).WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, b.String()
+}
+
+func TestHTTPAPI(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	h := startHTTPServer(t, aria)
+
+	basic := "Basic YWRtaW46YWRtaW4=" // admin:admin
+
+	// Requests are authenticated
+	status, body := post(t, h, "/query", "", "", `{"sql": "SHOW DATABASES;"}`)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized, got %d %s", status, body)
+	}
+
+	status, body = post(t, h, "/query", "Basic YWRtaW46d3Jvbmc=", "", `{"sql": "SHOW DATABASES;"}`)
+	if status != http.StatusUnauthorized || !strings.Contains(body, "authentication failed") {
+		t.Fatalf("expected authentication to fail, got %d %s", status, body)
+	}
+
+	for _, body := range []string{
+		`{"sql": "CREATE DATABASE test;"}`,
+		`{"database": "test", "sql": "CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, name CHAR(50), score DECIMAL(10,2));"}`,
+	} {
+		if status, resp := post(t, h, "/query", basic, "", body); status != http.StatusOK {
+			t.Fatalf("%s: %d %s", body, status, resp)
+		}
+	}
+
+	// A statement's placeholders are bound to its params
+	status, body = post(t, h, "/query", basic, "", `{"database": "test", "sql": "INSERT INTO t (name, score) VALUES ($1, $2), ($3, NULL)", "params": ["a", 1.5, "b"]}`)
+	if status != http.StatusOK || body != "{\"tag\":\"INSERT 0 2\"}\n" {
+		t.Fatalf("expected an insert, got %d %s", status, body)
+	}
+
+	status, body = post(t, h, "/query", basic, "", `{"database": "test", "sql": "SELECT * FROM t WHERE name = $1;", "params": ["a"]}`)
+	if status != http.StatusOK || body != `{"columns":[{"name":"id","type":"INT"},{"name":"name","type":"TEXT"},{"name":"score","type":"FLOAT"}],"rows":[[1,"a",1.5]],"tag":"SELECT 1"}`+"\n" {
+		t.Fatalf("unexpected result %d %s", status, body)
+	}
+
+	status, body = post(t, h, "/query", basic, "", `{"database": "test", "sql": "SELECT * FROM t WHERE id = $1;"}`)
+	if status != http.StatusBadRequest || !strings.Contains(body, "1 parameters, 0 given") {
+		t.Fatalf("expected missing params to fail, got %d %s", status, body)
+	}
+
+	status, body = post(t, h, "/query", basic, "", `{"database": "test", "sql": "SELEC 1;"}`)
+	if status != http.StatusBadRequest || !strings.Contains(body, fmt.Sprintf(`"code":%d`, protocol.ERROR_SYNTAX)) {
+		t.Fatalf("expected a syntax error, got %d %s", status, body)
+	}
+
+	// A bearer token stands for the basic credentials it was issued for
+	status, body = post(t, h, "/token", basic, "", "")
+	if status != http.StatusOK {
+		t.Fatalf("expected a token, got %d %s", status, body)
+	}
+
+	var token struct{ Token string }
+	if err := json.Unmarshal([]byte(body), &token); err != nil {
+		t.Fatal(err)
+	}
+
+	// Results are streamed as NDJSON if asked for
+	status, body = post(t, h, "/query", "Bearer "+token.Token, HTTP_NDJSON, `{"database": "test", "sql": "SELECT id, score FROM t;"}`)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if status != http.StatusOK || len(lines) != 4 || lines[1] != "[1,1.5]" || lines[2] != "[2,null]" || lines[3] != `{"tag":"SELECT 2"}` {
+		t.Fatalf("unexpected stream %d %q", status, lines)
+	}
+
+	status, body = post(t, h, "/query", "Bearer nope", "", `{"sql": "SHOW DATABASES;"}`)
+	if status != http.StatusUnauthorized {
+		t.Fatalf("expected an unknown token to fail, got %d %s", status, body)
+	}
+
+	// A transaction is committed once every statement ran
+	status, body = post(t, h, "/tx", basic, "", `{"database": "test", "statements": [{"sql": "UPDATE t SET score = $1 WHERE id = 2;", "params": [2.5]}, {"sql": "DELETE FROM t WHERE id = 1;"}]}`)
+	if status != http.StatusOK || body != `{"results":[{"tag":"UPDATE 1"},{"tag":"DELETE 1"}]}`+"\n" {
+		t.Fatalf("unexpected transaction result %d %s", status, body)
+	}
+
+	// and rolled back at the first error
+	status, body = post(t, h, "/tx", basic, "", `{"database": "test", "statements": [{"sql": "UPDATE t SET score = 3.5 WHERE id = 2;"}, {"sql": "SELECT * FROM missing;"}]}`)
+	if status != http.StatusUnprocessableEntity || !strings.Contains(body, `"statement":1`) {
+		t.Fatalf("expected the second statement to fail, got %d %s", status, body)
+	}
+
+	status, body = post(t, h, "/query", basic, "", `{"database": "test", "sql": "SELECT * FROM t;"}`)
+	if status != http.StatusOK || !strings.Contains(body, `"rows":[[2,"b",2.5]]`) {
+		t.Fatalf("expected the failed transaction rolled back, got %d %s", status, body)
+	}
+
+	// A user needs CONNECT
+	status, body = post(t, h, "/query", basic, "", `{"sql": "CREATE USER bob IDENTIFIED BY 'pw';"}`)
+	if status != http.StatusOK {
+		t.Fatal(status, body)
+	}
+
+	status, body = post(t, h, "/query", "Basic Ym9iOnB3", "", `{"sql": "SHOW DATABASES;"}`) // bob:pw
+	if status != http.StatusForbidden || !strings.Contains(body, fmt.Sprintf(`"code":%d`, protocol.ERROR_PRIVILEGE)) {
+		t.Fatalf("expected CONNECT to be required, got %d %s", status, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "https://"+h.Addr().String()+"/query", nil)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected GET to be refused, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPParameterBinding(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	h := startHTTPServer(t, aria)
+
+	basic := "Basic YWRtaW46YWRtaW4=" // admin:admin
+
+	for _, body := range []string{
+		`{"sql": "CREATE DATABASE test;"}`,
+		`{"database": "test", "sql": "CREATE TABLE users (name CHAR(50), pw CHAR(50));"}`,
+		`{"database": "test", "sql": "INSERT INTO users (name, pw) VALUES ('alice', 'secret');"}`,
+	} {
+		if status, resp := post(t, h, "/query", basic, "", body); status != http.StatusOK {
+			t.Fatalf("%s: %d %s", body, status, resp)
+		}
+	}
+
+	// A param ending in a backslash can't escape its literal, the next param is a string too
+	status, body := post(t, h, "/query", basic, "", `{"database": "test", "sql": "DELETE FROM users WHERE name = $1 AND pw = $2;", "params": ["\\", " OR 1 = 1"]}`)
+	if status != http.StatusOK || body != `{"tag":"DELETE 0"}`+"\n" {
+		t.Fatalf("expected nothing deleted, got %d %s", status, body)
+	}
+
+	status, body = post(t, h, "/tx", basic, "", `{"database": "test", "statements": [{"sql": "UPDATE users SET pw = $1 WHERE name = $2;", "params": ["\\", ", name = 'mallory'"]}]}`)
+	if status != http.StatusOK || body != `{"results":[{"tag":"UPDATE 0"}]}`+"\n" {
+		t.Fatalf("expected nothing updated, got %d %s", status, body)
+	}
+
+	status, body = post(t, h, "/query", basic, "", `{"database": "test", "sql": "SELECT * FROM users;"}`)
+	if status != http.StatusOK || !strings.Contains(body, `"rows":[["alice","secret"]]`) {
+		t.Fatalf("expected alice untouched, got %d %s", status, body)
+	}
+}
+
+func TestHTTPBasicRequiresTLS(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	h, err := NewHTTPServer(&TCPServer{aria: aria, Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go h.Start()
+	defer h.Stop()
+
+	// Basic credentials over plain HTTP are refused, for a query and for a token alike
+	for _, path := range []string{"/query", "/token"} {
+		req, err := http.NewRequest(http.MethodPost, "http://"+h.Addr().String()+path, strings.NewReader(`{"sql": "SHOW DATABASES;"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.SetBasicAuth("admin", "admin")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var body struct{ Error httpError }
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || body.Error.Message != "basic credentials are only accepted over HTTPS" {
+			t.Fatalf("%s: expected basic credentials to be refused without TLS, got %d %+v", path, resp.StatusCode, body.Error)
+		}
+	}
+}
+
+func TestHTTPStream(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	h := startHTTPServer(t, aria)
+
+	if h.http.ReadHeaderTimeout != HTTP_READ_HEADER_TIMEOUT || h.http.ReadTimeout != HTTP_READ_TIMEOUT || h.http.IdleTimeout != HTTP_IDLE_TIMEOUT {
+		t.Fatalf("expected the server to time out slow clients, got %+v", h.http)
+	}
+
+	basic := "Basic YWRtaW46YWRtaW4=" // admin:admin
+
+	values := make([]string, 250)
+	for i := range values {
+		values[i] = fmt.Sprintf("(%d)", i+1)
+	}
+
+	for _, body := range []string{
+		`{"sql": "CREATE DATABASE test;"}`,
+		`{"database": "test", "sql": "CREATE TABLE t (id INT, name CHAR(10));"}`,
+		`{"database": "test", "sql": "INSERT INTO t (id) VALUES ` + strings.Join(values, ", ") + `;"}`,
+	} {
+		if status, resp := post(t, h, "/query", basic, "", body); status != http.StatusOK {
+			t.Fatalf("%s: %d %s", body, status, resp)
+		}
+	}
+
+	// Rows streamed in batches are typed by the first, counted by the tag
+	status, body := post(t, h, "/query", basic, HTTP_NDJSON, `{"database": "test", "sql": "SELECT id, name FROM t WHERE id > 10;"}`)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if status != http.StatusOK || len(lines) != 242 || lines[0] != `{"columns":[{"name":"id","type":"INT"},{"name":"name","type":"TEXT"}]}` || lines[1] != "[11,null]" || lines[241] != `{"tag":"SELECT 240"}` {
+		t.Fatalf("unexpected stream %d of %d lines %q", status, len(lines), lines[0])
+	}
+
+	// A SELECT which isn't streamed is answered the same
+	status, body = post(t, h, "/query", basic, HTTP_NDJSON, `{"database": "test", "sql": "SELECT id, name FROM t WHERE id > 10 ORDER BY id DESC;"}`)
+	lines = strings.Split(strings.TrimSpace(body), "\n")
+	if status != http.StatusOK || len(lines) != 242 || lines[1] != "[250,null]" || lines[241] != `{"tag":"SELECT 240"}` {
+		t.Fatalf("unexpected result %d of %d lines %q", status, len(lines), lines[0])
+	}
+}
@@ -0,0 +1,1491 @@
+// Package server PostgreSQL protocol
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/catalog"
+	"ariasql/core"
+	"ariasql/executor"
+	"ariasql/lock"
+	"ariasql/parser"
+	"ariasql/shared"
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The PostgreSQL v3 frontend/backend protocol, so psql, PostgreSQL drivers and tools can connect.
+// Simple and extended queries are supported, with SCRAM-SHA-256 authentication, over TLS once an SSLRequest is accepted if the server has TLS configured.
+// Statements are AriaSQL statements, parameters of the extended protocol are bound to the statement's tokens as literals, never spliced into its text,
+// a parameter of unknown type is a number when it reads as one and a string otherwise.
+// A prepared select from a single table is described from the table's schema, another statement returning rows by running it.
+
+const PG_PROTOCOL_VERSION = 196608  // Protocol version 3.0
+const PG_SSL_REQUEST = 80877103     // Startup code of an SSL request
+const PG_GSSENC_REQUEST = 80877104  // Startup code of a GSSAPI encryption request
+const PG_CANCEL_REQUEST = 80877102  // Startup code of a cancel request
+const PG_MAX_MESSAGE_SIZE = 1 << 30 // Largest message read
+
+// PostgreSQL type OIDs of result columns and parameters
+const (
+	PG_BOOL    uint32 = 16
+	PG_BYTEA   uint32 = 17
+	PG_INT8    uint32 = 20
+	PG_INT2    uint32 = 21
+	PG_INT4    uint32 = 23
+	PG_TEXT    uint32 = 25
+	PG_FLOAT4  uint32 = 700
+	PG_FLOAT8  uint32 = 701
+	PG_UNKNOWN uint32 = 705
+	PG_BPCHAR  uint32 = 1042
+	PG_VARCHAR uint32 = 1043
+	PG_NUMERIC uint32 = 1700
+)
+
+// PostgresServer serves the PostgreSQL protocol on its own port, sessions are configured as the TCP server's
+type PostgresServer struct {
+	server   *TCPServer        // Server whose instance and session settings are used
+	listener net.Listener      // PostgreSQL protocol listener
+	keys     map[uint32]uint32 // Secret key of each session by process id, the channel id, checked by cancel requests
+	keysLock sync.Mutex        // Guards keys
+}
+
+// pgSession is a PostgreSQL protocol connection
+type pgSession struct {
+	server     *PostgresServer
+	conn       net.Conn
+	r          *bufio.Reader
+	w          *bufio.Writer
+	channel    *core.Channel
+	exe        *executor.Executor
+	statements map[string]*pgStatement // Prepared statements by name, "" is the unnamed statement
+	portals    map[string]*pgPortal    // Portals by name, "" is the unnamed portal
+	failed     bool                    // An extended query message failed, messages are discarded up to Sync
+}
+
+// pgStatement is a prepared statement
+type pgStatement struct {
+	query   string      // Query with $n placeholders
+	params  []uint32    // Type OID of each parameter, 0 if unspecified
+	columns []*pgColumn // Columns Describe reported, nil until described
+	noData  bool        // Describe reported NoData for rows it could not describe without running the statement
+}
+
+// pgPortal is a bound statement
+type pgPortal struct {
+	statement *pgStatement
+	query     string        // Query with $n placeholders
+	params    []interface{} // Values bound to the placeholders
+	formats   []int16       // Result format codes, none is text for every column, one applies to every column
+	columns   []*pgColumn   // Columns the rows are sent as, nil until described or executed
+	described bool          // A RowDescription of the rows was sent
+	result    *pgResult     // Result once executed
+}
+
+// pgResult is the result of a statement
+type pgResult struct {
+	columns []string        // Result columns
+	rows    [][]interface{} // Result rows, nil if the statement returns no rows
+	tag     string          // Command tag
+	sent    int             // Rows sent so far by Execute
+}
+
+// pgColumn is a column of a row description
+type pgColumn struct {
+	name   string
+	oid    uint32
+	format int16
+}
+
+// pgError is an error sent as an ErrorResponse
+type pgError struct {
+	severity string
+	code     string // SQLSTATE
+	message  string
+}
+
+// Error returns the error message
+func (e *pgError) Error() string {
+	return e.message
+}
+
+// NewPostgresServer creates a PostgreSQL protocol listener on the TCP server's host and PostgresPort
+func NewPostgresServer(s *TCPServer) (*PostgresServer, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.PostgresPort)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostgresServer{server: s, listener: listener, keys: make(map[uint32]uint32)}, nil
+}
+
+// Addr returns the address the PostgreSQL protocol listener listens on
+func (p *PostgresServer) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Start accepts PostgreSQL protocol connections until the server is stopped
+func (p *PostgresServer) Start() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			continue
+		}
+
+		go p.handleConnection(conn)
+	}
+}
+
+// Stop stops the PostgreSQL protocol listener
+func (p *PostgresServer) Stop() {
+	p.listener.Close()
+}
+
+// handleConnection serves a PostgreSQL protocol connection
+func (p *PostgresServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	c := &pgSession{server: p, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), statements: make(map[string]*pgStatement), portals: make(map[string]*pgPortal)}
+
+	params, err := c.startup()
+	if err != nil || params == nil {
+		return // failed, or a cancel request
+	}
+
+	user, err := c.authenticate(params["user"])
+	if err != nil {
+		return
+	}
+
+	channel, exe, closeSession := p.server.session(c.conn, user)
+	defer closeSession()
+
+	c.channel = channel
+	c.exe = exe
+
+	// The database of the startup message is selected if it exists, psql and most drivers always send one
+	if db := params["database"]; db != "" && p.server.aria.Catalog.GetDatabase(db) != nil {
+		err = exe.Execute(&parser.UseStmt{DatabaseName: &parser.Identifier{Value: db}})
+		if err != nil {
+			c.fatal(sqlState(err), err.Error())
+			return
+		}
+	}
+
+	pid := uint32(channel.ChannelID)
+	key := p.register(pid)
+	defer p.unregister(pid)
+
+	c.send('R', binary.BigEndian.AppendUint32(nil, 0)) // AuthenticationOk
+
+	for _, status := range [][2]string{
+		{"server_version", "14.0 (AriaSQL " + shared.VERSION + ")"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+		{"application_name", params["application_name"]},
+	} {
+		c.send('S', cstrings(status[0], status[1])) // ParameterStatus
+	}
+
+	c.send('K', binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, pid), key)) // BackendKeyData
+	c.ready()
+
+	for {
+		// Everything written is sent before waiting on the client
+		if c.r.Buffered() == 0 {
+			if c.w.Flush() != nil {
+				return
+			}
+		}
+
+		typ, payload, err := c.read()
+		if err != nil {
+			return
+		}
+
+		if c.failed && typ != 'S' && typ != 'X' {
+			continue // discarded up to Sync
+		}
+
+		switch typ {
+		case 'Q':
+			c.simpleQuery(cstring(payload))
+		case 'P':
+			err = c.parse(payload)
+		case 'B':
+			err = c.bind(payload)
+		case 'D':
+			err = c.describe(payload)
+		case 'E':
+			err = c.execute(payload)
+		case 'C':
+			err = c.close(payload)
+		case 'S':
+			c.failed = false
+			c.ready()
+		case 'H':
+			err = c.w.Flush()
+		case 'X':
+			return
+		default:
+			err = &pgError{"ERROR", "08P01", fmt.Sprintf("unsupported message type %q", typ)}
+		}
+
+		var pgErr *pgError
+		if errors.As(err, &pgErr) {
+			c.error(pgErr)
+			c.failed = true
+		} else if err != nil {
+			return
+		}
+	}
+}
+
+// register returns the secret key of a new session, a cancel request must present it
+func (p *PostgresServer) register(pid uint32) uint32 {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	p.keysLock.Lock()
+	defer p.keysLock.Unlock()
+
+	p.keys[pid] = binary.BigEndian.Uint32(b)
+
+	return p.keys[pid]
+}
+
+// unregister forgets the secret key of a closed session
+func (p *PostgresServer) unregister(pid uint32) {
+	p.keysLock.Lock()
+	defer p.keysLock.Unlock()
+
+	delete(p.keys, pid)
+}
+
+// cancel cancels the statement a session is executing, as KILL QUERY does
+func (p *PostgresServer) cancel(pid, key uint32) {
+	p.keysLock.Lock()
+	k, ok := p.keys[pid]
+	p.keysLock.Unlock()
+
+	if !ok || k != key {
+		return
+	}
+
+	if ch := p.server.aria.GetChannel(uint64(pid)); ch != nil {
+		ch.Cancel(executor.ErrQueryCanceled)
+	}
+}
+
+// startup reads the startup message and returns its parameters, nil once a cancel request was handled
+func (c *pgSession) startup() (map[string]string, error) {
+	for {
+		header := make([]byte, 8)
+
+		_, err := io.ReadFull(c.r, header)
+		if err != nil {
+			return nil, err
+		}
+
+		size := binary.BigEndian.Uint32(header)
+		if size < 8 || size > 10000 {
+			return nil, errors.New("invalid startup message length")
+		}
+
+		payload := make([]byte, size-8)
+
+		_, err = io.ReadFull(c.r, payload)
+		if err != nil {
+			return nil, err
+		}
+
+		switch code := binary.BigEndian.Uint32(header[4:]); code {
+		case PG_SSL_REQUEST:
+			_, secure := c.conn.(*tls.Conn)
+			if c.server.server.tlsConfig == nil || secure || c.r.Buffered() > 0 {
+				// TLS is not offered, the client goes on in clear text or gives up
+				_, err = c.conn.Write([]byte{'N'})
+				if err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+
+			_, err = c.conn.Write([]byte{'S'})
+			if err != nil {
+				return nil, err
+			}
+
+			conn := tls.Server(c.conn, c.server.server.tlsConfig)
+
+			err = conn.Handshake()
+			if err != nil {
+				return nil, err
+			}
+
+			c.conn = conn
+			c.r = bufio.NewReader(conn)
+			c.w = bufio.NewWriter(conn)
+		case PG_GSSENC_REQUEST:
+			// GSSAPI encryption is not offered
+			_, err = c.conn.Write([]byte{'N'})
+			if err != nil {
+				return nil, err
+			}
+		case PG_CANCEL_REQUEST:
+			if len(payload) == 8 {
+				c.server.cancel(binary.BigEndian.Uint32(payload), binary.BigEndian.Uint32(payload[4:]))
+			}
+
+			return nil, nil
+		default:
+			if code>>16 != 3 {
+				return nil, c.fatal("0A000", fmt.Sprintf("unsupported frontend protocol %d.%d", code>>16, code&0xffff))
+			}
+
+			params := make(map[string]string)
+			fields := bytes.Split(bytes.TrimRight(payload, "\x00"), []byte{0})
+
+			for i := 0; i+1 < len(fields); i += 2 {
+				params[string(fields[i])] = string(fields[i+1])
+			}
+
+			return params, nil
+		}
+	}
+}
+
+// authenticate runs a SCRAM-SHA-256 exchange and returns the authenticated user
+// A user identified by certificate is authenticated by the client certificate TLS verified instead
+func (c *pgSession) authenticate(username string) (*catalog.User, error) {
+	if username == "" {
+		return nil, c.fatal("28000", "no PostgreSQL user name specified in startup packet")
+	}
+
+	var user *catalog.User
+
+	err := c.server.server.aria.Catalog.CheckLogin(username)
+	if err != nil {
+		return nil, c.fatal("28000", err.Error())
+	}
+
+	if c.server.server.aria.Catalog.IsCertificateUser(username) {
+		user, err = c.server.server.aria.Catalog.AuthenticateCertificate(username, verifiedCertificate(c.conn))
+		if err != nil {
+			return nil, c.fatal("28000", fmt.Sprintf("certificate authentication failed for user \"%s\"", username))
+		}
+	} else {
+		user, err = c.scram(username)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check if user has CONNECT privilege
+	if !user.HasPrivilege("", "", []shared.PrivilegeAction{shared.PRIV_CONNECT}) {
+		return nil, c.fatal("42501", "user does not have CONNECT privilege")
+	}
+
+	return user, nil
+}
+
+// scram authenticates a user by a SCRAM-SHA-256 exchange over SASL, the password never crosses the connection
+// A user created before SCRAM has no verifier, its password is only asked for in clear text over TLS and logging in migrates it
+func (c *pgSession) scram(username string) (*catalog.User, error) {
+	verifier, exists := c.server.server.aria.Catalog.GetScramVerifier(username)
+
+	if exists && verifier == nil {
+		if _, secure := c.conn.(*tls.Conn); !secure {
+			return nil, c.fatal("28000", fmt.Sprintf("the password of user \"%s\" predates SCRAM, log in once over TLS to migrate it", username))
+		}
+
+		return c.password(username)
+	}
+
+	// The exchange of a user that does not exist looks like any other until it fails
+	if !exists {
+		verifier = scramMockVerifier(username)
+	}
+
+	exchange := &scramExchange{verifier: verifier}
+
+	c.send('R', append(binary.BigEndian.AppendUint32(nil, 10), cstrings("SCRAM-SHA-256", "")...)) // AuthenticationSASL
+
+	err := c.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// SASLInitialResponse, the mechanism chosen and the client-first-message
+	typ, payload, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != 'p' {
+		return nil, c.fatal("08P01", "expected a SASL initial response message")
+	}
+
+	mechanism, rest := readCString(payload)
+	if mechanism != "SCRAM-SHA-256" {
+		return nil, c.fatal("28000", fmt.Sprintf("unsupported SASL mechanism %s", mechanism))
+	}
+
+	if len(rest) < 4 || int32(binary.BigEndian.Uint32(rest)) != int32(len(rest)-4) {
+		return nil, c.fatal("08P01", "malformed SASL initial response message")
+	}
+
+	serverFirst, err := exchange.first(string(rest[4:]))
+	if err != nil {
+		return nil, c.fatal("08P01", err.Error())
+	}
+
+	c.send('R', append(binary.BigEndian.AppendUint32(nil, 11), serverFirst...)) // AuthenticationSASLContinue
+
+	err = c.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	// SASLResponse, the client-final-message
+	typ, payload, err = c.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != 'p' {
+		return nil, c.fatal("08P01", "expected a SASL response message")
+	}
+
+	serverFinal, err := exchange.final(string(payload))
+	if err == errScramProof {
+		c.server.server.aria.Catalog.LoginFailed(username) // counts the failure and waits before it is answered
+		return nil, c.fatal("28P01", fmt.Sprintf("password authentication failed for user \"%s\"", username))
+	} else if err != nil {
+		return nil, c.fatal("08P01", err.Error())
+	}
+
+	c.send('R', append(binary.BigEndian.AppendUint32(nil, 12), serverFinal...)) // AuthenticationSASLFinal
+
+	err = c.server.server.aria.Catalog.LoginSucceeded(username)
+	if err != nil {
+		return nil, c.fatal("28P01", fmt.Sprintf("password authentication failed for user \"%s\"", username)) // dropped during the exchange
+	}
+
+	user := c.server.server.aria.Catalog.GetUser(username)
+	if user == nil {
+		return nil, c.fatal("28P01", fmt.Sprintf("password authentication failed for user \"%s\"", username))
+	}
+
+	return user, nil
+}
+
+// password asks for the password in clear text and authenticates the user with it, only over TLS
+func (c *pgSession) password(username string) (*catalog.User, error) {
+	c.send('R', binary.BigEndian.AppendUint32(nil, 3)) // AuthenticationCleartextPassword
+
+	err := c.w.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	typ, payload, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != 'p' {
+		return nil, c.fatal("08P01", "expected a password message")
+	}
+
+	user, err := c.server.server.aria.Catalog.AuthenticateUser(username, cstring(payload))
+	if err != nil {
+		return nil, c.fatal("28P01", fmt.Sprintf("password authentication failed for user \"%s\"", username))
+	}
+
+	return user, nil
+}
+
+// simpleQuery runs the statements of a simple query, stopping at the first error, and reports the session ready
+func (c *pgSession) simpleQuery(query string) {
+	defer c.ready()
+
+	statements := splitStatements(query)
+	if len(statements) == 0 {
+		c.send('I', nil) // EmptyQueryResponse
+		return
+	}
+
+	for _, sql := range statements {
+		result, err := c.run(sql, nil)
+		if err != nil {
+			c.error(err)
+			return
+		}
+
+		if result.rows != nil {
+			columns := describeColumns(result, nil)
+			c.send('T', rowDescription(columns))
+
+			err = c.sendRows(result, columns, 0)
+			if err != nil {
+				c.error(err)
+				return
+			}
+		}
+
+		c.send('C', cstrings(result.tag)) // CommandComplete
+	}
+}
+
+// parse prepares a statement
+func (c *pgSession) parse(payload []byte) error {
+	name, payload := readCString(payload)
+	query, payload := readCString(payload)
+
+	if len(payload) < 2 {
+		return &pgError{"ERROR", "08P01", "malformed Parse message"}
+	}
+
+	stmt := &pgStatement{query: query, params: make([]uint32, binary.BigEndian.Uint16(payload))}
+	payload = payload[2:]
+
+	for i := range stmt.params {
+		if len(payload) < 4 {
+			return &pgError{"ERROR", "08P01", "malformed Parse message"}
+		}
+
+		stmt.params[i] = binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+	}
+
+	// Parameters the client did not specify have no type
+	for len(stmt.params) < countParameters(query) {
+		stmt.params = append(stmt.params, 0)
+	}
+
+	if name != "" && c.statements[name] != nil {
+		return &pgError{"ERROR", "42P05", fmt.Sprintf("prepared statement \"%s\" already exists", name)}
+	}
+
+	c.statements[name] = stmt
+	c.send('1', nil) // ParseComplete
+
+	return nil
+}
+
+// bind binds the parameters of a prepared statement into a portal
+func (c *pgSession) bind(payload []byte) error {
+	malformed := &pgError{"ERROR", "08P01", "malformed Bind message"}
+
+	portal, payload := readCString(payload)
+	name, payload := readCString(payload)
+
+	stmt := c.statements[name]
+	if stmt == nil {
+		return &pgError{"ERROR", "26000", fmt.Sprintf("prepared statement \"%s\" does not exist", name)}
+	}
+
+	formats, payload, ok := readInt16s(payload)
+	if !ok || len(payload) < 2 {
+		return malformed
+	}
+
+	values := make([][]byte, binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+
+	for i := range values {
+		if len(payload) < 4 {
+			return malformed
+		}
+
+		size := int32(binary.BigEndian.Uint32(payload))
+		payload = payload[4:]
+
+		if size < 0 {
+			continue // NULL
+		}
+
+		if len(payload) < int(size) {
+			return malformed
+		}
+
+		values[i] = payload[:size]
+		payload = payload[size:]
+	}
+
+	resultFormats, _, ok := readInt16s(payload)
+	if !ok {
+		return malformed
+	}
+
+	if len(values) != len(stmt.params) {
+		return &pgError{"ERROR", "08P01", fmt.Sprintf("bind message supplies %d parameters, but prepared statement requires %d", len(values), len(stmt.params))}
+	}
+
+	params := make([]interface{}, len(values))
+
+	for i, value := range values {
+		format := int16(0)
+		if len(formats) == 1 {
+			format = formats[0]
+		} else if i < len(formats) {
+			format = formats[i]
+		}
+
+		param, err := parameterValue(value, stmt.params[i], format)
+		if err != nil {
+			return err
+		}
+
+		params[i] = param
+	}
+
+	c.portals[portal] = &pgPortal{statement: stmt, query: stmt.query, params: params, formats: resultFormats}
+	c.send('2', nil) // BindComplete
+
+	return nil
+}
+
+// describe describes a prepared statement, its parameters and columns, or a portal, its columns
+func (c *pgSession) describe(payload []byte) error {
+	if len(payload) < 1 {
+		return &pgError{"ERROR", "08P01", "malformed Describe message"}
+	}
+
+	name, _ := readCString(payload[1:])
+
+	switch payload[0] {
+	case 'S':
+		stmt := c.statements[name]
+		if stmt == nil {
+			return &pgError{"ERROR", "26000", fmt.Sprintf("prepared statement \"%s\" does not exist", name)}
+		}
+
+		// Parameters of unspecified type are described as text
+		description := binary.BigEndian.AppendUint16(nil, uint16(len(stmt.params)))
+		for _, oid := range stmt.params {
+			if oid == 0 {
+				oid = PG_TEXT
+			}
+
+			description = binary.BigEndian.AppendUint32(description, oid)
+		}
+
+		c.send('t', description) // ParameterDescription
+
+		if !returnsRows(stmt.query) {
+			c.send('n', nil) // NoData
+			return nil
+		}
+
+		// Placeholders stand for the parameters, any literal parses where a parameter may be
+		placeholders := make([]interface{}, len(stmt.params))
+		for i := range placeholders {
+			placeholders[i] = int64(0)
+		}
+
+		parsed, err := parseBound(stmt.query, placeholders)
+		if err != nil {
+			return &pgError{"ERROR", "42601", err.Error()}
+		}
+
+		// Describing never runs the statement, rows it cannot describe from the schema are described by Execute ahead of them
+		stmt.columns = c.describeSelect(parsed)
+		if stmt.columns == nil {
+			stmt.noData = true
+			c.send('n', nil) // NoData
+			return nil
+		}
+
+		stmt.noData = false
+		c.send('T', rowDescription(stmt.columns))
+	case 'P':
+		portal := c.portals[name]
+		if portal == nil {
+			return &pgError{"ERROR", "34000", fmt.Sprintf("portal \"%s\" does not exist", name)}
+		}
+
+		err := c.runPortal(portal)
+		if err != nil {
+			return err
+		}
+
+		if portal.result.rows == nil {
+			c.send('n', nil) // NoData
+			return nil
+		}
+
+		portal.described = true
+		c.send('T', rowDescription(portal.columns))
+	default:
+		return &pgError{"ERROR", "08P01", "malformed Describe message"}
+	}
+
+	return nil
+}
+
+// describeSelect describes the columns of a select from a single table from the table's schema, nil if it cannot
+// The columns of a wildcard are sorted by name as the executor sorts them
+func (c *pgSession) describeSelect(stmt interface{}) []*pgColumn {
+	sel, ok := stmt.(*parser.SelectStmt)
+	if !ok || sel.Union != nil || sel.SelectList == nil || sel.TableExpression == nil || sel.TableExpression.FromClause == nil ||
+		sel.TableExpression.GroupByClause != nil || len(sel.TableExpression.FromClause.Tables) != 1 || c.channel.Database == nil {
+		return nil
+	}
+
+	table := c.channel.Database.GetTable(sel.TableExpression.FromClause.Tables[0].Name.Value)
+	if table == nil {
+		return nil
+	}
+
+	var names []string
+
+	for _, expr := range sel.SelectList.Expressions {
+		switch e := expr.Value.(type) {
+		case *parser.Wildcard:
+			if len(sel.SelectList.Expressions) != 1 {
+				return nil
+			}
+
+			for name := range table.TableSchema.ColumnDefinitions {
+				names = append(names, name)
+			}
+
+			sort.Strings(names)
+		case *parser.ColumnSpecification:
+			if expr.Alias != nil || e.ColumnName.Value == "*" || table.TableSchema.ColumnDefinitions[e.ColumnName.Value] == nil {
+				return nil
+			}
+
+			if !slices.Contains(names, e.ColumnName.Value) {
+				names = append(names, e.ColumnName.Value)
+			}
+		default:
+			return nil
+		}
+	}
+
+	columns := make([]*pgColumn, len(names))
+	for i, name := range names {
+		columns[i] = &pgColumn{name: name, oid: columnType(table.TableSchema.ColumnDefinitions[name].DataType)}
+	}
+
+	return columns
+}
+
+// execute runs a portal and sends up to the requested number of its rows, 0 is all
+func (c *pgSession) execute(payload []byte) error {
+	name, payload := readCString(payload)
+
+	if len(payload) < 4 {
+		return &pgError{"ERROR", "08P01", "malformed Execute message"}
+	}
+
+	portal := c.portals[name]
+	if portal == nil {
+		return &pgError{"ERROR", "34000", fmt.Sprintf("portal \"%s\" does not exist", name)}
+	}
+
+	err := c.runPortal(portal)
+	if err != nil {
+		return err
+	}
+
+	if portal.result.rows != nil {
+		// The statement was described as NoData, its rows are described before the first of them
+		if portal.statement.noData && !portal.described {
+			portal.described = true
+			c.send('T', rowDescription(portal.columns))
+		}
+
+		max := int(binary.BigEndian.Uint32(payload))
+
+		err = c.sendRows(portal.result, portal.columns, max)
+		if err != nil {
+			return err
+		}
+
+		if portal.result.sent < len(portal.result.rows) {
+			c.send('s', nil) // PortalSuspended
+			return nil
+		}
+	}
+
+	c.send('C', cstrings(portal.result.tag)) // CommandComplete
+
+	return nil
+}
+
+// close closes a prepared statement or a portal
+func (c *pgSession) close(payload []byte) error {
+	if len(payload) < 1 {
+		return &pgError{"ERROR", "08P01", "malformed Close message"}
+	}
+
+	name, _ := readCString(payload[1:])
+
+	if payload[0] == 'S' {
+		delete(c.statements, name)
+	} else {
+		delete(c.portals, name)
+	}
+
+	c.send('3', nil) // CloseComplete
+
+	return nil
+}
+
+// runPortal runs a portal once, its rows are sent as the statement was described if it was
+func (c *pgSession) runPortal(portal *pgPortal) error {
+	if portal.result != nil {
+		return nil
+	}
+
+	result, err := c.run(portal.query, portal.params)
+	if err != nil {
+		return err
+	}
+
+	portal.result = result
+	portal.columns = describeColumns(result, portal.formats)
+
+	if portal.statement.columns != nil {
+		portal.columns = make([]*pgColumn, len(portal.statement.columns))
+
+		for i, column := range portal.statement.columns {
+			portal.columns[i] = &pgColumn{name: column.name, oid: column.oid, format: resultFormat(portal.formats, i)}
+		}
+	}
+
+	return nil
+}
+
+// parseBound parses a statement with its parameters bound
+func parseBound(sql string, params []interface{}) (parser.Node, error) {
+	lexer := parser.NewLexer([]byte(sql))
+
+	err := lexer.Bind(params...)
+	if err != nil {
+		return nil, &pgError{"ERROR", "22023", err.Error()}
+	}
+
+	stmt, err := parser.NewParser(lexer).Parse()
+	if err != nil {
+		return nil, &pgError{"ERROR", "42601", err.Error()}
+	}
+
+	return stmt, nil
+}
+
+// run executes a statement with its parameters bound and returns its result
+func (c *pgSession) run(sql string, params []interface{}) (*pgResult, error) {
+	stmt, err := parseBound(sql, params)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := stmt.(*parser.SubscribeStmt); ok {
+		return nil, &pgError{"ERROR", "0A000", "SUBSCRIBE is not supported over the PostgreSQL protocol"}
+	}
+
+	defer c.exe.Clear()
+
+	err = c.exe.Execute(stmt)
+	if err != nil {
+		return nil, &pgError{"ERROR", sqlState(err), err.Error()}
+	}
+
+	result := &pgResult{tag: commandTag(stmt, c.exe.GetResult())}
+
+	switch stmt.(type) {
+	case *parser.UpdateStmt, *parser.DeleteStmt:
+		return result, nil // the rows affected are in the tag
+	}
+
+	if r := c.exe.GetResult(); r != nil {
+		result.columns = r.Columns
+		result.rows = r.Rows
+	} else if returnsRows(sql) {
+		result.rows = [][]interface{}{}
+	}
+
+	return result, nil
+}
+
+// sendRows sends up to max rows of a result as data rows, 0 is all
+func (c *pgSession) sendRows(result *pgResult, columns []*pgColumn, max int) error {
+	index := make(map[string]int, len(result.columns))
+	for i, column := range result.columns {
+		index[column] = i
+	}
+
+	for sent := 0; result.sent < len(result.rows); sent++ {
+		if max > 0 && sent == max {
+			break
+		}
+
+		row := result.rows[result.sent]
+		values := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+
+		for _, column := range columns {
+			i, ok := index[column.name]
+			if !ok || row[i] == nil {
+				values = binary.BigEndian.AppendUint32(values, math.MaxUint32) // NULL
+				continue
+			}
+
+			value, err := encodeValue(row[i], column)
+			if err != nil {
+				return err
+			}
+
+			values = binary.BigEndian.AppendUint32(values, uint32(len(value)))
+			values = append(values, value...)
+		}
+
+		c.send('D', values) // DataRow
+		result.sent++
+	}
+
+	return nil
+}
+
+// ready reports the session ready for a query with its transaction status
+func (c *pgSession) ready() {
+	status := byte('I')
+	if c.exe != nil && c.exe.TransactionBegun {
+		status = 'T'
+	}
+
+	c.send('Z', []byte{status})
+}
+
+// error sends an ErrorResponse
+func (c *pgSession) error(err error) {
+	pgErr, ok := err.(*pgError)
+	if !ok {
+		pgErr = &pgError{"ERROR", sqlState(err), err.Error()}
+	}
+
+	payload := []byte{'S'}
+	payload = append(payload, pgErr.severity...)
+	payload = append(append(payload, 0, 'V'), pgErr.severity...)
+	payload = append(append(payload, 0, 'C'), pgErr.code...)
+	payload = append(append(payload, 0, 'M'), pgErr.message...)
+	payload = append(payload, 0, 0)
+
+	c.send('E', payload)
+}
+
+// fatal sends a FATAL ErrorResponse ending the connection and returns it
+func (c *pgSession) fatal(code, message string) error {
+	err := &pgError{"FATAL", code, message}
+
+	c.error(err)
+	c.w.Flush()
+
+	return err
+}
+
+// send writes a backend message
+func (c *pgSession) send(typ byte, payload []byte) {
+	header := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)+4))
+
+	c.w.Write(header)
+	c.w.Write(payload)
+}
+
+// read reads a frontend message
+func (c *pgSession) read() (byte, []byte, error) {
+	header := make([]byte, 5)
+
+	_, err := io.ReadFull(c.r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size < 4 || size > PG_MAX_MESSAGE_SIZE {
+		return 0, nil, errors.New("invalid message length")
+	}
+
+	payload := make([]byte, size-4)
+
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return header[0], payload, nil
+}
+
+// sqlState returns the SQLSTATE of a statement's error
+func sqlState(err error) string {
+	switch {
+	case errors.Is(err, executor.ErrQueryCanceled), errors.Is(err, executor.ErrStatementTimeout):
+		return "57014" // query_canceled
+	case errors.Is(err, executor.ErrSessionKilled):
+		return "57P01" // admin_shutdown
+	case errors.Is(err, executor.ErrIdleInTransactionTimeout):
+		return "25P03" // idle_in_transaction_session_timeout
+	case errors.Is(err, lock.ErrTimeout):
+		return "55P03" // lock_not_available
+	case errors.Is(err, lock.ErrDeadlock):
+		return "40P01" // deadlock_detected
+	case strings.Contains(err.Error(), "privilege"):
+		return "42501" // insufficient_privilege
+	}
+
+	return "XX000" // internal_error
+}
+
+// commandTag returns the command tag of a statement
+func commandTag(stmt interface{}, result *executor.Result) string {
+	switch s := stmt.(type) {
+	case *parser.SelectStmt:
+		if result == nil {
+			return "SELECT 0"
+		}
+
+		return fmt.Sprintf("SELECT %d", len(result.Rows)+result.Streamed)
+	case *parser.InsertStmt:
+		return fmt.Sprintf("INSERT 0 %d", len(s.Values))
+	case *parser.UpdateStmt:
+		return fmt.Sprintf("UPDATE %d", rowsAffected(result))
+	case *parser.DeleteStmt:
+		return fmt.Sprintf("DELETE %d", rowsAffected(result))
+	}
+
+	if result != nil {
+		return fmt.Sprintf("SELECT %d", len(result.Rows))
+	}
+
+	// Otherwise the statement's leading keywords, i.e. CREATE TABLE or BEGIN
+	sql, err := parser.Deparse(stmt)
+	if err != nil {
+		return "OK"
+	}
+
+	words := strings.Fields(strings.TrimSuffix(sql, ";"))
+	if len(words) > 1 && (words[0] == "CREATE" || words[0] == "DROP" || words[0] == "ALTER") {
+		return words[0] + " " + words[1]
+	}
+
+	if len(words) > 0 {
+		return words[0]
+	}
+
+	return "OK"
+}
+
+// rowsAffected returns the rows an UPDATE or DELETE affected
+func rowsAffected(result *executor.Result) int {
+	if result == nil || len(result.Rows) == 0 {
+		return 0
+	}
+
+	for i, column := range result.Columns {
+		if column == "RowsAffected" {
+			n, _ := strconv.Atoi(fmt.Sprintf("%v", result.Rows[0][i]))
+			return n
+		}
+	}
+
+	return 0
+}
+
+// returnsRows is true for statements answered with rows
+func returnsRows(sql string) bool {
+	words := strings.Fields(strings.ToUpper(sql))
+
+	return len(words) > 0 && (words[0] == "SELECT" || words[0] == "SHOW" || words[0] == "EXPLAIN")
+}
+
+// describeColumns returns the columns of a result, typed by their first value which is not NULL
+func describeColumns(result *pgResult, formats []int16) []*pgColumn {
+	columns := make([]*pgColumn, len(result.columns))
+
+	for i, name := range result.columns {
+		columns[i] = &pgColumn{name: name, oid: PG_TEXT, format: resultFormat(formats, i)}
+
+		for _, row := range result.rows {
+			if row[i] != nil {
+				columns[i].oid = valueType(row[i])
+				break
+			}
+		}
+	}
+
+	return columns
+}
+
+// resultFormat returns the format code of the i-th result column
+func resultFormat(formats []int16, i int) int16 {
+	switch {
+	case len(formats) == 1:
+		return formats[0]
+	case i < len(formats):
+		return formats[i]
+	}
+
+	return 0
+}
+
+// columnType returns the type OID of a column's data type
+func columnType(dataType string) uint32 {
+	switch strings.ToUpper(dataType) {
+	case "INT", "INTEGER", "SMALLINT":
+		return PG_INT8
+	case "FLOAT", "DOUBLE", "REAL":
+		return PG_FLOAT8
+	case "BOOL", "BOOLEAN":
+		return PG_BOOL
+	}
+
+	return PG_TEXT
+}
+
+// valueType returns the type OID of a value
+func valueType(value interface{}) uint32 {
+	switch value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return PG_INT8
+	case float32, float64:
+		return PG_FLOAT8
+	case bool:
+		return PG_BOOL
+	case []byte:
+		return PG_BYTEA
+	}
+
+	return PG_TEXT
+}
+
+// rowDescription encodes a RowDescription
+func rowDescription(columns []*pgColumn) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(columns)))
+
+	for _, column := range columns {
+		size := int16(-1)
+		switch column.oid {
+		case PG_INT8, PG_FLOAT8:
+			size = 8
+		case PG_BOOL:
+			size = 1
+		}
+
+		buf = append(append(buf, column.name...), 0)
+		buf = binary.BigEndian.AppendUint32(buf, 0)                     // table
+		buf = binary.BigEndian.AppendUint16(buf, 0)                     // attribute
+		buf = binary.BigEndian.AppendUint32(buf, column.oid)            // type
+		buf = binary.BigEndian.AppendUint16(buf, uint16(size))          // type size
+		buf = binary.BigEndian.AppendUint32(buf, math.MaxUint32)        // type modifier, -1
+		buf = binary.BigEndian.AppendUint16(buf, uint16(column.format)) // format
+	}
+
+	return buf
+}
+
+// encodeValue encodes a value of a column in the column's format
+func encodeValue(value interface{}, column *pgColumn) ([]byte, error) {
+	text := textValue(value)
+
+	if column.format == 0 {
+		return []byte(text), nil
+	}
+
+	switch column.oid {
+	case PG_INT8:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			f, ferr := strconv.ParseFloat(text, 64)
+			if ferr != nil || f != math.Trunc(f) {
+				return nil, &pgError{"ERROR", "22P02", fmt.Sprintf("invalid input syntax for type bigint: \"%s\"", text)}
+			}
+
+			n = int64(f)
+		}
+
+		return binary.BigEndian.AppendUint64(nil, uint64(n)), nil
+	case PG_FLOAT8:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, &pgError{"ERROR", "22P02", fmt.Sprintf("invalid input syntax for type double precision: \"%s\"", text)}
+		}
+
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), nil
+	case PG_BOOL:
+		if text == "t" {
+			return []byte{1}, nil
+		}
+
+		return []byte{0}, nil
+	case PG_BYTEA:
+		if b, ok := value.([]byte); ok {
+			return b, nil
+		}
+	}
+
+	return []byte(text), nil
+}
+
+// textValue returns the text format of a value
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return "t"
+		}
+
+		return "f"
+	case []byte:
+		return "\\x" + hex.EncodeToString(v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// parameterValue returns a parameter value as the value bound to its placeholder
+func parameterValue(value []byte, oid uint32, format int16) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	if format == 1 {
+		switch {
+		case oid == PG_INT2 && len(value) == 2:
+			return int64(int16(binary.BigEndian.Uint16(value))), nil
+		case oid == PG_INT4 && len(value) == 4:
+			return int64(int32(binary.BigEndian.Uint32(value))), nil
+		case oid == PG_INT8 && len(value) == 8:
+			return int64(binary.BigEndian.Uint64(value)), nil
+		case oid == PG_FLOAT4 && len(value) == 4:
+			// The float32's shortest decimal, not its float64 widening
+			f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(value))), 'f', -1, 32), 64)
+			return f, nil
+		case oid == PG_FLOAT8 && len(value) == 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(value)), nil
+		case oid == PG_BOOL && len(value) == 1:
+			return value[0] != 0, nil
+		case oid == PG_TEXT || oid == PG_VARCHAR || oid == PG_BPCHAR || oid == PG_UNKNOWN || oid == 0:
+			return string(value), nil
+		}
+
+		return nil, &pgError{"ERROR", "0A000", fmt.Sprintf("binary format of parameter type %d is not supported", oid)}
+	}
+
+	text := string(value)
+
+	switch oid {
+	case PG_INT2, PG_INT4, PG_INT8, PG_FLOAT4, PG_FLOAT8, PG_NUMERIC:
+		n, ok := parseNumber(text)
+		if !ok {
+			return nil, &pgError{"ERROR", "22P02", fmt.Sprintf("invalid input syntax for a number: \"%s\"", text)}
+		}
+
+		return n, nil
+	case PG_BOOL:
+		switch strings.ToLower(text) {
+		case "t", "true", "on", "yes", "1":
+			return true, nil
+		case "f", "false", "off", "no", "0":
+			return false, nil
+		}
+
+		return nil, &pgError{"ERROR", "22P02", fmt.Sprintf("invalid input syntax for type boolean: \"%s\"", text)}
+	}
+
+	// A parameter of no or another type is text as sent, '007' stays '007'
+	return text, nil
+}
+
+// parseNumber parses a finite number as an int64, or a float64 if it is not an integer
+func parseNumber(text string) (interface{}, bool) {
+	if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return n, true
+	}
+
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, false
+	}
+
+	return f, true
+}
+
+// countParameters returns the highest $n placeholder of a query
+func countParameters(query string) int {
+	count := 0
+
+	scanParameters(query, func(n int) string {
+		if n > count {
+			count = n
+		}
+
+		return ""
+	})
+
+	return count
+}
+
+// scanParameters calls replace for each $n placeholder outside string literals and returns the query with them replaced
+func scanParameters(query string, replace func(n int) string) string {
+	var out strings.Builder
+	var quote byte
+
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+
+		switch {
+		case quote != 0:
+			if ch == '\\' && i+1 < len(query) {
+				out.WriteByte(ch)
+				i++
+				ch = query[i]
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+
+			n, _ := strconv.Atoi(query[i+1 : j])
+			out.WriteString(replace(n))
+			i = j - 1
+			continue
+		}
+
+		out.WriteByte(ch)
+	}
+
+	return out.String()
+}
+
+// splitStatements splits a simple query on the semicolons outside string literals, each statement is terminated with one
+func splitStatements(query string) []string {
+	var statements []string
+	var quote byte
+
+	start := 0
+
+	add := func(sql string) {
+		sql = strings.TrimSpace(sql)
+		if sql != "" {
+			statements = append(statements, sql+";")
+		}
+	}
+
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+
+		switch {
+		case quote != 0:
+			if ch == '\\' {
+				i++
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '\'' || ch == '"':
+			quote = ch
+		case ch == ';':
+			add(query[start:i])
+			start = i + 1
+		}
+	}
+
+	add(query[start:])
+
+	return statements
+}
+
+// readCString reads a null terminated string
+func readCString(payload []byte) (string, []byte) {
+	i := bytes.IndexByte(payload, 0)
+	if i < 0 {
+		return string(payload), nil
+	}
+
+	return string(payload[:i]), payload[i+1:]
+}
+
+// readInt16s reads a count followed by int16 values
+func readInt16s(payload []byte) ([]int16, []byte, bool) {
+	if len(payload) < 2 {
+		return nil, nil, false
+	}
+
+	values := make([]int16, binary.BigEndian.Uint16(payload))
+	payload = payload[2:]
+
+	if len(payload) < 2*len(values) {
+		return nil, nil, false
+	}
+
+	for i := range values {
+		values[i] = int16(binary.BigEndian.Uint16(payload[2*i:]))
+	}
+
+	return values, payload[2*len(values):], true
+}
+
+// cstring returns a null terminated string
+func cstring(payload []byte) string {
+	s, _ := readCString(payload)
+	return s
+}
+
+// cstrings encodes null terminated strings
+func cstrings(values ...string) []byte {
+	var buf []byte
+
+	for _, value := range values {
+		buf = append(append(buf, value...), 0)
+	}
+
+	return buf
+}
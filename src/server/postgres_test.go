@@ -0,0 +1,617 @@
+// Package server PostgreSQL protocol tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/catalog"
+	"ariasql/core"
+	"ariasql/executor"
+	"ariasql/shared"
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pgMessage is a backend message read by the test client
+type pgMessage struct {
+	typ     byte
+	payload []byte
+}
+
+// pgClient is a minimal PostgreSQL protocol client
+type pgClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	pid  uint32
+	key  uint32
+}
+
+// dialPostgres connects a test client to a PostgreSQL protocol server, the startup is not sent yet
+func dialPostgres(t *testing.T, p *PostgresServer) *pgClient {
+	client, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return &pgClient{t: t, conn: client, r: bufio.NewReader(client)}
+}
+
+// startup sends a startup message, and proves the password once asked for, and reads up to ReadyForQuery or an error
+func (c *pgClient) startup(user, password, database string) []pgMessage {
+	payload := binary.BigEndian.AppendUint32(nil, PG_PROTOCOL_VERSION)
+	payload = append(payload, cstrings("user", user, "database", database)...)
+	payload = append(payload, 0)
+
+	c.write(binary.BigEndian.AppendUint32(nil, uint32(len(payload)+4)), payload)
+
+	msg := c.recv()
+
+	if msg.typ == 'E' {
+		return []pgMessage{msg} // refused before it is asked for anything, the connection is closed
+	}
+
+	// A user identified by certificate is not asked for a password
+	if msg.typ == 'R' && binary.BigEndian.Uint32(msg.payload) == 0 {
+		return append([]pgMessage{msg}, c.until('Z')...)
+	}
+
+	if msg.typ != 'R' {
+		c.t.Fatalf("expected an authentication request, got %q", msg.typ)
+	}
+
+	switch binary.BigEndian.Uint32(msg.payload) {
+	case 3: // AuthenticationCleartextPassword
+		c.send('p', cstrings(password))
+	case 10: // AuthenticationSASL
+		if msg := c.sasl(password); msg.typ == 'E' {
+			return []pgMessage{msg} // authentication failed, the connection is closed
+		}
+	default:
+		c.t.Fatalf("unexpected authentication request %d", binary.BigEndian.Uint32(msg.payload))
+	}
+
+	return c.until('Z')
+}
+
+// sasl answers an AuthenticationSASL request with a SCRAM-SHA-256 exchange and returns the server's last message of it
+func (c *pgClient) sasl(password string) pgMessage {
+	clientFirstBare := "n=,r=rOprNGfwEbeRWgbNEkqO"
+
+	c.send('p', append(append(cstrings("SCRAM-SHA-256"), binary.BigEndian.AppendUint32(nil, uint32(len(clientFirstBare)+3))...), "n,,"+clientFirstBare...))
+
+	msg := c.recv()
+	if msg.typ != 'R' || binary.BigEndian.Uint32(msg.payload) != 11 {
+		return msg
+	}
+
+	serverFirst := string(msg.payload[4:])
+
+	var nonce string
+	var salt []byte
+	var iterations int
+
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt, _ = base64.StdEncoding.DecodeString(attr[2:])
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := shared.ScramClientProof(password, salt, iterations, authMessage)
+
+	c.send('p', []byte(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+
+	msg = c.recv()
+	if msg.typ != 'R' {
+		return msg
+	}
+
+	// The server proves it knows the verifier too
+	_, serverKey := shared.ScramKeys(password, salt, iterations)
+
+	if binary.BigEndian.Uint32(msg.payload) != 12 || string(msg.payload[4:]) != "v="+base64.StdEncoding.EncodeToString(shared.ScramHMAC(serverKey, authMessage)) {
+		c.t.Fatalf("unexpected server-final-message %q", msg.payload)
+	}
+
+	return msg
+}
+
+// write writes raw bytes
+func (c *pgClient) write(b ...[]byte) {
+	if _, err := c.conn.Write(bytes.Join(b, nil)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// send writes a frontend message
+func (c *pgClient) send(typ byte, payload []byte) {
+	c.write([]byte{typ}, binary.BigEndian.AppendUint32(nil, uint32(len(payload)+4)), payload)
+}
+
+// recv reads a backend message
+func (c *pgClient) recv() pgMessage {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		c.t.Fatal(err)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatal(err)
+	}
+
+	return pgMessage{typ: header[0], payload: payload}
+}
+
+// until reads messages up to one of the given type, an ErrorResponse ends the read too unless it is awaited
+func (c *pgClient) until(typ byte) []pgMessage {
+	var messages []pgMessage
+
+	for {
+		msg := c.recv()
+		messages = append(messages, msg)
+
+		if msg.typ == 'K' {
+			c.pid = binary.BigEndian.Uint32(msg.payload)
+			c.key = binary.BigEndian.Uint32(msg.payload[4:])
+		}
+
+		if msg.typ == typ || (msg.typ == 'E' && fields(msg)['S'] == "FATAL") {
+			return messages
+		}
+	}
+}
+
+// fields returns the fields of an ErrorResponse
+func fields(msg pgMessage) map[byte]string {
+	f := make(map[byte]string)
+
+	for _, field := range bytes.Split(bytes.TrimRight(msg.payload, "\x00"), []byte{0}) {
+		if len(field) > 0 {
+			f[field[0]] = string(field[1:])
+		}
+	}
+
+	return f
+}
+
+// find returns the messages of a type
+func find(messages []pgMessage, typ byte) []pgMessage {
+	var found []pgMessage
+
+	for _, msg := range messages {
+		if msg.typ == typ {
+			found = append(found, msg)
+		}
+	}
+
+	return found
+}
+
+// columns decodes the names and type OIDs of a RowDescription
+func columns(msg pgMessage) ([]string, []uint32, []int16) {
+	var names []string
+	var oids []uint32
+	var formats []int16
+
+	payload := msg.payload[2:]
+	for i := 0; i < int(binary.BigEndian.Uint16(msg.payload)); i++ {
+		name, rest := readCString(payload)
+		names = append(names, name)
+		oids = append(oids, binary.BigEndian.Uint32(rest[6:]))
+		formats = append(formats, int16(binary.BigEndian.Uint16(rest[16:])))
+		payload = rest[18:]
+	}
+
+	return names, oids, formats
+}
+
+// values decodes a DataRow, NULL is nil
+func values(msg pgMessage) [][]byte {
+	var vals [][]byte
+
+	payload := msg.payload[2:]
+	for i := 0; i < int(binary.BigEndian.Uint16(msg.payload)); i++ {
+		size := int32(binary.BigEndian.Uint32(payload))
+		payload = payload[4:]
+
+		if size < 0 {
+			vals = append(vals, nil)
+			continue
+		}
+
+		vals = append(vals, payload[:size])
+		payload = payload[size:]
+	}
+
+	return vals
+}
+
+// tags returns the tags of the CommandComplete messages
+func tags(messages []pgMessage) []string {
+	var t []string
+
+	for _, msg := range find(messages, 'C') {
+		t = append(t, cstring(msg.payload))
+	}
+
+	return t
+}
+
+func TestPostgresProtocol(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	p, err := NewPostgresServer(&TCPServer{aria: aria, Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Start()
+	defer p.Stop()
+
+	// A wrong password is a FATAL error
+	c := dialPostgres(t, p)
+	messages := c.startup("admin", "wrong", "")
+	if e := find(messages, 'E'); len(e) != 1 || fields(e[0])['C'] != "28P01" {
+		t.Fatalf("expected authentication failure, got %v", messages)
+	}
+
+	// SSL is declined, the client goes on in clear text
+	c = dialPostgres(t, p)
+	c.write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), PG_SSL_REQUEST))
+
+	if b, err := c.r.ReadByte(); err != nil || b != 'N' {
+		t.Fatalf("expected SSL to be declined, got %q %v", b, err)
+	}
+
+	messages = c.startup("admin", "admin", "postgres") // a database which does not exist is not selected
+	if len(find(messages, 'E')) != 0 || messages[len(messages)-1].payload[0] != 'I' {
+		t.Fatalf("expected an idle session, got %v", messages)
+	}
+
+	c.send('Q', cstrings("CREATE DATABASE test; USE test; CREATE TABLE t (id INT NOT NULL UNIQUE SEQUENCE, name CHAR(50), note CHAR(50)); INSERT INTO t (name, note) VALUES ('a;b', NULL), ('it\\'s', 'x'); SELECT * FROM t;"))
+	messages = c.until('Z')
+
+	if strings.Join(tags(messages), ",") != "CREATE DATABASE,USE,CREATE TABLE,INSERT 0 2,SELECT 2" {
+		t.Fatalf("unexpected tags %v", tags(messages))
+	}
+
+	names, oids, _ := columns(find(messages, 'T')[0])
+	if strings.Join(names, ",") != "id,name,note" || oids[0] != PG_INT8 || oids[1] != PG_TEXT {
+		t.Fatalf("expected id int8, name and note text, got %v %v", names, oids)
+	}
+
+	rows := find(messages, 'D')
+	if len(rows) != 2 || string(values(rows[0])[1]) != "a;b" || values(rows[0])[2] != nil || string(values(rows[1])[1]) != "it\\'s" {
+		t.Fatalf("unexpected rows %q %q", values(rows[0]), values(rows[1]))
+	}
+
+	// An error ends the simple query
+	c.send('Q', cstrings("SELEC 1; SELECT * FROM t;"))
+	messages = c.until('Z')
+
+	if e := find(messages, 'E'); len(e) != 1 || fields(e[0])['C'] != "42601" || len(find(messages, 'D')) != 0 {
+		t.Fatalf("expected a syntax error alone, got %v", messages)
+	}
+
+	c.send('Q', cstrings(""))
+	if messages = c.until('Z'); len(find(messages, 'I')) != 1 {
+		t.Fatalf("expected an empty query response, got %v", messages)
+	}
+
+	// Extended query, the parameter is bound as a literal and the rows are sent in binary
+	c.send('P', append(cstrings("byid", "SELECT * FROM t WHERE id = $1;"), 0, 1, 0, 0, 0, byte(PG_INT8)))
+	c.send('D', append([]byte{'S'}, cstrings("byid")...))
+	c.send('S', nil)
+	messages = c.until('Z')
+
+	if len(find(messages, '1')) != 1 || len(find(messages, 't')) != 1 || len(find(messages, 'T')) != 1 {
+		t.Fatalf("expected ParseComplete, ParameterDescription and RowDescription, got %v", messages)
+	}
+
+	bind := cstrings("", "byid")
+	bind = append(bind, 0, 0)                  // parameters in text
+	bind = append(bind, 0, 1, 0, 0, 0, 1, '2') // $1 = 2, typed int8 by Parse
+	bind = append(bind, 0, 1, 0, 1)            // results in binary
+	c.send('B', bind)
+	c.send('E', append(cstrings(""), 0, 0, 0, 0))
+	c.send('S', nil)
+	messages = c.until('Z')
+
+	rows = find(messages, 'D')
+	if len(rows) != 1 || binary.BigEndian.Uint64(values(rows[0])[0]) != 2 || strings.Join(tags(messages), ",") != "SELECT 1" {
+		t.Fatalf("expected row 2 in binary, got %v", messages)
+	}
+
+	// Rows of a portal are sent up to the limit of each Execute
+	c.send('P', append(cstrings("", "SELECT * FROM t;"), 0, 0))
+	c.send('B', append(cstrings("", ""), 0, 0, 0, 0, 0, 0))
+	c.send('D', append([]byte{'P'}, cstrings("")...))
+	c.send('E', append(cstrings(""), 0, 0, 0, 1))
+	c.send('E', append(cstrings(""), 0, 0, 0, 1))
+	c.send('S', nil)
+	messages = c.until('Z')
+
+	if len(find(messages, 'D')) != 2 || len(find(messages, 's')) != 1 || strings.Join(tags(messages), ",") != "SELECT 2" {
+		t.Fatalf("expected a row per Execute, got %v", messages)
+	}
+
+	// After an error messages are discarded up to Sync
+	c.send('B', append(cstrings("", "missing"), 0, 0, 0, 0, 0, 0))
+	c.send('E', append(cstrings(""), 0, 0, 0, 0))
+	c.send('S', nil)
+	messages = c.until('Z')
+
+	if e := find(messages, 'E'); len(e) != 1 || fields(e[0])['C'] != "26000" || len(find(messages, 'C')) != 0 {
+		t.Fatalf("expected an error alone, got %v", messages)
+	}
+
+	// The transaction status is reported
+	c.send('Q', cstrings("BEGIN; UPDATE t SET note = 'y' WHERE id = 1;"))
+	messages = c.until('Z')
+
+	if strings.Join(tags(messages), ",") != "BEGIN,UPDATE 1" || messages[len(messages)-1].payload[0] != 'T' {
+		t.Fatalf("expected a transaction begun, got %v", messages)
+	}
+
+	// A cancel request cancels the statement waiting on the transaction's lock
+	ex := executor.New(aria, aria.OpenChannel(aria.Catalog.GetUser("admin")))
+	if err := execute(ex, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- execute(ex, "UPDATE t SET note = 'z' WHERE id = 1;")
+	}()
+
+	c2 := dialPostgres(t, p)
+	c2.startup("admin", "admin", "test")
+	c2.send('Q', cstrings("UPDATE t SET note = 'z' WHERE id = 2;")) // not locked
+	c2.until('Z')
+
+	c3 := dialPostgres(t, p)
+	c3.startup("admin", "admin", "test")
+	c3.send('Q', cstrings("SELECT * FROM t FOR UPDATE;"))
+
+	time.Sleep(200 * time.Millisecond) // waiting on the lock
+
+	cancel := dialPostgres(t, p)
+	cancel.write(binary.BigEndian.AppendUint32(nil, 16), binary.BigEndian.AppendUint32(nil, PG_CANCEL_REQUEST), binary.BigEndian.AppendUint32(nil, c3.pid), binary.BigEndian.AppendUint32(nil, c3.key))
+
+	messages = c3.until('Z')
+	if e := find(messages, 'E'); len(e) != 1 || fields(e[0])['C'] != "57014" {
+		t.Fatalf("expected the statement to be canceled, got %v", messages)
+	}
+
+	c.send('Q', cstrings("ROLLBACK;"))
+	c.until('Z')
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	c.send('X', nil)
+}
+
+func TestPostgresParameterBinding(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	p, err := NewPostgresServer(&TCPServer{aria: aria, Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Start()
+	defer p.Stop()
+
+	c := dialPostgres(t, p)
+	c.startup("admin", "admin", "")
+
+	c.send('Q', cstrings("CREATE DATABASE test; USE test; CREATE TABLE users (name CHAR(50), pw CHAR(50)); INSERT INTO users (name, pw) VALUES ('alice', 'secret');"))
+	c.until('Z')
+
+	// query binds its text parameters and returns the rows
+	query := func(sql string, params ...string) []pgMessage {
+		c.send('P', append(cstrings("", sql), 0, 0))
+
+		bind := append(cstrings("", ""), 0, 0)
+		bind = binary.BigEndian.AppendUint16(bind, uint16(len(params)))
+		for _, param := range params {
+			bind = binary.BigEndian.AppendUint32(bind, uint32(len(param)))
+			bind = append(bind, param...)
+		}
+
+		c.send('B', append(bind, 0, 0))
+		c.send('E', append(cstrings(""), 0, 0, 0, 0))
+		c.send('S', nil)
+
+		return c.until('Z')
+	}
+
+	// A parameter ending in a backslash can't escape its literal, the next parameter is a string too
+	messages := query("SELECT * FROM users WHERE name = $1 AND pw = $2;", "\\", " OR 1 = 1")
+	if len(find(messages, 'E')) != 0 || len(find(messages, 'D')) != 0 {
+		t.Fatalf("expected no rows, got %v", messages)
+	}
+
+	messages = query("INSERT INTO users (name, pw) VALUES ($1, $2);", "bob\\", "'; DROP TABLE users; --")
+	if e := find(messages, 'E'); len(e) != 0 {
+		t.Fatalf("expected the insert to succeed, got %v", fields(e[0]))
+	}
+
+	messages = query("SELECT * FROM users WHERE name = $1;", "bob\\")
+	if rows := find(messages, 'D'); len(rows) != 1 || string(values(rows[0])[1]) != "\\'; DROP TABLE users; --" {
+		t.Fatalf("expected bob's row, got %v", messages)
+	}
+
+	// A parameter of no type is text, it is not read as a number
+	messages = query("INSERT INTO users (name, pw) VALUES ($1, $2);", "carol", "007")
+	if e := find(messages, 'E'); len(e) != 0 {
+		t.Fatalf("expected the insert to succeed, got %v", fields(e[0]))
+	}
+
+	messages = query("SELECT pw FROM users WHERE name = $1;", "carol")
+	if rows := find(messages, 'D'); len(rows) != 1 || string(values(rows[0])[0]) != "007" {
+		t.Fatalf("expected carol's password 007, got %v", messages)
+	}
+}
+
+func TestPostgresDescribeStatement(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	p, err := NewPostgresServer(&TCPServer{aria: aria, Host: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Start()
+	defer p.Stop()
+
+	c := dialPostgres(t, p)
+	c.startup("admin", "admin", "")
+
+	c.send('Q', cstrings("CREATE DATABASE test; USE test; CREATE TABLE t (id INT); INSERT INTO t (id) VALUES (1); BEGIN;"))
+	c.until('Z')
+
+	// Columns the schema does not tell are not found by running the statement, it would lock the rows
+	c.send('P', append(cstrings("locked", "SELECT id AS x FROM t FOR UPDATE;"), 0, 0))
+	c.send('D', append([]byte{'S'}, cstrings("locked")...))
+	c.send('S', nil)
+	messages := c.until('Z')
+
+	if len(find(messages, 'n')) != 1 || len(find(messages, 'T')) != 0 {
+		t.Fatalf("expected NoData, got %v", messages)
+	}
+
+	if locks := aria.Locks.Locks(); len(locks) != 0 {
+		t.Fatalf("expected Describe not to run the statement, got %d locks", len(locks))
+	}
+
+	// Execute describes the rows ahead of them
+	c.send('B', append(cstrings("", "locked"), 0, 0, 0, 0, 0, 0))
+	c.send('E', append(cstrings(""), 0, 0, 0, 0))
+	c.send('S', nil)
+	messages = c.until('Z')
+
+	if len(messages) < 3 || messages[1].typ != 'T' || messages[2].typ != 'D' {
+		t.Fatalf("expected BindComplete, RowDescription and the row, got %v", messages)
+	}
+
+	if names, _, _ := columns(messages[1]); !strings.Contains(strings.Join(names, ","), "x") {
+		t.Fatalf("expected column x, got %v", names)
+	}
+
+	if len(aria.Locks.Locks()) == 0 {
+		t.Fatal("expected Execute to lock the row")
+	}
+}
+
+func TestPostgresScram(t *testing.T) {
+	certs := newTestCerts(t, "svc")
+	aria := openInstance(t, &core.Config{})
+
+	s := &TCPServer{aria: aria, StartTLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey}
+	startTestServer(t, s)
+
+	p, err := NewPostgresServer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Start()
+	defer p.Stop()
+
+	// A user is asked for SCRAM-SHA-256, not for its password
+	c := dialPostgres(t, p)
+	payload := append(binary.BigEndian.AppendUint32(nil, PG_PROTOCOL_VERSION), cstrings("user", "admin", "")...)
+	c.write(binary.BigEndian.AppendUint32(nil, uint32(len(payload)+4)), payload)
+
+	if msg := c.recv(); msg.typ != 'R' || binary.BigEndian.Uint32(msg.payload) != 10 || cstring(msg.payload[4:]) != "SCRAM-SHA-256" {
+		t.Fatalf("expected a SCRAM-SHA-256 request, got %q %q", msg.typ, msg.payload)
+	}
+
+	if msg := c.sasl("admin"); msg.typ != 'R' {
+		t.Fatalf("expected admin to authenticate, got %q %q", msg.typ, msg.payload)
+	}
+
+	// as is a user which does not exist, until it fails
+	messages := dialPostgres(t, p).startup("nobody", "admin", "")
+	if e := find(messages, 'E'); len(e) != 1 || fields(e[0])['C'] != "28P01" {
+		t.Fatalf("expected nobody to fail to authenticate, got %v", messages)
+	}
+
+	// A user created before SCRAM only has a bcrypt hash, its password is not asked for in clear text without TLS
+	hash, err := shared.HashPassword("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aria.Catalog.Users["legacy"] = &catalog.User{Username: "legacy", Password: hash}
+
+	err = aria.Catalog.GrantPrivilegeToUser("legacy", &catalog.Privilege{DatabaseName: "*", TableName: "*", PrivilegeActions: []shared.PrivilegeAction{shared.PRIV_CONNECT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages = dialPostgres(t, p).startup("legacy", "old", "")
+	if e := find(messages, 'E'); len(e) != 1 || fields(e[0])['C'] != "28000" {
+		t.Fatalf("expected legacy to be refused without TLS, got %v", messages)
+	}
+
+	// but over TLS, which migrates it
+	c = dialPostgres(t, p)
+	c.write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), PG_SSL_REQUEST))
+
+	if b, err := c.r.ReadByte(); err != nil || b != 'S' {
+		t.Fatalf("expected SSL to be accepted, got %q %v", b, err)
+	}
+
+	secure := tls.Client(c.conn, &tls.Config{RootCAs: certs.pool, ServerName: "127.0.0.1"})
+	c = &pgClient{t: t, conn: secure, r: bufio.NewReader(secure)}
+
+	if messages := c.startup("legacy", "old", ""); len(find(messages, 'E')) != 0 {
+		t.Fatalf("expected legacy to authenticate over TLS, got %v", messages)
+	}
+
+	if legacy := aria.Catalog.GetUser("legacy"); legacy.Scram == nil {
+		t.Fatal("expected legacy to be migrated")
+	}
+
+	if messages := dialPostgres(t, p).startup("legacy", "old", ""); len(find(messages, 'E')) != 0 {
+		t.Fatalf("expected legacy to authenticate with SCRAM, got %v", messages)
+	}
+}
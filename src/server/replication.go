@@ -0,0 +1,285 @@
+// Package server replication
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/core"
+	"ariasql/executor"
+	"ariasql/wal"
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ReplicationServer receives the WAL stream of a primary on a replica and applies it
+type ReplicationServer struct {
+	aria     *core.AriaSQL             // AriaSQL instance pointer
+	config   *core.ReplicationListener // Listener configuration
+	listener net.Listener              // Replication listener
+	lock     sync.Mutex                // Guards conn
+	conn     net.Conn                  // Connection of the primary currently streaming, nil if none
+	streams  sync.WaitGroup            // Held by the connection of the primary currently streaming until it stops applying records
+	replayer *executor.Replayer        // Applies the stream, kept across connections so the transactions a lost connection left open go on once the primary resumes
+	done     chan struct{}             // Closed when the server is stopped
+	stop     sync.Once                 // Stops the server once
+}
+
+// NewReplicationServer creates a new ReplicationServer listening as configured by the instance's replication listener
+func NewReplicationServer(aria *core.AriaSQL) (*ReplicationServer, error) {
+	config := aria.Config.Replication
+	if config == nil {
+		return nil, errors.New("replication listener is not configured")
+	}
+
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+
+	var listener net.Listener
+	var err error
+
+	if config.TLS {
+		tlsConfig, err := replicationTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+
+		listener, err = tls.Listen("tcp", addr, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		listener, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s := &ReplicationServer{aria: aria, config: config, listener: listener, done: make(chan struct{})}
+
+	// Once promoted the stream of the old primary is no longer applied
+	aria.OnPromote(s.Stop)
+
+	return s, nil
+}
+
+// replicationTLSConfig returns the TLS configuration of a replication listener
+func replicationTLSConfig(config *core.ReplicationListener) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	// With a CA configured the primary must present a certificate signed by it
+	if config.TLSCA != "" {
+		ca, err := os.ReadFile(config.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("invalid replication CA certificate")
+		}
+
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// trusted returns true if a primary may stream without a secret, it connects from this host or presented a certificate signed by the configured CA
+func (s *ReplicationServer) trusted(conn net.Conn) bool {
+	if _, ok := conn.(*tls.Conn); ok && s.config.TLSCA != "" {
+		return true // the handshake verified the primary's certificate
+	}
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && addr.IP.IsLoopback()
+}
+
+// Addr returns the address the replication server listens on
+func (s *ReplicationServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Start accepts primaries until the server is stopped or the instance is promoted to primary
+func (s *ReplicationServer) Start() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+// Stop stops the replication server, closing the connection of the primary
+// Once the stream is no longer applied the transactions the primary left open are rolled back
+func (s *ReplicationServer) Stop() {
+	s.stop.Do(func() {
+		s.lock.Lock()
+		close(s.done)
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		s.lock.Unlock()
+
+		s.listener.Close()
+		s.streams.Wait()
+
+		if s.replayer != nil {
+			s.replayer.Close()
+		}
+	})
+}
+
+// handleConnection authenticates a primary and applies the records it streams
+func (s *ReplicationServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(core.REPLICATION_HANDSHAKE_TIMEOUT))
+
+	hs, err := core.ReadReplicationHandshake(conn)
+	if err != nil {
+		log.Printf("replication from %s: %s", conn.RemoteAddr(), err.Error())
+		return
+	}
+
+	if s.config.Secret != "" && subtle.ConstantTimeCompare([]byte(hs.Secret), []byte(s.config.Secret)) != 1 {
+		log.Printf("replication from %s: secret denied", conn.RemoteAddr())
+		core.WriteReplicationStatus(conn, core.REPLICATION_DENIED, 0)
+		return
+	}
+
+	if s.config.Secret == "" && !s.trusted(conn) {
+		log.Printf("replication from %s: denied, a secret is required for primaries on other hosts", conn.RemoteAddr())
+		core.WriteReplicationStatus(conn, core.REPLICATION_DENIED, 0)
+		return
+	}
+
+	// Only one primary streams at a time
+	s.lock.Lock()
+	select {
+	case <-s.done:
+		s.lock.Unlock()
+		return
+	default:
+	}
+	if s.conn != nil {
+		s.lock.Unlock()
+		core.WriteReplicationStatus(conn, core.REPLICATION_BUSY, 0)
+		return
+	}
+	s.conn = conn
+	s.streams.Add(1)
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.conn = nil
+		s.lock.Unlock()
+
+		s.streams.Done()
+	}()
+
+	if !s.aria.ReadOnly() {
+		core.WriteReplicationStatus(conn, core.REPLICATION_PRIMARY, s.aria.WAL.LSN())
+		return
+	}
+
+	// A primary on a newer timeline is followed as long as this replica did not apply records past its start
+	err = s.aria.FollowTimeline(hs.Timeline, hs.History)
+	if err != nil {
+		log.Printf("replication from %s: %s", conn.RemoteAddr(), err.Error())
+		core.WriteReplicationStatus(conn, core.REPLICATION_DIVERGED, s.aria.WAL.LSN())
+		return
+	}
+
+	// The primary resumes after the last record this replica applied
+	err = core.WriteReplicationStatus(conn, core.REPLICATION_OK, s.aria.WAL.LSN())
+	if err != nil {
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	if s.replayer == nil {
+		user := s.aria.Catalog.GetUser("admin") // will bypass privileges as records are replayed
+		if user == nil {
+			log.Println("replication: admin user not found")
+			return
+		}
+
+		s.replayer = executor.NewReplayer(s.aria, user)
+	}
+
+	r := bufio.NewReader(conn)
+
+	for {
+		rec, err := wal.ReadRecord(r)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Printf("replication from %s: %s", conn.RemoteAddr(), err.Error())
+			}
+			return
+		}
+
+		// Once promoted the stream of the old primary is no longer applied
+		if !s.aria.ReadOnly() {
+			return
+		}
+
+		err = s.replayer.Apply(rec)
+		if err != nil {
+			log.Printf("replication from %s: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+
+		// Records are acknowledged once flushed, acknowledgements cover the records before them so the records read in one go share a flush
+		if r.Buffered() > 0 {
+			continue
+		}
+
+		err = s.aria.WAL.Sync(rec.LSN)
+		if err != nil {
+			log.Printf("replication from %s: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+
+		err = core.WriteReplicationAck(conn, rec.LSN)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,446 @@
+// Package server replication tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/catalog"
+	"ariasql/core"
+	"ariasql/executor"
+	"ariasql/parser"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openInstance opens an AriaSQL instance within a temporary directory
+func openInstance(t *testing.T, config *core.Config) *core.AriaSQL {
+	config.DataDir = t.TempDir()
+
+	aria, err := core.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aria.Catalog = catalog.New(aria.Config.DataDir)
+
+	if err := aria.Catalog.Open(); err != nil {
+		t.Fatal(err)
+	}
+
+	aria.Channels = make([]*core.Channel, 0)
+	aria.ChannelsLock = &sync.Mutex{}
+
+	t.Cleanup(func() { aria.Close() })
+
+	return aria
+}
+
+// execute parses and executes a statement
+func execute(ex *executor.Executor, sql string) error {
+	stmt, err := parser.NewParser(parser.NewLexer([]byte(sql))).Parse()
+	if err != nil {
+		return err
+	}
+
+	return ex.Execute(stmt)
+}
+
+// waitForLSN waits until the instance's WAL reaches lsn
+func waitForLSN(t *testing.T, aria *core.AriaSQL, lsn uint64) {
+	deadline := time.Now().Add(10 * time.Second)
+
+	for aria.WAL.LSN() < lsn {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected replica at LSN %d, got %d", lsn, aria.WAL.LSN())
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	replica := openInstance(t, &core.Config{Replication: &core.ReplicationListener{Host: "127.0.0.1", Secret: "secret"}})
+
+	rs, err := NewReplicationServer(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Stop()
+
+	go rs.Start()
+
+	primary := openInstance(t, &core.Config{Replicas: []*core.Replica{{
+		Host:   "127.0.0.1",
+		Port:   rs.Addr().(*net.TCPAddr).Port,
+		Secret: "secret",
+	}}})
+
+	pex := executor.New(primary, primary.OpenChannel(primary.Catalog.GetUser("admin")))
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (a INT);",
+		"INSERT INTO t (a) VALUES (1);",
+	} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	primary.StartReplication()
+
+	waitForLSN(t, replica, primary.WAL.LSN())
+
+	if !primary.ReplicaStreams()[0].Connected() {
+		t.Fatal("expected replica to be connected")
+	}
+
+	rex := executor.New(replica, replica.OpenChannel(replica.Catalog.GetUser("admin")))
+
+	if err := execute(rex, "USE test;"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := execute(rex, "INSERT INTO t (a) VALUES (3);"); err == nil {
+		t.Fatal("expected replica to reject writes")
+	}
+
+	// The replica resumes from its last applied record
+	primary.StopReplication()
+
+	if err := execute(pex, "INSERT INTO t (a) VALUES (2);"); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.StartReplication()
+
+	waitForLSN(t, replica, primary.WAL.LSN())
+
+	rex.SetJsonOutput(true)
+
+	if err := execute(rex, "SELECT * FROM t;"); err != nil {
+		t.Fatal(err)
+	}
+
+	result := string(rex.GetResultSet())
+	if !strings.Contains(result, `"a":1`) || !strings.Contains(result, `"a":2`) || strings.Contains(result, `"a":3`) {
+		t.Fatalf("unexpected replica rows %s", result)
+	}
+
+	records, err := replica.WAL.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 5 || records[4].LSN != 5 {
+		t.Fatalf("expected replica WAL to mirror the primary's 5 records, got %d", len(records))
+	}
+}
+
+func TestReplicationResumeTransaction(t *testing.T) {
+	replica := openInstance(t, &core.Config{Replication: &core.ReplicationListener{Host: "127.0.0.1"}})
+
+	rs, err := NewReplicationServer(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Stop()
+
+	go rs.Start()
+
+	primary := openInstance(t, &core.Config{Replicas: []*core.Replica{{
+		Host: "127.0.0.1",
+		Port: rs.Addr().(*net.TCPAddr).Port,
+	}}})
+
+	primary.StartReplication()
+
+	pex := executor.New(primary, primary.OpenChannel(primary.Catalog.GetUser("admin")))
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (a INT);",
+		"BEGIN;",
+		"INSERT INTO t (a) VALUES (1);",
+	} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	waitForLSN(t, replica, primary.WAL.LSN())
+
+	// The connection is lost within the transaction, the primary resumes after the last record applied
+	primary.StopReplication()
+
+	for _, sql := range []string{"INSERT INTO t (a) VALUES (2);", "COMMIT;"} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	primary.StartReplication()
+	defer primary.StopReplication()
+
+	waitForLSN(t, replica, primary.WAL.LSN())
+
+	rex := executor.New(replica, replica.OpenChannel(replica.Catalog.GetUser("admin")))
+	rex.SetJsonOutput(true)
+
+	for _, sql := range []string{"USE test;", "SELECT * FROM t;"} {
+		if err := execute(rex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	result := string(rex.GetResultSet())
+	if !strings.Contains(result, `"a":1`) || !strings.Contains(result, `"a":2`) {
+		t.Fatalf("expected the transaction to commit on the replica, got %s", result)
+	}
+
+	// A transaction the primary left open is rolled back once the stream is no longer applied
+	for _, sql := range []string{"BEGIN;", "UPDATE t SET a = 3 WHERE a = 1;"} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	waitForLSN(t, replica, primary.WAL.LSN())
+
+	if len(replica.Transactions.Running()) != 1 {
+		t.Fatalf("expected the transaction to be open on the replica, got %v", replica.Transactions.Running())
+	}
+
+	rs.Stop()
+
+	if running := replica.Transactions.Running(); len(running) != 0 {
+		t.Fatalf("expected the transaction to be rolled back on the replica, got %v", running)
+	}
+}
+
+func TestReplicationDenied(t *testing.T) {
+	replica := openInstance(t, &core.Config{Replication: &core.ReplicationListener{Host: "127.0.0.1", Secret: "secret"}})
+
+	rs, err := NewReplicationServer(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Stop()
+
+	go rs.Start()
+
+	conn, err := net.Dial("tcp", rs.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	err = core.WriteReplicationHandshake(conn, &core.ReplicationHandshake{Secret: "wrong", Timeline: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = core.ReadReplicationStatus(conn)
+	if err == nil {
+		t.Fatal("expected secret to be denied")
+	}
+}
+
+func TestReplicationSecretRequired(t *testing.T) {
+	replica := openInstance(t, &core.Config{Replication: &core.ReplicationListener{Host: "127.0.0.1"}})
+
+	rs, err := NewReplicationServer(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Stop()
+
+	// Without a secret a primary on another host is denied, a pipe is no loopback connection
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go rs.handleConnection(server)
+
+	err = core.WriteReplicationHandshake(client, &core.ReplicationHandshake{Timeline: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = core.ReadReplicationStatus(client)
+	if err == nil {
+		t.Fatal("expected a primary on another host to be denied without a secret")
+	}
+}
+
+func TestReplicationPromote(t *testing.T) {
+	replica := openInstance(t, &core.Config{Replication: &core.ReplicationListener{Host: "127.0.0.1"}})
+
+	rs, err := NewReplicationServer(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rs.Stop()
+
+	go rs.Start()
+
+	primary := openInstance(t, &core.Config{Replicas: []*core.Replica{{
+		Host: "127.0.0.1",
+		Port: rs.Addr().(*net.TCPAddr).Port,
+	}}})
+
+	primary.StartReplication()
+
+	pex := executor.New(primary, primary.OpenChannel(primary.Catalog.GetUser("admin")))
+
+	// The old primary fails within a transaction
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (a INT);",
+		"BEGIN;",
+		"INSERT INTO t (a) VALUES (2);",
+	} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	waitForLSN(t, replica, primary.WAL.LSN())
+
+	rex := executor.New(replica, replica.OpenChannel(replica.Catalog.GetUser("admin")))
+
+	if err := execute(rex, "PROMOTE;"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Its unfinished transaction is rolled back before the promoted replica takes writes
+	if running := replica.Transactions.Running(); len(running) != 0 {
+		t.Fatalf("expected the old primary's transaction to be rolled back, got %v", running)
+	}
+
+	if timeline, _ := replica.Timeline(); timeline != 2 {
+		t.Fatalf("expected timeline 2, got %d", timeline)
+	}
+
+	// The promoted replica takes writes and no longer listens for its old primary
+	for _, sql := range []string{
+		"USE test;",
+		"INSERT INTO t (a) VALUES (1);",
+	} {
+		if err := execute(rex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		conn, err := net.Dial("tcp", rs.Addr().String())
+		if err != nil {
+			break
+		}
+
+		conn.Close()
+
+		if time.Now().After(deadline) {
+			t.Fatal("expected replication listener to be closed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := execute(rex, "PROMOTE;"); err == nil {
+		t.Fatal("expected error promoting a primary")
+	}
+}
+
+func TestSynchronousReplication(t *testing.T) {
+	replica := openInstance(t, &core.Config{Replication: &core.ReplicationListener{Host: "127.0.0.1"}})
+
+	rs, err := NewReplicationServer(replica)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go rs.Start()
+
+	primary := openInstance(t, &core.Config{
+		Replicas: []*core.Replica{{
+			Host: "127.0.0.1",
+			Port: rs.Addr().(*net.TCPAddr).Port,
+		}},
+		SynchronousReplicas: 1,
+		SynchronousTimeout:  500 * time.Millisecond,
+		SynchronousFallback: core.SYNCHRONOUS_FALLBACK_ERROR,
+	})
+
+	primary.StartReplication()
+
+	pex := executor.New(primary, primary.OpenChannel(primary.Catalog.GetUser("admin")))
+
+	for _, sql := range []string{
+		"CREATE DATABASE test;",
+		"USE test;",
+		"CREATE TABLE t (a INT);",
+		"BEGIN;",
+		"INSERT INTO t (a) VALUES (1);",
+		"COMMIT;",
+	} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	// The commit returned after the replica applied and flushed it
+	if replica.WAL.LSN() != primary.WAL.LSN() || replica.WAL.Synced() != primary.WAL.LSN() {
+		t.Fatalf("expected replica flushed to LSN %d once COMMIT returned, got %d flushed to %d", primary.WAL.LSN(), replica.WAL.LSN(), replica.WAL.Synced())
+	}
+
+	// Without the replica the commit times out
+	rs.Stop()
+
+	for _, sql := range []string{"BEGIN;", "INSERT INTO t (a) VALUES (2);"} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if err := execute(pex, "COMMIT;"); err == nil {
+		t.Fatal("expected COMMIT to time out waiting for the replica")
+	}
+
+	// The session can commit asynchronously
+	for _, sql := range []string{"SET synchronous_replicas = 0;", "BEGIN;", "INSERT INTO t (a) VALUES (3);", "COMMIT;"} {
+		if err := execute(pex, sql); err != nil {
+			t.Fatalf("%s: %s", sql, err)
+		}
+	}
+
+	if err := execute(pex, "SET no_such_setting = 1;"); err == nil {
+		t.Fatal("expected error for unknown setting")
+	}
+}
@@ -0,0 +1,212 @@
+// Package server SCRAM-SHA-256 authentication
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/protocol"
+	"ariasql/shared"
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const SCRAM_NONCE_SIZE = 18 // Random bytes of the server's part of the nonce
+
+// scramMockKey salts the mock verifiers of users that do not exist, the same user always gets the same salt
+var scramMockKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// scramMockVerifier returns a verifier no proof matches, the exchange of a user that does not exist looks like any other until it fails
+func scramMockVerifier(username string) *shared.ScramVerifier {
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	return &shared.ScramVerifier{
+		Salt:       shared.ScramHMAC(scramMockKey, username)[:shared.SCRAM_SALT_SIZE],
+		Iterations: shared.SCRAM_ITERATIONS,
+		StoredKey:  key,
+		ServerKey:  key,
+	}
+}
+
+// errScramProof is returned by a SCRAM exchange whose client did not prove it knows the password
+var errScramProof = errors.New("authentication failed")
+
+// scramExchange is a SCRAM-SHA-256 exchange against a user's verifier, its messages are carried by the protocol the user logs in with
+type scramExchange struct {
+	verifier    *shared.ScramVerifier
+	gs2         string // gs2-header of the client-first-message
+	bare        string // client-first-message-bare
+	nonce       string // Client nonce followed by the server's
+	serverFirst string // server-first-message
+}
+
+// first answers the client-first-message with the server-first-message
+func (e *scramExchange) first(clientFirst string) (string, error) {
+	// gs2-header then client-first-message-bare, n=user,r=nonce
+	gs2, bare, err := parseScramClientFirst(clientFirst)
+	if err != nil {
+		return "", err
+	}
+
+	clientNonce, _ := scramAttribute(bare, 'r')
+
+	b := make([]byte, SCRAM_NONCE_SIZE)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	e.gs2 = gs2
+	e.bare = bare
+	e.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(b)
+	e.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", e.nonce, base64.StdEncoding.EncodeToString(e.verifier.Salt), e.verifier.Iterations)
+
+	return e.serverFirst, nil
+}
+
+// final checks the client-final-message and answers it with the server-final-message, errScramProof if the proof does not match
+func (e *scramExchange) final(clientFinal string) (string, error) {
+	// c=channel binding,r=nonce,p=proof, the proof is last and not part of the auth message
+	i := strings.LastIndex(clientFinal, ",p=")
+	if i < 0 {
+		return "", errors.New("expected a SCRAM client-final-message")
+	}
+
+	withoutProof := clientFinal[:i]
+
+	binding, _ := scramAttribute(withoutProof, 'c')
+	if binding != base64.StdEncoding.EncodeToString([]byte(e.gs2)) {
+		return "", errors.New("SCRAM channel binding does not match")
+	}
+
+	if finalNonce, _ := scramAttribute(withoutProof, 'r'); finalNonce != e.nonce {
+		return "", errors.New("SCRAM nonce does not match")
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[i+3:])
+	if err != nil {
+		return "", errors.New("malformed SCRAM proof")
+	}
+
+	authMessage := e.bare + "," + e.serverFirst + "," + withoutProof
+
+	if !e.verifier.VerifyProof(authMessage, proof) {
+		return "", errScramProof
+	}
+
+	return "v=" + base64.StdEncoding.EncodeToString(e.verifier.ServerSignature(authMessage)), nil
+}
+
+// scram runs a SCRAM-SHA-256 exchange against a user's verifier, unless the client proves it knows the password an error is written and returned
+func (s *TCPServer) scram(username string, verifier *shared.ScramVerifier, r io.Reader, w *bufio.Writer) error {
+	exchange := &scramExchange{verifier: verifier}
+
+	clientFirst, err := scramMessage(r, w, []byte{protocol.AUTH_SCRAM_SHA_256})
+	if err != nil {
+		return err
+	}
+
+	serverFirst, err := exchange.first(clientFirst)
+	if err != nil {
+		return fail(w, protocol.ERROR_PROTOCOL, err.Error())
+	}
+
+	clientFinal, err := scramMessage(r, w, append([]byte{protocol.AUTH_SCRAM_CONTINUE}, serverFirst...))
+	if err != nil {
+		return err
+	}
+
+	serverFinal, err := exchange.final(clientFinal)
+	if err == errScramProof {
+		s.aria.Catalog.LoginFailed(username) // counts the failure and waits before it is answered
+		return fail(w, protocol.ERROR_AUTHENTICATION, "authentication failed")
+	} else if err != nil {
+		return fail(w, protocol.ERROR_PROTOCOL, err.Error())
+	}
+
+	return protocol.WriteMessage(w, protocol.AUTHENTICATION, append([]byte{protocol.AUTH_SCRAM_FINAL}, serverFinal...))
+}
+
+// scramMessage writes an authentication message and reads the client's answer
+func scramMessage(r io.Reader, w *bufio.Writer, payload []byte) (string, error) {
+	err := protocol.WriteMessage(w, protocol.AUTHENTICATION, payload)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	msg, err := protocol.ReadMessage(r)
+	if err != nil {
+		return "", err
+	}
+
+	if msg.Type != protocol.PASSWORD {
+		return "", fail(w, protocol.ERROR_PROTOCOL, "expected a SCRAM message")
+	}
+
+	return string(msg.Payload), nil
+}
+
+// parseScramClientFirst splits a client-first-message into its gs2-header and its bare message
+func parseScramClientFirst(msg string) (string, string, error) {
+	// n,, or y,, the client does not bind the channel, p= asks for a binding the server does not offer
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return "", "", errors.New("unsupported SCRAM channel binding, expected n or y")
+	}
+
+	if parts[1] != "" {
+		return "", "", errors.New("SCRAM authorization identities are not supported")
+	}
+
+	bare := parts[2]
+
+	if !strings.HasPrefix(bare, "n=") {
+		return "", "", errors.New("expected a SCRAM client-first-message")
+	}
+
+	if nonce, ok := scramAttribute(bare, 'r'); !ok || nonce == "" {
+		return "", "", errors.New("expected a SCRAM client nonce")
+	}
+
+	if _, ok := scramAttribute(bare, 'm'); ok {
+		return "", "", errors.New("SCRAM extensions are not supported")
+	}
+
+	return parts[0] + ",,", bare, nil
+}
+
+// scramAttribute returns the value of an attribute of a SCRAM message
+func scramAttribute(msg string, name byte) (string, bool) {
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:], true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,288 @@
+// Package server SCRAM-SHA-256 authentication tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/catalog"
+	"ariasql/core"
+	"ariasql/protocol"
+	"ariasql/shared"
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scramLogin answers a SCRAM-SHA-256 authentication request and returns the server's message following the exchange
+func scramLogin(t *testing.T, client net.Conn, password string) *protocol.Message {
+	clientFirstBare := "n=,r=fyko+d2lbbFgONRv9qkxdawL"
+	send(t, client, protocol.PASSWORD, []byte("n,,"+clientFirstBare))
+
+	msg := receive(t, client)
+	if msg.Type != protocol.AUTHENTICATION || msg.Payload[0] != protocol.AUTH_SCRAM_CONTINUE {
+		return msg
+	}
+
+	serverFirst := string(msg.Payload[1:])
+
+	var nonce string
+	var salt []byte
+	var iterations int
+
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt, _ = base64.StdEncoding.DecodeString(attr[2:])
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+
+	if !strings.HasPrefix(nonce, "fyko+d2lbbFgONRv9qkxdawL") || len(salt) == 0 || iterations == 0 {
+		t.Fatalf("unexpected server-first-message %s", serverFirst)
+	}
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := shared.ScramClientProof(password, salt, iterations, authMessage)
+
+	send(t, client, protocol.PASSWORD, []byte(withoutProof+",p="+base64.StdEncoding.EncodeToString(proof)))
+
+	msg = receive(t, client)
+	if msg.Type != protocol.AUTHENTICATION {
+		return msg
+	}
+
+	// The server proves it knows the verifier too
+	_, serverKey := shared.ScramKeys(password, salt, iterations)
+
+	if msg.Payload[0] != protocol.AUTH_SCRAM_FINAL || string(msg.Payload[1:]) != "v="+base64.StdEncoding.EncodeToString(shared.ScramHMAC(serverKey, authMessage)) {
+		t.Fatalf("unexpected server-final-message %q", msg.Payload)
+	}
+
+	return receive(t, client)
+}
+
+// dial serves a connection of the framed protocol over a pipe
+func dial(t *testing.T, aria *core.AriaSQL) net.Conn {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	go (&TCPServer{aria: aria}).handleConnection(server)
+
+	return client
+}
+
+func TestScramAuthentication(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	if e := framedLogin(t, dial(t, aria), "admin", "admin"); e != nil {
+		t.Fatal(e)
+	}
+
+	// The password is no longer kept
+	if admin := aria.Catalog.GetUser("admin"); admin.Password != "" || admin.Scram == nil {
+		t.Fatalf("expected only a SCRAM verifier, got %+v", admin)
+	}
+
+	if e := framedLogin(t, dial(t, aria), "admin", "wrong"); e == nil || e.Code != protocol.ERROR_AUTHENTICATION {
+		t.Fatalf("expected a wrong password to fail, got %v", e)
+	}
+
+	// A user that does not exist is asked for SCRAM like any other
+	if e := framedLogin(t, dial(t, aria), "nobody", "admin"); e == nil || e.Code != protocol.ERROR_AUTHENTICATION {
+		t.Fatalf("expected an unknown user to fail, got %v", e)
+	}
+
+	// A password with the text protocol's separator in it
+	if err := aria.Catalog.CreateNewUser("bob", `p\0w`); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := framedLogin(t, dial(t, aria), "bob", `p\0w`); e == nil || e.Code != protocol.ERROR_PRIVILEGE {
+		t.Fatalf("expected bob to authenticate without CONNECT, got %v", e)
+	}
+
+	// Channel binding is not offered
+	client := dial(t, aria)
+	send(t, client, protocol.STARTUP, protocol.EncodeStartup("admin"))
+	receive(t, client)
+	send(t, client, protocol.PASSWORD, []byte("p=tls-server-end-point,,n=,r=abc"))
+
+	msg := receive(t, client)
+	if e, _ := protocol.DecodeError(msg.Payload); msg.Type != protocol.ERROR || e.Code != protocol.ERROR_PROTOCOL {
+		t.Fatalf("expected channel binding to be refused, got %q", msg.Payload)
+	}
+}
+
+func TestScramMigration(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	// A user created before SCRAM only has a bcrypt hash
+	hash, err := shared.HashPassword("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aria.Catalog.Users["legacy"] = &catalog.User{Username: "legacy", Password: hash}
+
+	err = aria.Catalog.GrantPrivilegeToUser("legacy", &catalog.Privilege{DatabaseName: "*", TableName: "*", PrivilegeActions: []shared.PrivilegeAction{shared.PRIV_CONNECT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// and is asked for its password
+	client := dial(t, aria)
+	send(t, client, protocol.STARTUP, protocol.EncodeStartup("legacy"))
+
+	if msg := receive(t, client); msg.Type != protocol.AUTHENTICATION || msg.Payload[0] != protocol.AUTH_PASSWORD {
+		t.Fatalf("expected a password request, got %q", msg.Payload)
+	}
+
+	send(t, client, protocol.PASSWORD, []byte("old"))
+
+	if msg := receive(t, client); msg.Type != protocol.AUTHENTICATED {
+		t.Fatalf("expected legacy to authenticate, got %q", msg.Payload)
+	}
+
+	// once, its password is then migrated to a SCRAM verifier
+	if legacy := aria.Catalog.GetUser("legacy"); legacy.Password != "" || legacy.Scram == nil {
+		t.Fatalf("expected legacy to be migrated, got %+v", legacy)
+	}
+
+	// and expires counting from the migration
+	if legacy := aria.Catalog.GetUser("legacy"); legacy.PasswordChanged.IsZero() {
+		t.Fatal("expected the migration to set when the password was changed")
+	}
+
+	client = dial(t, aria)
+	send(t, client, protocol.STARTUP, protocol.EncodeStartup("legacy"))
+
+	msg := receive(t, client)
+	if msg.Type != protocol.AUTHENTICATION || msg.Payload[0] != protocol.AUTH_SCRAM_SHA_256 {
+		t.Fatalf("expected SCRAM, got %q", msg.Payload)
+	}
+
+	if msg = scramLogin(t, client, "old"); msg.Type != protocol.AUTHENTICATED {
+		t.Fatalf("expected legacy to authenticate with SCRAM, got %q", msg.Payload)
+	}
+
+	// The verifier survives a restart
+	if err := aria.Catalog.ReadUsersFromFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := aria.Catalog.AuthenticateUser("legacy", "old"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+	aria.Catalog.LoginPolicy = &catalog.LoginPolicy{MaxFailedLogins: 3, LockoutDuration: time.Hour, FailedLoginDelay: 50 * time.Millisecond}
+
+	if err := aria.Catalog.CreateNewUser("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := aria.Catalog.GrantPrivilegeToUser("bob", &catalog.Privilege{DatabaseName: "*", TableName: "*", PrivilegeActions: []shared.PrivilegeAction{shared.PRIV_CONNECT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed login is answered later the more the user failed
+	for i := 1; i <= 2; i++ {
+		start := time.Now()
+
+		if e := framedLogin(t, dial(t, aria), "bob", "wrong"); e == nil || e.Message != "authentication failed" {
+			t.Fatalf("expected a wrong password to fail, got %v", e)
+		}
+
+		if elapsed := time.Since(start); elapsed < time.Duration(i)*50*time.Millisecond {
+			t.Fatalf("expected failure %d to be delayed, answered after %s", i, elapsed)
+		}
+	}
+
+	// A user name which does not exist is answered as late
+	for i := 1; i <= 2; i++ {
+		start := time.Now()
+
+		if e := framedLogin(t, dial(t, aria), "nobody", "wrong"); e == nil {
+			t.Fatal("expected nobody to fail to log in")
+		}
+
+		if elapsed := time.Since(start); elapsed < time.Duration(i)*50*time.Millisecond {
+			t.Fatalf("expected failure %d of nobody to be delayed like bob's, answered after %s", i, elapsed)
+		}
+	}
+
+	// A success resets the count
+	if e := framedLogin(t, dial(t, aria), "bob", "secret"); e != nil {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 3; i++ {
+		framedLogin(t, dial(t, aria), "bob", "wrong")
+	}
+
+	// The third failure in a row locks bob out, even with the right password
+	if e := framedLogin(t, dial(t, aria), "bob", "secret"); e == nil || e.Message != "account is locked" {
+		t.Fatalf("expected bob to be locked out, got %v", e)
+	}
+
+	if _, err := aria.Catalog.AuthenticateUser("bob", "secret"); err != catalog.ErrAccountLocked {
+		t.Fatalf("expected bob to be locked out of every protocol, got %v", err)
+	}
+
+	// until unlocked
+	if err := aria.Catalog.LockUser("bob", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := framedLogin(t, dial(t, aria), "bob", "secret"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestLoginDefaultPolicy(t *testing.T) {
+	aria := openInstance(t, &core.Config{})
+
+	// The default policy with shorter delays
+	policy := catalog.DefaultLoginPolicy
+	policy.FailedLoginDelay = time.Millisecond
+	policy.MaxLoginDelay = time.Millisecond
+	aria.Catalog.LoginPolicy = &policy
+
+	if err := aria.Catalog.CreateNewUser("bob", "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := aria.Catalog.AuthenticateUser("bob", "wrong"); err == nil {
+			t.Fatal("expected a wrong password to fail")
+		}
+	}
+
+	// Accounts are only locked out once the policy sets MaxFailedLogins
+	if _, err := aria.Catalog.AuthenticateUser("bob", "secret"); err != nil {
+		t.Fatalf("expected bob not to be locked out, got %v", err)
+	}
+}
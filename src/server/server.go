@@ -18,31 +18,51 @@
 package server
 
 import (
+	"ariasql/catalog"
 	"ariasql/core"
 	"ariasql/executor"
 	"ariasql/parser"
 	"ariasql/shared"
 	"bytes"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 // TCPServer is the main AriaSQL Server structure
 type TCPServer struct {
 	Port       int    // Port to listen on, default is 3695
 	Host       string // Host to listen on, default is 0.0.0.0
-	listener   *net.TCPListener
+	listener   net.Listener
 	addr       *net.TCPAddr
 	aria       *core.AriaSQL // AriaSQL instance pointer
 	BufferSize int           // Buffer size for reading from the connection, default is 1024
-	TLS        bool          // Enable TLS, default is false
+	TLS        bool          // Enable TLS, every connection is TLS from its first byte, default is false
 	TLSCert    string        // TLS certificate file
 	TLSKey     string        // TLS key file
-	json       bool          // Enable JSON output, default is false
+	// StartTLS lets clients of a server without TLS enabled upgrade their connection to TLS before the startup message
+	StartTLS             bool
+	TLSMinVersion        string      // Lowest TLS version accepted, 1.0, 1.1, 1.2 or 1.3, default is 1.2
+	TLSCipherSuites      []string    // Cipher suites accepted below TLS 1.3, i.e. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, Go's defaults if empty
+	TLSClientCA          string      // CA bundle file client certificates are verified against, client certificates are not asked for if empty
+	TLSRequireClientCert bool        // Refuse clients without a certificate verified against TLSClientCA
+	tlsConfig            *tls.Config // TLS configuration of the files and settings above, nil if TLS and StartTLS are disabled
+	json                 bool        // Enable JSON output, default is false
+	// TextProtocol serves the old protocol, base64 credentials then a statement per read answered with text, instead of framed messages
+	TextProtocol bool
+	// Timeouts of every session, SET statement_timeout, lock_timeout and idle_in_transaction_timeout override them per session
+	StatementTimeout         time.Duration // A statement running longer is canceled and the transaction begun rolled back, 0 is no limit
+	LockTimeout              time.Duration // A statement waiting longer for a lock fails, LockTimeout of ariaconf.yaml applies if 0
+	IdleInTransactionTimeout time.Duration // A transaction left idle longer is rolled back, 0 is no limit
+	PostgresPort             int           // Port of the PostgreSQL protocol listener, 0 disables it
+	HTTPPort                 int           // Port of the HTTP API listener, 0 disables it
 }
 
 // NewTCPServer creates a new TCPServer
@@ -57,18 +77,13 @@ func NewTCPServer(port int, host string, aria *core.AriaSQL, bufferSize int) (*T
 	// if it doesn't, create it with the default values
 
 	if _, err := os.Stat(fmt.Sprintf("%s%sariaserver.yaml", aria.Config.DataDir, shared.GetOsPathSeparator())); os.IsNotExist(err) {
-		// Resolve the string address to a TCP address
-		tcpAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", host, port))
-		if err != nil {
-			return nil, err
-		}
+		server := &TCPServer{Port: port, Host: host, aria: aria, BufferSize: bufferSize}
 
 		// Start listening for TCP connections on the given address
-		listener, err := net.ListenTCP("tcp", tcpAddr)
+		err = server.listen()
 		if err != nil {
 			return nil, err
 		}
-		server := &TCPServer{Port: port, Host: host, listener: listener, addr: tcpAddr, aria: aria, BufferSize: bufferSize}
 
 		// create a new file
 		f, err := os.Create(fmt.Sprintf("%s%sariaserver.yaml", aria.Config.DataDir, shared.GetOsPathSeparator()))
@@ -108,33 +123,56 @@ func NewTCPServer(port int, host string, aria *core.AriaSQL, bufferSize int) (*T
 			return nil, err
 		}
 
-		// Resolve the string address to a TCP address
-		tcpAddr, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", server.Host, server.Port))
-		if err != nil {
-			return nil, err
-		}
+		server.aria = aria
 
 		// Start listening for TCP connections on the given address
-		listener, err := net.ListenTCP("tcp", tcpAddr)
+		err = server.listen()
 		if err != nil {
 			return nil, err
 		}
 
-		server.aria = aria
-		server.listener = listener
-		server.addr = tcpAddr
-
 		return &server, nil
 
 	}
 
 }
 
+// listen listens on the server's host and port, connections are TLS from their first byte if TLS is enabled
+func (s *TCPServer) listen() error {
+	var err error
+
+	s.tlsConfig, err = s.loadTLS()
+	if err != nil {
+		return err
+	}
+
+	// Resolve the string address to a TCP address
+	s.addr, err = net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", s.Host, s.Port))
+	if err != nil {
+		return err
+	}
+
+	s.listener, err = net.ListenTCP("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	if s.TLS {
+		s.listener = tls.NewListener(s.listener, s.tlsConfig)
+	}
+
+	return nil
+}
+
 // Start starts the server
 func (s *TCPServer) Start() {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
 			continue
 		}
 
@@ -153,6 +191,33 @@ func (s *TCPServer) handleConnection(conn net.Conn) {
 	// Defer closing the connection
 	defer conn.Close()
 
+	if s.TextProtocol {
+		s.handleTextConnection(conn)
+		return
+	}
+
+	s.handleFramedConnection(conn)
+}
+
+// session opens a channel for an authenticated user, the returned function closes it
+func (s *TCPServer) session(conn net.Conn, user *catalog.User) (*core.Channel, *executor.Executor, func()) {
+	channel := s.aria.OpenChannel(user)
+
+	// KILL ends the session by closing its connection
+	channel.OnKill(func() { conn.Close() })
+
+	exe := executor.New(s.aria, channel)
+	exe.SetTimeouts(executor.Timeouts{Statement: s.StatementTimeout, Lock: s.LockTimeout, IdleInTransaction: s.IdleInTransactionTimeout})
+
+	return channel, exe, func() {
+		exe.Close() // a connection closed mid transaction rolls it back
+		s.aria.CloseChannel(channel)
+	}
+}
+
+// handleTextConnection serves the text protocol
+func (s *TCPServer) handleTextConnection(conn net.Conn) {
+
 	// Create a new buffer to read from the connection
 	buf := make([]byte, s.BufferSize)
 
@@ -173,8 +238,12 @@ func (s *TCPServer) handleConnection(conn net.Conn) {
 		return
 	}
 
-	username := strings.Split(string(decodedAuth), "\\0")[0]
-	password := strings.Split(string(decodedAuth), "\\0")[1]
+	// The password is everything after the first separator, it may contain the separator itself
+	username, password, ok := strings.Cut(string(decodedAuth), "\\0")
+	if !ok {
+		conn.Write([]byte("ERR: Authentication failed\n"))
+		return
+	}
 
 	// Authenticate the user
 	user, err := s.aria.Catalog.AuthenticateUser(username, password)
@@ -190,16 +259,14 @@ func (s *TCPServer) handleConnection(conn net.Conn) {
 	}
 
 	// Open a new channel
-	channel := s.aria.OpenChannel(user)
-	defer s.aria.CloseChannel(channel)
+	_, exe, closeSession := s.session(conn, user)
+	defer closeSession()
 
 	// Write the OK response to the connection
 	// We also pass AriaSQL version to client
 	// The reasoning behind this is so a client connecting can check the AriaSQL version, possibly right when connecting for example, on the CLI.
 	conn.Write([]byte("OK\nVERSION: " + shared.VERSION + "\n"))
 
-	exe := executor.New(s.aria, channel)
-
 	if s.json {
 		exe.SetJsonOutput(true)
 
@@ -241,6 +308,14 @@ func (s *TCPServer) handleConnection(conn net.Conn) {
 				continue
 			}
 
+			if subscribeStmt, ok := ast.(*parser.SubscribeStmt); ok {
+				err = s.subscribe(conn, exe, subscribeStmt)
+				if err != nil {
+					conn.Write(append([]byte(fmt.Sprintf("ERR: %s", err.Error())), []byte("\n")...))
+				}
+				continue
+			}
+
 			err = exe.Execute(ast)
 			if err != nil {
 				// Write the error to the connection
@@ -269,3 +344,50 @@ func (s *TCPServer) handleConnection(conn net.Conn) {
 	}
 
 }
+
+// subscribe streams the changes committed to a table to the connection as newline delimited JSON, one event per line
+// The stream ends when the client sends anything, i.e. UNSUBSCRIBE;, or disconnects
+func (s *TCPServer) subscribe(conn net.Conn, exe *executor.Executor, stmt *parser.SubscribeStmt) error {
+	sub, err := exe.Subscribe(stmt)
+	if err != nil {
+		return err
+	}
+
+	defer sub.Close()
+
+	conn.Write([]byte("OK\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, s.BufferSize))
+		done <- err
+	}()
+
+	enc := json.NewEncoder(conn)
+
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				return nil // client went away, the connection loop ends on its next read
+			}
+
+			conn.Write([]byte("OK\n"))
+			return nil
+		case event, ok := <-sub.C:
+			if !ok {
+				// Stop waiting on the client before handing the connection back
+				conn.SetReadDeadline(time.Now())
+				<-done
+				conn.SetReadDeadline(time.Time{})
+
+				return errors.New("subscriber fell behind, subscribe again")
+			}
+
+			err := enc.Encode(event)
+			if err != nil {
+				return nil
+			}
+		}
+	}
+}
@@ -26,15 +26,25 @@ import (
 )
 
 func TestNewTCPServer(t *testing.T) {
-	aria := core.New(&core.Config{
+	defer os.Remove("ariaserver.yaml")
+	defer os.Remove("ariaconf.yaml")
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+	defer os.Remove("xid.dat")
+	aria, err := core.New(&core.Config{
 		DataDir: "./",
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	server, err := NewTCPServer(3695, "0.0.0.0", aria, 1024)
 	if err != nil {
 		t.Fatalf("Failed to create new server: %v", err)
 	}
 
+	defer server.Stop()
+
 	if server.Port != 3695 {
 		t.Errorf("Expected port to be 3695, got %d", server.Port)
 	}
@@ -53,11 +63,19 @@ func TestTCPServer_Start(t *testing.T) {
 	defer os.Remove("ariasql.log")
 	defer os.Remove(".ariaconfig")
 	defer os.Remove("ariaserver.yaml")
-	aria := core.New(&core.Config{
+	defer os.Remove("ariaconf.yaml")
+	defer os.Remove("users.usrs")
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+	defer os.Remove("xid.dat")
+	aria, err := core.New(&core.Config{
 		DataDir: "./",
 	})
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	err := aria.Catalog.Open()
+	err = aria.Catalog.Open()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,149 @@
+// Package server TLS
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/protocol"
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLS versions TLSMinVersion accepts
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLS builds the TLS configuration of the server's settings, nil if TLS and StartTLS are disabled
+func (s *TCPServer) loadTLS() (*tls.Config, error) {
+	if !s.TLS && !s.StartTLS {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.TLSCert, s.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if s.TLSMinVersion != "" {
+		version, ok := tlsVersions[s.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %s, expected 1.0, 1.1, 1.2 or 1.3", s.TLSMinVersion)
+		}
+
+		config.MinVersion = version
+	}
+
+	for _, name := range s.TLSCipherSuites {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	if s.TLSClientCA != "" {
+		pem, err := os.ReadFile(s.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TLS client CA: %w", err)
+		}
+
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in TLS client CA " + s.TLSClientCA)
+		}
+
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.TLSRequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if s.TLSRequireClientCert {
+		return nil, errors.New("TLSRequireClientCert requires a TLSClientCA to verify client certificates against")
+	}
+
+	return config, nil
+}
+
+// cipherSuite returns the id of a secure cipher suite by name
+func cipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// verifiedCertificate returns the client certificate of a TLS connection verified against the client CA, nil if there is none
+func verifiedCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
+}
+
+// startTLS answers a STARTTLS message and upgrades the connection, the TLS connection is returned once its handshake is done
+// A server without TLS configured answers with an error and the client goes on in clear text
+func (s *TCPServer) startTLS(conn net.Conn, r *bufio.Reader, w *bufio.Writer) (net.Conn, error) {
+	if s.tlsConfig == nil {
+		return conn, writeError(w, protocol.ERROR_PROTOCOL, "TLS is not available")
+	}
+
+	if _, ok := conn.(*tls.Conn); ok {
+		return nil, fail(w, protocol.ERROR_PROTOCOL, "connection is already TLS")
+	}
+
+	// Anything the client sent after STARTTLS would bypass TLS
+	if r.Buffered() > 0 {
+		return nil, fail(w, protocol.ERROR_PROTOCOL, "unexpected data after STARTTLS")
+	}
+
+	err := protocol.WriteMessage(w, protocol.STARTTLS, nil)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Server(conn, s.tlsConfig)
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
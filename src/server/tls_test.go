@@ -0,0 +1,417 @@
+// Package server TLS tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package server
+
+import (
+	"ariasql/catalog"
+	"ariasql/core"
+	"ariasql/protocol"
+	"ariasql/shared"
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCerts are the files of a CA, a server certificate for 127.0.0.1 and a client certificate, both signed by the CA
+type testCerts struct {
+	ca, serverCert, serverKey string
+	pool                      *x509.CertPool
+	client                    tls.Certificate
+}
+
+// newTestCerts writes a CA, a server certificate and a client certificate for common name cn
+func newTestCerts(t *testing.T, cn string) *testCerts {
+	dir := t.TempDir()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "AriaSQL test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// issue signs a certificate with the CA and returns its PEM certificate and key
+	issue := func(serial int64, template *x509.Certificate) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		template.SerialNumber = big.NewInt(serial)
+		template.NotBefore = time.Now().Add(-time.Hour)
+		template.NotAfter = time.Now().Add(time.Hour)
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+
+	serverCert, serverKey := issue(2, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+
+	clientCert, clientKey := issue(3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	certs := &testCerts{
+		ca:         filepath.Join(dir, "ca.pem"),
+		serverCert: filepath.Join(dir, "server.pem"),
+		serverKey:  filepath.Join(dir, "server.key"),
+		pool:       x509.NewCertPool(),
+	}
+
+	certs.pool.AddCert(caCert)
+
+	for file, b := range map[string][]byte{
+		certs.ca:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		certs.serverCert: serverCert,
+		certs.serverKey:  serverKey,
+	} {
+		if err := os.WriteFile(file, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	certs.client, err = tls.X509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certs
+}
+
+// startTestServer listens on a free port of 127.0.0.1 and serves connections until the test ends
+func startTestServer(t *testing.T, s *TCPServer) string {
+	s.Host = "127.0.0.1"
+
+	if err := s.listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.Start()
+	t.Cleanup(s.Stop)
+
+	return s.listener.Addr().String()
+}
+
+func TestLoadTLS(t *testing.T) {
+	certs := newTestCerts(t, "svc")
+
+	for _, s := range []*TCPServer{
+		{TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey, TLSMinVersion: "1.4"},
+		{TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey, TLSCipherSuites: []string{"TLS_RSA_WITH_RC4_128_SHA"}},
+		{TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey, TLSRequireClientCert: true},
+		{TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey, TLSClientCA: certs.serverKey},
+		{StartTLS: true, TLSCert: "missing.pem", TLSKey: certs.serverKey},
+	} {
+		if _, err := s.loadTLS(); err == nil {
+			t.Fatalf("expected %+v to be refused", s)
+		}
+	}
+
+	s := &TCPServer{TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey, TLSMinVersion: "1.3",
+		TLSCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}, TLSClientCA: certs.ca}
+
+	config, err := s.loadTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.MinVersion != tls.VersionTLS13 || len(config.CipherSuites) != 1 || config.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("unexpected configuration %+v", config)
+	}
+
+	if config, _ = (&TCPServer{}).loadTLS(); config != nil {
+		t.Fatal("expected no configuration without TLS")
+	}
+}
+
+func TestTLSListener(t *testing.T) {
+	certs := newTestCerts(t, "svc")
+
+	addr := startTestServer(t, &TCPServer{aria: openInstance(t, &core.Config{}), TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey,
+		TLSClientCA: certs.ca, TLSRequireClientCert: true})
+
+	// A client with a certificate the CA signed connects
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.client}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if e := framedLogin(t, conn, "admin", "admin"); e != nil {
+		t.Fatal(e)
+	}
+
+	// A client without one is refused
+	conn, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1)) // TLS 1.3 reports the refused certificate on the first read
+		conn.Close()
+	}
+
+	if err == nil {
+		t.Fatal("expected a client without a certificate to be refused")
+	}
+
+	// as is a client below the minimum version
+	_, err = tls.Dial("tcp", addr, &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.client}, MaxVersion: tls.VersionTLS11})
+	if err == nil {
+		t.Fatal("expected TLS 1.1 to be refused")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	certs := newTestCerts(t, "svc")
+	aria := openInstance(t, &core.Config{})
+
+	s := &TCPServer{aria: aria, StartTLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey}
+	addr := startTestServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	send(t, conn, protocol.STARTTLS, nil)
+	if msg := receive(t, conn); msg.Type != protocol.STARTTLS {
+		t.Fatalf("expected STARTTLS to be accepted, got %q", msg.Type)
+	}
+
+	secure := tls.Client(conn, &tls.Config{RootCAs: certs.pool, ServerName: "127.0.0.1"})
+	if err := secure.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := framedLogin(t, secure, "admin", "admin"); e != nil {
+		t.Fatal(e)
+	}
+
+	// The PostgreSQL protocol accepts an SSLRequest
+	p, err := NewPostgresServer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Start()
+	defer p.Stop()
+
+	conn, err = net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), PG_SSL_REQUEST)); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil || b[0] != 'S' {
+		t.Fatalf("expected SSL to be accepted, got %q %v", b, err)
+	}
+
+	secure = tls.Client(conn, &tls.Config{RootCAs: certs.pool, ServerName: "127.0.0.1"})
+	c := &pgClient{t: t, conn: secure, r: bufio.NewReader(secure)}
+
+	if messages := c.startup("admin", "admin", ""); len(find(messages, 'E')) != 0 {
+		t.Fatalf("expected a session over TLS, got %v", messages)
+	}
+
+	// A server without TLS answers STARTTLS with an error and the client goes on in clear text
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go (&TCPServer{aria: aria}).handleConnection(server)
+
+	send(t, client, protocol.STARTTLS, nil)
+	if msg := receive(t, client); msg.Type != protocol.ERROR {
+		t.Fatalf("expected STARTTLS to be refused, got %q", msg.Type)
+	}
+
+	if e := framedLogin(t, client, "admin", "admin"); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestCertificateAuthentication(t *testing.T) {
+	certs := newTestCerts(t, "svc")
+	aria := openInstance(t, &core.Config{})
+
+	for user, subject := range map[string]string{"svc": "CN=svc", "other": "CN=other"} {
+		if err := aria.Catalog.CreateNewCertificateUser(user, subject); err != nil {
+			t.Fatal(err)
+		}
+
+		err := aria.Catalog.GrantPrivilegeToUser(user, &catalog.Privilege{DatabaseName: "*", TableName: "*", PrivilegeActions: []shared.PrivilegeAction{shared.PRIV_ALL}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := aria.Catalog.CreateNewCertificateUser("bad", "OU=svc"); err == nil {
+		t.Fatal("expected a subject other than CN or SAN to be refused")
+	}
+
+	s := &TCPServer{aria: aria, TLS: true, TLSCert: certs.serverCert, TLSKey: certs.serverKey, TLSClientCA: certs.ca}
+	addr := startTestServer(t, s)
+
+	dial := func(client bool) net.Conn {
+		config := &tls.Config{RootCAs: certs.pool}
+		if client {
+			config.Certificates = []tls.Certificate{certs.client}
+		}
+
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { conn.Close() })
+
+		return conn
+	}
+
+	// The certificate's common name identifies svc without a password
+	if e := framedLogin(t, dial(true), "svc", ""); e != nil {
+		t.Fatal(e)
+	}
+
+	// but not another user
+	if e := framedLogin(t, dial(true), "other", ""); e == nil || e.Code != protocol.ERROR_AUTHENTICATION {
+		t.Fatalf("expected other to be refused, got %v", e)
+	}
+
+	// and not without the certificate, a password does not do
+	if e := framedLogin(t, dial(false), "svc", "svc"); e == nil || e.Code != protocol.ERROR_AUTHENTICATION {
+		t.Fatalf("expected svc without its certificate to be refused, got %v", e)
+	}
+
+	// Password users still log in with their password
+	if e := framedLogin(t, dial(true), "admin", "admin"); e != nil {
+		t.Fatal(e)
+	}
+
+	// The PostgreSQL protocol does not ask svc for a password either
+	p, err := NewPostgresServer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go p.Start()
+	defer p.Stop()
+
+	conn, err := net.Dial("tcp", p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	if _, err := conn.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, 8), PG_SSL_REQUEST)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	secure := tls.Client(conn, &tls.Config{RootCAs: certs.pool, ServerName: "127.0.0.1", Certificates: []tls.Certificate{certs.client}})
+	c := &pgClient{t: t, conn: secure, r: bufio.NewReader(secure)}
+
+	if messages := c.startup("svc", "", ""); len(find(messages, 'E')) != 0 || messages[0].typ != 'R' {
+		t.Fatalf("expected svc to be authenticated by its certificate, got %v", messages)
+	}
+
+	// as the HTTP API does not ask a request for credentials
+	h, err := NewHTTPServer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go h.Start()
+	defer h.Stop()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: certs.pool, Certificates: []tls.Certificate{certs.client}}}}
+
+	resp, err := client.Post("https://"+h.Addr().String()+"/query", "application/json", strings.NewReader(`{"sql": "CREATE DATABASE certs;"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected svc to be authenticated by its certificate, got %d", resp.StatusCode)
+	}
+
+	// Alternative names match SAN=
+	user := &catalog.User{Certificate: "SAN=svc.internal"}
+	if !user.MatchesCertificate(&x509.Certificate{DNSNames: []string{"db.internal", "svc.internal"}}) || user.MatchesCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "svc.internal"}}) {
+		t.Fatal("expected SAN= to match alternative names only")
+	}
+}
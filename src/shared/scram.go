@@ -0,0 +1,102 @@
+// Package shared SCRAM-SHA-256
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package shared
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const SCRAM_ITERATIONS = 4096 // PBKDF2 iterations of new SCRAM verifiers
+const SCRAM_SALT_SIZE = 16    // Bytes of salt of new SCRAM verifiers
+
+// ScramVerifier is what the server keeps of a password to verify SCRAM-SHA-256 proofs (RFC 5802, RFC 7677), the password can't be recovered from it
+type ScramVerifier struct {
+	Salt       []byte // Random salt of the password
+	Iterations int    // PBKDF2 iterations
+	StoredKey  []byte // H(ClientKey), verifies the client's proof
+	ServerKey  []byte // Signs the server's final message, proving the server knows the verifier
+}
+
+// NewScramVerifier creates a SCRAM-SHA-256 verifier of a password with a random salt
+func NewScramVerifier(password string) (*ScramVerifier, error) {
+	salt := make([]byte, SCRAM_SALT_SIZE)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	clientKey, serverKey := ScramKeys(password, salt, SCRAM_ITERATIONS)
+	storedKey := sha256.Sum256(clientKey)
+
+	return &ScramVerifier{Salt: salt, Iterations: SCRAM_ITERATIONS, StoredKey: storedKey[:], ServerKey: serverKey}, nil
+}
+
+// ScramKeys derives the client and server keys of a password
+func ScramKeys(password string, salt []byte, iterations int) ([]byte, []byte) {
+	salted := pbkdf2.Key([]byte(password), salt, iterations, sha256.Size, sha256.New)
+	return ScramHMAC(salted, "Client Key"), ScramHMAC(salted, "Server Key")
+}
+
+// ScramHMAC returns HMAC-SHA-256 of a message
+func ScramHMAC(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
+
+// ScramClientProof returns the proof a client with the password sends for an exchange's auth message
+func ScramClientProof(password string, salt []byte, iterations int, authMessage string) []byte {
+	clientKey, _ := ScramKeys(password, salt, iterations)
+	storedKey := sha256.Sum256(clientKey)
+
+	proof := ScramHMAC(storedKey[:], authMessage)
+	subtle.XORBytes(proof, proof, clientKey)
+
+	return proof
+}
+
+// Verify checks a password against the verifier
+func (v *ScramVerifier) Verify(password string) bool {
+	clientKey, _ := ScramKeys(password, v.Salt, v.Iterations)
+	storedKey := sha256.Sum256(clientKey)
+
+	return subtle.ConstantTimeCompare(storedKey[:], v.StoredKey) == 1
+}
+
+// VerifyProof checks a client's proof of an exchange's auth message
+func (v *ScramVerifier) VerifyProof(authMessage string, proof []byte) bool {
+	if len(proof) != sha256.Size {
+		return false
+	}
+
+	// The proof is ClientKey XOR HMAC(StoredKey, AuthMessage), recover ClientKey and hash it
+	clientKey := ScramHMAC(v.StoredKey, authMessage)
+	subtle.XORBytes(clientKey, clientKey, proof)
+	storedKey := sha256.Sum256(clientKey)
+
+	return subtle.ConstantTimeCompare(storedKey[:], v.StoredKey) == 1
+}
+
+// ServerSignature returns the signature of an exchange's auth message the server sends in its final message
+func (v *ScramVerifier) ServerSignature(authMessage string) []byte {
+	return ScramHMAC(v.ServerKey, authMessage)
+}
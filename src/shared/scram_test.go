@@ -0,0 +1,76 @@
+// Package shared SCRAM-SHA-256 tests
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestScramRFC7677(t *testing.T) {
+	// The example exchange of RFC 7677 section 3, user "user" with password "pencil"
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+
+	proof := ScramClientProof("pencil", salt, 4096, authMessage)
+	if base64.StdEncoding.EncodeToString(proof) != "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Fatalf("unexpected proof %s", base64.StdEncoding.EncodeToString(proof))
+	}
+
+	clientKey, serverKey := ScramKeys("pencil", salt, 4096)
+	storedKey := sha256.Sum256(clientKey)
+	v := &ScramVerifier{Salt: salt, Iterations: 4096, StoredKey: storedKey[:], ServerKey: serverKey}
+
+	if !v.VerifyProof(authMessage, proof) {
+		t.Fatal("expected the proof to be verified")
+	}
+
+	if base64.StdEncoding.EncodeToString(v.ServerSignature(authMessage)) != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Fatal("unexpected server signature")
+	}
+
+	if v.VerifyProof(authMessage+"x", proof) || v.VerifyProof(authMessage, proof[1:]) {
+		t.Fatal("expected a proof of another message to be refused")
+	}
+}
+
+func TestNewScramVerifier(t *testing.T) {
+	v, err := NewScramVerifier("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(v.Salt) != SCRAM_SALT_SIZE || v.Iterations != SCRAM_ITERATIONS {
+		t.Fatalf("unexpected verifier %+v", v)
+	}
+
+	if !v.Verify("secret") || v.Verify("Secret") {
+		t.Fatal("expected only the password to be verified")
+	}
+
+	other, err := NewScramVerifier("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(other.StoredKey) == string(v.StoredKey) {
+		t.Fatal("expected verifiers of the same password to be salted differently")
+	}
+}
@@ -598,11 +598,7 @@ func (b *BTree) remove(x *Node, key, value []byte) error {
 			}
 		}
 
-		// if the key has no values, remove the key
-		if len(x.Keys[i].V) == 0 {
-			// @TODO: remove the key from the node
-			return nil
-		}
+		// @TODO: remove the key from the node once it has no values, for now it is kept with none
 
 		// encode the node
 		encodedNode, err := encodeNode(x)
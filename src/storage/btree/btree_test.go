@@ -231,6 +231,45 @@ func TestBTree_Remove(t *testing.T) {
 	}
 }
 
+func TestBTree_RemoveLastValue(t *testing.T) {
+	defer os.Remove("btree.db")
+	defer os.Remove("btree.db.del")
+
+	btree, err := Open("btree.db", os.O_CREATE|os.O_RDWR, 0644, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = btree.Put([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// removing the last value of a key must be written to disk like any other
+	err = btree.Remove([]byte("key"), []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	btree.Close()
+
+	btree, err = Open("btree.db", os.O_RDWR, 0644, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer btree.Close()
+
+	key, err := btree.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(key.V) != 0 {
+		t.Fatalf("expected no values, got %d", len(key.V))
+	}
+}
+
 func BenchmarkBTree_Put(b *testing.B) {
 	defer os.Remove("btree.db")
 	defer os.Remove("btree.db.del")
@@ -168,6 +168,12 @@ func (p *Pager) WriteTo(pageID int64, data []byte) error {
 
 	}
 
+	// the deleted pages file must not list the page once it holds data again
+	err := p.writeDelPages()
+	if err != nil {
+		return err
+	}
+
 	// the reason we are doing this is because we are going to write to the page thus having any overflowed pages which are linked to the page may not be needed
 
 	// check if data is larger than the page size
@@ -433,6 +439,38 @@ func (p *Pager) DeletePage(pageID int64) error {
 	return nil
 }
 
+// ReadData reads n bytes of data starting at a page and running on into the pages after it, without following overflow headers
+// Used for files whose pages are written in order, such as the WAL
+func (p *Pager) ReadData(pageID int64, n int) ([]byte, error) {
+	result := make([]byte, 0, n)
+	page := make([]byte, PAGE_SIZE+HEADER_SIZE)
+
+	for len(result) < n {
+		_, err := p.file.ReadAt(page, pageID*(PAGE_SIZE+HEADER_SIZE))
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, page[HEADER_SIZE:HEADER_SIZE+min(PAGE_SIZE, n-len(result))]...)
+		pageID++
+	}
+
+	return result, nil
+}
+
+// Sync flushes the file to stable storage
+func (p *Pager) Sync() error {
+	return p.file.Sync()
+}
+
+// Truncate cuts the file down to the given number of pages
+func (p *Pager) Truncate(pages int64) error {
+	p.StatLock.Lock()
+	defer p.StatLock.Unlock()
+
+	return p.file.Truncate(pages * (PAGE_SIZE + HEADER_SIZE))
+}
+
 // Count returns the number of pages
 func (p *Pager) Count() int64 {
 
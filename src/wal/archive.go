@@ -0,0 +1,410 @@
+// Package wal archive
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package wal
+
+import (
+	"ariasql/shared"
+	"ariasql/storage/btree"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ARCHIVE_SEGMENT_EXTENSION = ".wal"    // Archived WAL segment file extension
+const BASE_BACKUP_PREFIX = "base_"          // Base backup directory prefix, followed by the backup LSN
+const BASE_BACKUP_LABEL = "backup_label"    // Base backup label file, describes the backup
+const PRE_RECOVERY_PREFIX = "pre_recovery_" // Directory holding history set aside by a point-in-time recovery
+
+// Archive is a WAL archive directory
+// The archive keeps rotated WAL segments together with base backups of the instance, a base backup plus the segments after it can recover the instance to any point after the backup
+type Archive struct {
+	Directory string      // Archive directory
+	lock      *sync.Mutex // Archive lock
+}
+
+// BaseBackup is a copy of the instance data files taken at a point in the WAL
+type BaseBackup struct {
+	Directory string    `yaml:"-"` // Backup directory
+	LSN       uint64    // The backup contains every record up to and including this LSN
+	Timestamp time.Time // Time the backup was taken
+}
+
+// OpenArchive opens a WAL archive, creating the directory if it does not exist
+func OpenArchive(directory string) (*Archive, error) {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Archive{Directory: directory, lock: &sync.Mutex{}}, nil
+}
+
+// segmentFirstLSN returns the first LSN of an archived segment from its file name
+func segmentFirstLSN(path string) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ARCHIVE_SEGMENT_EXTENSION), 10, 64)
+}
+
+// archiveSegment moves a WAL file into the archive as a segment starting at firstLSN
+func (a *Archive) archiveSegment(path string, firstLSN uint64) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	dest := filepath.Join(a.Directory, fmt.Sprintf("%020d%s", firstLSN, ARCHIVE_SEGMENT_EXTENSION))
+
+	err := os.Rename(path, dest)
+	if err != nil {
+		// Archive may be on another device
+		err = shared.CopyFile(path, dest)
+		if err != nil {
+			return err
+		}
+
+		return os.Remove(path)
+	}
+
+	return nil
+}
+
+// Segments returns the archived segment paths ordered by their first LSN
+func (a *Archive) Segments() ([]string, error) {
+	entries, err := os.ReadDir(a.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := make([]string, 0)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ARCHIVE_SEGMENT_EXTENSION) {
+			continue
+		}
+
+		if _, err := segmentFirstLSN(entry.Name()); err != nil {
+			continue
+		}
+
+		segments = append(segments, filepath.Join(a.Directory, entry.Name()))
+	}
+
+	// Names are zero padded so they sort by LSN
+	sort.Strings(segments)
+
+	return segments, nil
+}
+
+// readSegment reads all records from an archived segment
+func readSegment(path string) ([]*Record, error) {
+	_, err := os.Stat(path + ".del")
+	hadDel := err == nil
+
+	pager, err := btree.OpenPager(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{file: pager, FilePath: path, lock: &sync.Mutex{}}
+	defer func() {
+		w.Close()
+		if !hadDel {
+			os.Remove(path + ".del")
+		}
+	}()
+
+	return w.records()
+}
+
+// Records returns every archived record ordered by LSN
+// Damaged segments are read around, the intact records are returned along with a *CorruptionError
+func (a *Archive) Records() ([]*Record, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	segments, err := a.Segments()
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*Record, 0)
+	corruption := &CorruptionError{}
+
+	for _, segment := range segments {
+		recs, err := readSegment(segment)
+		if err != nil {
+			var cerr *CorruptionError
+			if !errors.As(err, &cerr) {
+				return nil, err
+			}
+
+			for _, c := range cerr.Corruptions {
+				// Damage at the start of a segment follows the last record of the segment before it
+				if c.AfterLSN == 0 && len(records) > 0 {
+					c.AfterLSN = records[len(records)-1].LSN
+				}
+
+				corruption.Corruptions = append(corruption.Corruptions, c)
+			}
+		}
+
+		records = append(records, recs...)
+	}
+
+	if len(corruption.Corruptions) > 0 {
+		return records, corruption
+	}
+
+	return records, nil
+}
+
+// LastLSN returns the LSN of the last archived record, or of the newest base backup if it is further ahead
+func (a *Archive) LastLSN() (uint64, error) {
+	var lsn uint64
+
+	segments, err := a.Segments()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(segments) > 0 {
+		recs, err := readSegment(segments[len(segments)-1])
+		var cerr *CorruptionError
+		if err != nil && !errors.As(err, &cerr) {
+			return 0, err
+		}
+
+		if len(recs) > 0 {
+			lsn = recs[len(recs)-1].LSN
+		}
+	}
+
+	backups, err := a.BaseBackups()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(backups) > 0 && backups[len(backups)-1].LSN > lsn {
+		lsn = backups[len(backups)-1].LSN
+	}
+
+	return lsn, nil
+}
+
+// CreateBaseBackup copies the given data files and directories into a new base backup at lsn
+// The WAL should be rotated beforehand so every record after lsn is in later segments
+func (a *Archive) CreateBaseBackup(lsn uint64, paths ...string) (*BaseBackup, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	backup := &BaseBackup{
+		Directory: filepath.Join(a.Directory, fmt.Sprintf("%s%020d", BASE_BACKUP_PREFIX, lsn)),
+		LSN:       lsn,
+		Timestamp: time.Now(),
+	}
+
+	if _, err := os.Stat(backup.Directory); err == nil {
+		return nil, fmt.Errorf("base backup at LSN %d already exists", lsn)
+	}
+
+	err := os.MkdirAll(backup.Directory, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		dest := filepath.Join(backup.Directory, filepath.Base(path))
+
+		if info.IsDir() {
+			err = shared.CopyDir(path, dest)
+		} else {
+			err = shared.CopyFile(path, dest)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The label is written last, a backup without a label is incomplete and ignored
+	label, err := yaml.Marshal(backup)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(backup.Directory, BASE_BACKUP_LABEL), label, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return backup, nil
+}
+
+// BaseBackups returns the complete base backups within the archive ordered by LSN
+func (a *Archive) BaseBackups() ([]*BaseBackup, error) {
+	entries, err := os.ReadDir(a.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]*BaseBackup, 0)
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), BASE_BACKUP_PREFIX) {
+			continue
+		}
+
+		dir := filepath.Join(a.Directory, entry.Name())
+
+		label, err := os.ReadFile(filepath.Join(dir, BASE_BACKUP_LABEL))
+		if err != nil {
+			continue // incomplete backup
+		}
+
+		backup := &BaseBackup{}
+		err = yaml.Unmarshal(label, backup)
+		if err != nil {
+			return nil, err
+		}
+
+		backup.Directory = dir
+		backups = append(backups, backup)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].LSN < backups[j].LSN
+	})
+
+	return backups, nil
+}
+
+// LatestBaseBackup returns the newest base backup which does not go past the recovery target, nil if there is none
+func (a *Archive) LatestBaseBackup(target *RecoveryTarget) (*BaseBackup, error) {
+	backups, err := a.BaseBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		if target.Reached(&Record{LSN: backups[i].LSN, Timestamp: backups[i].Timestamp}) {
+			continue
+		}
+
+		return backups[i], nil
+	}
+
+	return nil, nil
+}
+
+// SetAside moves segments and base backups newer than lsn out of the archive
+// After a point-in-time recovery the history past the recovery point no longer applies, it is kept in a pre_recovery directory for inspection
+func (a *Archive) SetAside(lsn uint64) (string, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	dir := filepath.Join(a.Directory, fmt.Sprintf("%s%d", PRE_RECOVERY_PREFIX, time.Now().UnixNano()))
+
+	segments, err := a.Segments()
+	if err != nil {
+		return "", err
+	}
+
+	backups, err := a.BaseBackups()
+	if err != nil {
+		return "", err
+	}
+
+	var moves []string
+
+	for _, segment := range segments {
+		firstLSN, err := segmentFirstLSN(segment)
+		if err != nil {
+			return "", err
+		}
+
+		if firstLSN > lsn {
+			moves = append(moves, segment)
+		}
+	}
+
+	for _, backup := range backups {
+		if backup.LSN > lsn {
+			moves = append(moves, backup.Directory)
+		}
+	}
+
+	if len(moves) == 0 {
+		return "", nil
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	for _, path := range moves {
+		err = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return dir, nil
+}
+
+// Restore copies the backed up data files into directory
+func (b *BaseBackup) Restore(directory string) error {
+	entries, err := os.ReadDir(b.Directory)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) == 0 {
+		return errors.New("base backup is empty")
+	}
+
+	for _, entry := range entries {
+		if entry.Name() == BASE_BACKUP_LABEL {
+			continue
+		}
+
+		src := filepath.Join(b.Directory, entry.Name())
+		dest := filepath.Join(directory, entry.Name())
+
+		if entry.IsDir() {
+			err = shared.CopyDir(src, dest)
+		} else {
+			err = shared.CopyFile(src, dest)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
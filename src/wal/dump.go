@@ -0,0 +1,156 @@
+// Package wal dump
+// Copyright (C) AriaSQL
+// Author(s): Alex Gaetano Padula
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+package wal
+
+import (
+	"ariasql/parser"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const DUMP_TIME_FORMAT = "2006-01-02 15:04:05.000" // Timestamp format used by Dump
+
+// DumpFilter selects which records are dumped
+type DumpFilter struct {
+	Table string    // Only records touching this table, can be qualified as database.table, empty for all tables
+	From  time.Time // Only records appended at or after this time, zero for no lower bound
+	To    time.Time // Only records appended at or before this time, zero for no upper bound
+}
+
+// Match returns true if the record passes the filter
+func (f *DumpFilter) Match(rec *Record) bool {
+	if f == nil {
+		return true
+	}
+
+	if !f.From.IsZero() && rec.Timestamp.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && rec.Timestamp.After(f.To) {
+		return false
+	}
+
+	if f.Table != "" {
+		for _, table := range rec.Tables() {
+			if table == f.Table || (rec.Database != "" && rec.Database+"."+table == f.Table) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// Tables returns the names of the tables the record's statement touches
+func (rec *Record) Tables() []string {
+	return stmtTables(rec.Stmt)
+}
+
+// stmtTables returns the names of the tables a statement touches
+func stmtTables(stmt interface{}) []string {
+	switch s := stmt.(type) {
+	case *parser.CreateTableStmt:
+		return []string{s.TableName.Value}
+	case *parser.DropTableStmt:
+		return []string{s.TableName.Value}
+	case *parser.AlterTableStmt:
+		return []string{s.TableName.Value}
+	case *parser.CreateIndexStmt:
+		return []string{s.TableName.Value}
+	case *parser.DropIndexStmt:
+		return []string{s.TableName.Value}
+	case *parser.InsertStmt:
+		return []string{s.TableName.Value}
+	case *parser.UpdateStmt:
+		return []string{s.TableName.Value}
+	case *parser.DeleteStmt:
+		return []string{s.TableName.Value}
+	case *parser.SelectStmt:
+		var tables []string
+		if s.TableExpression != nil && s.TableExpression.FromClause != nil {
+			for _, table := range s.TableExpression.FromClause.Tables {
+				tables = append(tables, table.Name.Value)
+			}
+		}
+
+		if s.Union != nil {
+			tables = append(tables, stmtTables(s.Union)...)
+		}
+
+		return tables
+	case *parser.ExplainStmt:
+		return stmtTables(s.Stmt)
+	case *parser.GrantStmt:
+		return privilegeTables(s.PrivilegeDefinition)
+	case *parser.RevokeStmt:
+		return privilegeTables(s.PrivilegeDefinition)
+	}
+
+	return nil
+}
+
+// privilegeTables returns the table of a database.table privilege object
+func privilegeTables(def *parser.PrivilegeDefinition) []string {
+	if def == nil || def.Object == nil {
+		return nil
+	}
+
+	parts := strings.Split(def.Object.Value, ".")
+	if len(parts) != 2 || parts[1] == "*" {
+		return nil
+	}
+
+	return []string{parts[1]}
+}
+
+// Dump writes the records passing the filter to w, one per line, as
+// LSN, timestamp, user, database and the statement rendered back to SQL
+// Passwords are redacted
+func Dump(w io.Writer, records []*Record, filter *DumpFilter) error {
+	for _, rec := range records {
+		if !filter.Match(rec) {
+			continue
+		}
+
+		sql, err := parser.Deparse(parser.Redact(rec.Stmt))
+		if err != nil {
+			sql = fmt.Sprintf("-- %s", err.Error())
+		}
+
+		user := rec.User
+		if user == "" {
+			user = "-"
+		}
+
+		database := rec.Database
+		if database == "" {
+			database = "-"
+		}
+
+		_, err = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", rec.LSN, rec.Timestamp.Format(DUMP_TIME_FORMAT), user, database, sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -19,14 +19,28 @@ package wal
 import (
 	"ariasql/catalog"
 	"ariasql/parser"
+	"ariasql/shared"
 	"ariasql/storage/btree"
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
 	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
+const RECORD_MAGIC = 0x41574c52 // "AWLR", marks the start of a record frame
+const RECORD_HEADER_SIZE = 12   // Frame header, magic, payload length and CRC-32C checksum of the payload
+const MAX_RECORD_SIZE = 1 << 30 // Largest record payload accepted from a stream
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 // WAL is a write-ahead log file
 type WAL struct {
 	// The file descriptor for the WAL file
@@ -34,7 +48,98 @@ type WAL struct {
 	// The file path for the WAL file
 	FilePath string
 	lock     *sync.Mutex // Lock for the WAL file
+	syncLock *sync.Mutex // Serializes flushes, records appended while one runs are flushed together by the next
 	// Every WAL contains ASTs to recover the database
+	lsn         uint64          // Last log sequence number handed out
+	synced      uint64          // Last log sequence number flushed to stable storage
+	firstLSN    uint64          // Log sequence number of the first record within the file, 0 if the file is empty
+	archive     *Archive        // WAL archive, nil if archiving is disabled
+	segmentSize int64           // Size in bytes at which the WAL file is rotated into the archive, 0 rotates only on base backups
+	subscribers []*Subscription // Receive every appended record, i.e. replication to replicas
+}
+
+// Subscription receives the frame of every record appended to the WAL after it was created
+// C is closed if the subscriber falls behind and its buffer fills up, the subscriber must then read the records it missed from the WAL
+type Subscription struct {
+	C   chan []byte // Record frames in LSN order
+	wal *WAL
+}
+
+// Record is a single entry within the WAL
+type Record struct {
+	LSN       uint64      // Log sequence number, every appended record gets a higher LSN than the one before it
+	Timestamp time.Time   // Time the record was appended
+	User      string      // User which executed the statement, empty if unknown
+	Database  string      // Database the statement was executed against, empty if none was in use
+	Channel   uint64      // Channel which executed the statement, statements of one channel are replayed on one executor
+	Xid       uint64      // Transaction the statement ran in, 0 if none
+	Commit    bool        // The record commits transaction Xid, a transaction without a commit record is undone on recovery
+	Stmt      interface{} // The statement AST
+}
+
+// RecoveryTarget is the point at which WAL replay stops
+type RecoveryTarget struct {
+	Time time.Time // Replay records appended at or before this time, zero means no time limit
+	LSN  uint64    // Replay records up to and including this LSN, 0 means no LSN limit
+}
+
+// Reached returns true if the record is past the recovery target and must not be replayed
+func (t *RecoveryTarget) Reached(rec *Record) bool {
+	if t == nil {
+		return false
+	}
+
+	if t.LSN != 0 && rec.LSN > t.LSN {
+		return true
+	}
+
+	if !t.Time.IsZero() && rec.Timestamp.After(t.Time) {
+		return true
+	}
+
+	return false
+}
+
+// Corruption is a damaged region within a WAL file which was skipped while reading
+type Corruption struct {
+	FilePath string // WAL file or archived segment
+	Page     int64  // First damaged page
+	Pages    int64  // Number of damaged pages skipped
+	AfterLSN uint64 // LSN of the last intact record before the damage, 0 if there is none
+	Reason   string // Why the first damaged page could not be read
+}
+
+// Error describes the damaged region
+func (c *Corruption) Error() string {
+	return fmt.Sprintf("%s: %d damaged page(s) at page %d (byte offset %d) after LSN %d, %s", c.FilePath, c.Pages, c.Page, c.Page*(btree.PAGE_SIZE+btree.HEADER_SIZE), c.AfterLSN, c.Reason)
+}
+
+// CorruptionError is returned along with the intact records when a WAL has damage before its last record
+// A damaged tail is a torn write and is treated as the end of the log instead
+type CorruptionError struct {
+	Corruptions []*Corruption
+}
+
+// Error lists every damaged region
+func (e *CorruptionError) Error() string {
+	msgs := make([]string, 0, len(e.Corruptions))
+	for _, c := range e.Corruptions {
+		msgs = append(msgs, c.Error())
+	}
+
+	return "WAL is corrupted: " + strings.Join(msgs, "; ")
+}
+
+// StopLSN returns the LSN of the last record before the first damaged region, replay must not go past it
+func (e *CorruptionError) StopLSN() uint64 {
+	var lsn uint64
+	for i, c := range e.Corruptions {
+		if i == 0 || c.AfterLSN < lsn {
+			lsn = c.AfterLSN
+		}
+	}
+
+	return lsn
 }
 
 // OpenWAL opens a new WAL file
@@ -101,768 +206,616 @@ func OpenWAL(filePath string, flags int, perm os.FileMode) (*WAL, error) {
 	gob.Register(&parser.BeginStmt{})
 	gob.Register(&parser.CommitStmt{})
 	gob.Register(&parser.RollbackStmt{})
+	gob.Register(&parser.SavepointStmt{})
+	gob.Register(&parser.ReleaseSavepointStmt{})
+	gob.Register(&parser.PrepareTransactionStmt{})
 	gob.Register(&parser.SelectStmt{})
 	gob.Register(&parser.AlterTableStmt{})
-
-	return &WAL{
+	gob.Register(&parser.DropDatabaseStmt{})
+	gob.Register(&parser.WhereClause{})
+	gob.Register(&parser.ComparisonPredicate{})
+	gob.Register(&parser.LogicalCondition{})
+	gob.Register(&parser.ValueExpression{})
+	gob.Register(&parser.ColumnSpecification{})
+	gob.Register(&parser.BinaryExpression{})
+	gob.Register(&parser.AggregateFunc{})
+	gob.Register(&parser.UnaryExpr{})
+	gob.Register(&parser.NotExpr{})
+	gob.Register(&parser.BetweenPredicate{})
+	gob.Register(&parser.InPredicate{})
+	gob.Register(&parser.LikePredicate{})
+	gob.Register(&parser.IsPredicate{})
+	gob.Register(&parser.ExistsPredicate{})
+	gob.Register(&shared.SysDate{})
+	gob.Register(&shared.SysTime{})
+	gob.Register(&shared.SysTimestamp{})
+	gob.Register(&shared.GenUUID{})
+	gob.Register(time.Time{})
+
+	w := &WAL{
 		file:     wal,
 		FilePath: filePath,
 		lock:     &sync.Mutex{},
-	}, nil
-}
-
-// Close the WAL file
-func (w *WAL) Close() error {
-	return w.file.Close()
-}
+		syncLock: &sync.Mutex{},
+	}
 
-// Append data to the WAL file
-func (w *WAL) Append(data []byte) error {
-	w.lock.Lock()
-	defer w.lock.Unlock()
-	_, err := w.file.Write(data)
+	// Continue the log sequence from the last record in the file
+	// Damage in the middle of the file is reported when the records are read for recovery
+	records, _, tail, err := w.scan()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
-
-// Encode ASTs to be written to the WAL file
-func (w *WAL) Encode(stmt interface{}) []byte {
-
-	buff := bytes.NewBuffer([]byte{})
-
-	switch stmt.(type) {
-
-	case *parser.CreateDatabaseStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
+	// A file with pages but not a single record frame predates framing, it is migrated rather than cut off as a torn tail
+	if len(records) == 0 && wal.Count() > 0 && !w.startsRecord(0) {
+		err = w.migrate(flags, perm)
 		if err != nil {
-			return nil
+			w.file.Close()
+			return nil, err
 		}
 
-	case *parser.CreateTableStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt.(*parser.CreateTableStmt))
-		if err != nil {
-			return nil
-		}
-	case *parser.InsertStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
-	case *parser.DropTableStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
+		records, _, tail, err = w.scan()
 		if err != nil {
-			return nil
+			return nil, err
 		}
+	}
 
-	case *parser.UpdateStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	if len(records) > 0 {
+		w.firstLSN = records[0].LSN
+		w.lsn = records[len(records)-1].LSN
+		w.synced = w.lsn
+	}
 
-	case *parser.DeleteStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
+	// Cut off a torn tail so new records follow the last intact one
+	// Only framed files get here, with intact records before the tail or a torn first record
+	if flags&(os.O_WRONLY|os.O_RDWR) != 0 && tail < w.file.Count() {
+		err = w.file.Truncate(tail)
 		if err != nil {
-			return nil
+			return nil, err
 		}
+	}
 
-	case *parser.CreateIndexStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	return w, nil
+}
 
-	case *parser.DropIndexStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// startsRecord returns true if the page starts with a record header
+func (w *WAL) startsRecord(page int64) bool {
+	header, err := w.file.ReadData(page, RECORD_HEADER_SIZE)
+	return err == nil && binary.BigEndian.Uint32(header[0:4]) == RECORD_MAGIC
+}
 
-	case *parser.UseStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// migrate rewrites a WAL file of unframed records, as written before records were framed, into record frames
+// A file holding no unframed record either is not a WAL that can be read and is refused rather than truncated
+func (w *WAL) migrate(flags int, perm os.FileMode) error {
+	records := make([]*Record, 0)
 
-	case *parser.AlterUserStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
+	// Pages which do not start a record (such as overflow pages) do not decode and are skipped, as they were read before framing
+	for page := int64(0); page < w.file.Count(); page++ {
+		data, err := w.file.GetPage(page)
 		if err != nil {
-			return nil
+			continue
 		}
 
-	case *parser.CreateUserStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
+		rec := &Record{}
+		if gob.NewDecoder(bytes.NewReader(data)).Decode(rec) == nil && rec.Stmt != nil {
+			records = append(records, rec)
 		}
+	}
 
-	case *parser.DropUserStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	if len(records) == 0 {
+		return fmt.Errorf("%s holds no WAL records that can be read, move it aside to start a new WAL", w.FilePath)
+	}
 
-	case *parser.GrantStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	if flags&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return fmt.Errorf("%s holds WAL records written before records were framed, open it for writing once to migrate them", w.FilePath)
+	}
 
-	case *parser.RevokeStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	log.Printf("wal: migrating %d record(s) of %s to framed records", len(records), w.FilePath)
 
-	case *parser.ExecStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	// The framed records are written aside and replace the file once complete
+	migrated := w.FilePath + ".migrate"
+	os.Remove(migrated)
+	os.Remove(migrated + ".del")
 
-	case *parser.DeallocateStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	file, err := btree.OpenPager(migrated, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return err
+	}
 
-	case *parser.WhileStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
+	for _, rec := range records {
+		data, err := encodeRecord(rec)
+		if err == nil {
+			_, err = file.Write(data)
 		}
 
-	case *parser.IfStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
 		if err != nil {
-			return nil
+			file.Close()
+			return err
 		}
+	}
 
-	case *parser.BeginEndBlock:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	err = file.Sync()
+	if err != nil {
+		file.Close()
+		return err
+	}
 
-	case *parser.ElseIfStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
 
-	case *parser.OpenStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	err = w.file.Close()
+	if err != nil {
+		return err
+	}
 
-	case *parser.FetchStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	err = os.Rename(migrated, w.FilePath)
+	if err != nil {
+		return err
+	}
 
-	case *parser.PrintStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	os.Remove(migrated + ".del")
 
-	case *parser.CloseStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	w.file, err = btree.OpenPager(w.FilePath, flags, perm)
+	return err
+}
 
-	case *parser.ExitStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// LSN returns the last log sequence number handed out
+func (w *WAL) LSN() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.lsn
+}
 
-	case *parser.BreakStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// SetLSN continues the log sequence from lsn if it is ahead of the WAL file
+// Used when the records before the current file have been archived
+func (w *WAL) SetLSN(lsn uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	case *parser.ReturnStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	if lsn > w.lsn {
+		w.lsn = lsn
+	}
+}
 
-	case *parser.Procedure:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// Sync flushes the WAL file to stable storage up to at least lsn, a commit is durable once it returns
+// Commits syncing at the same time share one flush, the first flush covers every record appended before it began
+func (w *WAL) Sync(lsn uint64) error {
+	w.syncLock.Lock()
+	defer w.syncLock.Unlock()
 
-	case *parser.Variable:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	w.lock.Lock()
+	if w.synced >= lsn {
+		w.lock.Unlock()
+		return nil
+	}
 
-	case *parser.DeclareStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	file, target := w.file, w.lsn
+	w.lock.Unlock()
 
-	case *parser.ConcatFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	// Appending goes on while the file is flushed
+	err := file.Sync()
 
-	case *parser.SetStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	case *parser.ElseClause:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
+	if err != nil {
+		if w.synced >= lsn {
+			return nil // the file was rotated, which flushed it
 		}
 
-	case *parser.CaseExpr:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+		return err
+	}
 
-	case *parser.SubstrFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	if target > w.synced {
+		w.synced = target
+	}
 
-	case *parser.TrimFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	return nil
+}
 
-	case *parser.LengthFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// Synced returns the last log sequence number flushed to stable storage
+func (w *WAL) Synced() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.synced
+}
 
-	case *parser.PositionFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// SetArchive enables WAL archiving, the WAL file is rotated into the archive once it grows past segmentSize bytes
+func (w *WAL) SetArchive(archive *Archive, segmentSize int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	case *parser.RoundFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	w.archive = archive
+	w.segmentSize = segmentSize
+}
 
-	case *parser.ReverseFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// Close the WAL file
+func (w *WAL) Close() error {
+	return w.file.Close()
+}
 
-	case *parser.CoalesceFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+// Log assigns the next LSN and the current time to the record and appends it
+// The LSN is handed out under the same lock as the write so records are in LSN order within the file
+func (w *WAL) Log(rec *Record) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
 
-	case *parser.CastFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	rec.LSN = w.lsn + 1
+	rec.Timestamp = time.Now()
 
-	case *parser.LowerFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
 
-	case *parser.UpperFunc:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	err = w.append(data)
+	if err != nil {
+		return err
+	}
 
-	case *parser.ProcedureStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	w.lsn = rec.LSN
 
-	case *parser.Parameter:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	return nil
+}
 
-	case *parser.PrivilegeDefinition:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
+// append writes a record frame to the WAL file, the caller must hold the lock
+func (w *WAL) append(data []byte) error {
+	if w.firstLSN == 0 {
+		rec, err := w.DecodeRecord(data)
 		if err != nil {
-			return nil
+			return err
 		}
 
-	case *parser.BeginStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+		w.firstLSN = rec.LSN
+	}
 
-	case *parser.CommitStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	_, err := w.file.Write(data)
+	if err != nil {
+		return err
+	}
 
-	case *parser.RollbackStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	w.publish(data)
 
-	case *parser.CreateProcedureStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
+	// Rotate into the archive once the segment is full
+	if w.archive != nil && w.segmentSize > 0 && w.file.Count()*(btree.PAGE_SIZE+btree.HEADER_SIZE) >= w.segmentSize {
+		return w.rotate()
+	}
 
-	case *parser.DropProcedureStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
-		}
-	case *parser.AlterTableStmt:
-		enc := gob.NewEncoder(buff)
-		err := enc.Encode(stmt)
-		if err != nil {
-			return nil
+	return nil
+}
+
+// AppendRecord appends an already sequenced record to the WAL file, keeping its LSN and timestamp
+// Used when replaying records into a new WAL during recovery and when applying records streamed from a primary
+func (w *WAL) AppendRecord(rec *Record) error {
+	data, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if rec.LSN > w.lsn {
+		w.lsn = rec.LSN
+	}
+
+	return w.append(data)
+}
+
+// Rotate moves the current WAL file into the archive as a segment and starts a new WAL file
+func (w *WAL) Rotate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return w.rotate()
+}
+
+// rotate rotates the WAL file, the caller must hold the lock
+func (w *WAL) rotate() error {
+	if w.archive == nil {
+		return errors.New("WAL archiving is not enabled")
+	}
+
+	if w.firstLSN == 0 {
+		return nil // Nothing to archive
+	}
+
+	// The segment is flushed before it is archived, so are the commits within it
+	err := w.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	w.synced = w.lsn
+
+	err = w.file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = w.archive.archiveSegment(w.FilePath, w.firstLSN)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(w.FilePath + ".del")
+
+	w.file, err = btree.OpenPager(w.FilePath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.firstLSN = 0
+
+	return nil
+}
+
+// Subscribe returns a subscription to the records appended from now on, buffering up to size frames
+func (w *WAL) Subscribe(size int) *Subscription {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	sub := &Subscription{C: make(chan []byte, size), wal: w}
+	w.subscribers = append(w.subscribers, sub)
+
+	return sub
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.wal.lock.Lock()
+	defer s.wal.lock.Unlock()
+
+	s.wal.unsubscribe(s)
+}
+
+// unsubscribe removes a subscriber and closes its channel, the caller must hold the lock
+func (w *WAL) unsubscribe(sub *Subscription) {
+	for i, s := range w.subscribers {
+		if s == sub {
+			w.subscribers = append(w.subscribers[:i], w.subscribers[i+1:]...)
+			close(sub.C)
+			return
 		}
+	}
+}
 
-	default:
-		return nil
+// publish hands an appended frame to the subscribers, the caller must hold the lock
+// A subscriber whose buffer is full is dropped rather than holding up the WAL
+func (w *WAL) publish(data []byte) {
+	for _, sub := range append([]*Subscription{}, w.subscribers...) {
+		select {
+		case sub.C <- data:
+		default:
+			w.unsubscribe(sub)
+		}
 	}
+}
 
-	return buff.Bytes()
-}
-
-// Decode wal entries
-func (w *WAL) Decode(data []byte) interface{} {
-
-	stmtTypes := []interface{}{
-		&parser.InsertStmt{},
-		&parser.CreateDatabaseStmt{},
-		&parser.CreateTableStmt{},
-		&parser.DropTableStmt{},
-		&parser.UpdateStmt{},
-		&parser.DeleteStmt{},
-		&parser.CreateIndexStmt{},
-		&parser.DropIndexStmt{},
-		&parser.UseStmt{},
-		&parser.AlterUserStmt{},
-		&parser.CreateUserStmt{},
-		&parser.DropUserStmt{},
-		&parser.GrantStmt{},
-		&parser.RevokeStmt{},
-		&parser.ExecStmt{},
-		&parser.DeallocateStmt{},
-		&parser.WhileStmt{},
-		&parser.IfStmt{},
-		&parser.BeginEndBlock{},
-		&parser.ElseIfStmt{},
-		&parser.OpenStmt{},
-		&parser.FetchStmt{},
-		&parser.PrintStmt{},
-		&parser.CloseStmt{},
-		&parser.ExitStmt{},
-		&parser.BreakStmt{},
-		&parser.ReturnStmt{},
-		&parser.Procedure{},
-		&parser.Variable{},
-		&parser.DeclareStmt{},
-		&parser.ConcatFunc{},
-		&parser.SetStmt{},
-		&parser.ElseClause{},
-		&parser.CaseExpr{},
-		&parser.SubstrFunc{},
-		&parser.TrimFunc{},
-		&parser.LengthFunc{},
-		&parser.PositionFunc{},
-		&parser.RoundFunc{},
-		&parser.ReverseFunc{},
-		&parser.CoalesceFunc{},
-		&parser.CastFunc{},
-		&parser.LowerFunc{},
-		&parser.UpperFunc{},
-		&parser.ProcedureStmt{},
-		&parser.Parameter{},
-		&parser.PrivilegeDefinition{},
-		&parser.BeginStmt{},
-		&parser.CommitStmt{},
-		&parser.RollbackStmt{},
-		&parser.CreateProcedureStmt{},
-		&parser.DropProcedureStmt{},
-		&parser.AlterTableStmt{},
-	}
-
-	for _, stmtType := range stmtTypes {
-
-		switch stmtType.(type) {
-		case *parser.CreateDatabaseStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.CreateDatabaseStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+// encodeRecord encodes a WAL record into a frame
+// The frame header holds the payload length and checksum so torn or damaged records are detected when read back
+func encodeRecord(rec *Record) ([]byte, error) {
+	buff := bytes.NewBuffer(make([]byte, RECORD_HEADER_SIZE))
 
-			return stmt
-		case *parser.CreateTableStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.CreateTableStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	enc := gob.NewEncoder(buff)
+	err := enc.Encode(rec)
+	if err != nil {
+		return nil, err
+	}
 
-			return stmt
-		case *parser.DropTableStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.DropTableStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	data := buff.Bytes()
+	payload := data[RECORD_HEADER_SIZE:]
 
-			return stmt
-		case *parser.InsertStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.InsertStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	binary.BigEndian.PutUint32(data[0:4], RECORD_MAGIC)
+	binary.BigEndian.PutUint32(data[4:8], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[8:12], crc32.Checksum(payload, crcTable))
 
-			if stmt.Values == nil {
-				continue
-			}
+	return data, nil
+}
 
-			return stmt
-		case *parser.CreateIndexStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.CreateIndexStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+// EncodeRecord encodes a WAL record into a frame, as written to the WAL file
+func EncodeRecord(rec *Record) ([]byte, error) {
+	return encodeRecord(rec)
+}
 
-			if stmt.IndexName == nil {
-				continue
-			}
+// ReadRecord reads a single record frame from r, i.e. a replication stream
+func ReadRecord(r io.Reader) (*Record, error) {
+	header := make([]byte, RECORD_HEADER_SIZE)
 
-			return stmt
-		case *parser.DropIndexStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.DropIndexStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
 
-			if stmt.IndexName == nil {
-				continue
-			}
+	if binary.BigEndian.Uint32(header[0:4]) != RECORD_MAGIC {
+		return nil, errors.New("record header is missing")
+	}
 
-			return stmt
-		case *parser.CreateUserStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.CreateUserStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length > MAX_RECORD_SIZE {
+		return nil, fmt.Errorf("record of %d bytes is too large", length)
+	}
 
-			if stmt.Username == nil {
-				continue
-			}
+	data := make([]byte, RECORD_HEADER_SIZE+int(length))
+	copy(data, header)
 
-			return stmt
-		case *parser.DropUserStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.DropUserStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	_, err = io.ReadFull(r, data[RECORD_HEADER_SIZE:])
+	if err != nil {
+		return nil, err
+	}
 
-			if stmt.Username == nil {
-				continue
-			}
+	return (&WAL{}).DecodeRecord(data)
+}
 
-			return stmt
-		case *parser.GrantStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.GrantStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+// decodeFrame verifies a record frame and returns its payload, trailing bytes such as page padding are ignored
+func decodeFrame(data []byte) ([]byte, error) {
+	if len(data) < RECORD_HEADER_SIZE {
+		return nil, errors.New("record header is incomplete")
+	}
 
-			if stmt.PrivilegeDefinition == nil {
-				continue
-			}
+	if binary.BigEndian.Uint32(data[0:4]) != RECORD_MAGIC {
+		return nil, errors.New("record header is missing")
+	}
 
-			return stmt
-		case *parser.RevokeStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.RevokeStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	length := int(binary.BigEndian.Uint32(data[4:8]))
+	if len(data)-RECORD_HEADER_SIZE < length {
+		return nil, fmt.Errorf("record is incomplete, expected %d bytes got %d", length, len(data)-RECORD_HEADER_SIZE)
+	}
 
-			if stmt.PrivilegeDefinition == nil {
-				continue
-			}
+	payload := data[RECORD_HEADER_SIZE : RECORD_HEADER_SIZE+length]
 
-			return stmt
-		case *parser.UseStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.UseStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(data[8:12]) {
+		return nil, errors.New("record checksum mismatch")
+	}
 
-			if stmt.DatabaseName == nil {
-				continue
-			}
+	return payload, nil
+}
 
-			return stmt
-		case *parser.AlterUserStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.AlterUserStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+// framePages returns the number of pages a record frame of the given data occupies
+func framePages(data []byte) int64 {
+	length := int64(RECORD_HEADER_SIZE)
+	if len(data) >= RECORD_HEADER_SIZE {
+		length += int64(binary.BigEndian.Uint32(data[4:8]))
+	}
 
-			if stmt.Username == nil {
-				continue
-			}
+	pages := (length + btree.PAGE_SIZE - 1) / btree.PAGE_SIZE
+	if pages < 1 {
+		pages = 1
+	}
 
-			return stmt
-		case *parser.AlterTableStmt:
-			dec := gob.NewDecoder(bytes.NewBuffer(data))
-			stmt := &parser.AlterTableStmt{}
-			err := dec.Decode(stmt)
-			if err != nil {
-				continue
-			}
+	return pages
+}
 
-			return stmt
+// DecodeRecord decodes a WAL record frame
+func (w *WAL) DecodeRecord(data []byte) (*Record, error) {
+	payload, err := decodeFrame(data)
+	if err != nil {
+		return nil, err
+	}
 
-		}
+	dec := gob.NewDecoder(bytes.NewBuffer(payload))
+	rec := &Record{}
+	err = dec.Decode(rec)
+	if err != nil {
+		return nil, err
+	}
 
+	if rec.Stmt == nil {
+		return nil, errors.New("record has no statement")
 	}
 
-	return nil
+	return rec, nil
 }
 
-// RecoverASTs Recover abstract syntax trees from the WAL file
-func (w *WAL) RecoverASTs() ([]interface{}, error) {
+// Records returns all records within the WAL file in the order they were appended
+// If the file is damaged before its last record the intact records are returned along with a *CorruptionError
+func (w *WAL) Records() ([]*Record, error) {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	stmts := make([]interface{}, 0)
+	return w.records()
+}
+
+// ReadWAL reads all records of a WAL file without opening it for writing
+// A torn tail is left in place and a file written before records were framed is refused rather than migrated
+func ReadWAL(filePath string) ([]*Record, error) {
+	_, err := os.Stat(filePath + ".del")
+	hadDel := err == nil
+
+	w, err := OpenWAL(filePath, os.O_RDONLY, 0644)
+	if !hadDel {
+		defer os.Remove(filePath + ".del")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer w.Close()
+
+	return w.Records()
+}
+
+// records reads all records from the WAL file, the caller must hold the lock
+func (w *WAL) records() ([]*Record, error) {
+	records, corruptions, _, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(corruptions) > 0 {
+		return records, &CorruptionError{Corruptions: corruptions}
+	}
+
+	return records, nil
+}
+
+// readRecord reads the record starting at page, returning the number of pages it spans
+// Only the pages of the frame are read, a page not starting with a record header costs a single page read
+func (w *WAL) readRecord(page, pages int64) (*Record, int64, error) {
+	header, err := w.file.ReadData(page, RECORD_HEADER_SIZE)
+	if err != nil {
+		return nil, 0, fmt.Errorf("page is unreadable, %s", err.Error())
+	}
+
+	if binary.BigEndian.Uint32(header[0:4]) != RECORD_MAGIC {
+		return nil, 0, errors.New("record header is missing")
+	}
+
+	span := framePages(header)
+	if page+span > pages {
+		return nil, 0, errors.New("record runs past the end of the file")
+	}
+
+	data, err := w.file.ReadData(page, RECORD_HEADER_SIZE+int(binary.BigEndian.Uint32(header[4:8])))
+	if err != nil {
+		return nil, 0, fmt.Errorf("page is unreadable, %s", err.Error())
+	}
+
+	rec, err := w.DecodeRecord(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rec, span, nil
+}
+
+// scan reads the WAL file record by record in a single pass
+// Damaged pages followed by an intact record are skipped and reported as corruption,
+// damage with no intact record after it is a torn write at the tail and ends the log.
+// tail is the number of pages holding the log
+func (w *WAL) scan() (records []*Record, corruptions []*Corruption, tail int64, err error) {
+	records = make([]*Record, 0)
 
 	pages := w.file.Count()
 
-	for i := 0; i < int(pages); i++ {
-		data, err := w.file.GetPage(int64(i))
+	var lastLSN uint64
+	var damaged *Corruption // Damaged region no intact record has followed yet
+
+	for page := int64(0); page < pages; {
+		rec, span, err := w.readRecord(page, pages)
 		if err != nil {
-			return nil, err
+			if damaged == nil {
+				damaged = &Corruption{FilePath: w.FilePath, Page: page, AfterLSN: lastLSN, Reason: err.Error()}
+			}
+
+			page++
+			continue
 		}
 
-		stmt := w.Decode(data)
-		if stmt != nil {
-			switch stmt := stmt.(type) {
-			case *parser.CreateDatabaseStmt:
-				stmts = append(stmts, stmt)
-			case *parser.CreateTableStmt:
-				stmts = append(stmts, stmt)
-			case *parser.DropTableStmt:
-				stmts = append(stmts, stmt)
-			case *parser.InsertStmt:
-				stmts = append(stmts, stmt)
-			case *parser.UpdateStmt:
-				stmts = append(stmts, stmt)
-			case *parser.DeleteStmt:
-				stmts = append(stmts, stmt)
-			case *parser.CreateIndexStmt:
-				stmts = append(stmts, stmt)
-			case *parser.DropIndexStmt:
-				stmts = append(stmts, stmt)
-			case *parser.UseStmt:
-				stmts = append(stmts, stmt)
-			case *parser.AlterUserStmt:
-				stmts = append(stmts, stmt)
-			case *parser.CreateUserStmt:
-				stmts = append(stmts, stmt)
-			case *parser.DropUserStmt:
-				stmts = append(stmts, stmt)
-			case *parser.GrantStmt:
-				stmts = append(stmts, stmt)
-			case *parser.RevokeStmt:
-				stmts = append(stmts, stmt)
-			case *parser.ExecStmt:
-				stmts = append(stmts, stmt)
-			case *parser.DeallocateStmt:
-				stmts = append(stmts, stmt)
-			case *parser.WhileStmt:
-				stmts = append(stmts, stmt)
-			case *parser.IfStmt:
-				stmts = append(stmts, stmt)
-			case *parser.BeginEndBlock:
-				stmts = append(stmts, stmt)
-			case *parser.ElseIfStmt:
-				stmts = append(stmts, stmt)
-			case *parser.OpenStmt:
-				stmts = append(stmts, stmt)
-			case *parser.FetchStmt:
-				stmts = append(stmts, stmt)
-			case *parser.PrintStmt:
-				stmts = append(stmts, stmt)
-			case *parser.CloseStmt:
-				stmts = append(stmts, stmt)
-			case *parser.ExitStmt:
-				stmts = append(stmts, stmt)
-			case *parser.BreakStmt:
-				stmts = append(stmts, stmt)
-			case *parser.ReturnStmt:
-				stmts = append(stmts, stmt)
-			case *parser.Procedure:
-				stmts = append(stmts, stmt)
-			case *parser.Variable:
-				stmts = append(stmts, stmt)
-			case *parser.DeclareStmt:
-				stmts = append(stmts, stmt)
-			case *parser.ConcatFunc:
-				stmts = append(stmts, stmt)
-			case *parser.SetStmt:
-				stmts = append(stmts, stmt)
-			case *parser.ElseClause:
-				stmts = append(stmts, stmt)
-			case *parser.CaseExpr:
-				stmts = append(stmts, stmt)
-			case *parser.SubstrFunc:
-				stmts = append(stmts, stmt)
-			case *parser.TrimFunc:
-				stmts = append(stmts, stmt)
-			case *parser.LengthFunc:
-				stmts = append(stmts, stmt)
-			case *parser.PositionFunc:
-				stmts = append(stmts, stmt)
-			case *parser.RoundFunc:
-				stmts = append(stmts, stmt)
-			case *parser.ReverseFunc:
-				stmts = append(stmts, stmt)
-			case *parser.CoalesceFunc:
-				stmts = append(stmts, stmt)
-			case *parser.CastFunc:
-				stmts = append(stmts, stmt)
-			case *parser.LowerFunc:
-				stmts = append(stmts, stmt)
-			case *parser.UpperFunc:
-				stmts = append(stmts, stmt)
-			case *parser.ProcedureStmt:
-				stmts = append(stmts, stmt)
-			case *parser.Parameter:
-				stmts = append(stmts, stmt)
-			case *parser.PrivilegeDefinition:
-				stmts = append(stmts, stmt)
-			case *parser.BeginStmt:
-				stmts = append(stmts, stmt)
-			case *parser.CommitStmt:
-				stmts = append(stmts, stmt)
-			case *parser.RollbackStmt:
-				stmts = append(stmts, stmt)
-			case *parser.CreateProcedureStmt:
-				stmts = append(stmts, stmt)
-			case *parser.DropProcedureStmt:
-				stmts = append(stmts, stmt)
-			case *parser.AlterTableStmt:
-				stmts = append(stmts, stmt)
-			default:
-				return nil, errors.New("unknown statement type found in WAL")
-			}
+		if damaged != nil {
+			damaged.Pages = page - damaged.Page
+			corruptions = append(corruptions, damaged)
+			damaged = nil
 		}
 
+		records = append(records, rec)
+		lastLSN = rec.LSN
+		page += span
+		tail = page
 	}
 
-	return stmts, nil
+	return records, corruptions, tail, nil
 }
@@ -18,8 +18,14 @@ package wal
 
 import (
 	"ariasql/parser"
+	"ariasql/storage/btree"
+	"bytes"
+	"encoding/gob"
+	"errors"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestOpenWAL(t *testing.T) {
@@ -33,7 +39,7 @@ func TestOpenWAL(t *testing.T) {
 	defer wal.Close()
 }
 
-func TestWAL_Append(t *testing.T) {
+func TestWAL_Log(t *testing.T) {
 	defer os.Remove("wal.dat")
 	defer os.Remove("wal.dat.del")
 
@@ -44,13 +50,13 @@ func TestWAL_Append(t *testing.T) {
 
 	defer wal.Close()
 
-	err = wal.Append(wal.Encode(parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}}))
+	err = wal.Log(&Record{Stmt: &parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}}})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func TestWAL_RecoverASTs(t *testing.T) {
+func TestWAL_RecordStatements(t *testing.T) {
 	defer os.Remove("wal.dat")
 	defer os.Remove("wal.dat.del")
 
@@ -61,62 +67,670 @@ func TestWAL_RecoverASTs(t *testing.T) {
 
 	defer wal.Close()
 
-	err = wal.Append(wal.Encode(&parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}}))
+	err = wal.Log(&Record{Stmt: &parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}}})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = wal.Append(wal.Encode(&parser.UseStmt{DatabaseName: &parser.Identifier{Value: "test"}}))
+	err = wal.Log(&Record{Stmt: &parser.UseStmt{DatabaseName: &parser.Identifier{Value: "test"}}})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = wal.Append(wal.Encode(&parser.CreateTableStmt{TableName: &parser.Identifier{Value: "users"}}))
+	err = wal.Log(&Record{Stmt: &parser.CreateTableStmt{TableName: &parser.Identifier{Value: "users"}}})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = wal.Append(wal.Encode(&parser.InsertStmt{
+	err = wal.Log(&Record{Stmt: &parser.InsertStmt{
 		TableName:   &parser.Identifier{Value: "users"},
 		ColumnNames: []*parser.Identifier{{Value: "user_id"}, {Value: "users"}},
-		Values: [][]*parser.Literal{
-			{{Value: 1}, {Value: "frankenstein"}},
-			{{Value: 2}, {Value: "frankenstein"}},
-			{{Value: 3}, {Value: "drako"}},
+		Values: [][]interface{}{
+			{&parser.Literal{Value: 1}, &parser.Literal{Value: "frankenstein"}},
+			{&parser.Literal{Value: 2}, &parser.Literal{Value: "frankenstein"}},
+			{&parser.Literal{Value: 3}, &parser.Literal{Value: "drako"}},
 		}},
-	))
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	asts, err := wal.RecoverASTs()
+	records, err := wal.Records()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(asts) != 4 {
-		t.Fatalf("expected 4 ast, got %d", len(asts))
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
 	}
 
-	for _, ast := range asts {
-		switch ast.(type) {
+	for _, rec := range records {
+		switch ast := rec.Stmt.(type) {
 		case *parser.CreateDatabaseStmt:
-			if ast.(*parser.CreateDatabaseStmt).Name.Value != "test" {
-				t.Fatalf("expected test, got %s", ast.(*parser.CreateDatabaseStmt).Name.Value)
+			if ast.Name.Value != "test" {
+				t.Fatalf("expected test, got %s", ast.Name.Value)
 			}
 		case *parser.UseStmt:
-			if ast.(*parser.UseStmt).DatabaseName.Value != "test" {
-				t.Fatalf("expected test, got %s", ast.(*parser.UseStmt).DatabaseName.Value)
+			if ast.DatabaseName.Value != "test" {
+				t.Fatalf("expected test, got %s", ast.DatabaseName.Value)
 			}
 		case *parser.CreateTableStmt:
-			if ast.(*parser.CreateTableStmt).TableName.Value != "users" {
-				t.Fatalf("expected users, got %s", ast.(*parser.CreateTableStmt).TableName.Value)
+			if ast.TableName.Value != "users" {
+				t.Fatalf("expected users, got %s", ast.TableName.Value)
 			}
 		case *parser.InsertStmt:
-			if ast.(*parser.InsertStmt).TableName.Value != "users" {
-				t.Fatalf("expected users, got %s", ast.(*parser.InsertStmt).TableName.Value)
+			if ast.TableName.Value != "users" {
+				t.Fatalf("expected users, got %s", ast.TableName.Value)
 			}
 		}
 	}
 
 }
+
+func TestWAL_Records(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now()
+
+	err = wal.Log(&Record{Stmt: &parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Log(&Record{Stmt: &parser.UseStmt{DatabaseName: &parser.Identifier{Value: "test"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	for i, rec := range records {
+		if rec.LSN != uint64(i+1) {
+			t.Fatalf("expected LSN %d, got %d", i+1, rec.LSN)
+		}
+
+		if rec.Timestamp.Before(before) {
+			t.Fatalf("expected timestamp after %s, got %s", before, rec.Timestamp)
+		}
+	}
+
+	wal.Close()
+
+	// The log sequence continues after reopening
+	wal, err = OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	if wal.LSN() != 2 {
+		t.Fatalf("expected LSN 2, got %d", wal.LSN())
+	}
+}
+
+func TestRecoveryTarget_Reached(t *testing.T) {
+	now := time.Now()
+
+	target := &RecoveryTarget{LSN: 5}
+
+	if target.Reached(&Record{LSN: 5, Timestamp: now}) {
+		t.Fatal("expected LSN 5 to be replayed")
+	}
+
+	if !target.Reached(&Record{LSN: 6, Timestamp: now}) {
+		t.Fatal("expected LSN 6 to be past the target")
+	}
+
+	target = &RecoveryTarget{Time: now}
+
+	if target.Reached(&Record{LSN: 100, Timestamp: now}) {
+		t.Fatal("expected record at target time to be replayed")
+	}
+
+	if !target.Reached(&Record{LSN: 100, Timestamp: now.Add(time.Second)}) {
+		t.Fatal("expected record after target time to be past the target")
+	}
+}
+
+func TestWAL_Rotate(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+	defer os.RemoveAll("archive")
+
+	archive, err := OpenArchive("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	wal.SetArchive(archive, 0)
+
+	err = wal.Log(&Record{Stmt: &parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := archive.CreateBaseBackup(wal.LSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = wal.Log(&Record{Stmt: &parser.UseStmt{DatabaseName: &parser.Identifier{Value: "test"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := archive.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 1 {
+		t.Fatalf("expected 1 segment, got %d", len(segments))
+	}
+
+	archived, err := archive.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(archived) != 1 || archived[0].LSN != 1 {
+		t.Fatalf("expected archived record with LSN 1, got %v", archived)
+	}
+
+	current, err := wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(current) != 1 || current[0].LSN != 2 {
+		t.Fatalf("expected current record with LSN 2, got %v", current)
+	}
+
+	latest, err := archive.LatestBaseBackup(&RecoveryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if latest == nil || latest.LSN != backup.LSN {
+		t.Fatalf("expected base backup at LSN %d", backup.LSN)
+	}
+
+	// A target before the backup has no usable backup
+	latest, err = archive.LatestBaseBackup(&RecoveryTarget{Time: backup.Timestamp.Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if latest != nil {
+		t.Fatal("expected no base backup before the target")
+	}
+}
+
+func TestDump(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	stmts := []interface{}{
+		&parser.CreateUserStmt{Username: &parser.Identifier{Value: "alex"}, Password: &parser.Literal{Value: "secret"}},
+		&parser.DeleteStmt{TableName: &parser.Identifier{Value: "users"}},
+		&parser.DropTableStmt{TableName: &parser.Identifier{Value: "orders"}},
+	}
+
+	for _, stmt := range stmts {
+		err = wal.Log(&Record{User: "admin", Database: "test", Stmt: stmt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+
+	err = Dump(buf, records, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 lines, got %d", len(lines))
+	}
+
+	if !strings.HasSuffix(lines[0], "\tadmin\ttest\tCREATE USER alex IDENTIFIED BY '********';") {
+		t.Fatalf("unexpected line %s", lines[0])
+	}
+
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatal("expected password to be redacted")
+	}
+
+	buf.Reset()
+
+	err = Dump(buf, records, &DumpFilter{Table: "test.users"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(buf.String(), "2\t") || !strings.HasSuffix(buf.String(), "\tDELETE FROM users;\n") {
+		t.Fatalf("unexpected dump %s", buf.String())
+	}
+
+	buf.Reset()
+
+	err = Dump(buf, records, &DumpFilter{From: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() != 0 {
+		t.Fatalf("expected no records, got %s", buf.String())
+	}
+}
+
+func TestWAL_TornTail(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The second record spans several pages
+	stmts := []interface{}{
+		&parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}},
+		&parser.InsertStmt{
+			TableName:   &parser.Identifier{Value: "users"},
+			ColumnNames: []*parser.Identifier{{Value: "name"}},
+			Values:      [][]interface{}{{&parser.Literal{Value: "'" + strings.Repeat("a", 3000) + "'"}}},
+		},
+		&parser.DropTableStmt{TableName: &parser.Identifier{Value: "users"}},
+	}
+
+	for _, stmt := range stmts {
+		err = wal.Log(&Record{Stmt: stmt})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wal.Close()
+
+	info, err := os.Stat("wal.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the last record
+	err = os.Truncate("wal.dat", info.Size()-btree.PAGE_SIZE/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	records, err := wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+
+	if len(records[1].Stmt.(*parser.InsertStmt).Values[0][0].(*parser.Literal).Value.(string)) != 3002 {
+		t.Fatal("expected multi page record to be intact")
+	}
+
+	// New records follow the last intact one
+	err = wal.Log(&Record{Stmt: &parser.DropTableStmt{TableName: &parser.Identifier{Value: "users"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err = wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 3 || records[2].LSN != 3 {
+		t.Fatalf("expected 3 records ending at LSN 3, got %d", len(records))
+	}
+}
+
+func TestReadWAL(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		err = wal.Log(&Record{Stmt: &parser.DropTableStmt{TableName: &parser.Identifier{Value: name}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wal.Close()
+
+	info, err := os.Stat("wal.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tear the last record
+	err = os.Truncate("wal.dat", info.Size()-btree.PAGE_SIZE/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadWAL("wal.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+
+	// The torn tail is only read, not cut off
+	torn, err := os.Stat("wal.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if torn.Size() != info.Size()-btree.PAGE_SIZE/2 {
+		t.Fatalf("expected the file to be left at %d bytes, got %d", info.Size()-btree.PAGE_SIZE/2, torn.Size())
+	}
+}
+
+func TestWAL_Upgrade(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	// Opening registers the statement types the records are encoded with
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wal.Close()
+
+	// A WAL written before records were framed holds a bare record per page, the second spans several pages
+	pager, err := btree.OpenPager("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, stmt := range []interface{}{
+		&parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}},
+		&parser.InsertStmt{
+			TableName:   &parser.Identifier{Value: "users"},
+			ColumnNames: []*parser.Identifier{{Value: "name"}},
+			Values:      [][]interface{}{{&parser.Literal{Value: "'" + strings.Repeat("a", 3000) + "'"}}},
+		},
+		&parser.DropTableStmt{TableName: &parser.Identifier{Value: "users"}},
+	} {
+		buff := bytes.NewBuffer(nil)
+
+		err = gob.NewEncoder(buff).Encode(&Record{LSN: uint64(i + 1), Timestamp: time.Now(), Stmt: stmt})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = pager.Write(buff.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pager.Close()
+
+	// It is not read as a torn tail and erased
+	_, err = OpenWAL("wal.dat", os.O_RDONLY, 0644)
+	if err == nil || !strings.Contains(err.Error(), "open it for writing once to migrate them") {
+		t.Fatalf("expected a read-only open to refuse the migration, got %v", err)
+	}
+
+	wal, err = OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	err = wal.Log(&Record{Stmt: &parser.DropTableStmt{TableName: &parser.Identifier{Value: "users"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := wal.Records()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 4 || records[1].LSN != 2 || records[3].LSN != 4 {
+		t.Fatalf("expected the 3 migrated records and a new one, got %d", len(records))
+	}
+
+	if len(records[1].Stmt.(*parser.InsertStmt).Values[0][0].(*parser.Literal).Value.(string)) != 3002 {
+		t.Fatal("expected multi page record to be migrated intact")
+	}
+}
+
+func TestWAL_Unreadable(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	data := bytes.Repeat([]byte("not a wal"), 1000)
+
+	err := os.WriteFile("wal.dat", data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file of no records at all is refused and left as it is
+	_, err = OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err == nil || !strings.Contains(err.Error(), "holds no WAL records") {
+		t.Fatalf("expected the file to be refused, got %v", err)
+	}
+
+	if b, _ := os.ReadFile("wal.dat"); !bytes.Equal(b, data) {
+		t.Fatal("expected the file to be left as it is")
+	}
+}
+
+func TestWAL_Corruption(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		err = wal.Log(&Record{Stmt: &parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: name}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wal.Close()
+
+	// Damage the payload of the second record
+	f, err := os.OpenFile("wal.dat", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.WriteAt([]byte("garbage"), (btree.PAGE_SIZE+btree.HEADER_SIZE)+btree.HEADER_SIZE+RECORD_HEADER_SIZE+8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Close()
+
+	wal, err = OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	records, err := wal.Records()
+
+	var corruption *CorruptionError
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expected corruption error, got %v", err)
+	}
+
+	if len(records) != 2 || records[0].LSN != 1 || records[1].LSN != 3 {
+		t.Fatalf("expected records 1 and 3, got %d records", len(records))
+	}
+
+	if len(corruption.Corruptions) != 1 {
+		t.Fatalf("expected 1 corruption, got %d", len(corruption.Corruptions))
+	}
+
+	c := corruption.Corruptions[0]
+	if c.Page != 1 || c.Pages != 1 || c.AfterLSN != 1 {
+		t.Fatalf("expected page 1 after LSN 1, got %s", c.Error())
+	}
+
+	// Recovery stops before the damage
+	if corruption.StopLSN() != 1 {
+		t.Fatalf("expected recovery to stop at LSN 1, got %d", corruption.StopLSN())
+	}
+}
+
+func TestWAL_Subscribe(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	sub := wal.Subscribe(1)
+
+	err = wal.Log(&Record{Channel: 7, Stmt: &parser.DropTableStmt{TableName: &parser.Identifier{Value: "orders"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := ReadRecord(bytes.NewReader(<-sub.C))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.LSN != 1 || rec.Channel != 7 {
+		t.Fatalf("expected LSN 1 on channel 7, got LSN %d on channel %d", rec.LSN, rec.Channel)
+	}
+
+	// A subscriber which falls behind is dropped
+	for i := 0; i < 2; i++ {
+		err = wal.Log(&Record{Stmt: &parser.DropTableStmt{TableName: &parser.Identifier{Value: "orders"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-sub.C
+
+	if _, ok := <-sub.C; ok {
+		t.Fatal("expected subscription to be closed")
+	}
+
+	sub.Close() // closing a dropped subscription is a no-op
+}
+
+func TestWAL_Sync(t *testing.T) {
+	defer os.Remove("wal.dat")
+	defer os.Remove("wal.dat.del")
+
+	wal, err := OpenWAL("wal.dat", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer wal.Close()
+
+	// Commits flushing at the same time share flushes, each returns once its record is flushed
+	errs := make(chan error, 8)
+
+	for i := 0; i < 8; i++ {
+		go func() {
+			rec := &Record{Stmt: &parser.CreateDatabaseStmt{Name: &parser.Identifier{Value: "test"}}}
+
+			err := wal.Log(rec)
+			if err == nil {
+				err = wal.Sync(rec.LSN)
+			}
+
+			if err == nil && wal.Synced() < rec.LSN {
+				err = errors.New("record not flushed")
+			}
+
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if wal.Synced() != wal.LSN() {
+		t.Fatalf("expected every record flushed, synced %d of %d", wal.Synced(), wal.LSN())
+	}
+}